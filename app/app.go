@@ -1,11 +1,16 @@
 package app
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"slices"
 	"sync"
+	"time"
 
 	"example-api-server/appinterface"
+	"example-api-server/keyring"
+	"example-api-server/wal"
 )
 
 type appCommandTag int
@@ -16,63 +21,148 @@ const (
 	contactDetails
 	deleteContact
 	updateContact
+	getTrash
+	restoreContact
+	patchContact
+	batch
+	importContacts
+	changes
+	contactsAfter
+	snapshot
+	restore
+	shareContact
 )
 
+// maxChangeLog is how many changes are remembered for sync tokens.  Clients
+// holding an older token have to start over with a full sync.
+const maxChangeLog = 10000
+
+// purgeInterval is how often the actor checks the trash for contacts that
+// have outlived the retention period.  Tests shorten it.
+var purgeInterval = time.Minute
+
+// readBurst is how many reads in a row the actor takes ahead of the writes,
+// purges and rekeys waiting, before it gives them a turn.
+const readBurst = 8
+
 type appCommand struct {
 	tag       appCommandTag
 	inContact appinterface.Contact
+	ifMatch   []int
+	patch     appinterface.ContactPatch
+	batch     []appinterface.BatchOperation
+	contacts  []appinterface.Contact
+	dryRun    bool
+	since     int
+	limit     int
+	snapshot  appinterface.SnapshotData
+	shares    []appinterface.Share
+	// principal is who the command is for, nil for a caller that may see
+	// every contact.
+	principal *appinterface.Principal
 	result    chan any
+	// queued is when the command was handed to the actor.
+	queued time.Time
+}
+
+// principalOf returns the principal ctx carries, or nil if it carries none.
+func principalOf(ctx context.Context) *appinterface.Principal {
+	if p, ok := appinterface.PrincipalFrom(ctx); ok {
+		return &p
+	}
+	return nil
+}
+
+type contactChange struct {
+	seq int
+	id  int
+}
+
+type batchResponse struct {
+	results []appinterface.BatchResult
+	err     error
 }
 
 type app struct {
-	commands chan appCommand
-	wg       *sync.WaitGroup
+	// reads and writes are the lanes commands wait in for the actor.
+	reads          chan appCommand
+	writes         chan appCommand
+	queueTimeout   time.Duration
+	wg             *sync.WaitGroup
+	trashRetention time.Duration
+	// walPath is empty for an app that only keeps its state in memory.
+	walPath      string
+	syncPolicy   wal.SyncPolicy
+	syncInterval time.Duration
+	// keys, when set, encrypt every record written to the log.
+	keys *keyring.Keyring
+	// ready receives the outcome of recovering from the log.
+	ready chan error
 }
 
-func (a *app) AddContact(firstName string, lastName string, email string) (err error) {
+func (a *app) AddContact(ctx context.Context, firstName string, lastName string, email string) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
 		}
 	}()
-	a.commands <- appCommand{
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
 		tag: addContact,
 		inContact: appinterface.Contact{
 			FirstName: firstName,
 			LastName:  lastName,
 			Email:     email,
 		},
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return err
+	}
+	// Reads can overtake writes, so the add is waited for, or a read made
+	// right after it could miss the contact.
+	if v, ok := <-r; ok && v != nil {
+		return v.(error)
 	}
-	return
+	return nil
 }
 
-func (a *app) GetContacts() (result []appinterface.Contact, err error) {
+func (a *app) GetContacts(ctx context.Context) (result []appinterface.Contact, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
 		}
 	}()
 	r := make(chan any, 1)
-	a.commands <- appCommand{
-		tag:    getContacts,
-		result: r,
+	err = a.enqueue(ctx, appCommand{
+		tag:       getContacts,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return result, err
 	}
 	return (<-r).([]appinterface.Contact), nil
 }
 
-func (a *app) ContactDetails(id int) (result appinterface.Contact, err error) {
+func (a *app) ContactDetails(ctx context.Context, id int) (result appinterface.Contact, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
 		}
 	}()
 	r := make(chan any, 1)
-	a.commands <- appCommand{
+	err = a.enqueue(ctx, appCommand{
 		tag: contactDetails,
 		inContact: appinterface.Contact{
 			ID: id,
 		},
-		result: r,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return result, err
 	}
 	result, ok := (<-r).(appinterface.Contact)
 	if !ok {
@@ -81,29 +171,49 @@ func (a *app) ContactDetails(id int) (result appinterface.Contact, err error) {
 	return result, nil
 }
 
-func (a *app) DeleteContact(id int) (err error) {
+// awaitError waits for the actor to answer a command whose only result is an
+// error.  A closed channel with no answer means the contact was not found.
+func awaitError(r chan any) error {
+	v, ok := <-r
+	if !ok {
+		return io.EOF
+	}
+	if v != nil {
+		return v.(error)
+	}
+	return nil
+}
+
+func (a *app) DeleteContact(ctx context.Context, id int, ifMatch []int) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
 		}
 	}()
-
-	a.commands <- appCommand{
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
 		tag: deleteContact,
 		inContact: appinterface.Contact{
 			ID: id,
 		},
+		ifMatch:   ifMatch,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return err
 	}
-	return
+	return awaitError(r)
 }
 
-func (a *app) UpdateContact(id int, firstName string, lastName string, email string) (err error) {
+func (a *app) UpdateContact(ctx context.Context, id int, ifMatch []int, firstName string, lastName string, email string) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
 		}
 	}()
-	a.commands <- appCommand{
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
 		tag: updateContact,
 		inContact: appinterface.Contact{
 			ID:        id,
@@ -111,27 +221,273 @@ func (a *app) UpdateContact(id int, firstName string, lastName string, email str
 			LastName:  lastName,
 			Email:     email,
 		},
+		ifMatch:   ifMatch,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return err
 	}
-	return nil
+	return awaitError(r)
+}
+
+func (a *app) GetTrash(ctx context.Context) (result []appinterface.TrashedContact, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
+		tag:       getTrash,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return result, err
+	}
+	return (<-r).([]appinterface.TrashedContact), nil
+}
+
+func (a *app) RestoreContact(ctx context.Context, id int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
+		tag: restoreContact,
+		inContact: appinterface.Contact{
+			ID: id,
+		},
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return err
+	}
+	return awaitError(r)
+}
+
+func (a *app) PatchContact(ctx context.Context, id int, ifMatch []int, patch appinterface.ContactPatch) (result appinterface.Contact, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
+		tag: patchContact,
+		inContact: appinterface.Contact{
+			ID: id,
+		},
+		ifMatch:   ifMatch,
+		patch:     patch,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return result, err
+	}
+	return awaitContact(r)
+}
+
+// awaitContact waits for the actor to answer a command whose result is the
+// contact it changed.
+func awaitContact(r chan any) (result appinterface.Contact, err error) {
+	v, ok := <-r
+	if !ok {
+		return result, io.EOF
+	}
+	switch v := v.(type) {
+	case appinterface.Contact:
+		return v, nil
+	case error:
+		return result, v
+	}
+	return result, nil
+}
+
+func (a *app) ShareContact(ctx context.Context, id int, ifMatch []int, shares []appinterface.Share) (result appinterface.Contact, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
+		tag: shareContact,
+		inContact: appinterface.Contact{
+			ID: id,
+		},
+		ifMatch:   ifMatch,
+		shares:    shares,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return result, err
+	}
+	return awaitContact(r)
+}
+
+func (a *app) Batch(ctx context.Context, ops []appinterface.BatchOperation) (results []appinterface.BatchResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
+		tag:       batch,
+		batch:     ops,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return results, err
+	}
+	br := (<-r).(batchResponse)
+	return br.results, br.err
+}
+
+func (a *app) Import(ctx context.Context, contacts []appinterface.Contact, dryRun bool) (results []appinterface.ImportResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
+		tag:       importContacts,
+		contacts:  contacts,
+		dryRun:    dryRun,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return results, err
+	}
+	switch v := (<-r).(type) {
+	case []appinterface.ImportResult:
+		return v, nil
+	case error:
+		return nil, v
+	}
+	return nil, nil
+}
+
+func (a *app) Changes(ctx context.Context, since int) (result appinterface.ChangeSet, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
+		tag:       changes,
+		since:     since,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return result, err
+	}
+	switch v := (<-r).(type) {
+	case appinterface.ChangeSet:
+		return v, nil
+	case error:
+		return result, v
+	}
+	return result, nil
+}
+
+func (a *app) ContactsAfter(ctx context.Context, after appinterface.Contact, limit int) (result []appinterface.Contact, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
+		tag:       contactsAfter,
+		inContact: after,
+		limit:     limit,
+		principal: principalOf(ctx),
+		result:    r,
+	})
+	if err != nil {
+		return result, err
+	}
+	return (<-r).([]appinterface.Contact), nil
+}
+
+func (a *app) Snapshot() (result appinterface.SnapshotData, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	r := make(chan any, 1)
+	err = a.enqueue(context.Background(), appCommand{
+		tag:    snapshot,
+		result: r,
+	})
+	if err != nil {
+		return result, err
+	}
+	return (<-r).(appinterface.SnapshotData), nil
+}
+
+func (a *app) Restore(ctx context.Context, data appinterface.SnapshotData) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	r := make(chan any, 1)
+	err = a.enqueue(ctx, appCommand{
+		tag:      restore,
+		snapshot: data,
+		result:   r,
+	})
+	if err != nil {
+		return err
+	}
+	return awaitError(r)
 }
 
 func (a *app) Stop() {
-	close(a.commands)
+	unregister(a)
+	close(a.writes)
+	close(a.reads)
 }
 
 func (a *app) Wait() {
 	a.wg.Wait()
 }
 
-func NewApp(queueSize int) appinterface.App {
+// NewApp returns an app that keeps its contacts in memory.  Up to
+// queueSize reads, and as many writes, wait for it at a time; further ones
+// wait up to queueTimeout for room before failing with ErrOverloaded.
+func NewApp(queueSize int, queueTimeout time.Duration, trashRetention time.Duration) appinterface.App {
 	if queueSize < 10 {
 		queueSize = 10
 	}
+	if queueTimeout <= 0 {
+		queueTimeout = defaultQueueTimeout
+	}
 	wg := &sync.WaitGroup{}
+	wg.Add(1)
 	r := &app{
-		commands: make(chan appCommand, queueSize),
-		wg:       wg,
+		reads:          make(chan appCommand, queueSize),
+		writes:         make(chan appCommand, queueSize),
+		queueTimeout:   queueTimeout,
+		wg:             wg,
+		trashRetention: trashRetention,
 	}
+	register(r)
 	go r.run()
 	return r
 }
@@ -142,6 +498,13 @@ func (a *app) run() {
 	}()
 	currentID := 0
 	var contacts []appinterface.Contact
+	var trash []appinterface.TrashedContact
+	// changeSeq counts mutations and changeLog remembers which contact each
+	// of the most recent ones touched, which is what sync tokens are made of.
+	// Tokens older than changeLogStart can no longer be served.
+	changeSeq := 0
+	changeLogStart := 0
+	var changeLog []contactChange
 	sortContacts := func() {
 		slices.SortFunc(contacts, func(a, b appinterface.Contact) int {
 			switch {
@@ -185,55 +548,851 @@ func (a *app) run() {
 			return a.ID == id
 		})
 	}
+	findTrashIndexByID := func(id int) int {
+		return slices.IndexFunc(trash, func(a appinterface.TrashedContact) bool {
+			return a.ID == id
+		})
+	}
 
-	ac := func(firstName string, lastName string, email string) {
+	// canRead checks a contact against the principal of a command, which
+	// may see every contact when nil.
+	canRead := func(p *appinterface.Principal, c appinterface.Contact) bool {
+		return p == nil || p.CanRead(c)
+	}
+	visible := func(p *appinterface.Principal, cs []appinterface.Contact) []appinterface.Contact {
+		result := make([]appinterface.Contact, 0, len(cs))
+		for _, c := range cs {
+			if canRead(p, c) {
+				result = append(result, c)
+			}
+		}
+		return result
+	}
+	// writable finds the contact id for p to change.  Contacts p may not
+	// see are not found, so their IDs cannot be probed.
+	writable := func(p *appinterface.Principal, id int) (int, error) {
+		idx := findIndexByID(id)
+		if idx < 0 || !canRead(p, contacts[idx]) {
+			return -1, io.EOF
+		}
+		if p != nil && !p.CanWrite(contacts[idx]) {
+			return idx, appinterface.ErrReadOnly
+		}
+		return idx, nil
+	}
+
+	logChange := func(c contactChange) {
+		changeLog = append(changeLog, c)
+		if len(changeLog) > maxChangeLog {
+			n := len(changeLog) - maxChangeLog
+			changeLogStart = changeLog[n-1].seq
+			changeLog = slices.Delete(changeLog, 0, n)
+		}
+	}
+	// pending collects the changes made by the command being run, which is
+	// what gets written to the log once it is done.
+	var pending []contactChange
+	// saved holds the contacts the command being run changed as they were
+	// before, while it is being logged.
+	var saved map[int]savedContact
+	save := func(id int) {
+		if saved == nil {
+			return
+		}
+		if _, ok := saved[id]; ok {
+			return
+		}
+		if idx := findIndexByID(id); idx >= 0 {
+			saved[id] = savedContact{TrashedContact: appinterface.TrashedContact{Contact: contacts[idx]}, inContacts: true}
+		} else if idx := findTrashIndexByID(id); idx >= 0 {
+			saved[id] = savedContact{TrashedContact: trash[idx], inTrash: true}
+		}
+	}
+	changed := func(id int) {
+		changeSeq++
+		c := contactChange{seq: changeSeq, id: id}
+		logChange(c)
+		pending = append(pending, c)
+	}
+
+	// changesSince reports contacts p may no longer see as deleted, so a
+	// contact unshared from p leaves its clients too.
+	changesSince := func(p *appinterface.Principal, since int) any {
+		if since == 0 {
+			return appinterface.ChangeSet{
+				Token:   changeSeq,
+				Updated: visible(p, contacts),
+			}
+		}
+		if since < changeLogStart || since > changeSeq {
+			return appinterface.ErrSyncTokenExpired
+		}
+		result := appinterface.ChangeSet{Token: changeSeq}
+		seen := map[int]bool{}
+		start, _ := slices.BinarySearchFunc(changeLog, since+1, func(c contactChange, seq int) int {
+			return c.seq - seq
+		})
+		for _, c := range changeLog[start:] {
+			if seen[c.id] {
+				continue
+			}
+			seen[c.id] = true
+			if idx := findIndexByID(c.id); idx >= 0 && canRead(p, contacts[idx]) {
+				result.Updated = append(result.Updated, contacts[idx])
+			} else {
+				result.Deleted = append(result.Deleted, c.id)
+			}
+		}
+		return result
+	}
+
+	// ac adds a contact owned by p.
+	ac := func(p *appinterface.Principal, firstName string, lastName string, email string) (appinterface.Contact, error) {
 		contact := appinterface.Contact{
 			FirstName: firstName,
 			LastName:  lastName,
 			Email:     email,
 		}
+		if p != nil {
+			contact.Owner = p.Name
+		}
+		if err := contact.Validate(); err != nil {
+			return contact, err
+		}
 		_, ok := findIndexByContent(contact)
-		if !ok {
-			currentID++
-			contact.ID = currentID
-			contacts = append(contacts, contact)
-			sortContacts()
+		if ok {
+			return contact, appinterface.ErrDuplicateContact
 		}
+		currentID++
+		contact.ID = currentID
+		contact.Version = 1
+		contacts = append(contacts, contact)
+		changed(contact.ID)
+		sortContacts()
+		return contact, nil
 	}
 
-	uc := func(id int, firstName string, lastName string, email string) {
-		idx := findIndexByID(id)
-		if idx >= 0 {
-			contacts[idx].FirstName = firstName
-			contacts[idx].LastName = lastName
-			contacts[idx].Email = email
+	// versionMatches implements the If-Match check: an empty list matches
+	// any version.
+	versionMatches := func(version int, ifMatch []int) bool {
+		return len(ifMatch) == 0 || slices.Contains(ifMatch, version)
+	}
+
+	// keptEmail is the email address a change by p leaves the contact at
+	// idx with.
+	keptEmail := func(p *appinterface.Principal, idx int, email string) string {
+		if p != nil && p.KeepEmails {
+			return contacts[idx].Email
+		}
+		return email
+	}
+
+	uc := func(p *appinterface.Principal, idx int, ifMatch []int, firstName string, lastName string, email string) error {
+		if !versionMatches(contacts[idx].Version, ifMatch) {
+			return appinterface.ErrVersionMismatch
+		}
+		email = keptEmail(p, idx, email)
+		updated := appinterface.Contact{
+			FirstName: firstName,
+			LastName:  lastName,
+			Email:     email,
+		}
+		if err := updated.Validate(); err != nil {
+			return err
+		}
+		save(contacts[idx].ID)
+		contacts[idx].FirstName = firstName
+		contacts[idx].LastName = lastName
+		contacts[idx].Email = email
+		contacts[idx].Version++
+		changed(contacts[idx].ID)
+		sortContacts()
+		return nil
+	}
+
+	// pc applies patch to a copy of the contact and only keeps the result if
+	// it is still a valid contact, so a failed patch leaves nothing behind.
+	pc := func(p *appinterface.Principal, idx int, ifMatch []int, patch appinterface.ContactPatch) any {
+		current := contacts[idx]
+		if !versionMatches(current.Version, ifMatch) {
+			return appinterface.ErrVersionMismatch
+		}
+		patched, err := patch(current)
+		if err != nil {
+			return err
+		}
+		// Only ShareContact changes who a contact belongs to or is
+		// shared with.
+		patched.ID = current.ID
+		patched.Owner = current.Owner
+		patched.Shares = current.Shares
+		patched.Email = keptEmail(p, idx, patched.Email)
+		patched.Version = current.Version + 1
+		if err := patched.Validate(); err != nil {
+			return err
+		}
+		save(patched.ID)
+		contacts[idx] = patched
+		changed(patched.ID)
+		sortContacts()
+		return patched
+	}
+
+	// sc replaces who a contact is shared with.
+	sc := func(p *appinterface.Principal, idx int, ifMatch []int, shares []appinterface.Share) any {
+		if p != nil && !p.Owns(contacts[idx]) {
+			return appinterface.ErrNotOwner
+		}
+		if !versionMatches(contacts[idx].Version, ifMatch) {
+			return appinterface.ErrVersionMismatch
+		}
+		for _, share := range shares {
+			if err := share.Validate(); err != nil {
+				return err
+			}
+		}
+		save(contacts[idx].ID)
+		contacts[idx].Shares = slices.Clone(shares)
+		contacts[idx].Version++
+		changed(contacts[idx].ID)
+		return contacts[idx]
+	}
+
+	dc := func(idx int, ifMatch []int) error {
+		if !versionMatches(contacts[idx].Version, ifMatch) {
+			return appinterface.ErrVersionMismatch
+		}
+		save(contacts[idx].ID)
+		trash = append(trash, appinterface.TrashedContact{
+			Contact:   contacts[idx],
+			DeletedAt: time.Now(),
+		})
+		changed(contacts[idx].ID)
+		contacts = slices.Delete(contacts, idx, idx+1)
+		return nil
+	}
+
+	rc := func(idx int) error {
+		contact := trash[idx].Contact
+		if _, ok := findIndexByContent(contact); ok {
+			return appinterface.ErrDuplicateContact
+		}
+		save(contact.ID)
+		trash = slices.Delete(trash, idx, idx+1)
+		contact.Version++
+		contacts = append(contacts, contact)
+		changed(contact.ID)
+		sortContacts()
+		return nil
+	}
+
+	applyBatchOperation := func(p *appinterface.Principal, op appinterface.BatchOperation) (appinterface.Contact, error) {
+		var ifMatch []int
+		if op.Version > 0 {
+			ifMatch = []int{op.Version}
+		}
+		switch op.Op {
+		case appinterface.BatchCreate:
+			return ac(p, op.FirstName, op.LastName, op.Email)
+		case appinterface.BatchUpdate:
+			idx, err := writable(p, op.ID)
+			if err != nil {
+				return op.Contact, err
+			}
+			err = uc(p, idx, ifMatch, op.FirstName, op.LastName, op.Email)
+			if err != nil {
+				return op.Contact, err
+			}
+			return contacts[findIndexByID(op.ID)], nil
+		case appinterface.BatchDelete:
+			idx, err := writable(p, op.ID)
+			if err != nil {
+				return op.Contact, err
+			}
+			deleted := contacts[idx]
+			return deleted, dc(idx, ifMatch)
+		}
+		return op.Contact, appinterface.ErrUnknownBatchOperation
+	}
+
+	// checkpoint remembers the contacts, trash, ID sequence and change log
+	// and returns a function that puts them back the way they were.
+	checkpoint := func() func() {
+		savedContacts := slices.Clone(contacts)
+		savedTrash := slices.Clone(trash)
+		savedID := currentID
+		savedSeq, savedLogStart, savedLog := changeSeq, changeLogStart, slices.Clone(changeLog)
+		return func() {
+			contacts, trash, currentID = savedContacts, savedTrash, savedID
+			changeSeq, changeLogStart, changeLog = savedSeq, savedLogStart, savedLog
+		}
+	}
+
+	// undo returns a function that undoes the command just run, going by
+	// pending and saved: it puts back the contacts it changed, drops the
+	// ones it created and rewinds the ID and change sequences to id and seq.
+	// Sync tokens handed out since then expire.
+	undo := func(id int, seq int) func() {
+		before := saved
+		for _, c := range pending {
+			if _, ok := before[c.id]; !ok {
+				before[c.id] = savedContact{}
+			}
+		}
+		return func() {
+			for contactID, c := range before {
+				if idx := findIndexByID(contactID); idx >= 0 {
+					contacts = slices.Delete(contacts, idx, idx+1)
+				}
+				if idx := findTrashIndexByID(contactID); idx >= 0 {
+					trash = slices.Delete(trash, idx, idx+1)
+				}
+				switch {
+				case c.inContacts:
+					contacts = append(contacts, c.Contact)
+				case c.inTrash:
+					idx, _ := slices.BinarySearchFunc(trash, c.DeletedAt, func(t appinterface.TrashedContact, at time.Time) int {
+						return t.DeletedAt.Compare(at)
+					})
+					trash = slices.Insert(trash, idx, c.TrashedContact)
+				}
+			}
 			sortContacts()
+			currentID, changeSeq = id, seq
+			end, _ := slices.BinarySearchFunc(changeLog, seq+1, func(c contactChange, seq int) int {
+				return c.seq - seq
+			})
+			changeLog = changeLog[:end]
+			if changeLogStart > changeSeq {
+				changeLogStart, changeLog = changeSeq, nil
+			}
+		}
+	}
+
+	// applyBatch applies every operation or, if any of them fails, rolls
+	// all of them back.
+	applyBatch := func(p *appinterface.Principal, ops []appinterface.BatchOperation) batchResponse {
+		rollback := checkpoint()
+		results := make([]appinterface.BatchResult, len(ops))
+		for i, op := range ops {
+			contact, err := applyBatchOperation(p, op)
+			if err != nil {
+				rollback()
+				for j := range results {
+					results[j] = appinterface.BatchResult{Err: appinterface.ErrBatchRolledBack}
+				}
+				results[i] = appinterface.BatchResult{Contact: op.Contact, Err: err}
+				return batchResponse{results: results, err: err}
+			}
+			results[i] = appinterface.BatchResult{Contact: contact}
 		}
+		return batchResponse{results: results}
 	}
 
-	for cmd := range a.commands {
+	// importContact creates, updates or skips a single imported contact.
+	// Contacts identical to an existing one are skipped; otherwise a contact
+	// with the ID of an existing one updates it and the rest are created.
+	// imported holds the IDs of the contacts the import has created so far,
+	// which no later contact names: they are only the IDs this book happened
+	// to give them.
+	importContact := func(p *appinterface.Principal, contact appinterface.Contact, imported map[int]bool) appinterface.ImportResult {
+		if err := contact.Validate(); err != nil {
+			return appinterface.ImportResult{Action: appinterface.ImportFailed, Contact: contact, Err: err}
+		}
+		if idx, ok := findIndexByContent(contact); ok {
+			if !canRead(p, contacts[idx]) {
+				return appinterface.ImportResult{Action: appinterface.ImportFailed, Contact: contact, Err: appinterface.ErrDuplicateContact}
+			}
+			return appinterface.ImportResult{Action: appinterface.ImportSkipped, Contact: contacts[idx]}
+		}
+		idx, err := -1, io.EOF
+		if contact.ID != 0 && !imported[contact.ID] {
+			idx, err = writable(p, contact.ID)
+		}
+		// A contact whose ID names none here, as one exported from another
+		// instance does, is new.
+		if err == io.EOF {
+			created, err := ac(p, contact.FirstName, contact.LastName, contact.Email)
+			if err != nil {
+				return appinterface.ImportResult{Action: appinterface.ImportFailed, Contact: contact, Err: err}
+			}
+			imported[created.ID] = true
+			return appinterface.ImportResult{Action: appinterface.ImportCreated, Contact: created}
+		}
+		if err != nil {
+			return appinterface.ImportResult{Action: appinterface.ImportFailed, Contact: contact, Err: err}
+		}
+		err = uc(p, idx, nil, contact.FirstName, contact.LastName, contact.Email)
+		if err != nil {
+			return appinterface.ImportResult{Action: appinterface.ImportFailed, Contact: contact, Err: err}
+		}
+		return appinterface.ImportResult{Action: appinterface.ImportUpdated, Contact: contacts[findIndexByID(contact.ID)]}
+	}
+
+	applyImport := func(p *appinterface.Principal, rows []appinterface.Contact, dryRun bool) []appinterface.ImportResult {
+		rollback := checkpoint()
+		results := make([]appinterface.ImportResult, len(rows))
+		imported := map[int]bool{}
+		for i, row := range rows {
+			results[i] = importContact(p, row, imported)
+		}
+		if dryRun {
+			rollback()
+		}
+		return results
+	}
+
+	restoreSnapshot := func(data appinterface.SnapshotData) error {
+		if len(contacts) > 0 || len(trash) > 0 {
+			return appinterface.ErrNotEmpty
+		}
+		contacts = slices.Clone(data.Contacts)
+		trash = slices.Clone(data.Trash)
+		sortContacts()
+		slices.SortStableFunc(trash, func(a, b appinterface.TrashedContact) int {
+			return a.DeletedAt.Compare(b.DeletedAt)
+		})
+		currentID = max(currentID, data.NextID-1)
+		for _, c := range contacts {
+			currentID = max(currentID, c.ID)
+		}
+		for _, c := range trash {
+			currentID = max(currentID, c.ID)
+		}
+		// Nothing from before the snapshot can be replayed, so every sync
+		// token handed out earlier has to start over.
+		changeSeq = max(changeSeq, data.ChangeSeq) + 1
+		changeLogStart = changeSeq
+		changeLog = nil
+		return nil
+	}
+
+	// Trash is appended to in deletion order, so everything older than the
+	// cutoff sits at the front.
+	purgeTrash := func(now time.Time) []int {
+		cutoff := now.Add(-a.trashRetention)
+		var purged []int
+		for len(purged) < len(trash) && !trash[len(purged)].DeletedAt.After(cutoff) {
+			purged = append(purged, trash[len(purged)].ID)
+		}
+		trash = slices.Delete(trash, 0, len(purged))
+		return purged
+	}
+
+	snapshotData := func() appinterface.SnapshotData {
+		return appinterface.SnapshotData{
+			NextID:    currentID + 1,
+			ChangeSeq: changeSeq,
+			Contacts:  append([]appinterface.Contact{}, contacts...),
+			Trash:     append([]appinterface.TrashedContact{}, trash...),
+		}
+	}
+
+	// stateRecord logs the whole state, change log included.
+	stateRecord := func() walRecord {
+		data := snapshotData()
+		rec := walRecord{
+			FormatVersion: walFormatVersion,
+			NextID:        data.NextID,
+			Snapshot:      &data,
+			LogStart:      changeLogStart,
+		}
+		for _, c := range changeLog {
+			rec.Changes = append(rec.Changes, walChange{Seq: c.seq, ID: c.id})
+		}
+		return rec
+	}
+
+	// changeRecord logs the final state of every contact the current
+	// command touched.
+	changeRecord := func() walRecord {
+		rec := walRecord{NextID: currentID + 1}
+		seen := map[int]bool{}
+		for _, c := range pending {
+			rec.Changes = append(rec.Changes, walChange{Seq: c.seq, ID: c.id})
+			if seen[c.id] {
+				continue
+			}
+			seen[c.id] = true
+			if idx := findIndexByID(c.id); idx >= 0 {
+				rec.Contacts = append(rec.Contacts, contacts[idx])
+			} else if idx := findTrashIndexByID(c.id); idx >= 0 {
+				rec.Trashed = append(rec.Trashed, trash[idx])
+			}
+		}
+		return rec
+	}
+
+	replayRecord := func(rec walRecord) error {
+		if rec.FormatVersion > walFormatVersion {
+			return fmt.Errorf("%w: version %d, supported %d", errWALTooNew, rec.FormatVersion, walFormatVersion)
+		}
+		if rec.Snapshot != nil {
+			contacts = rec.Snapshot.Contacts
+			trash = rec.Snapshot.Trash
+			changeSeq = rec.Snapshot.ChangeSeq
+			changeLogStart = rec.LogStart
+			changeLog = nil
+		}
+		for _, c := range rec.Changes {
+			changeSeq = max(changeSeq, c.Seq)
+			logChange(contactChange{seq: c.Seq, id: c.ID})
+		}
+		for _, c := range rec.Contacts {
+			if idx := findTrashIndexByID(c.ID); idx >= 0 {
+				trash = slices.Delete(trash, idx, idx+1)
+			}
+			if idx := findIndexByID(c.ID); idx >= 0 {
+				contacts[idx] = c
+			} else {
+				contacts = append(contacts, c)
+			}
+		}
+		for _, c := range rec.Trashed {
+			if idx := findIndexByID(c.ID); idx >= 0 {
+				contacts = slices.Delete(contacts, idx, idx+1)
+			}
+			if idx := findTrashIndexByID(c.ID); idx >= 0 {
+				trash = slices.Delete(trash, idx, idx+1)
+			}
+			trash = append(trash, c)
+		}
+		for _, id := range rec.Purged {
+			if idx := findTrashIndexByID(id); idx >= 0 {
+				trash = slices.Delete(trash, idx, idx+1)
+			}
+		}
+		currentID = max(currentID, rec.NextID-1)
+		return nil
+	}
+
+	var journal *wal.Log
+	// rewrite compacts the log into a single snapshot record, sealed with
+	// the current key.
+	rewrite := func() error {
+		payload, err := a.encodeRecord(stateRecord())
+		if err != nil {
+			return err
+		}
+		return journal.Rewrite(payload)
+	}
+	// rekey fires when records sealed with an old key, or not at all, or
+	// of an older format were replayed, to have the whole log rewritten
+	// with the current key and format once the app is up.
+	var rekey <-chan time.Time
+	if a.walPath != "" {
+		stale := false
+		var err error
+		journal, err = wal.Open(a.walPath, a.syncPolicy, a.syncInterval, func(payload []byte) error {
+			rec, keyID, err := a.decodeRecord(payload)
+			if err != nil {
+				return err
+			}
+			stale = stale || (a.keys != nil && keyID != a.keys.Current())
+			// Rewriting a log of an older format stamps it with the current
+			// one, which older binaries refuse.
+			stale = stale || (rec.Snapshot != nil && rec.FormatVersion < walFormatVersion)
+			return replayRecord(rec)
+		})
+		if err != nil {
+			a.ready <- err
+			return
+		}
+		// Replaying keeps contacts in log order; lookups by content need
+		// them sorted.
+		sortContacts()
+		defer journal.Close()
+		// A new log starts with an empty snapshot so that it carries its
+		// format version from the first record.
+		if journal.Size() == 0 {
+			err = rewrite()
+			if err != nil {
+				a.ready <- err
+				return
+			}
+		}
+		if stale {
+			rekey = time.After(0)
+		}
+	}
+	if a.ready != nil {
+		a.ready <- nil
+	}
+	// compactedSize is the size of the log right after it was last
+	// compacted.
+	var compactedSize int64
+	compact := func() {
+		if journal.Size() < max(minCompactSize, 2*compactedSize) {
+			return
+		}
+		// A failed compaction leaves the old log in place, so there is
+		// nothing to do but try again after the next change.
+		if rewrite() == nil {
+			compactedSize = journal.Size()
+		}
+	}
+	// persist logs rec and calls reply once it is durable.
+	persist := func(rec walRecord, reply func(error)) {
+		payload, err := a.encodeRecord(rec)
+		if err != nil {
+			reply(err)
+			return
+		}
+		journal.Append(payload, reply)
+		compact()
+	}
+
+	respond := func(cmd appCommand, reply any, found bool) {
+		if cmd.result == nil {
+			return
+		}
+		if found {
+			cmd.result <- reply
+		}
+		close(cmd.result)
+	}
+
+	// unacked are the commands whose records are not durable yet, oldest
+	// first.  logged wakes the actor once the log is done with one of them.
+	var unacked []*unlogged
+	logged := make(chan struct{}, 1)
+	// settle answers the commands the log is done with.  A failed record
+	// fails every one logged after it too, so once one has failed, all of
+	// those are rolled back, newest first, before any of them is answered.
+	settle := func() {
+		failed := len(unacked)
+		for i, u := range unacked {
+			if !u.settled {
+				select {
+				case u.err = <-u.done:
+					u.settled = true
+				default:
+				}
+			}
+			if u.settled && u.err != nil && failed == len(unacked) {
+				failed = i
+			}
+		}
+		for i := len(unacked) - 1; i >= failed; i-- {
+			unacked[i].rollback()
+		}
+		for _, u := range unacked[failed:] {
+			err := u.err
+			if err == nil {
+				err = unacked[failed].err
+			}
+			respond(u.cmd, failedReply(u.cmd, err), true)
+		}
+		waiting := unacked[:0]
+		for _, u := range unacked[:failed] {
+			if u.settled {
+				respond(u.cmd, u.reply, u.found)
+			} else {
+				waiting = append(waiting, u)
+			}
+		}
+		clear(unacked[len(waiting):])
+		unacked = waiting
+	}
+
+	// apply runs a command and returns its answer.  found is false for
+	// commands on a contact that does not exist.
+	apply := func(cmd appCommand) (reply any, found bool) {
+		p := cmd.principal
 		switch cmd.tag {
 		case addContact:
-			ac(cmd.inContact.FirstName, cmd.inContact.LastName, cmd.inContact.Email)
+			_, _ = ac(p, cmd.inContact.FirstName, cmd.inContact.LastName, cmd.inContact.Email)
+			return nil, false
 		case getContacts:
-			cpy := make([]appinterface.Contact, len(contacts))
-			copy(cpy, contacts)
-			cmd.result <- cpy
-			close(cmd.result)
+			return visible(p, contacts), true
 		case contactDetails:
 			idx := findIndexByID(cmd.inContact.ID)
-			if idx >= 0 {
-				cmd.result <- contacts[idx]
+			if idx >= 0 && canRead(p, contacts[idx]) {
+				return contacts[idx], true
 			}
-			close(cmd.result)
 		case deleteContact:
-			idx := findIndexByID(cmd.inContact.ID)
-			if idx >= 0 {
-				slices.Delete(contacts, idx, idx+1)
-				contacts = contacts[:len(contacts)-1]
+			idx, err := writable(p, cmd.inContact.ID)
+			if err == nil {
+				return dc(idx, cmd.ifMatch), true
 			}
+			return err, idx >= 0
 		case updateContact:
-			uc(cmd.inContact.ID, cmd.inContact.FirstName, cmd.inContact.LastName, cmd.inContact.Email)
+			idx, err := writable(p, cmd.inContact.ID)
+			if err == nil {
+				return uc(p, idx, cmd.ifMatch, cmd.inContact.FirstName, cmd.inContact.LastName, cmd.inContact.Email), true
+			}
+			return err, idx >= 0
+		case patchContact:
+			idx, err := writable(p, cmd.inContact.ID)
+			if err == nil {
+				return pc(p, idx, cmd.ifMatch, cmd.patch), true
+			}
+			return err, idx >= 0
+		case shareContact:
+			idx := findIndexByID(cmd.inContact.ID)
+			if idx >= 0 && canRead(p, contacts[idx]) {
+				return sc(p, idx, cmd.ifMatch, cmd.shares), true
+			}
+		case batch:
+			return applyBatch(p, cmd.batch), true
+		case importContacts:
+			return applyImport(p, cmd.contacts, cmd.dryRun), true
+		case snapshot:
+			return snapshotData(), true
+		case restore:
+			return restoreSnapshot(cmd.snapshot), true
+		case contactsAfter:
+			// Contacts are unique by content, so the position just past
+			// the cursor is where the next page starts.
+			start, found := findIndexByContent(cmd.inContact)
+			if found {
+				start++
+			}
+			page := []appinterface.Contact{}
+			for _, c := range contacts[start:] {
+				if len(page) >= cmd.limit {
+					break
+				}
+				if canRead(p, c) {
+					page = append(page, c)
+				}
+			}
+			return page, true
+		case changes:
+			return changesSince(p, cmd.since), true
+		case getTrash:
+			cpy := []appinterface.TrashedContact{}
+			for _, t := range trash {
+				if canRead(p, t.Contact) {
+					cpy = append(cpy, t)
+				}
+			}
+			return cpy, true
+		case restoreContact:
+			idx := findTrashIndexByID(cmd.inContact.ID)
+			if idx >= 0 && canRead(p, trash[idx].Contact) {
+				if p != nil && !p.CanWrite(trash[idx].Contact) {
+					return appinterface.ErrReadOnly, true
+				}
+				return rc(idx), true
+			}
+		}
+		return nil, false
+	}
+
+	purge := time.NewTicker(purgeInterval)
+	defer purge.Stop()
+
+	// A stopped app still answers the commands queued before it stopped,
+	// so the loop only ends once both lanes are closed and drained.
+	reads, writes := a.reads, a.writes
+	// streak is how many reads were taken ahead of everything else in a
+	// row.
+	streak := 0
+	for reads != nil || writes != nil {
+		settle()
+		var cmd appCommand
+		var ok bool
+		lane := &reads
+		// Reads are taken ahead of everything else, so a flood of writes
+		// cannot hold them up, but only readBurst of them in a row.  Then a
+		// waiting write goes next, and the timers get their turn, so a
+		// flood of reads cannot hold up the rest either.
+		taken := false
+		if streak < readBurst {
+			select {
+			case cmd, ok = <-reads:
+				taken = true
+				streak++
+			default:
+			}
+		}
+		if !taken {
+			readable := reads
+			if streak == readBurst && len(writes) > 0 {
+				readable = nil
+			}
+			streak = 0
+			select {
+			case now := <-purge.C:
+				if journal != nil && journal.Err() != nil {
+					continue
+				}
+				purged := purgeTrash(now)
+				if journal != nil && len(purged) > 0 {
+					persist(walRecord{NextID: currentID + 1, Purged: purged}, func(error) {})
+				}
+				continue
+			case <-rekey:
+				rekey = nil
+				if rewrite() != nil {
+					rekey = time.After(purgeInterval)
+					continue
+				}
+				compactedSize = journal.Size()
+				continue
+			case <-logged:
+				continue
+			case cmd, ok = <-readable:
+			case cmd, ok = <-writes:
+				lane = &writes
+			}
+		}
+		if !ok {
+			*lane = nil
+			continue
+		}
+		if lane == &writes {
+			took("write", cmd)
+		} else {
+			took("read", cmd)
+		}
+		pending = pending[:0]
+		if journal == nil || !mutates(cmd) {
+			reply, found := apply(cmd)
+			respond(cmd, reply, found)
+			continue
+		}
+		if err := journal.Err(); err != nil {
+			respond(cmd, failedReply(cmd, err), true)
+			continue
+		}
+		// Commands that end up changing nothing, like a rolled back
+		// batch, leave the sequence where it was and log nothing.
+		seq, id := changeSeq, currentID
+		var rollback func()
+		if cmd.tag == restore {
+			// A restore only ever fills an empty book.
+			rollback = checkpoint()
 		}
+		saved = map[int]savedContact{}
+		reply, found := apply(cmd)
+		if changeSeq == seq {
+			saved = nil
+			respond(cmd, reply, found)
+			continue
+		}
+		rec := changeRecord()
+		if cmd.tag == restore {
+			rec = stateRecord()
+		} else {
+			rollback = undo(id, seq)
+		}
+		saved = nil
+		u := &unlogged{cmd: cmd, reply: reply, found: found, rollback: rollback, done: make(chan error, 1)}
+		unacked = append(unacked, u)
+		persist(rec, func(err error) {
+			u.done <- err
+			select {
+			case logged <- struct{}{}:
+			default:
+			}
+		})
+	}
+	if journal != nil {
+		// Closing the log flushes it, which settles every record still
+		// waiting for an fsync.
+		_ = journal.Close()
+		settle()
 	}
 }
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/appinterface/apptest"
+)
+
+func TestApp(t *testing.T) {
+	apptest.TestApp(t, func(t *testing.T) appinterface.App {
+		a := NewApp(100, time.Second, time.Hour)
+		t.Cleanup(func() { stopApp(a) })
+		return a
+	})
+}
+
+// TestPurgeTrash checks that the actor empties the trash of contacts deleted
+// longer ago than the retention period, and only of those.
+func TestPurgeTrash(t *testing.T) {
+	interval := purgeInterval
+	purgeInterval = time.Millisecond
+	t.Cleanup(func() { purgeInterval = interval })
+	ctx := context.Background()
+	trashed := func(a appinterface.App) int {
+		ts, err := a.GetTrash(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(ts)
+	}
+
+	kept := NewApp(100, time.Second, time.Hour)
+	t.Cleanup(func() { stopApp(kept) })
+	purged := NewApp(100, time.Second, time.Millisecond)
+	t.Cleanup(func() { stopApp(purged) })
+	for _, a := range []appinterface.App{kept, purged} {
+		addNumbered(t, a, 1)
+		addNumbered(t, a, 2)
+		if err := a.DeleteContact(ctx, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the purge", func() bool { return trashed(purged) == 0 })
+	if got := firstNames(t, purged); len(got) != 1 || got[0] != contactNumber(2) {
+		t.Errorf("contacts after the purge: %v", got)
+	}
+	// Give the first app's actor a few ticks too.
+	time.Sleep(20 * purgeInterval)
+	if n := trashed(kept); n != 1 {
+		t.Errorf("%d contacts in the trash within the retention period, want 1", n)
+	}
+}
@@ -0,0 +1,225 @@
+package app
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/keyring"
+	"example-api-server/wal"
+)
+
+// newKey returns a key entry "<id>:<base64 key>" for keyring.Parse.
+func newKey(t *testing.T, id string) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func parseKeys(t *testing.T, entries ...string) *keyring.Keyring {
+	t.Helper()
+	k, err := keyring.Parse(strings.Join(entries, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func openSealedApp(path string, keys *keyring.Keyring) (appinterface.App, error) {
+	return NewPersistentApp(100, time.Second, time.Hour, path, wal.SyncAlways, time.Millisecond, keys)
+}
+
+// sealedWith reports whether the log at path holds a record sealed with the
+// key id, whose envelope names it in the clear.
+func sealedWith(t *testing.T, path string, id string) bool {
+	t.Helper()
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Contains(bts, append([]byte{0x01, byte(len(id))}, id...))
+}
+
+// waitForRewrite waits until done reports the log at path rewritten, which
+// the app does on its own shortly after starting.
+func waitForRewrite(t *testing.T, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("the log was not rewritten")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDecodeRecord(t *testing.T) {
+	keys := parseKeys(t, newKey(t, "k"))
+	plain, err := json.Marshal(walRecord{NextID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := keys.Seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name    string
+		keys    *keyring.Keyring
+		payload []byte
+		keyID   string
+		want    error
+	}{
+		{name: "plaintext", payload: plain},
+		{name: "plaintext with keys", keys: keys, payload: plain},
+		{name: "sealed", keys: keys, payload: sealed, keyID: "k"},
+		{name: "sealed without keys", payload: sealed, want: errWALEncrypted},
+		{name: "sealed with another key", keys: parseKeys(t, newKey(t, "other")), payload: sealed, keyID: "k", want: keyring.ErrUnknownKey},
+		{name: "sealed with a wrong key", keys: parseKeys(t, newKey(t, "k")), payload: sealed, keyID: "k", want: keyring.ErrWrongKey},
+		{name: "tampered", keys: keys, payload: tampered, keyID: "k", want: keyring.ErrWrongKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &app{keys: test.keys}
+			rec, keyID, err := a.decodeRecord(test.payload)
+			if !errors.Is(err, test.want) || keyID != test.keyID {
+				t.Fatalf("got %q %v, want %q %v", keyID, err, test.keyID, test.want)
+			}
+			if err == nil && rec.NextID != 7 {
+				t.Errorf("record: %+v", rec)
+			}
+		})
+	}
+}
+
+func TestSealedLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contacts.wal")
+	key := newKey(t, "k")
+	a, err := openSealedApp(path, parseKeys(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		addNumbered(t, a, i)
+	}
+	stopApp(a)
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bts, []byte(contactNumber(0))) || bytes.Contains(bts, []byte("c0@example.com")) {
+		t.Errorf("the sealed log holds contacts in the clear")
+	}
+
+	// Starting without the key, or with the wrong one, is refused rather
+	// than starting empty.
+	for _, test := range []struct {
+		name string
+		keys *keyring.Keyring
+		want error
+	}{
+		{name: "no keys", want: errWALEncrypted},
+		{name: "another key", keys: parseKeys(t, newKey(t, "other")), want: keyring.ErrUnknownKey},
+		{name: "wrong key", keys: parseKeys(t, newKey(t, "k")), want: keyring.ErrWrongKey},
+	} {
+		if a, err := openSealedApp(path, test.keys); !errors.Is(err, test.want) {
+			if a != nil {
+				stopApp(a)
+			}
+			t.Errorf("starting with %s: %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	a, err = openSealedApp(path, parseKeys(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopApp(a)
+	if got := firstNames(t, a); !slices.Equal(got, []string{contactNumber(0), contactNumber(1), contactNumber(2)}) {
+		t.Errorf("contacts after reopening: %q", got)
+	}
+}
+
+// TestRekeyAfterRotation checks that a log sealed with an old key is
+// rewritten with the current one, after which the old key is no longer
+// needed.
+func TestRekeyAfterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contacts.wal")
+	oldKey, currentKey := newKey(t, "old"), newKey(t, "new")
+	a, err := openSealedApp(path, parseKeys(t, oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		addNumbered(t, a, i)
+	}
+	stopApp(a)
+
+	a, err = openSealedApp(path, parseKeys(t, oldKey, currentKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRewrite(t, func() bool { return !sealedWith(t, path, "old") })
+	addNumbered(t, a, 3)
+	stopApp(a)
+	if !sealedWith(t, path, "new") {
+		t.Errorf("the log is not sealed with the new key")
+	}
+
+	a, err = openSealedApp(path, parseKeys(t, currentKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopApp(a)
+	if got := firstNames(t, a); len(got) != 4 || got[3] != contactNumber(3) {
+		t.Errorf("contacts after the rotation: %q", got)
+	}
+}
+
+// TestPlaintextLogIsSealed checks that turning encryption on seals a log
+// written without it.
+func TestPlaintextLogIsSealed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contacts.wal")
+	a := openApp(t, path, wal.SyncAlways)
+	addNumbered(t, a, 0)
+	stopApp(a)
+
+	key := newKey(t, "k")
+	a, err := openSealedApp(path, parseKeys(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRewrite(t, func() bool {
+		bts, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return !bytes.Contains(bts, []byte(contactNumber(0)))
+	})
+	stopApp(a)
+	if _, err := openSealedApp(path, nil); !errors.Is(err, errWALEncrypted) {
+		t.Errorf("opening the sealed log without keys: %v", err)
+	}
+	a, err = openSealedApp(path, parseKeys(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopApp(a)
+	if got := firstNames(t, a); !slices.Equal(got, []string{contactNumber(0)}) {
+		t.Errorf("contacts after sealing: %q", got)
+	}
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/keyring"
+	"example-api-server/wal"
+)
+
+// minCompactSize is the smallest log that is compacted.  Past that the log is
+// compacted whenever it has grown to twice the size it had after the last
+// compaction.
+const minCompactSize = 16 << 20
+
+// walFormatVersion is the version of walRecord this binary writes.  Records
+// carry it in FormatVersion, at least on every snapshot record, and a log
+// holding a newer one is refused.  Records from before versions were written
+// have none and are version 1.  Version 2 added the owners and shares of
+// contacts.
+const walFormatVersion = 2
+
+// walRecord is what the actor logs for each command that changed something:
+// the final state of every contact it touched, so replaying records never
+// depends on re-running a command.  A record with a snapshot replaces the
+// whole state instead; compaction and restores write those.
+type walRecord struct {
+	FormatVersion int                           `json:"formatVersion,omitempty"`
+	NextID        int                           `json:"nextId"`
+	Changes       []walChange                   `json:"changes,omitempty"`
+	Contacts      []appinterface.Contact        `json:"contacts,omitempty"`
+	Trashed       []appinterface.TrashedContact `json:"trashed,omitempty"`
+	Purged        []int                         `json:"purged,omitempty"`
+	Snapshot      *appinterface.SnapshotData    `json:"snapshot,omitempty"`
+	// LogStart is the oldest sync token the change log of a snapshot
+	// record can serve.
+	LogStart int `json:"logStart,omitempty"`
+}
+
+// errWALTooNew is returned when recovering from a log written by a newer
+// binary.
+var errWALTooNew = errors.New("write-ahead log is newer than this version supports")
+
+type walChange struct {
+	Seq int `json:"seq"`
+	ID  int `json:"id"`
+}
+
+// errWALEncrypted is returned when recovering from an encrypted log without
+// a key.
+var errWALEncrypted = errors.New("write-ahead log is encrypted and no encryption key is configured")
+
+// NewPersistentApp returns an app that recovers its state from the
+// write-ahead log at path and logs every change to it.  A command is only
+// answered once its change is as durable as policy makes it.  If the log
+// fails, the changes it could not make durable are undone and refused, and so
+// is every later change until the app is restarted.
+//
+// With keys every record is encrypted with the current key.  Records found
+// sealed with an older key, or written before encryption was turned on, are
+// rewritten with the current one shortly after the app starts.
+func NewPersistentApp(queueSize int, queueTimeout time.Duration, trashRetention time.Duration, path string, policy wal.SyncPolicy, syncInterval time.Duration, keys *keyring.Keyring) (appinterface.App, error) {
+	if queueSize < 10 {
+		queueSize = 10
+	}
+	if queueTimeout <= 0 {
+		queueTimeout = defaultQueueTimeout
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	r := &app{
+		reads:          make(chan appCommand, queueSize),
+		writes:         make(chan appCommand, queueSize),
+		queueTimeout:   queueTimeout,
+		wg:             wg,
+		trashRetention: trashRetention,
+		walPath:        path,
+		syncPolicy:     policy,
+		syncInterval:   syncInterval,
+		keys:           keys,
+		ready:          make(chan error, 1),
+	}
+	go r.run()
+	err := <-r.ready
+	if err != nil {
+		return nil, err
+	}
+	register(r)
+	return r, nil
+}
+
+func (a *app) encodeRecord(rec walRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil || a.keys == nil {
+		return payload, err
+	}
+	return a.keys.Seal(payload)
+}
+
+// decodeRecord decodes a logged record and returns the ID of the key it was
+// sealed with, empty for a plaintext record.
+func (a *app) decodeRecord(payload []byte) (walRecord, string, error) {
+	var rec walRecord
+	keyID := ""
+	if keyring.IsSealed(payload) {
+		if a.keys == nil {
+			return rec, "", errWALEncrypted
+		}
+		var err error
+		payload, keyID, err = a.keys.Open(payload)
+		if err != nil {
+			return rec, keyID, err
+		}
+	}
+	return rec, keyID, json.Unmarshal(payload, &rec)
+}
+
+// mutates reports whether a command may change the state.
+func mutates(cmd appCommand) bool {
+	switch cmd.tag {
+	case addContact, deleteContact, updateContact, patchContact, shareContact, batch, restore, restoreContact:
+		return true
+	case importContacts:
+		return !cmd.dryRun
+	}
+	return false
+}
+
+// savedContact is a contact as it was before a command changed it, kept so
+// the change can be undone.  A contact the command created was in neither
+// the contacts nor the trash.
+type savedContact struct {
+	appinterface.TrashedContact
+	inContacts bool
+	inTrash    bool
+}
+
+// unlogged is a command whose changes are applied but whose record is not
+// durable yet.  It is answered once the record is, or, should logging it
+// fail, once rollback has undone its changes.
+type unlogged struct {
+	cmd      appCommand
+	reply    any
+	found    bool
+	rollback func()
+	// done receives the outcome of logging the record.
+	done    chan error
+	settled bool
+	err     error
+}
+
+// failedReply is the answer to a command whose change could not be logged.
+func failedReply(cmd appCommand, err error) any {
+	if cmd.tag == batch {
+		return batchResponse{err: err}
+	}
+	return err
+}
@@ -0,0 +1,243 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/wal"
+)
+
+// failLog swaps the file under the open log at path for device, which
+// fails every write to it (/dev/full) or only every fsync (/dev/null).
+func failLog(t *testing.T, path string, device string) {
+	t.Helper()
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd:", err)
+	}
+	for _, entry := range fds {
+		target, err := os.Readlink("/proc/self/fd/" + entry.Name())
+		if err != nil || target != path {
+			continue
+		}
+		fd, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev, err := os.OpenFile(device, os.O_WRONLY, 0)
+		if err != nil {
+			t.Skip(err)
+		}
+		defer dev.Close()
+		if err := syscall.Dup3(int(dev.Fd()), fd, syscall.O_CLOEXEC); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Fatalf("%s is not open", path)
+}
+
+// appState is everything a client can see of an app.
+type appState struct {
+	contacts []appinterface.Contact
+	trash    []appinterface.TrashedContact
+	token    int
+}
+
+func stateOf(t *testing.T, a appinterface.App) appState {
+	t.Helper()
+	ctx := context.Background()
+	contacts, err := a.GetContacts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trash, err := a.GetTrash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := a.Changes(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return appState{contacts: contacts, trash: trash, token: changes.Token}
+}
+
+var logFailures = []struct {
+	name   string
+	policy wal.SyncPolicy
+	device string
+}{
+	{"write always", wal.SyncAlways, "/dev/full"},
+	{"fsync always", wal.SyncAlways, "/dev/null"},
+	{"write batch", wal.SyncBatch, "/dev/full"},
+	{"fsync batch", wal.SyncBatch, "/dev/null"},
+	{"write os", wal.SyncOS, "/dev/full"},
+}
+
+// TestFailedLogRollsBack checks that a change the log fails to make durable
+// is refused and leaves nothing behind, whether the write or the fsync
+// fails.
+func TestFailedLogRollsBack(t *testing.T) {
+	ctx := context.Background()
+	// The book holds Ada (ID 1) and Alan (ID 3), and Grace (ID 2) in the
+	// trash.
+	changes := map[string]func(a appinterface.App) error{
+		"add": func(a appinterface.App) error {
+			return a.AddContact(ctx, "Charles", "Babbage", "charles@example.com")
+		},
+		"update": func(a appinterface.App) error {
+			return a.UpdateContact(ctx, 1, nil, "Augusta", "King", "ada@example.com")
+		},
+		"patch": func(a appinterface.App) error {
+			_, err := a.PatchContact(ctx, 3, nil, func(c appinterface.Contact) (appinterface.Contact, error) {
+				c.Email = "turing@example.org"
+				return c, nil
+			})
+			return err
+		},
+		"share": func(a appinterface.App) error {
+			_, err := a.ShareContact(ctx, 1, nil, []appinterface.Share{{User: "bob", Access: appinterface.AccessRead}})
+			return err
+		},
+		"delete": func(a appinterface.App) error {
+			return a.DeleteContact(ctx, 1, nil)
+		},
+		"restore from trash": func(a appinterface.App) error {
+			return a.RestoreContact(ctx, 2)
+		},
+		"batch": func(a appinterface.App) error {
+			_, err := a.Batch(ctx, []appinterface.BatchOperation{
+				{Op: appinterface.BatchCreate, Contact: appinterface.Contact{FirstName: "Charles", LastName: "Babbage", Email: "charles@example.com"}},
+				{Op: appinterface.BatchUpdate, Contact: appinterface.Contact{ID: 3, FirstName: "Alan", LastName: "Turing", Email: "turing@example.org"}},
+				{Op: appinterface.BatchDelete, Contact: appinterface.Contact{ID: 1}},
+			})
+			return err
+		},
+		"import": func(a appinterface.App) error {
+			_, err := a.Import(ctx, []appinterface.Contact{
+				{FirstName: "Charles", LastName: "Babbage", Email: "charles@example.com"},
+				{ID: 1, FirstName: "Ada", LastName: "King", Email: "ada@example.com"},
+			}, false)
+			return err
+		},
+	}
+	seed := func(t *testing.T, a appinterface.App) {
+		for _, c := range []appinterface.Contact{
+			{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"},
+			{FirstName: "Grace", LastName: "Hopper", Email: "grace@example.com"},
+			{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"},
+		} {
+			if err := a.AddContact(ctx, c.FirstName, c.LastName, c.Email); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := a.DeleteContact(ctx, 2, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, change := range changes {
+		t.Run("healthy/"+name, func(t *testing.T) {
+			a := openApp(t, filepath.Join(t.TempDir(), "contacts.wal"), wal.SyncAlways)
+			seed(t, a)
+			if err := change(a); err != nil {
+				t.Fatalf("the change fails on a healthy log: %v", err)
+			}
+		})
+	}
+	for _, failure := range logFailures {
+		for name, change := range changes {
+			t.Run(failure.name+"/"+name, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "contacts.wal")
+				a := openApp(t, path, failure.policy)
+				seed(t, a)
+				before := stateOf(t, a)
+
+				failLog(t, path, failure.device)
+				if err := change(a); err == nil {
+					t.Fatal("the change succeeded")
+				}
+				if after := stateOf(t, a); !reflect.DeepEqual(after, before) {
+					t.Errorf("the failed change was kept:\n got %+v\nwant %+v", after, before)
+				}
+				if set, err := a.Changes(ctx, before.token); err != nil || len(set.Updated) > 0 || len(set.Deleted) > 0 {
+					t.Errorf("changes since the last token: %+v %v", set, err)
+				}
+				// The log stays failed, so the next change is refused
+				// without being applied.
+				if err := change(a); err == nil {
+					t.Error("a change after the failure succeeded")
+				}
+				if after := stateOf(t, a); !reflect.DeepEqual(after, before) {
+					t.Errorf("a change after the failure was kept: %+v", after)
+				}
+			})
+		}
+	}
+}
+
+func TestFailedLogRollsBackRestore(t *testing.T) {
+	for _, failure := range logFailures {
+		t.Run(failure.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "contacts.wal")
+			a := openApp(t, path, failure.policy)
+			before := stateOf(t, a)
+			failLog(t, path, failure.device)
+			err := a.Restore(context.Background(), appinterface.SnapshotData{
+				NextID:    2,
+				ChangeSeq: 5,
+				Contacts:  []appinterface.Contact{{ID: 1, Version: 1, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}},
+			})
+			if err == nil {
+				t.Fatal("the restore succeeded")
+			}
+			if after := stateOf(t, a); !reflect.DeepEqual(after, before) {
+				t.Errorf("the failed restore was kept:\n got %+v\nwant %+v", after, before)
+			}
+		})
+	}
+}
+
+// TestFailedFsyncRollsBackEveryWaitingWrite fails the fsync that a batch of
+// concurrent writes waits for, and checks that none of them is kept.
+func TestFailedFsyncRollsBackEveryWaitingWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contacts.wal")
+	a, err := NewPersistentApp(100, time.Second, time.Hour, path, wal.SyncBatch, 50*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stopApp(a) })
+	addNumbered(t, a, 0)
+	before := stateOf(t, a)
+
+	failLog(t, path, "/dev/null")
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = a.UpdateContact(context.Background(), 1, nil, contactNumber(i+1), "Test", "c0@example.com")
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("write %d succeeded", i)
+		}
+	}
+	if after := stateOf(t, a); !reflect.DeepEqual(after, before) {
+		t.Errorf("failed writes were kept:\n got %+v\nwant %+v", after, before)
+	}
+}
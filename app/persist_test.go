@@ -0,0 +1,310 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/wal"
+)
+
+var policies = map[string]wal.SyncPolicy{"always": wal.SyncAlways, "batch": wal.SyncBatch, "os": wal.SyncOS}
+
+// openApp opens a persistent app on the log at path that is stopped when
+// the test ends, unless the test stops it first.
+func openApp(t *testing.T, path string, policy wal.SyncPolicy) appinterface.App {
+	t.Helper()
+	a, err := NewPersistentApp(100, time.Second, time.Hour, path, policy, time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	t.Cleanup(func() { stopApp(a) })
+	return a
+}
+
+// stopApp stops a and waits for it, which closes its log.  Stopping it
+// again does nothing.
+func stopApp(a appinterface.App) {
+	defer func() { _ = recover() }()
+	a.Stop()
+	a.Wait()
+}
+
+// firstNames are the first names of contacts, sorted.
+func firstNames(t *testing.T, a appinterface.App) []string {
+	t.Helper()
+	contacts, err := a.GetContacts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, c := range contacts {
+		result = append(result, c.FirstName)
+	}
+	slices.Sort(result)
+	return result
+}
+
+func contactNumber(i int) string {
+	return fmt.Sprintf("Contact%04d", i)
+}
+
+func addNumbered(t *testing.T, a appinterface.App, i int) {
+	t.Helper()
+	err := a.AddContact(context.Background(), contactNumber(i), "Test", fmt.Sprintf("c%d@example.com", i))
+	if err != nil {
+		t.Fatalf("adding contact %d: %v", i, err)
+	}
+}
+
+// TestTornLogKeepsAcknowledgedWrites cuts the log off at every fsync point
+// and part way through every record after it, as a crash could, and checks
+// that reopening it recovers every write acknowledged before the cut and
+// nothing of the torn record.
+func TestTornLogKeepsAcknowledgedWrites(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "contacts.wal")
+	a := openApp(t, path, wal.SyncAlways)
+	const writes = 5
+	// synced[i] is the size of the log once the first i writes were
+	// acknowledged.
+	synced := make([]int64, writes+1)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced[0] = info.Size()
+	for i := 1; i <= writes; i++ {
+		addNumbered(t, a, i)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		synced[i] = info.Size()
+	}
+	stopApp(a)
+	log, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i <= writes; i++ {
+		var want []string
+		for j := 1; j <= i; j++ {
+			want = append(want, contactNumber(j))
+		}
+		cuts := []int64{synced[i]}
+		if i < writes {
+			next := synced[i+1]
+			// In the header, right after it and part way through the
+			// payload.
+			cuts = append(cuts, synced[i]+3, synced[i]+8, (synced[i]+next)/2, next-1)
+		}
+		for _, cut := range cuts {
+			torn := filepath.Join(dir, fmt.Sprintf("torn-%d.wal", cut))
+			if err := os.WriteFile(torn, log[:cut], 0o600); err != nil {
+				t.Fatal(err)
+			}
+			recovered := openApp(t, torn, wal.SyncAlways)
+			if got := firstNames(t, recovered); !slices.Equal(got, want) {
+				t.Errorf("cut at %d of %d: recovered %q, want %q", cut, len(log), got, want)
+			}
+			// The torn tail is gone, so the log takes new records.
+			addNumbered(t, recovered, 100)
+			stopApp(recovered)
+			reopened := openApp(t, torn, wal.SyncAlways)
+			if got := firstNames(t, reopened); !slices.Equal(got, append(slices.Clone(want), contactNumber(100))) {
+				t.Errorf("cut at %d: after a write and another reopen %q", cut, got)
+			}
+			stopApp(reopened)
+		}
+	}
+}
+
+// TestWriterProcess is the process TestKilledWriterKeepsAcknowledgedWrites
+// kills: it adds contacts to the log named by the environment and prints
+// the number of each one once it is acknowledged.
+func TestWriterProcess(t *testing.T) {
+	path := os.Getenv("APP_TEST_WAL")
+	if path == "" {
+		t.Skip("only run by TestKilledWriterKeepsAcknowledgedWrites")
+	}
+	a := openApp(t, path, policies[os.Getenv("APP_TEST_SYNC")])
+	for i := 1; ; i++ {
+		addNumbered(t, a, i)
+		fmt.Println(i)
+	}
+}
+
+// TestKilledWriterKeepsAcknowledgedWrites kills a process part way through
+// a stream of writes and checks that every write it had acknowledged is
+// there when the log is reopened.
+func TestKilledWriterKeepsAcknowledgedWrites(t *testing.T) {
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "contacts.wal")
+			cmd := exec.Command(os.Args[0], "-test.run=^TestWriterProcess$")
+			cmd.Env = append(os.Environ(), "APP_TEST_WAL="+path, "APP_TEST_SYNC="+name)
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			lines := bufio.NewScanner(stdout)
+			acknowledged := 0
+			for acknowledged < 200 && lines.Scan() {
+				acknowledged, err = strconv.Atoi(lines.Text())
+				if err != nil {
+					t.Fatalf("writer printed %q", lines.Text())
+				}
+			}
+			if err := cmd.Process.Kill(); err != nil {
+				t.Fatal(err)
+			}
+			// Whatever it printed before it died was acknowledged too.
+			for lines.Scan() {
+				if n, err := strconv.Atoi(lines.Text()); err == nil {
+					acknowledged = n
+				}
+			}
+			_ = cmd.Wait()
+			if acknowledged == 0 {
+				t.Fatal("the writer acknowledged nothing")
+			}
+
+			a := openApp(t, path, policy)
+			got := firstNames(t, a)
+			for i := 1; i <= acknowledged; i++ {
+				if _, found := slices.BinarySearch(got, contactNumber(i)); !found {
+					t.Fatalf("acknowledged contact %d of %d is missing after the kill", i, acknowledged)
+				}
+			}
+			// Besides those, only the write it had not printed yet and the
+			// one in flight when it died may have made it.
+			if len(got) > acknowledged+2 {
+				t.Errorf("recovered %d contacts, %d acknowledged", len(got), acknowledged)
+			}
+		})
+	}
+}
+
+// version1Log is a compacted log as version 1 of the format wrote it, before
+// records carried a format version and contacts had owners: a snapshot of
+// Ada and Grace, then Alan added, Grace deleted and Ada renamed.
+func version1Log(deletedAt time.Time) []string {
+	return []string{
+		`{"nextId":3,"changes":[{"seq":1,"id":1},{"seq":2,"id":2}],"snapshot":{"nextId":3,"changeSeq":2,"contacts":[` +
+			`{"id":1,"firstName":"Ada","lastName":"Lovelace","email":"ada@example.com","version":1},` +
+			`{"id":2,"firstName":"Grace","lastName":"Hopper","email":"grace@example.com","version":1}],"trash":[]}}`,
+		`{"nextId":4,"changes":[{"seq":3,"id":3}],"contacts":[{"id":3,"firstName":"Alan","lastName":"Turing","email":"alan@example.org","version":1}]}`,
+		`{"nextId":4,"changes":[{"seq":4,"id":2}],"trashed":[{"id":2,"firstName":"Grace","lastName":"Hopper","email":"grace@example.com","version":1,` +
+			`"deletedAt":"` + deletedAt.Format(time.RFC3339Nano) + `"}]}`,
+		`{"nextId":4,"changes":[{"seq":5,"id":1}],"contacts":[{"id":1,"firstName":"Ada","lastName":"King","email":"ada@example.com","version":2}]}`,
+	}
+}
+
+// writeLog writes a log of the given records.
+func writeLog(t *testing.T, path string, records []string) {
+	t.Helper()
+	log, err := wal.Open(path, wal.SyncAlways, 0, func([]byte) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		log.Append([]byte(rec), func(err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// firstRecord returns the first record of the log at path.
+func firstRecord(t *testing.T, path string) walRecord {
+	t.Helper()
+	var first *walRecord
+	log, err := wal.Open(path, wal.SyncAlways, 0, func(payload []byte) error {
+		if first == nil {
+			first = &walRecord{}
+			return json.Unmarshal(payload, first)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+	if first == nil {
+		t.Fatal("the log is empty")
+	}
+	return *first
+}
+
+// TestReadsVersion1Log recovers from a log of the first format and checks
+// that it is rewritten in the current one without losing anything.
+func TestReadsVersion1Log(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "contacts.wal")
+	writeLog(t, path, version1Log(time.Now()))
+	check := func(a appinterface.App) {
+		t.Helper()
+		if got, want := firstNames(t, a), []string{"Ada", "Alan"}; !slices.Equal(got, want) {
+			t.Errorf("contacts %q, want %q", got, want)
+		}
+		ada, err := a.ContactDetails(ctx, 1)
+		if err != nil || ada.LastName != "King" || ada.Version != 2 || ada.Owner != "" {
+			t.Errorf("Ada is %+v %v", ada, err)
+		}
+		trash, err := a.GetTrash(ctx)
+		if err != nil || len(trash) != 1 || trash[0].ID != 2 {
+			t.Errorf("trash %+v %v", trash, err)
+		}
+		changes, err := a.Changes(ctx, 3)
+		if err != nil || changes.Token != 5 || len(changes.Updated) != 1 || changes.Updated[0].ID != 1 || !slices.Equal(changes.Deleted, []int{2}) {
+			t.Errorf("changes since 3: %+v %v", changes, err)
+		}
+	}
+
+	a := openApp(t, path, wal.SyncAlways)
+	check(a)
+	// The log is rewritten in the current format shortly after starting.
+	deadline := time.Now().Add(5 * time.Second)
+	for firstRecord(t, path).FormatVersion != walFormatVersion {
+		if time.Now().After(deadline) {
+			t.Fatal("the version 1 log was not rewritten")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopApp(a)
+
+	a = openApp(t, path, wal.SyncAlways)
+	check(a)
+	addNumbered(t, a, 1)
+	if c, err := a.ContactDetails(ctx, 4); err != nil || c.FirstName != contactNumber(1) {
+		t.Errorf("the next contact is not number 4: %+v %v", c, err)
+	}
+}
+
+func TestRefusesNewerLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contacts.wal")
+	writeLog(t, path, []string{fmt.Sprintf(`{"formatVersion":%d,"nextId":1,"snapshot":{"nextId":1,"changeSeq":0,"contacts":[],"trash":[]}}`, walFormatVersion+1)})
+	_, err := NewPersistentApp(100, time.Second, time.Hour, path, wal.SyncAlways, 0, nil)
+	if !errors.Is(err, errWALTooNew) {
+		t.Errorf("opening a newer log: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"example-api-server/appinterface"
+)
+
+// defaultQueueTimeout is how long an operation waits for room in a full
+// queue when no timeout is given.
+const defaultQueueTimeout = time.Second
+
+// queueMetrics describes the queues of every app, by lane: how many
+// commands wait in them, how many the actors took and how long those had
+// waited in all, and how many were turned away because a queue was full.
+var queueMetrics = expvar.NewMap("app_queue")
+
+// liveApps are the apps whose queues queueMetrics adds up.
+var liveApps = struct {
+	sync.Mutex
+	apps map[*app]struct{}
+}{apps: map[*app]struct{}{}}
+
+func init() {
+	queueMetrics.Set("read_depth", expvar.Func(func() any {
+		return queueDepth(func(a *app) int { return len(a.reads) })
+	}))
+	queueMetrics.Set("write_depth", expvar.Func(func() any {
+		return queueDepth(func(a *app) int { return len(a.writes) })
+	}))
+}
+
+func queueDepth(depth func(*app) int) int {
+	liveApps.Lock()
+	defer liveApps.Unlock()
+	total := 0
+	for a := range liveApps.apps {
+		total += depth(a)
+	}
+	return total
+}
+
+func register(a *app) {
+	liveApps.Lock()
+	defer liveApps.Unlock()
+	liveApps.apps[a] = struct{}{}
+}
+
+func unregister(a *app) {
+	liveApps.Lock()
+	defer liveApps.Unlock()
+	delete(liveApps.apps, a)
+}
+
+// laneOf returns the lane a command waits in: reads and writes have queues
+// of their own, and the actor takes up to readBurst reads ahead of a
+// waiting write, so reads are never stuck behind a flood of writes, nor
+// writes behind a flood of reads.
+func (a *app) laneOf(cmd appCommand) (chan appCommand, string) {
+	if mutates(cmd) {
+		return a.writes, "write"
+	}
+	return a.reads, "read"
+}
+
+// enqueue hands cmd to the actor.  Rather than let callers pile up behind a
+// full queue, it gives up with ErrOverloaded once the queue has stayed full
+// for the queue timeout.
+func (a *app) enqueue(ctx context.Context, cmd appCommand) error {
+	lane, name := a.laneOf(cmd)
+	cmd.queued = time.Now()
+	select {
+	case lane <- cmd:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(a.queueTimeout)
+	defer timer.Stop()
+	select {
+	case lane <- cmd:
+		return nil
+	case <-timer.C:
+		queueMetrics.Add(name+"_overloaded", 1)
+		return appinterface.ErrOverloaded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// took records how long a command the actor took from lane had waited.
+func took(name string, cmd appCommand) {
+	queueMetrics.Add(name+"_commands", 1)
+	queueMetrics.AddFloat(name+"_wait_seconds", time.Since(cmd.queued).Seconds())
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+)
+
+// blockActor runs f in a's actor, which takes nothing else until f
+// returns.
+func blockActor(t *testing.T, a appinterface.App, f func()) {
+	t.Helper()
+	_, err := a.PatchContact(context.Background(), 1, nil, func(c appinterface.Contact) (appinterface.Contact, error) {
+		f()
+		return c, nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestWritesGetThroughAFloodOfReads queues a write behind a full read queue
+// and checks that the actor takes it after no more than readBurst of the
+// reads.
+func TestWritesGetThroughAFloodOfReads(t *testing.T) {
+	ctx := context.Background()
+	const queued = 5 * readBurst
+	a := NewApp(queued, time.Second, time.Hour)
+	t.Cleanup(func() { stopApp(a) })
+	addNumbered(t, a, 1)
+	entered, release := make(chan struct{}), make(chan struct{})
+	go blockActor(t, a, func() {
+		close(entered)
+		<-release
+	})
+	<-entered
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for range queued {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.GetContacts(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	waitFor(t, "the reads to queue", func() bool { return len(a.(*app).reads) == queued })
+	// left is how many reads still wait when the write is taken.
+	left := make(chan int, 1)
+	go blockActor(t, a, func() { left <- len(a.(*app).reads) })
+	waitFor(t, "the write to queue", func() bool { return len(a.(*app).writes) == 1 })
+
+	close(release)
+	if n := <-left; queued-n > readBurst {
+		t.Errorf("the write waited for %d of %d reads, want at most %d", queued-n, queued, readBurst)
+	}
+}
+
+// fullApp returns an app whose actor is stuck and whose read queue is
+// full, so the next read has to wait.
+func fullApp(t *testing.T, queueTimeout time.Duration) appinterface.App {
+	a := NewApp(10, queueTimeout, time.Hour)
+	addNumbered(t, a, 1)
+	queued := cap(a.(*app).reads)
+	entered, release := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		blockActor(t, a, func() {
+			close(entered)
+			<-release
+		})
+	}()
+	<-entered
+	for range queued {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.GetContacts(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	waitFor(t, "the read queue to fill", func() bool { return len(a.(*app).reads) == queued })
+	t.Cleanup(func() {
+		close(release)
+		wg.Wait()
+		stopApp(a)
+	})
+	return a
+}
+
+func TestEnqueueGivesUpOnAFullQueue(t *testing.T) {
+	a := fullApp(t, 10*time.Millisecond)
+	overloaded := func() int64 {
+		if v, ok := queueMetrics.Get("read_overloaded").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := overloaded()
+	if _, err := a.GetContacts(context.Background()); !errors.Is(err, appinterface.ErrOverloaded) {
+		t.Errorf("read on a full queue: %v, want %v", err, appinterface.ErrOverloaded)
+	}
+	if got := overloaded() - before; got != 1 {
+		t.Errorf("read_overloaded went up by %d, want 1", got)
+	}
+}
+
+func TestEnqueueStopsWaitingWhenCanceled(t *testing.T) {
+	a := fullApp(t, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.GetContacts(ctx)
+		done <- err
+	}()
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled read on a full queue: %v, want %v", err, context.Canceled)
+	}
+}
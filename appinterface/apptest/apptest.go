@@ -0,0 +1,455 @@
+// Package apptest runs the same tests against every implementation of
+// appinterface.App, so the in-memory app and the SQL store cannot drift
+// apart.
+package apptest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"example-api-server/appinterface"
+)
+
+// TestApp runs the suite against apps made by open, which returns a new,
+// empty app that is stopped when the test ends.
+func TestApp(t *testing.T, open func(t *testing.T) appinterface.App) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, a appinterface.App)
+	}{
+		{"CRUD", testCRUD},
+		{"IfMatch", testIfMatch},
+		{"Trash", testTrash},
+		{"Batch", testBatch},
+		{"BatchRollback", testBatchRollback},
+		{"Import", testImport},
+		{"ImportDryRun", testImportDryRun},
+		{"Share", testShare},
+		{"ContactsAfter", testContactsAfter},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, open(t))
+		})
+	}
+}
+
+var (
+	ada   = appinterface.Contact{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}
+	alan  = appinterface.Contact{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"}
+	grace = appinterface.Contact{FirstName: "Grace", LastName: "Hopper", Email: "grace@example.org"}
+)
+
+func asUser(name string) context.Context {
+	return appinterface.WithPrincipal(context.Background(), appinterface.Principal{Name: name})
+}
+
+func add(t *testing.T, ctx context.Context, a appinterface.App, contacts ...appinterface.Contact) {
+	t.Helper()
+	for _, c := range contacts {
+		if err := a.AddContact(ctx, c.FirstName, c.LastName, c.Email); err != nil {
+			t.Fatalf("adding %s: %v", c.FirstName, err)
+		}
+	}
+}
+
+// describe sums a contact up in one line, so that backends that leave no
+// shares as nil or as an empty list compare the same.
+func describe(c appinterface.Contact) string {
+	s := fmt.Sprintf("%d:%s %s <%s> v%d", c.ID, c.FirstName, c.LastName, c.Email, c.Version)
+	if c.Owner != "" {
+		s += " owner " + c.Owner
+	}
+	for _, share := range c.Shares {
+		s += fmt.Sprintf(" %s%s=%s", share.User, share.Group, share.Access)
+	}
+	return s
+}
+
+func describeAll(contacts []appinterface.Contact) []string {
+	result := []string{}
+	for _, c := range contacts {
+		result = append(result, describe(c))
+	}
+	return result
+}
+
+// contacts lists what ctx sees of a.
+func contacts(t *testing.T, ctx context.Context, a appinterface.App) []string {
+	t.Helper()
+	cs, err := a.GetContacts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return describeAll(cs)
+}
+
+func trash(t *testing.T, a appinterface.App) []string {
+	t.Helper()
+	ts, err := a.GetTrash(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := []string{}
+	for _, c := range ts {
+		if c.DeletedAt.IsZero() {
+			t.Errorf("%s has no time of deletion", describe(c.Contact))
+		}
+		result = append(result, describe(c.Contact))
+	}
+	return result
+}
+
+func expect(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	if want == nil {
+		want = []string{}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("%s:\n got %q\nwant %q", what, got, want)
+	}
+}
+
+func expectErr(t *testing.T, what string, err error, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Errorf("%s: got %v, want %v", what, err, want)
+	}
+}
+
+func testCRUD(t *testing.T, a appinterface.App) {
+	ctx := context.Background()
+	add(t, ctx, a, grace, ada, alan)
+	// Duplicate and invalid contacts are dropped quietly.
+	add(t, ctx, a, ada, appinterface.Contact{FirstName: "Mallory"})
+	expect(t, "contacts", contacts(t, ctx, a),
+		"2:Ada Lovelace <ada@example.com> v1",
+		"3:Alan Turing <alan@example.org> v1",
+		"1:Grace Hopper <grace@example.org> v1")
+
+	c, err := a.ContactDetails(ctx, 2)
+	if err != nil || describe(c) != "2:Ada Lovelace <ada@example.com> v1" {
+		t.Errorf("details: %s %v", describe(c), err)
+	}
+	_, err = a.ContactDetails(ctx, 9)
+	expectErr(t, "details of an unknown contact", err, io.EOF)
+
+	if err := a.UpdateContact(ctx, 2, nil, "Augusta", "King", "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	expectErr(t, "updating an unknown contact", a.UpdateContact(ctx, 9, nil, "Augusta", "King", "ada@example.com"), io.EOF)
+	expectErr(t, "updating to an invalid contact", a.UpdateContact(ctx, 2, nil, "Augusta", "King", ""), appinterface.ErrInvalidContact)
+
+	if err := a.DeleteContact(ctx, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.ContactDetails(ctx, 3)
+	expectErr(t, "details of a deleted contact", err, io.EOF)
+	expectErr(t, "deleting twice", a.DeleteContact(ctx, 3, nil), io.EOF)
+
+	// IDs are never handed out twice.
+	add(t, ctx, a, alan)
+	expect(t, "contacts after the changes", contacts(t, ctx, a),
+		"4:Alan Turing <alan@example.org> v1",
+		"2:Augusta King <ada@example.com> v2",
+		"1:Grace Hopper <grace@example.org> v1")
+}
+
+func testIfMatch(t *testing.T, a appinterface.App) {
+	ctx := context.Background()
+	add(t, ctx, a, ada)
+	if err := a.UpdateContact(ctx, 1, []int{1}, "Ada", "King", "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	expectErr(t, "stale update", a.UpdateContact(ctx, 1, []int{1}, "Augusta", "King", "ada@example.com"), appinterface.ErrVersionMismatch)
+	if err := a.UpdateContact(ctx, 1, []int{1, 2}, "Augusta", "King", "ada@example.com"); err != nil {
+		t.Errorf("update matching one of the versions: %v", err)
+	}
+
+	rename := func(c appinterface.Contact) (appinterface.Contact, error) {
+		c.FirstName = "Countess"
+		return c, nil
+	}
+	_, err := a.PatchContact(ctx, 1, []int{2}, rename)
+	expectErr(t, "stale patch", err, appinterface.ErrVersionMismatch)
+	patched, err := a.PatchContact(ctx, 1, []int{3}, rename)
+	if err != nil || describe(patched) != "1:Countess King <ada@example.com> v4" {
+		t.Errorf("patch: %s %v", describe(patched), err)
+	}
+	failed := errors.New("patch failed")
+	_, err = a.PatchContact(ctx, 1, nil, func(c appinterface.Contact) (appinterface.Contact, error) { return c, failed })
+	expectErr(t, "failing patch", err, failed)
+
+	_, err = a.ShareContact(ctx, 1, []int{3}, nil)
+	expectErr(t, "stale share", err, appinterface.ErrVersionMismatch)
+	expectErr(t, "stale delete", a.DeleteContact(ctx, 1, []int{3}), appinterface.ErrVersionMismatch)
+	expect(t, "contacts after the stale changes", contacts(t, ctx, a), "1:Countess King <ada@example.com> v4")
+	if err := a.DeleteContact(ctx, 1, []int{4}); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	expect(t, "contacts after the delete", contacts(t, ctx, a))
+}
+
+func testTrash(t *testing.T, a appinterface.App) {
+	ctx := context.Background()
+	add(t, ctx, a, ada, grace)
+	if err := a.DeleteContact(ctx, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "trash", trash(t, a), "1:Ada Lovelace <ada@example.com> v1")
+	expect(t, "contacts", contacts(t, ctx, a), "2:Grace Hopper <grace@example.org> v1")
+
+	if err := a.RestoreContact(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "trash after restoring", trash(t, a))
+	expect(t, "contacts after restoring", contacts(t, ctx, a),
+		"1:Ada Lovelace <ada@example.com> v2",
+		"2:Grace Hopper <grace@example.org> v1")
+	expectErr(t, "restoring twice", a.RestoreContact(ctx, 1), io.EOF)
+	expectErr(t, "restoring an unknown contact", a.RestoreContact(ctx, 9), io.EOF)
+
+	// A contact is not restored next to a live copy of itself.
+	if err := a.DeleteContact(ctx, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	add(t, ctx, a, ada)
+	expectErr(t, "restoring over a duplicate", a.RestoreContact(ctx, 1), appinterface.ErrDuplicateContact)
+	expect(t, "trash after the refused restore", trash(t, a), "1:Ada Lovelace <ada@example.com> v2")
+}
+
+func testBatch(t *testing.T, a appinterface.App) {
+	ctx := context.Background()
+	add(t, ctx, a, ada, grace)
+	results, err := a.Batch(ctx, []appinterface.BatchOperation{
+		{Op: appinterface.BatchCreate, Contact: alan},
+		{Op: appinterface.BatchUpdate, Contact: appinterface.Contact{ID: 1, Version: 1, FirstName: "Augusta", LastName: "King", Email: "ada@example.com"}},
+		{Op: appinterface.BatchDelete, Contact: appinterface.Contact{ID: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("%s: %v", describe(r.Contact), r.Err)
+		}
+		got = append(got, describe(r.Contact))
+	}
+	expect(t, "results", got,
+		"3:Alan Turing <alan@example.org> v1",
+		"1:Augusta King <ada@example.com> v2",
+		"2:Grace Hopper <grace@example.org> v1")
+	expect(t, "contacts", contacts(t, ctx, a),
+		"3:Alan Turing <alan@example.org> v1",
+		"1:Augusta King <ada@example.com> v2")
+	expect(t, "trash", trash(t, a), "2:Grace Hopper <grace@example.org> v1")
+}
+
+// testBatchRollback fails the third operation of batches and checks that
+// the first two are undone.
+func testBatchRollback(t *testing.T, a appinterface.App) {
+	ctx := context.Background()
+	add(t, ctx, a, ada, grace)
+	first := []appinterface.BatchOperation{
+		{Op: appinterface.BatchCreate, Contact: alan},
+		{Op: appinterface.BatchDelete, Contact: appinterface.Contact{ID: 2}},
+	}
+	for _, test := range []struct {
+		name string
+		op   appinterface.BatchOperation
+		want error
+	}{
+		{"unknown contact", appinterface.BatchOperation{Op: appinterface.BatchUpdate, Contact: appinterface.Contact{ID: 9, FirstName: "A", LastName: "B", Email: "c"}}, io.EOF},
+		{"deleted contact", appinterface.BatchOperation{Op: appinterface.BatchDelete, Contact: appinterface.Contact{ID: 2}}, io.EOF},
+		{"stale version", appinterface.BatchOperation{Op: appinterface.BatchDelete, Contact: appinterface.Contact{ID: 1, Version: 2}}, appinterface.ErrVersionMismatch},
+		{"duplicate", appinterface.BatchOperation{Op: appinterface.BatchCreate, Contact: alan}, appinterface.ErrDuplicateContact},
+		{"invalid", appinterface.BatchOperation{Op: appinterface.BatchCreate, Contact: appinterface.Contact{FirstName: "Mallory"}}, appinterface.ErrInvalidContact},
+		{"unknown op", appinterface.BatchOperation{Op: "merge", Contact: appinterface.Contact{ID: 1}}, appinterface.ErrUnknownBatchOperation},
+	} {
+		results, err := a.Batch(ctx, append(slices.Clone(first), test.op))
+		expectErr(t, test.name, err, test.want)
+		if len(results) != 3 {
+			t.Fatalf("%s: %d results", test.name, len(results))
+		}
+		for i, want := range []error{appinterface.ErrBatchRolledBack, appinterface.ErrBatchRolledBack, test.want} {
+			expectErr(t, fmt.Sprintf("%s: result %d", test.name, i), results[i].Err, want)
+		}
+		expect(t, test.name+": contacts", contacts(t, ctx, a),
+			"1:Ada Lovelace <ada@example.com> v1",
+			"2:Grace Hopper <grace@example.org> v1")
+		expect(t, test.name+": trash", trash(t, a))
+	}
+	// Nor are the IDs of the contacts they created used up.
+	add(t, ctx, a, alan)
+	if got := contacts(t, ctx, a); !slices.Contains(got, "3:Alan Turing <alan@example.org> v1") {
+		t.Errorf("contacts after the rolled back batches: %q", got)
+	}
+}
+
+func describeImport(results []appinterface.ImportResult) []string {
+	var result []string
+	for _, r := range results {
+		s := string(r.Action) + " " + describe(r.Contact)
+		if r.Err != nil {
+			s += ": " + strings.SplitN(r.Err.Error(), ":", 2)[0]
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// imports holds a contact already there, one updating Grace by her ID, one
+// with an ID no contact has, one without an ID, one with the ID the one
+// before it is given and an invalid one.
+var imports = []appinterface.Contact{
+	ada,
+	{ID: 2, FirstName: "Amazing Grace", LastName: "Hopper", Email: "grace@example.org"},
+	{ID: 99, FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"},
+	{FirstName: "Edsger", LastName: "Dijkstra", Email: "edsger@example.org"},
+	{ID: 4, FirstName: "Barbara", LastName: "Liskov", Email: "barbara@example.org"},
+	{FirstName: "Mallory"},
+}
+
+var importResults = []string{
+	"skipped 1:Ada Lovelace <ada@example.com> v1",
+	"updated 2:Amazing Grace Hopper <grace@example.org> v2",
+	"created 3:Alan Turing <alan@example.org> v1",
+	"created 4:Edsger Dijkstra <edsger@example.org> v1",
+	"created 5:Barbara Liskov <barbara@example.org> v1",
+	"failed 0:Mallory  <> v0: invalid contact",
+}
+
+func testImport(t *testing.T, a appinterface.App) {
+	ctx := context.Background()
+	add(t, ctx, a, ada, grace)
+	results, err := a.Import(ctx, imports, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "results", describeImport(results), importResults...)
+	expect(t, "contacts", contacts(t, ctx, a),
+		"1:Ada Lovelace <ada@example.com> v1",
+		"3:Alan Turing <alan@example.org> v1",
+		"2:Amazing Grace Hopper <grace@example.org> v2",
+		"5:Barbara Liskov <barbara@example.org> v1",
+		"4:Edsger Dijkstra <edsger@example.org> v1")
+
+	// An import only changes contacts the caller may change.
+	add(t, asUser("ed"), a, appinterface.Contact{FirstName: "Edith", LastName: "Clarke", Email: "edith@example.org"})
+	results, err = a.Import(asUser("vi"), []appinterface.Contact{{ID: 6, FirstName: "Edith", LastName: "Clarke", Email: "clarke@example.org"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "results of an import naming a contact the caller cannot see", describeImport(results),
+		"created 7:Edith Clarke <clarke@example.org> v1 owner vi")
+}
+
+func testImportDryRun(t *testing.T, a appinterface.App) {
+	ctx := context.Background()
+	add(t, ctx, a, ada, grace)
+	results, err := a.Import(ctx, imports, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "results", describeImport(results), importResults...)
+	expect(t, "contacts", contacts(t, ctx, a),
+		"1:Ada Lovelace <ada@example.com> v1",
+		"2:Grace Hopper <grace@example.org> v1")
+	add(t, ctx, a, alan)
+	expect(t, "contacts added after the dry run", contacts(t, ctx, a),
+		"1:Ada Lovelace <ada@example.com> v1",
+		"3:Alan Turing <alan@example.org> v1",
+		"2:Grace Hopper <grace@example.org> v1")
+}
+
+func testShare(t *testing.T, a appinterface.App) {
+	ed, vi, mallory := asUser("ed"), asUser("vi"), asUser("mallory")
+	engineers := appinterface.WithPrincipal(context.Background(), appinterface.Principal{Name: "eve", Groups: []string{"engineering"}})
+	add(t, ed, a, ada)
+	add(t, context.Background(), a, grace)
+	expect(t, "vi's contacts", contacts(t, vi, a), "2:Grace Hopper <grace@example.org> v1")
+	_, err := a.ContactDetails(vi, 1)
+	expectErr(t, "vi's details of ed's contact", err, io.EOF)
+	expectErr(t, "vi updating ed's contact", a.UpdateContact(vi, 1, nil, "Ada", "King", "ada@example.com"), io.EOF)
+	_, err = a.ShareContact(vi, 1, nil, []appinterface.Share{{User: "vi", Access: appinterface.AccessWrite}})
+	expectErr(t, "vi sharing ed's contact", err, io.EOF)
+
+	shared, err := a.ShareContact(ed, 1, []int{1}, []appinterface.Share{{User: "vi", Access: appinterface.AccessRead}, {Group: "engineering", Access: appinterface.AccessWrite}})
+	if err != nil || describe(shared) != "1:Ada Lovelace <ada@example.com> v2 owner ed vi=read engineering=write" {
+		t.Fatalf("share: %s %v", describe(shared), err)
+	}
+	expect(t, "vi's contacts", contacts(t, vi, a),
+		"1:Ada Lovelace <ada@example.com> v2 owner ed vi=read engineering=write",
+		"2:Grace Hopper <grace@example.org> v1")
+	expect(t, "mallory's contacts", contacts(t, mallory, a), "2:Grace Hopper <grace@example.org> v1")
+	expectErr(t, "vi updating a contact shared to read", a.UpdateContact(vi, 1, nil, "Ada", "King", "ada@example.com"), appinterface.ErrReadOnly)
+	expectErr(t, "vi deleting a contact shared to read", a.DeleteContact(vi, 1, nil), appinterface.ErrReadOnly)
+	_, err = a.ShareContact(vi, 1, nil, nil)
+	expectErr(t, "vi unsharing ed's contact", err, appinterface.ErrNotOwner)
+	_, err = a.ShareContact(ed, 1, nil, []appinterface.Share{{User: "vi", Group: "engineering", Access: appinterface.AccessRead}})
+	expectErr(t, "a share naming a user and a group", err, appinterface.ErrInvalidShare)
+	_, err = a.ShareContact(ed, 1, nil, []appinterface.Share{{User: "vi", Access: "admin"}})
+	expectErr(t, "a share with unknown access", err, appinterface.ErrInvalidShare)
+
+	if err := a.UpdateContact(engineers, 1, nil, "Ada", "King", "ada@example.com"); err != nil {
+		t.Errorf("a group member updating a contact shared to write: %v", err)
+	}
+	c, err := a.ContactDetails(ed, 1)
+	if err != nil || describe(c) != "1:Ada King <ada@example.com> v3 owner ed vi=read engineering=write" {
+		t.Errorf("after the group member's update: %s %v", describe(c), err)
+	}
+
+	if _, err := a.ShareContact(ed, 1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "vi's contacts after unsharing", contacts(t, vi, a), "2:Grace Hopper <grace@example.org> v1")
+	expect(t, "everyone's contacts", contacts(t, context.Background(), a),
+		"1:Ada King <ada@example.com> v4 owner ed",
+		"2:Grace Hopper <grace@example.org> v1")
+}
+
+func testContactsAfter(t *testing.T, a appinterface.App) {
+	ctx := context.Background()
+	add(t, ctx, a, grace, ada, alan)
+	add(t, asUser("ed"), a, appinterface.Contact{FirstName: "Barbara", LastName: "Liskov", Email: "barbara@example.org"})
+	add(t, ctx, a, appinterface.Contact{FirstName: "Edsger", LastName: "Dijkstra", Email: "edsger@example.org"})
+
+	pages := func(ctx context.Context, limit int) []string {
+		var result []string
+		var after appinterface.Contact
+		for range 10 {
+			page, err := a.ContactsAfter(ctx, after, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, c := range page {
+				names = append(names, c.FirstName)
+			}
+			result = append(result, strings.Join(names, ","))
+			if len(page) == 0 {
+				return result
+			}
+			after = page[len(page)-1]
+		}
+		t.Fatal("paging did not end")
+		return nil
+	}
+	expect(t, "pages of 2", pages(ctx, 2), "Ada,Alan", "Barbara,Edsger", "Grace", "")
+	expect(t, "pages of 5", pages(ctx, 5), "Ada,Alan,Barbara,Edsger,Grace", "")
+	expect(t, "vi's pages of 2", pages(asUser("vi"), 2), "Ada,Alan", "Edsger,Grace", "")
+
+	// A cursor need not be a contact that still exists.
+	page, err := a.ContactsAfter(ctx, appinterface.Contact{FirstName: "Alan", LastName: "Zuse"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "page after a contact that does not exist", describeAll(page),
+		"4:Barbara Liskov <barbara@example.org> v1 owner ed",
+		"5:Edsger Dijkstra <edsger@example.org> v1")
+}
@@ -1,18 +1,367 @@
 package appinterface
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrDuplicateContact is returned when an operation would produce a contact
+// identical to one that is already in the address book.
+var ErrDuplicateContact = errors.New("contact already exists")
+
+// ErrVersionMismatch is returned when a conditional update or delete names a
+// version of the contact that is no longer current.
+var ErrVersionMismatch = errors.New("contact version mismatch")
+
 type Contact struct {
 	ID        int    `json:"id"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	Email     string `json:"email"`
+	// Version is bumped by the app every time the contact changes and is
+	// used to build its ETag.
+	Version int `json:"version"`
+	// Owner is the user who added the contact, and Shares who else may see
+	// or change it.  Contacts without an owner, added before contacts had
+	// owners or by a server without authentication, are open to everyone.
+	Owner  string  `json:"owner,omitempty"`
+	Shares []Share `json:"shares,omitempty"`
+}
+
+// ErrInvalidContact is returned when a contact fails validation.
+var ErrInvalidContact = errors.New("invalid contact")
+
+// Validate checks that the contact has all of its required fields.
+func (c Contact) Validate() error {
+	if c.FirstName == "" || c.LastName == "" || c.Email == "" {
+		return fmt.Errorf("%w: missing required fields", ErrInvalidContact)
+	}
+	return nil
+}
+
+// ContactPatch computes the new state of a contact from its current state.
+// The app runs it while holding the contact, so nothing can change the
+// contact between the read and the write.  The ID and Version of the result
+// are ignored.
+type ContactPatch func(current Contact) (Contact, error)
+
+// ErrBatchRolledBack is reported for the operations of a batch that were
+// undone, or never attempted, because another operation in it failed.
+var ErrBatchRolledBack = errors.New("not applied: batch rolled back")
+
+// ErrUnknownBatchOperation is returned for a batch operation whose Op is not
+// one of the Batch* constants.
+var ErrUnknownBatchOperation = errors.New("unknown batch operation")
+
+type BatchOp string
+
+const (
+	BatchCreate BatchOp = "create"
+	BatchUpdate BatchOp = "update"
+	BatchDelete BatchOp = "delete"
+)
+
+// BatchOperation is one step of a batch.  Updates and deletes find their
+// contact by ID and, when Version is set, only apply to that version.
+type BatchOperation struct {
+	Op BatchOp `json:"op"`
+	Contact
+}
+
+// BatchResult is the outcome of a single batch operation.  Contact is the
+// contact as created, updated or deleted.
+type BatchResult struct {
+	Contact Contact
+	Err     error
+}
+
+type ImportAction string
+
+const (
+	ImportCreated ImportAction = "created"
+	ImportUpdated ImportAction = "updated"
+	ImportSkipped ImportAction = "skipped"
+	ImportFailed  ImportAction = "failed"
+)
+
+// ImportResult is what happened, or in a dry run what would happen, to one
+// imported contact.  Err is set when Action is ImportFailed.
+type ImportResult struct {
+	Action  ImportAction
+	Contact Contact
+	Err     error
+}
+
+// ErrSyncTokenExpired is returned when asked for the changes since a sync
+// token the app no longer has enough history to answer.
+var ErrSyncTokenExpired = errors.New("sync token expired")
+
+// ChangeSet lists the contacts changed since a sync token, and the token to
+// use next time.
+type ChangeSet struct {
+	Token   int
+	Updated []Contact
+	Deleted []int
+}
+
+// ErrOverloaded is returned when an app is too busy to take on another
+// operation.  Trying again shortly may succeed.
+var ErrOverloaded = errors.New("too busy, try again later")
+
+// ErrNotEmpty is returned when restoring a snapshot into an app that already
+// holds contacts.
+var ErrNotEmpty = errors.New("address book is not empty")
+
+// SnapshotData is a consistent point-in-time copy of everything the app
+// stores.  NextID and ChangeSeq carry the ID and sync token sequences over so
+// that neither repeats after a restore.
+type SnapshotData struct {
+	NextID    int              `json:"nextId"`
+	ChangeSeq int              `json:"changeSeq"`
+	Contacts  []Contact        `json:"contacts"`
+	Trash     []TrashedContact `json:"trash"`
+}
+
+// TrashedContact is a deleted contact waiting in the trash to be either
+// restored or purged.
+type TrashedContact struct {
+	Contact
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// ErrReadOnly is returned when changing a contact that is only shared
+// read-only with the caller.
+var ErrReadOnly = errors.New("contact is shared read-only")
+
+// ErrNotOwner is returned when someone other than a contact's owner tries to
+// change who it is shared with.
+var ErrNotOwner = errors.New("only the owner of a contact may share it")
+
+// ErrInvalidShare is returned for a share that does not name exactly one
+// user or group, or whose access is unknown.
+var ErrInvalidShare = errors.New("invalid share")
+
+type Access string
+
+const (
+	AccessRead  Access = "read"
+	AccessWrite Access = "write"
+)
+
+// Share lets a user, or every member of a group, read or change a contact.
+type Share struct {
+	User   string `json:"user,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Access Access `json:"access"`
 }
 
+func (s Share) Validate() error {
+	if (s.User == "") == (s.Group == "") {
+		return fmt.Errorf("%w: a share names either a user or a group", ErrInvalidShare)
+	}
+	if s.Access != AccessRead && s.Access != AccessWrite {
+		return fmt.Errorf("%w: access must be %q or %q", ErrInvalidShare, AccessRead, AccessWrite)
+	}
+	return nil
+}
+
+// Principal is the user an operation is done for.  Apps only let it see
+// the contacts it owns, that are shared with it or that have no owner.
+type Principal struct {
+	Name   string
+	Groups []string
+	// All lets the principal see and change every contact, as admins, who
+	// can take a snapshot of the whole book anyway, can.
+	All bool
+	// KeepEmails has changes keep the email address a contact has, for a
+	// principal that is only shown masked or hidden ones and would write
+	// those back over the real one.  New contacts take the one given.
+	KeepEmails bool
+}
+
+type principalContextKey struct{}
+
+// WithPrincipal returns a context that carries p to the app.  Operations
+// whose context carries no principal, such as those of a server without
+// authentication, see and may change every contact.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+// PrincipalFrom returns the principal ctx carries, if any.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(Principal)
+	return p, ok
+}
+
+// Owns reports whether p may share c.
+func (p Principal) Owns(c Contact) bool {
+	return p.All || (c.Owner != "" && c.Owner == p.Name)
+}
+
+// SharedWith returns the most a share of c gives p, or "" if none does.
+func (p Principal) SharedWith(c Contact) Access {
+	var access Access
+	for _, s := range c.Shares {
+		if (s.User != "" && s.User == p.Name) || (s.Group != "" && slices.Contains(p.Groups, s.Group)) {
+			if s.Access == AccessWrite {
+				return AccessWrite
+			}
+			access = s.Access
+		}
+	}
+	return access
+}
+
+func (p Principal) CanRead(c Contact) bool {
+	return c.Owner == "" || p.Owns(c) || p.SharedWith(c) != ""
+}
+
+func (p Principal) CanWrite(c Contact) bool {
+	return c.Owner == "" || p.Owns(c) || p.SharedWith(c) == AccessWrite
+}
+
+// App is an address book.  The context of an operation on contacts carries
+// the principal it is done for, if any: contacts the principal may not see
+// are not found, and changing one it may only read fails with ErrReadOnly.
 type App interface {
-	AddContact(firstName string, lastName string, email string) error
-	GetContacts() ([]Contact, error)
-	ContactDetails(id int) (Contact, error)
-	DeleteContact(id int) error
-	UpdateContact(id int, firstName string, lastName string, email string) error
+	AddContact(ctx context.Context, firstName string, lastName string, email string) error
+	GetContacts(ctx context.Context) ([]Contact, error)
+	// ContactsAfter returns up to limit contacts that sort after the given
+	// one, so large lists can be walked a page at a time.  The zero Contact
+	// starts from the beginning.
+	ContactsAfter(ctx context.Context, after Contact, limit int) ([]Contact, error)
+	ContactDetails(ctx context.Context, id int) (Contact, error)
+	// DeleteContact and UpdateContact only apply when the contact's current
+	// version is in ifMatch; an empty ifMatch applies unconditionally.
+	DeleteContact(ctx context.Context, id int, ifMatch []int) error
+	UpdateContact(ctx context.Context, id int, ifMatch []int, firstName string, lastName string, email string) error
+	PatchContact(ctx context.Context, id int, ifMatch []int, patch ContactPatch) (Contact, error)
+	// ShareContact replaces who a contact is shared with.  Only its owner
+	// may share it.
+	ShareContact(ctx context.Context, id int, ifMatch []int, shares []Share) (Contact, error)
+	// Batch applies all of ops, in order, or none of them.  When it returns
+	// an error, that is the error of the operation that failed.
+	Batch(ctx context.Context, ops []BatchOperation) ([]BatchResult, error)
+	// Import applies each contact independently: identical contacts are
+	// skipped, contacts with the ID of one the caller can see update that
+	// contact and the rest, whatever their ID, are created.  Only contacts
+	// there before the import are matched by ID.  A dry run reports the
+	// results without keeping any changes.
+	Import(ctx context.Context, contacts []Contact, dryRun bool) ([]ImportResult, error)
+	// Changes reports what changed after the sync token since.  A since of
+	// zero returns every contact.
+	Changes(ctx context.Context, since int) (ChangeSet, error)
+	Snapshot() (SnapshotData, error)
+	// Restore loads a snapshot into an empty app.
+	Restore(ctx context.Context, data SnapshotData) error
+	GetTrash(ctx context.Context) ([]TrashedContact, error)
+	RestoreContact(ctx context.Context, id int) error
 	Stop()
 	Wait()
 }
+
+// DefaultBook is the address book of the routes without a book in their
+// path, and the only one served over CardDAV and LDAP.
+const DefaultBook = "default"
+
+// ErrNoSuchBook is returned for an address book that does not exist.
+var ErrNoSuchBook = errors.New("no such address book")
+
+// ErrInvalidBookName is returned for a book name that is not safe to use in
+// a URL or a file name.
+var ErrInvalidBookName = errors.New("book names must be 1 to 63 lowercase letters, digits, '-' or '_', starting with a letter or digit")
+
+// ValidateBookName checks that name can be used as a book name.
+func ValidateBookName(name string) error {
+	if name == "" || len(name) > 63 {
+		return ErrInvalidBookName
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case (r == '-' || r == '_') && i > 0:
+		default:
+			return ErrInvalidBookName
+		}
+	}
+	return nil
+}
+
+// Books holds the address books of a deployment.  Each book is an App of
+// its own, with its own contacts, IDs, change log and trash, so nothing done
+// through one book can reach another's contacts.
+type Books interface {
+	// Book returns the named book, or ErrNoSuchBook.
+	Book(name string) (App, error)
+	Names() []string
+	Stop()
+	Wait()
+}
+
+type appBooks struct {
+	names []string
+	apps  map[string]App
+}
+
+// NewBooks returns books made of separate apps, which are stopped with them.
+func NewBooks(names []string, apps map[string]App) Books {
+	return &appBooks{names: names, apps: apps}
+}
+
+func (b *appBooks) Book(name string) (App, error) {
+	app, ok := b.apps[name]
+	if !ok {
+		return nil, ErrNoSuchBook
+	}
+	return app, nil
+}
+
+func (b *appBooks) Names() []string {
+	return append([]string{}, b.names...)
+}
+
+func (b *appBooks) Stop() {
+	for _, app := range b.apps {
+		app.Stop()
+	}
+}
+
+func (b *appBooks) Wait() {
+	for _, app := range b.apps {
+		app.Wait()
+	}
+}
+
+type wrappedBooks struct {
+	Books
+	apps map[string]App
+}
+
+// WrapBooks returns books with each of its apps wrapped by wrap, which is
+// given the name of the book too.
+func WrapBooks(books Books, wrap func(name string, app App) (App, error)) (Books, error) {
+	w := &wrappedBooks{Books: books, apps: map[string]App{}}
+	for _, name := range books.Names() {
+		app, err := books.Book(name)
+		if err != nil {
+			return nil, err
+		}
+		w.apps[name], err = wrap(name, app)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *wrappedBooks) Book(name string) (App, error) {
+	app, ok := w.apps[name]
+	if !ok {
+		return nil, ErrNoSuchBook
+	}
+	return app, nil
+}
@@ -0,0 +1,309 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"example-api-server/appinterface"
+)
+
+// Request is who made the request behind an operation, and from where.
+type Request struct {
+	Actor string
+	IP    string
+	ID    string
+}
+
+type requestContextKey struct{}
+
+// WithRequest returns a context that carries r to the audited app, which
+// records it with every change made under that context.
+func WithRequest(ctx context.Context, r Request) context.Context {
+	return context.WithValue(ctx, requestContextKey{}, r)
+}
+
+// pinRetries bounds how many times an operation is retried when the contact
+// changes between reading it and changing it.
+const pinRetries = 3
+
+// auditedApp records every change made through it.  To record exactly the
+// contact it changed, it reads the contact first and then only changes that
+// version of it, retrying if something else got there in between.
+type auditedApp struct {
+	appinterface.App
+	log  *Log
+	book string
+}
+
+// Wrap returns app with every change made to the contacts of book recorded
+// in l.
+func Wrap(app appinterface.App, l *Log, book string) appinterface.App {
+	return &auditedApp{App: app, log: l, book: book}
+}
+
+// record appends a change to the log.  The change has already been made by
+// then and cannot be taken back, so an entry that cannot be written fails
+// the operation that made it, and the log refuses every change after it.
+func (a *auditedApp) record(ctx context.Context, op Op, id int, before *appinterface.Contact, after *appinterface.Contact) error {
+	r, _ := ctx.Value(requestContextKey{}).(Request)
+	_, err := a.log.Append(Entry{
+		Book:      a.book,
+		Actor:     r.Actor,
+		IP:        r.IP,
+		RequestID: r.ID,
+		Op:        op,
+		ContactID: id,
+		Before:    before,
+		After:     after,
+	})
+	if err != nil {
+		change := fmt.Sprintf("%s of contact %d", op, id)
+		if id == 0 {
+			change = string(op)
+		}
+		log.Printf("Error writing audit entry for %s in book[%s]: %v\n", change, a.book, err)
+		return fmt.Errorf("%s was made but not recorded: %w", change, err)
+	}
+	return nil
+}
+
+// pinned runs change against the version of contact id it reads first, as
+// long as that version is in ifMatch, and returns what it read.
+func (a *auditedApp) pinned(ctx context.Context, id int, ifMatch []int, change func(version int) error) (appinterface.Contact, error) {
+	var err error
+	for range pinRetries {
+		var before appinterface.Contact
+		before, err = a.App.ContactDetails(ctx, id)
+		if err != nil {
+			return before, err
+		}
+		if len(ifMatch) > 0 && !slices.Contains(ifMatch, before.Version) {
+			return before, appinterface.ErrVersionMismatch
+		}
+		err = change(before.Version)
+		if err == nil || !errors.Is(err, appinterface.ErrVersionMismatch) || len(ifMatch) > 0 {
+			return before, err
+		}
+	}
+	return appinterface.Contact{}, err
+}
+
+// AddContact creates the contact as a batch of one, which, unlike an add,
+// answers with the contact it created.
+func (a *auditedApp) AddContact(ctx context.Context, firstName string, lastName string, email string) error {
+	if err := a.log.Err(); err != nil {
+		return err
+	}
+	results, err := a.App.Batch(ctx, []appinterface.BatchOperation{{
+		Op:      appinterface.BatchCreate,
+		Contact: appinterface.Contact{FirstName: firstName, LastName: lastName, Email: email},
+	}})
+	// Adds drop invalid and duplicate contacts quietly.
+	if errors.Is(err, appinterface.ErrInvalidContact) || errors.Is(err, appinterface.ErrDuplicateContact) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return a.record(ctx, OpAdd, results[0].Contact.ID, nil, &results[0].Contact)
+}
+
+func (a *auditedApp) DeleteContact(ctx context.Context, id int, ifMatch []int) error {
+	if err := a.log.Err(); err != nil {
+		return err
+	}
+	before, err := a.pinned(ctx, id, ifMatch, func(version int) error {
+		return a.App.DeleteContact(ctx, id, []int{version})
+	})
+	if err != nil {
+		return err
+	}
+	return a.record(ctx, OpDelete, id, &before, nil)
+}
+
+// UpdateContact goes through PatchContact, which hands over the contact as
+// it was and answers with it as it is.
+func (a *auditedApp) UpdateContact(ctx context.Context, id int, ifMatch []int, firstName string, lastName string, email string) error {
+	_, err := a.PatchContact(ctx, id, ifMatch, func(current appinterface.Contact) (appinterface.Contact, error) {
+		current.FirstName = firstName
+		current.LastName = lastName
+		current.Email = email
+		return current, nil
+	})
+	return err
+}
+
+func (a *auditedApp) PatchContact(ctx context.Context, id int, ifMatch []int, patch appinterface.ContactPatch) (appinterface.Contact, error) {
+	if err := a.log.Err(); err != nil {
+		return appinterface.Contact{}, err
+	}
+	var before appinterface.Contact
+	after, err := a.App.PatchContact(ctx, id, ifMatch, func(current appinterface.Contact) (appinterface.Contact, error) {
+		before = current
+		return patch(current)
+	})
+	if err != nil {
+		return after, err
+	}
+	return after, a.record(ctx, OpUpdate, id, &before, &after)
+}
+
+func (a *auditedApp) ShareContact(ctx context.Context, id int, ifMatch []int, shares []appinterface.Share) (appinterface.Contact, error) {
+	if err := a.log.Err(); err != nil {
+		return appinterface.Contact{}, err
+	}
+	var after appinterface.Contact
+	before, err := a.pinned(ctx, id, ifMatch, func(version int) error {
+		var err error
+		after, err = a.App.ShareContact(ctx, id, []int{version}, shares)
+		return err
+	})
+	if err != nil {
+		return after, err
+	}
+	return after, a.record(ctx, OpShare, id, &before, &after)
+}
+
+// Batch pins each update and delete to the version of its contact it reads
+// first, unless the batch touched the contact already, in which case the
+// contact as that earlier operation left it is what it changes.
+func (a *auditedApp) Batch(ctx context.Context, ops []appinterface.BatchOperation) ([]appinterface.BatchResult, error) {
+	if err := a.log.Err(); err != nil {
+		return nil, err
+	}
+	var (
+		results []appinterface.BatchResult
+		befores []*appinterface.Contact
+		err     error
+	)
+	for range pinRetries {
+		pinnedOps := slices.Clone(ops)
+		befores = make([]*appinterface.Contact, len(ops))
+		seen := map[int]bool{}
+		repinned := false
+		for i, op := range pinnedOps {
+			if op.Op != appinterface.BatchUpdate && op.Op != appinterface.BatchDelete {
+				continue
+			}
+			if seen[op.ID] {
+				continue
+			}
+			seen[op.ID] = true
+			before, err := a.App.ContactDetails(ctx, op.ID)
+			if err != nil {
+				// The batch fails on it the same way.
+				continue
+			}
+			befores[i] = &before
+			if op.Version == 0 {
+				pinnedOps[i].Version = before.Version
+				repinned = true
+			}
+		}
+		results, err = a.App.Batch(ctx, pinnedOps)
+		if err == nil || !errors.Is(err, appinterface.ErrVersionMismatch) || !repinned {
+			break
+		}
+	}
+	if err != nil {
+		return results, err
+	}
+	current := map[int]appinterface.Contact{}
+	for i, op := range ops {
+		c := results[i].Contact
+		before := befores[i]
+		if prev, ok := current[c.ID]; ok {
+			before = &prev
+		}
+		switch op.Op {
+		case appinterface.BatchCreate:
+			err = a.record(ctx, OpAdd, c.ID, nil, &c)
+			current[c.ID] = c
+		case appinterface.BatchUpdate:
+			err = a.record(ctx, OpUpdate, c.ID, before, &c)
+			current[c.ID] = c
+		case appinterface.BatchDelete:
+			err = a.record(ctx, OpDelete, c.ID, &c, nil)
+			delete(current, c.ID)
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// Import reads the contacts it will update beforehand.  Unlike the other
+// changes an import does not pin them, so a contact changed by someone else
+// in between is recorded as it was when it was read.
+func (a *auditedApp) Import(ctx context.Context, contacts []appinterface.Contact, dryRun bool) ([]appinterface.ImportResult, error) {
+	if err := a.log.Err(); err != nil && !dryRun {
+		return nil, err
+	}
+	befores := map[int]appinterface.Contact{}
+	if !dryRun {
+		for _, c := range contacts {
+			if c.ID == 0 {
+				continue
+			}
+			if before, err := a.App.ContactDetails(ctx, c.ID); err == nil {
+				befores[c.ID] = before
+			}
+		}
+	}
+	results, err := a.App.Import(ctx, contacts, dryRun)
+	if err != nil || dryRun {
+		return results, err
+	}
+	for _, r := range results {
+		c := r.Contact
+		switch r.Action {
+		case appinterface.ImportCreated:
+			err = a.record(ctx, OpAdd, c.ID, nil, &c)
+		case appinterface.ImportUpdated:
+			var before *appinterface.Contact
+			if b, ok := befores[c.ID]; ok {
+				before = &b
+			}
+			err = a.record(ctx, OpUpdate, c.ID, before, &c)
+			befores[c.ID] = c
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+func (a *auditedApp) RestoreContact(ctx context.Context, id int) error {
+	err := a.log.Err()
+	if err != nil {
+		return err
+	}
+	err = a.App.RestoreContact(ctx, id)
+	if err != nil {
+		return err
+	}
+	var after *appinterface.Contact
+	if c, err := a.App.ContactDetails(ctx, id); err == nil {
+		after = &c
+	}
+	return a.record(ctx, OpRestore, id, nil, after)
+}
+
+// Restore records a restore as one entry rather than one for each contact
+// the snapshot holds.
+func (a *auditedApp) Restore(ctx context.Context, data appinterface.SnapshotData) error {
+	err := a.log.Err()
+	if err != nil {
+		return err
+	}
+	err = a.App.Restore(ctx, data)
+	if err != nil {
+		return err
+	}
+	return a.record(ctx, OpRestoreSnapshot, 0, nil, nil)
+}
@@ -0,0 +1,123 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"example-api-server/app"
+	"example-api-server/appinterface"
+)
+
+// newAudited returns an in-memory app audited in a new log, which are both
+// closed when the test ends.
+func newAudited(t *testing.T) (appinterface.App, *Log) {
+	t.Helper()
+	l, err := Open(filepath.Join(t.TempDir(), "audit.jsonl"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := app.NewApp(10, time.Second, time.Hour)
+	t.Cleanup(func() {
+		a.Stop()
+		a.Wait()
+		l.Close()
+	})
+	return Wrap(a, l, appinterface.DefaultBook), l
+}
+
+func entries(t *testing.T, l *Log) []Entry {
+	t.Helper()
+	var result []Entry
+	if err := l.Query(Filter{}, func(e Entry) bool {
+		result = append(result, e)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// TestFailedAppendRefusesChanges checks that a change whose entry cannot be
+// written fails, and that no change is made after it.
+func TestFailedAppendRefusesChanges(t *testing.T) {
+	ctx := context.Background()
+	a, l := newAudited(t)
+	if err := a.AddContact(ctx, "Ada", "Lovelace", "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Writes to a file opened read-only fail.
+	l.file.Close()
+	var err error
+	l.file, err = os.Open(l.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.AddContact(ctx, "Grace", "Hopper", "grace@example.org"); !errors.Is(err, ErrFailed) {
+		t.Errorf("adding a contact that cannot be recorded: %v", err)
+	}
+	if err := l.Err(); !errors.Is(err, ErrFailed) {
+		t.Errorf("the log has not failed: %v", err)
+	}
+	before, err := a.GetContacts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := map[string]func() error{
+		"add":    func() error { return a.AddContact(ctx, "Alan", "Turing", "alan@example.org") },
+		"update": func() error { return a.UpdateContact(ctx, 1, nil, "Augusta", "King", "ada@example.com") },
+		"delete": func() error { return a.DeleteContact(ctx, 1, nil) },
+		"batch": func() error {
+			_, err := a.Batch(ctx, []appinterface.BatchOperation{{Op: appinterface.BatchCreate, Contact: appinterface.Contact{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"}}})
+			return err
+		},
+		"import": func() error {
+			_, err := a.Import(ctx, []appinterface.Contact{{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"}}, false)
+			return err
+		},
+	}
+	for name, change := range changes {
+		if err := change(); !errors.Is(err, ErrFailed) {
+			t.Errorf("%s after the log failed: %v", name, err)
+		}
+	}
+	after, err := a.GetContacts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("changes were made after the log failed: %+v, want %+v", after, before)
+	}
+	if got := entries(t, l); len(got) != 1 || got[0].After.FirstName != "Ada" {
+		t.Errorf("entries %+v", got)
+	}
+}
+
+func TestRestoreIsRecorded(t *testing.T) {
+	a, l := newAudited(t)
+	ctx := WithRequest(context.Background(), Request{Actor: "alice", ID: "restore-1"})
+	err := a.Restore(ctx, appinterface.SnapshotData{
+		NextID:    2,
+		ChangeSeq: 1,
+		Contacts:  []appinterface.Contact{{ID: 1, Version: 1, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := entries(t, l)
+	if len(got) != 1 || got[0].Op != OpRestoreSnapshot || got[0].Actor != "alice" || got[0].RequestID != "restore-1" || got[0].ContactID != 0 {
+		t.Errorf("entries %+v", got)
+	}
+	// A restore the app refuses is not recorded.
+	if err := a.Restore(ctx, appinterface.SnapshotData{NextID: 1}); !errors.Is(err, appinterface.ErrNotEmpty) {
+		t.Errorf("restoring into a book with contacts: %v", err)
+	}
+	if got := entries(t, l); len(got) != 1 {
+		t.Errorf("entries after a refused restore %+v", got)
+	}
+}
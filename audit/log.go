@@ -0,0 +1,416 @@
+// Package audit keeps an append-only record of every change made to the
+// contacts: who made it, from where, in which request, and the contact
+// before and after.
+//
+// The record is a file of JSON lines, each carrying the SHA-256 hash of the
+// previous one and its own, so a line that is changed, removed or inserted
+// breaks the chain from that line on.  Rewriting the whole chain from the
+// changed line is only detected by comparing the head hash against a copy
+// kept somewhere else, which Verify returns for that purpose.
+//
+// With encryption keys each line is sealed, and written as base64.  The
+// chain runs through the entries themselves, so it is the same sealed or
+// not, and survives the log being sealed again with a new key.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/keyring"
+)
+
+// ErrTampered is returned for a log whose hash chain is broken.
+var ErrTampered = errors.New("audit log has been tampered with")
+
+// ErrEncrypted is returned for a log with sealed entries opened without
+// keys.
+var ErrEncrypted = errors.New("audit log is encrypted but no encryption keys are configured")
+
+// ErrFailed is returned once an entry could not be written.  Nothing more
+// is appended to the log, and the audited apps refuse every change, until
+// the server is restarted.
+var ErrFailed = errors.New("audit log cannot be written, changes are refused")
+
+type Op string
+
+const (
+	OpAdd     Op = "add"
+	OpUpdate  Op = "update"
+	OpDelete  Op = "delete"
+	OpRestore Op = "restore"
+	OpShare   Op = "share"
+	// OpRestoreSnapshot is a whole book restored from a snapshot.  Its
+	// entry names no contact.
+	OpRestoreSnapshot Op = "restore-snapshot"
+)
+
+// Entry is one change.  Before is missing for contacts that did not exist
+// yet, After for contacts that were deleted.
+type Entry struct {
+	Seq       int                   `json:"seq"`
+	Time      time.Time             `json:"time"`
+	Book      string                `json:"book"`
+	Actor     string                `json:"actor,omitempty"`
+	IP        string                `json:"ip,omitempty"`
+	RequestID string                `json:"requestId,omitempty"`
+	Op        Op                    `json:"op"`
+	ContactID int                   `json:"contactId"`
+	Before    *appinterface.Contact `json:"before,omitempty"`
+	After     *appinterface.Contact `json:"after,omitempty"`
+	PrevHash  string                `json:"prevHash"`
+	Hash      string                `json:"hash"`
+}
+
+// hash returns the hash of e, which covers every field but Hash itself, so
+// through PrevHash it covers every entry before e as well.
+func (e Entry) hash() (string, error) {
+	e.Hash = ""
+	bts, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(bts)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Filter selects entries.  Zero fields match every entry.
+type Filter struct {
+	Since     time.Time
+	Book      string
+	Actor     string
+	ContactID int
+}
+
+func (f Filter) matches(e Entry) bool {
+	return (f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Book == "" || e.Book == f.Book) &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.ContactID == 0 || e.ContactID == f.ContactID)
+}
+
+// Log is an audit log file.  Entries are only ever appended to it.
+type Log struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	// keys, when set, seal every entry written.
+	keys *keyring.Keyring
+	// size is how much of the file holds whole entries, which readers stop
+	// at so they never see half of one being appended.
+	size int64
+	seq  int
+	head string
+	// failed is why an entry could not be written, after which no more are.
+	failed error
+}
+
+// Open opens the log at path, creating it if needed, after checking its
+// hash chain.  A last line cut short by a crash is dropped; any other break
+// in the chain is reported as ErrTampered.  With keys, entries are sealed,
+// and a log with entries sealed with an older key, or not at all, is
+// sealed again with the current one.
+func Open(path string, keys *keyring.Keyring) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{path: path, file: file, keys: keys}
+	stale := false
+	l.size, err = scan(file, -1, keys, func(e Entry, keyID string) bool {
+		l.seq = e.Seq
+		l.head = e.Hash
+		stale = stale || (keys != nil && keyID != keys.Current())
+		return true
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() > l.size {
+		log.Printf("Dropping %d bytes of an unfinished entry at the end of audit log[%s]\n", info.Size()-l.size, path)
+		err = file.Truncate(l.size)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if stale {
+		err = l.rekey()
+		if err != nil {
+			l.file.Close()
+			return nil, fmt.Errorf("sealing the audit log with key %q: %w", keys.Current(), err)
+		}
+	}
+	_, err = l.file.Seek(l.size, io.SeekStart)
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// rekey writes every entry, sealed with the current key, to a new file that
+// then replaces the log whole, so a crash leaves either the old log or the
+// new one.
+func (l *Log) rekey() error {
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".rekey*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	out := bufio.NewWriter(tmp)
+	var size int64
+	var werr error
+	_, err = l.file.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = scan(l.file, l.size, l.keys, func(e Entry, _ string) bool {
+			var line []byte
+			line, werr = l.encode(e)
+			if werr == nil {
+				_, werr = out.Write(line)
+				size += int64(len(line))
+			}
+			return werr == nil
+		})
+	}
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(l.path))
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	l.file.Close()
+	l.file = tmp
+	l.size = size
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// encode turns e into a line of the log, sealed if the log has keys.
+func (l *Log) encode(e Entry) ([]byte, error) {
+	line, err := json.Marshal(e)
+	if err != nil || l.keys == nil {
+		return append(line, '\n'), err
+	}
+	sealed, err := l.keys.Seal(line)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(base64.StdEncoding.EncodeToString(sealed)), '\n'), nil
+}
+
+// decode returns the entry a line holds, as JSON, and the ID of the key it
+// was sealed with, empty for an entry that was not.
+func decode(line []byte, keys *keyring.Keyring) ([]byte, string, error) {
+	if bytes.HasPrefix(line, []byte("{")) {
+		return line, "", nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrTampered, err)
+	}
+	if keys == nil {
+		return nil, "", ErrEncrypted
+	}
+	return keys.Open(sealed)
+}
+
+// scan reads up to limit bytes of entries from r, or all of them if limit
+// is negative, opening the sealed ones with keys and checking the chain as
+// it goes, and passes each, with the ID of the key it was sealed with, to
+// fn until it returns false.  It returns how many bytes the whole entries
+// it read took up; an unterminated last line is not counted.
+func scan(r io.Reader, limit int64, keys *keyring.Keyring, fn func(e Entry, keyID string) bool) (int64, error) {
+	if limit >= 0 {
+		r = io.LimitReader(r, limit)
+	}
+	in := bufio.NewReader(r)
+	var size int64
+	prev := Entry{}
+	for {
+		line, err := in.ReadBytes('\n')
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		read := len(line)
+		line, keyID, err := decode(bytes.TrimSuffix(line, []byte("\n")), keys)
+		if err != nil {
+			return size, fmt.Errorf("entry after %d: %w", prev.Seq, err)
+		}
+		var e Entry
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return size, fmt.Errorf("%w: entry after %d is not valid JSON: %v", ErrTampered, prev.Seq, err)
+		}
+		hash, err := e.hash()
+		if err != nil {
+			return size, err
+		}
+		// Entries are written exactly as they encode, so anything added to a
+		// line, which decoding would silently drop, shows up here.
+		canonical, err := json.Marshal(e)
+		if err != nil {
+			return size, err
+		}
+		if e.Seq != prev.Seq+1 || e.PrevHash != prev.Hash || e.Hash != hash || !bytes.Equal(canonical, line) {
+			return size, fmt.Errorf("%w: chain breaks at entry %d", ErrTampered, prev.Seq+1)
+		}
+		size += int64(read)
+		prev = e
+		if !fn(e, keyID) {
+			return size, nil
+		}
+	}
+}
+
+// Append chains e onto the log and writes it through to disk.  Seq,
+// PrevHash and Hash are filled in, and Time if it is zero.
+func (l *Log) Append(e Entry) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failed != nil {
+		return e, fmt.Errorf("%w: %v", ErrFailed, l.failed)
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	// Times are kept in UTC so that an entry encodes the same way after
+	// being read back, which its hash depends on.
+	e.Time = e.Time.UTC()
+	e.Seq = l.seq + 1
+	e.PrevHash = l.head
+	var err error
+	e.Hash, err = e.hash()
+	if err != nil {
+		return e, err
+	}
+	line, err := l.encode(e)
+	if err != nil {
+		return e, err
+	}
+	_, err = l.file.Write(line)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// Whatever part of the line made it out is dropped, or it would
+		// break the chain for every later entry.
+		if terr := l.file.Truncate(l.size); terr != nil {
+			log.Printf("Error truncating audit log[%s]: %v\n", l.path, terr)
+		}
+		l.file.Seek(l.size, io.SeekStart)
+		l.failed = err
+		return e, fmt.Errorf("%w: %v", ErrFailed, err)
+	}
+	l.size += int64(len(line))
+	l.seq = e.Seq
+	l.head = e.Hash
+	return e, nil
+}
+
+// Err returns an error wrapping ErrFailed once an entry could not be
+// written, and nil until then.
+func (l *Log) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failed == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrFailed, l.failed)
+}
+
+// read passes the entries written so far to fn until it returns false,
+// reading the file separately from the appends, which carry on meanwhile.
+func (l *Log) read(fn func(Entry) bool) error {
+	l.mu.Lock()
+	size := l.size
+	l.mu.Unlock()
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = scan(file, size, l.keys, func(e Entry, _ string) bool {
+		return fn(e)
+	})
+	return err
+}
+
+// Query passes the entries f matches to fn, oldest first, until it returns
+// false.
+func (l *Log) Query(f Filter, fn func(Entry) bool) error {
+	return l.read(func(e Entry) bool {
+		if !f.matches(e) {
+			return true
+		}
+		return fn(e)
+	})
+}
+
+// Verification is the outcome of checking the whole chain.
+type Verification struct {
+	Entries int    `json:"entries"`
+	Head    string `json:"head"`
+}
+
+// Verify checks the hash chain of every entry written so far.  Keep the
+// head hash it returns somewhere else to later prove that nothing before it
+// was rewritten.
+func (l *Log) Verify() (Verification, error) {
+	var v Verification
+	err := l.read(func(e Entry) bool {
+		v.Entries++
+		v.Head = e.Hash
+		return true
+	})
+	return v, err
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example-api-server/appinterface"
+	"example-api-server/keyring"
+)
+
+// newKey returns a key entry "<id>:<base64 key>" for keyring.Parse.
+func newKey(t *testing.T, id string) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func parseKeys(t *testing.T, entries ...string) *keyring.Keyring {
+	t.Helper()
+	k, err := keyring.Parse(strings.Join(entries, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// writeEntries opens the log at path with keys, appends two entries for Ada and
+// returns the head of the chain once it is closed.
+func writeEntries(t *testing.T, path string, keys *keyring.Keyring) string {
+	t.Helper()
+	l, err := Open(path, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, op := range []Op{OpAdd, OpUpdate} {
+		_, err := l.Append(Entry{Book: appinterface.DefaultBook, Op: op, ContactID: 1,
+			After: &appinterface.Contact{ID: 1, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.Head
+}
+
+// head opens the log at path with keys and returns its verified head.
+func head(t *testing.T, path string, keys *keyring.Keyring) (Verification, error) {
+	t.Helper()
+	l, err := Open(path, keys)
+	if err != nil {
+		return Verification{}, err
+	}
+	defer l.Close()
+	return l.Verify()
+}
+
+func TestSealedLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	oldKey, currentKey := newKey(t, "old"), newKey(t, "new")
+	want := writeEntries(t, path, parseKeys(t, oldKey))
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"Lovelace", "ada@example.com", `"op"`} {
+		if bytes.Contains(file, []byte(plain)) {
+			t.Errorf("the sealed log holds %q:\n%s", plain, file)
+		}
+	}
+
+	if _, err := Open(path, nil); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("opening without keys: %v", err)
+	}
+	if _, err := Open(path, parseKeys(t, currentKey)); !errors.Is(err, keyring.ErrUnknownKey) {
+		t.Errorf("opening without the key it was sealed with: %v", err)
+	}
+
+	// After a rotation the log is sealed with the new key only, and holds
+	// the same chain.
+	if got, err := head(t, path, parseKeys(t, oldKey, currentKey)); err != nil || got.Head != want || got.Entries != 2 {
+		t.Fatalf("after the rotation: %+v %v, want head %s", got, err, want)
+	}
+	if got, err := head(t, path, parseKeys(t, currentKey)); err != nil || got.Head != want {
+		t.Errorf("without the old key: %+v %v", got, err)
+	}
+	// New entries carry on the chain.
+	writeEntries(t, path, parseKeys(t, currentKey))
+	if got, err := head(t, path, parseKeys(t, currentKey)); err != nil || got.Entries != 4 {
+		t.Errorf("after more entries: %+v %v", got, err)
+	}
+}
+
+func TestPlaintextLogIsSealed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	key := newKey(t, "k")
+	want := writeEntries(t, path, nil)
+	if got, err := head(t, path, parseKeys(t, key)); err != nil || got.Head != want {
+		t.Fatalf("turning encryption on: %+v %v, want head %s", got, err, want)
+	}
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(file, []byte("Lovelace")) {
+		t.Errorf("the log was not sealed:\n%s", file)
+	}
+}
+
+func TestTamperedSealedLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	keys := parseKeys(t, newKey(t, "k"))
+	writeEntries(t, path, keys)
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(file, []byte("\n"))
+	second := lines[1]
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(lines[1])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	lines[1] = []byte(base64.StdEncoding.EncodeToString(sealed) + "\n")
+	if err := os.WriteFile(path, bytes.Join(lines, nil), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, keys); !errors.Is(err, keyring.ErrWrongKey) {
+		t.Errorf("opening a log with a changed entry: %v", err)
+	}
+
+	// Dropping a whole sealed line breaks the chain.
+	if err := os.WriteFile(path, second, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, keys); !errors.Is(err, ErrTampered) {
+		t.Errorf("opening a log missing its first entry: %v", err)
+	}
+}
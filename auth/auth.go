@@ -0,0 +1,253 @@
+// Package auth holds the API keys clients authenticate with and the login
+// sessions of browsers.
+//
+// API keys are random tokens, so a SHA-256 hash is enough to keep them from
+// being usable by anyone who reads the configuration or the keys file; only
+// the hash is ever stored.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyPrefix starts every generated API key, so one is easy to recognise in a
+// secret scanner or a leaked log.
+const keyPrefix = "eas_"
+
+const hashPrefix = "sha256:"
+
+var (
+	ErrKeyNotFound   = errors.New("API key not found")
+	ErrConfiguredKey = errors.New("API key is set in the configuration and cannot be deleted here")
+	ErrNoKeysFile    = errors.New("no keys file is configured to store API keys in")
+	ErrInvalidName   = errors.New("API key name must not be empty")
+)
+
+// Key is an API key, of which only the hash is known.  Name identifies the
+// client using it; several keys may share one.
+type Key struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      Role      `json:"role"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Configured is true for keys from the configuration file, as opposed
+	// to those created through the store.
+	Configured bool `json:"-"`
+}
+
+// GenerateKey returns a new random API key.
+func GenerateKey() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return keyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash returns the hash an API key is stored as.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// ParseHash checks that hash is one returned by Hash.
+func ParseHash(hash string) error {
+	h, ok := strings.CutPrefix(hash, hashPrefix)
+	if !ok {
+		return fmt.Errorf("hash must start with %q", hashPrefix)
+	}
+	b, err := hex.DecodeString(h)
+	if err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("hash must be %d hex digits after %q", 2*sha256.Size, hashPrefix)
+	}
+	return nil
+}
+
+// keyID derives a short, stable ID from a hash.  It names a key in listings
+// without giving away the whole hash.
+func keyID(hash string) string {
+	return strings.TrimPrefix(hash, hashPrefix)[:12]
+}
+
+// NewConfiguredKey returns the key for a name, role and hash from the
+// configuration.
+func NewConfiguredKey(name string, role string, hash string) (Key, error) {
+	if name == "" {
+		return Key{}, ErrInvalidName
+	}
+	r, err := ParseRole(role)
+	if err != nil {
+		return Key{}, err
+	}
+	err = ParseHash(hash)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{ID: keyID(hash), Name: name, Role: r, Hash: hash, Configured: true}, nil
+}
+
+// keysFile is the document the created keys are kept in.
+type keysFile struct {
+	Keys []Key `json:"keys"`
+}
+
+// Store looks up the clients API keys belong to.  Keys come from the
+// configuration and, when the store has a file, are created and deleted
+// through it too.
+type Store struct {
+	mu         sync.RWMutex
+	path       string
+	configured []Key
+	created    []Key
+	byHash     map[string]Key
+}
+
+// NewStore returns a store of the configured keys and, if path is not
+// empty, the keys created earlier and saved there.
+func NewStore(configured []Key, path string) (*Store, error) {
+	s := &Store{path: path, configured: configured}
+	if path != "" {
+		bts, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			var f keysFile
+			err = json.Unmarshal(bts, &f)
+			if err != nil {
+				return nil, fmt.Errorf("keys file[%s]: %v", path, err)
+			}
+			for i, k := range f.Keys {
+				if err := ParseHash(k.Hash); err != nil {
+					return nil, fmt.Errorf("keys file[%s]: key %s: %v", path, k.ID, err)
+				}
+				f.Keys[i].Role, err = ParseRole(string(k.Role))
+				if err != nil {
+					return nil, fmt.Errorf("keys file[%s]: key %s: %v", path, k.ID, err)
+				}
+			}
+			s.created = f.Keys
+		}
+	}
+	s.index()
+	return s, nil
+}
+
+func (s *Store) index() {
+	s.byHash = map[string]Key{}
+	for _, k := range s.configured {
+		s.byHash[k.Hash] = k
+	}
+	for _, k := range s.created {
+		s.byHash[k.Hash] = k
+	}
+}
+
+// Len returns how many keys there are.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.byHash)
+}
+
+// Lookup returns the key a client presented, if it is one of the store's.
+func (s *Store) Lookup(key string) (Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.byHash[Hash(key)]
+	return k, ok
+}
+
+// Keys returns every key, the configured ones first.
+func (s *Store) Keys() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Concat(s.configured, s.created)
+}
+
+// Create makes a new key with role for the client name and saves it,
+// returning the key itself, which is not kept and cannot be recovered later.
+func (s *Store) Create(name string, role Role) (Key, string, error) {
+	if name == "" {
+		return Key{}, "", ErrInvalidName
+	}
+	if s.path == "" {
+		return Key{}, "", ErrNoKeysFile
+	}
+	secret, err := GenerateKey()
+	if err != nil {
+		return Key{}, "", err
+	}
+	hash := Hash(secret)
+	k := Key{ID: keyID(hash), Name: name, Role: role, Hash: hash, CreatedAt: time.Now().UTC()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.save(append(slices.Clip(s.created), k))
+	if err != nil {
+		return Key{}, "", err
+	}
+	s.created = append(s.created, k)
+	s.index()
+	return k, secret, nil
+}
+
+// Delete removes a created key.  Configured keys can only be removed from
+// the configuration.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.created, func(k Key) bool { return k.ID == id })
+	if i < 0 {
+		if slices.ContainsFunc(s.configured, func(k Key) bool { return k.ID == id }) {
+			return ErrConfiguredKey
+		}
+		return ErrKeyNotFound
+	}
+	created := slices.Delete(slices.Clone(s.created), i, i+1)
+	err := s.save(created)
+	if err != nil {
+		return err
+	}
+	s.created = created
+	s.index()
+	return nil
+}
+
+// save writes keys to the keys file, next to it first and renamed into
+// place, so a crash never loses the keys already there.
+func (s *Store) save(keys []Key) error {
+	bts, err := json.MarshalIndent(keysFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(bts)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
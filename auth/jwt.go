@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksCheckInterval is how often, at most, the JWKS file is checked for
+	// changes.
+	jwksCheckInterval = time.Second
+	// minHMACKeySize and minRSAKeyBits refuse keys too weak to sign with.
+	minHMACKeySize = 32
+	minRSAKeyBits  = 2048
+)
+
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrUnsupportedAlg = errors.New("unsupported token algorithm")
+	ErrUnknownKID     = errors.New("token is signed with an unknown key")
+	ErrBadSignature   = errors.New("token signature is invalid")
+	ErrTokenExpired   = errors.New("token has expired")
+	ErrTokenNotYet    = errors.New("token is not valid yet")
+	ErrWrongIssuer    = errors.New("token has the wrong issuer")
+	ErrWrongAudience  = errors.New("token is not meant for this server")
+	ErrNoRole         = errors.New("token grants no role")
+	ErrNoName         = errors.New("token names no client")
+)
+
+// JWTOptions says what a token must claim to be accepted, and how its
+// claims map onto a client.
+type JWTOptions struct {
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// NameClaim names the client, "sub" if empty.
+	NameClaim string
+	// RoleClaim holds a string or a list of strings, "role" if empty.
+	RoleClaim string
+	// Roles maps the values of RoleClaim onto roles.  If it is empty the
+	// values are taken to be role names.  The highest role found wins.
+	Roles map[string]Role
+	// Leeway allows for clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// jwk is a key of a JWKS file.  Only the fields of symmetric and RSA keys
+// are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// verifyKey is a key tokens can be checked with, for the one algorithm it
+// is used with.
+type verifyKey struct {
+	kid    string
+	alg    string
+	secret []byte
+	public *rsa.PublicKey
+}
+
+// JWTVerifier checks bearer JWTs against the keys of a JWKS file, which it
+// reloads when the file changes.
+type JWTVerifier struct {
+	path    string
+	options JWTOptions
+
+	mu        sync.Mutex
+	keys      []verifyKey
+	modTime   time.Time
+	size      int64
+	checkedAt time.Time
+}
+
+// NewJWTVerifier loads the JWKS file at path.
+func NewJWTVerifier(path string, options JWTOptions) (*JWTVerifier, error) {
+	if options.NameClaim == "" {
+		options.NameClaim = "sub"
+	}
+	if options.RoleClaim == "" {
+		options.RoleClaim = "role"
+	}
+	v := &JWTVerifier{path: path, options: options}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadJWKS(path)
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.modTime, v.size, v.checkedAt = keys, info.ModTime(), info.Size(), time.Now()
+	return v, nil
+}
+
+func b64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func loadJWKS(path string) ([]verifyKey, error) {
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(bts, &set)
+	if err != nil {
+		return nil, fmt.Errorf("JWKS file[%s]: %v", path, err)
+	}
+	var keys []verifyKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key := verifyKey{kid: k.Kid, alg: k.Alg}
+		switch k.Kty {
+		case "oct":
+			if key.alg == "" {
+				key.alg = "HS256"
+			}
+			key.secret, err = b64(k.K)
+			if err == nil && len(key.secret) < minHMACKeySize {
+				err = fmt.Errorf("key must be at least %d bytes", minHMACKeySize)
+			}
+		case "RSA":
+			if key.alg == "" {
+				key.alg = "RS256"
+			}
+			key.public, err = rsaPublicKey(k.N, k.E)
+		default:
+			// Other key types may be in the set for other consumers.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JWKS file[%s]: key %d[%s]: %v", path, i, k.Kid, err)
+		}
+		if key.alg != "HS256" && key.alg != "RS256" {
+			continue
+		}
+		if (key.alg == "HS256") != (k.Kty == "oct") {
+			return nil, fmt.Errorf("JWKS file[%s]: key %d[%s]: alg %s does not fit key type %s", path, i, k.Kid, key.alg, k.Kty)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func rsaPublicKey(n string, e string) (*rsa.PublicKey, error) {
+	nb, err := b64(n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	eb, err := b64(e)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %v", err)
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid exponent")
+	}
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}
+	if pub.N.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("key must be at least %d bits", minRSAKeyBits)
+	}
+	return pub, nil
+}
+
+// currentKeys returns the keys, first reloading them if the file has
+// changed.  A file that fails to load is logged and the keys loaded before
+// are kept, so a half-written file does not lock every client out.
+func (v *JWTVerifier) currentKeys() []verifyKey {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	if now.Sub(v.checkedAt) < jwksCheckInterval {
+		return v.keys
+	}
+	v.checkedAt = now
+	info, err := os.Stat(v.path)
+	if err != nil {
+		log.Printf("Error checking JWKS file[%s]: %v\n", v.path, err)
+		return v.keys
+	}
+	if info.ModTime().Equal(v.modTime) && info.Size() == v.size {
+		return v.keys
+	}
+	keys, err := loadJWKS(v.path)
+	if err != nil {
+		log.Printf("Error reloading JWKS file, keeping the keys loaded before: %v\n", err)
+		return v.keys
+	}
+	log.Printf("Reloaded %d keys from JWKS file[%s]\n", len(keys), v.path)
+	v.keys, v.modTime, v.size = keys, info.ModTime(), info.Size()
+	return v.keys
+}
+
+// LooksLikeJWT tells a JWT apart from an API key, which never has dots.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks a token's signature and claims and returns the client it
+// was issued to and its role.
+func (v *JWTVerifier) Verify(token string) (name string, role Role, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", ErrMalformedToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = decodeSegment(parts[0], &header)
+	if err != nil {
+		return "", "", err
+	}
+	if header.Alg != "HS256" && header.Alg != "RS256" {
+		return "", "", fmt.Errorf("%w: %q", ErrUnsupportedAlg, header.Alg)
+	}
+	sig, err := b64(parts[2])
+	if err != nil {
+		return "", "", ErrMalformedToken
+	}
+	err = v.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], sig)
+	if err != nil {
+		return "", "", err
+	}
+	var claims map[string]any
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return "", "", err
+	}
+	err = v.checkClaims(claims, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	// A client without a name would add contacts owned by no one, which
+	// are open to everyone, and leave no name in the audit log.
+	name, _ = claims[v.options.NameClaim].(string)
+	if strings.TrimSpace(name) == "" {
+		return "", "", fmt.Errorf("%w: no %s claim", ErrNoName, v.options.NameClaim)
+	}
+	role, ok := v.role(claims[v.options.RoleClaim])
+	if !ok {
+		return "", "", ErrNoRole
+	}
+	return name, role, nil
+}
+
+func decodeSegment(segment string, value any) error {
+	bts, err := b64(segment)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	err = json.Unmarshal(bts, value)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+// verifySignature checks signed against the key kid, or every key for alg
+// if the token names none.  Keys are only ever used with the algorithm
+// they are for, so an RSA public key can never be passed off as an HMAC
+// secret.
+func (v *JWTVerifier) verifySignature(alg string, kid string, signed string, sig []byte) error {
+	found := false
+	for _, k := range v.currentKeys() {
+		if k.alg != alg || (kid != "" && k.kid != kid) {
+			continue
+		}
+		found = true
+		switch alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, k.secret)
+			mac.Write([]byte(signed))
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return nil
+			}
+		case "RS256":
+			sum := sha256.Sum256([]byte(signed))
+			if rsa.VerifyPKCS1v15(k.public, crypto.SHA256, sum[:], sig) == nil {
+				return nil
+			}
+		}
+	}
+	if !found {
+		return ErrUnknownKID
+	}
+	return ErrBadSignature
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]any, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: no exp claim", ErrMalformedToken)
+	}
+	if !now.Before(time.Unix(int64(exp), 0).Add(v.options.Leeway)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.options.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return ErrTokenNotYet
+	}
+	if v.options.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.options.Issuer {
+			return ErrWrongIssuer
+		}
+	}
+	if v.options.Audience != "" && !containsString(claims["aud"], v.options.Audience) {
+		return ErrWrongAudience
+	}
+	return nil
+}
+
+// containsString reports whether a claim that is a string or a list of
+// strings holds s.
+func containsString(claim any, s string) bool {
+	for _, value := range claimStrings(claim) {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+func claimStrings(claim any) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []any:
+		var values []string
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// role returns the highest role the claim's values map onto.
+func (v *JWTVerifier) role(claim any) (Role, bool) {
+	var best Role
+	for _, value := range claimStrings(claim) {
+		r, ok := v.options.Roles[value]
+		if len(v.options.Roles) == 0 {
+			var err error
+			r, err = ParseRole(value)
+			ok = err == nil && value != ""
+		}
+		if ok && (best == "" || r.rank() > best.rank()) {
+			best = r
+		}
+	}
+	return best, best != ""
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys are the keys of the JWKS file the tests verify against: an HMAC
+// secret with kid "hmac" and an RSA key pair with kid "rsa".
+type testKeys struct {
+	secret  []byte
+	private *rsa.PrivateKey
+	path    string
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	k := &testKeys{secret: make([]byte, minHMACKeySize)}
+	if _, err := rand.Read(k.secret); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	k.private, err = rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	jwks, err := json.Marshal(map[string]any{"keys": []jwk{
+		{Kty: "oct", Kid: "hmac", K: enc(k.secret)},
+		{Kty: "RSA", Kid: "rsa", N: enc(k.private.N.Bytes()), E: enc(big.NewInt(int64(k.private.E)).Bytes())},
+		// Keys for other uses and of other types are passed over.
+		{Kty: "EC", Kid: "ec"},
+		{Kty: "oct", Kid: "enc", Use: "enc", K: enc(k.secret)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.path = filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(k.path, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// sign makes a token with the given header and claims, signed with the
+// HMAC secret for HS256 and the RSA key for RS256.
+func (k *testKeys) sign(t *testing.T, header map[string]any, claims map[string]any) string {
+	t.Helper()
+	segment := func(v any) string {
+		bts, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(bts)
+	}
+	signed := segment(header) + "." + segment(claims)
+	var sig []byte
+	switch header["alg"] {
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sum := sha256.Sum256([]byte(signed))
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.private, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// claims are valid claims for alice as an editor, with changes applied.
+// A nil value removes a claim.
+func claims(changes map[string]any) map[string]any {
+	result := map[string]any{
+		"sub":  "alice",
+		"role": "editor",
+		"iss":  "https://issuer.example.com",
+		"aud":  []string{"contacts", "other"},
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(result, k)
+		} else {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	v, err := NewJWTVerifier(keys.path, JWTOptions{Issuer: "https://issuer.example.com", Audience: "contacts", Leeway: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs256 := map[string]any{"alg": "HS256", "kid": "hmac"}
+	rs256 := map[string]any{"alg": "RS256", "kid": "rsa"}
+	tests := []struct {
+		name    string
+		token   string
+		role    Role
+		wantErr error
+	}{
+		{name: "HS256", token: keys.sign(t, hs256, claims(nil)), role: RoleEditor},
+		{name: "RS256", token: keys.sign(t, rs256, claims(nil)), role: RoleEditor},
+		{name: "no kid", token: keys.sign(t, map[string]any{"alg": "RS256"}, claims(nil)), role: RoleEditor},
+		{name: "highest of several roles", token: keys.sign(t, hs256, claims(map[string]any{"role": []string{"viewer", "admin", "nonsense"}})), role: RoleAdmin},
+		{name: "expired within the leeway", token: keys.sign(t, hs256, claims(map[string]any{"exp": time.Now().Add(-30 * time.Second).Unix()})), role: RoleEditor},
+
+		{name: "expired", token: keys.sign(t, hs256, claims(map[string]any{"exp": time.Now().Add(-2 * time.Minute).Unix()})), wantErr: ErrTokenExpired},
+		{name: "no exp", token: keys.sign(t, hs256, claims(map[string]any{"exp": nil})), wantErr: ErrMalformedToken},
+		{name: "not yet valid", token: keys.sign(t, hs256, claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})), wantErr: ErrTokenNotYet},
+		{name: "alg none", token: keys.sign(t, map[string]any{"alg": "none"}, claims(nil)), wantErr: ErrUnsupportedAlg},
+		{name: "alg HS512", token: keys.sign(t, map[string]any{"alg": "HS512", "kid": "hmac"}, claims(nil)), wantErr: ErrUnsupportedAlg},
+		// An RSA key is never taken for an HMAC secret, nor the other way
+		// round.
+		{name: "HS256 with the RSA key's kid", token: keys.sign(t, map[string]any{"alg": "HS256", "kid": "rsa"}, claims(nil)), wantErr: ErrUnknownKID},
+		{name: "RS256 with the HMAC key's kid", token: keys.sign(t, map[string]any{"alg": "RS256", "kid": "hmac"}, claims(nil)), wantErr: ErrUnknownKID},
+		{name: "unknown kid", token: keys.sign(t, map[string]any{"alg": "HS256", "kid": "gone"}, claims(nil)), wantErr: ErrUnknownKID},
+		{name: "key for encryption", token: keys.sign(t, map[string]any{"alg": "HS256", "kid": "enc"}, claims(nil)), wantErr: ErrUnknownKID},
+		{name: "tampered claims", token: tamper(keys.sign(t, rs256, claims(nil))), wantErr: ErrBadSignature},
+		{name: "wrong issuer", token: keys.sign(t, hs256, claims(map[string]any{"iss": "https://evil.example.com"})), wantErr: ErrWrongIssuer},
+		{name: "wrong audience", token: keys.sign(t, hs256, claims(map[string]any{"aud": "other"})), wantErr: ErrWrongAudience},
+		{name: "no role", token: keys.sign(t, hs256, claims(map[string]any{"role": nil})), wantErr: ErrNoRole},
+		{name: "unknown role", token: keys.sign(t, hs256, claims(map[string]any{"role": "root"})), wantErr: ErrNoRole},
+		{name: "no name", token: keys.sign(t, hs256, claims(map[string]any{"sub": nil})), wantErr: ErrNoName},
+		{name: "empty name", token: keys.sign(t, hs256, claims(map[string]any{"sub": ""})), wantErr: ErrNoName},
+		{name: "blank name", token: keys.sign(t, hs256, claims(map[string]any{"sub": "  "})), wantErr: ErrNoName},
+		{name: "name not a string", token: keys.sign(t, hs256, claims(map[string]any{"sub": 42})), wantErr: ErrNoName},
+		{name: "not a JWT", token: "a.b", wantErr: ErrMalformedToken},
+		{name: "header not JSON", token: "bm90IGpzb24." + strings.SplitN(keys.sign(t, hs256, claims(nil)), ".", 2)[1], wantErr: ErrMalformedToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, role, err := v.Verify(test.token)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("got %q %q %v, want %v", name, role, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || name != "alice" || role != test.role {
+				t.Errorf("got %q %q %v, want alice %q", name, role, err, test.role)
+			}
+		})
+	}
+}
+
+// tamper changes the claims of a token without signing it again.
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","role":"admin","exp":9999999999}`))
+	return strings.Join(parts, ".")
+}
+
+func TestVerifyClaimOptions(t *testing.T) {
+	keys := newTestKeys(t)
+	v, err := NewJWTVerifier(keys.path, JWTOptions{
+		NameClaim: "email",
+		RoleClaim: "groups",
+		Roles:     map[string]Role{"contacts-readers": RoleViewer, "contacts-admins": RoleAdmin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := keys.sign(t, map[string]any{"alg": "HS256"}, claims(map[string]any{"email": "alice@example.com", "groups": []string{"contacts-readers", "admin"}}))
+	name, role, err := v.Verify(token)
+	if err != nil || name != "alice@example.com" || role != RoleViewer {
+		t.Errorf("got %q %q %v", name, role, err)
+	}
+	// The name comes from the configured claim only.
+	token = keys.sign(t, map[string]any{"alg": "HS256"}, claims(map[string]any{"groups": "contacts-admins"}))
+	if _, _, err := v.Verify(token); !errors.Is(err, ErrNoName) {
+		t.Errorf("token without the name claim: %v", err)
+	}
+}
+
+func TestLoadJWKSRejectsWeakKeys(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strong, err := rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]jwk{
+		"short secret":     {Kty: "oct", K: enc(make([]byte, minHMACKeySize-1))},
+		"small RSA key":    {Kty: "RSA", N: enc(weak.N.Bytes()), E: enc(big.NewInt(int64(weak.E)).Bytes())},
+		"RSA key as HS256": {Kty: "RSA", Alg: "HS256", N: enc(strong.N.Bytes()), E: enc(big.NewInt(int64(strong.E)).Bytes())},
+	} {
+		t.Run(name, func(t *testing.T) {
+			jwks, _ := json.Marshal(map[string]any{"keys": []jwk{key}})
+			path := filepath.Join(t.TempDir(), "jwks.json")
+			if err := os.WriteFile(path, jwks, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewJWTVerifier(path, JWTOptions{}); err == nil {
+				t.Error("the key was accepted")
+			}
+		})
+	}
+}
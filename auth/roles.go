@@ -0,0 +1,87 @@
+package auth
+
+import "fmt"
+
+// Role is what a client is allowed to do.  Each role can do everything the
+// one before it can.
+type Role string
+
+const (
+	// RoleViewer may only read contacts.
+	RoleViewer Role = "viewer"
+	// RoleEditor may also add, update and import contacts and bring them
+	// back from the trash.
+	RoleEditor Role = "editor"
+	// RoleAdmin may also delete contacts, take and restore snapshots and
+	// manage API keys.
+	RoleAdmin Role = "admin"
+)
+
+// Permission is an operation a role may or may not be allowed.
+type Permission int
+
+const (
+	PermRead Permission = iota
+	PermWrite
+	PermDelete
+	PermAdmin
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermRead:
+		return "read contacts"
+	case PermWrite:
+		return "change contacts"
+	case PermDelete:
+		return "delete contacts"
+	case PermAdmin:
+		return "administer the server"
+	}
+	return fmt.Sprintf("Permission(%d)", int(p))
+}
+
+// ParseRole parses a role name.  No name is a viewer, so a key given
+// without a role can never do more than read.
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleViewer, RoleEditor, RoleAdmin:
+		return r, nil
+	case "":
+		return RoleViewer, nil
+	}
+	return RoleViewer, fmt.Errorf("unknown role %q, expected viewer, editor or admin", s)
+}
+
+// Can reports whether the role is allowed p.
+func (r Role) Can(p Permission) bool {
+	switch r {
+	case RoleViewer:
+		return p == PermRead
+	case RoleEditor:
+		return p == PermRead || p == PermWrite
+	case RoleAdmin:
+		return true
+	}
+	return false
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleEditor:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// MinRole returns the lesser of two roles.
+func MinRole(a Role, b Role) Role {
+	if b.rank() < a.rank() {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// Session is a browser signed in with an API key.
+type Session struct {
+	// Name and Role are those of the key the browser signed in with.
+	Name    string
+	Role    Role
+	KeyID   string
+	Expires time.Time
+	// CSRFToken must come back with every change the browser makes, which
+	// a page on another site cannot read and so cannot send.
+	CSRFToken string
+}
+
+// Sessions keeps the login sessions of browsers in memory, so a restart
+// signs everyone out.  Like API keys, session tokens are only kept hashed.
+type Sessions struct {
+	mu       sync.Mutex
+	lifetime time.Duration
+	byHash   map[string]Session
+}
+
+func NewSessions(lifetime time.Duration) *Sessions {
+	return &Sessions{lifetime: lifetime, byHash: map[string]Session{}}
+}
+
+// Start begins a session for the client a key belongs to and returns the
+// token the browser presents from then on.
+func (s *Sessions) Start(key Key) (string, Session, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", Session{}, err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return "", Session{}, err
+	}
+	now := time.Now()
+	session := Session{Name: key.Name, Role: key.Role, KeyID: key.ID, Expires: now.Add(s.lifetime), CSRFToken: csrfToken}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Sweeping here keeps abandoned sessions from piling up without a
+	// goroutine of their own.
+	for h, other := range s.byHash {
+		if !now.Before(other.Expires) {
+			delete(s.byHash, h)
+		}
+	}
+	s.byHash[Hash(token)] = session
+	return token, session, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Lookup returns the session a token belongs to, unless it has expired.
+func (s *Sessions) Lookup(token string) (Session, bool) {
+	h := Hash(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.byHash[h]
+	if !ok {
+		return Session{}, false
+	}
+	if !time.Now().Before(session.Expires) {
+		delete(s.byHash, h)
+		return Session{}, false
+	}
+	return session, true
+}
+
+// End signs a session out.
+func (s *Sessions) End(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byHash, Hash(token))
+}
+
+// EndKey signs out every session started with the key id, so deleting a
+// key locks out the browsers that signed in with it too.
+func (s *Sessions) EndKey(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, session := range s.byHash {
+		if session.KeyID == id {
+			delete(s.byHash, h)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T, name string, role Role) Key {
+	t.Helper()
+	secret, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewConfiguredKey(name, string(role), Hash(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func startSession(t *testing.T, s *Sessions, k Key) (string, Session) {
+	t.Helper()
+	token, session, err := s.Start(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, session
+}
+
+func TestSessions(t *testing.T) {
+	s := NewSessions(time.Hour)
+	ada, bob := testKey(t, "ada", RoleEditor), testKey(t, "bob", RoleViewer)
+	first, session := startSession(t, s, ada)
+	if session.Name != "ada" || session.Role != RoleEditor || session.KeyID != ada.ID || session.CSRFToken == "" {
+		t.Errorf("session: %+v", session)
+	}
+	if d := time.Until(session.Expires); d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("session expires in %v", d)
+	}
+	second, other := startSession(t, s, ada)
+	if second == first || other.CSRFToken == session.CSRFToken {
+		t.Errorf("two sessions share tokens")
+	}
+	third, _ := startSession(t, s, bob)
+
+	if got, ok := s.Lookup(first); !ok || got != session {
+		t.Errorf("lookup: %+v %v", got, ok)
+	}
+	// Only the token itself finds the session.
+	for _, wrong := range []string{"", session.CSRFToken, Hash(first), first + "x"} {
+		if _, ok := s.Lookup(wrong); ok {
+			t.Errorf("%q found a session", wrong)
+		}
+	}
+
+	s.End(first)
+	if _, ok := s.Lookup(first); ok {
+		t.Errorf("the session outlived End")
+	}
+	if _, ok := s.Lookup(second); !ok {
+		t.Errorf("End ended another session of the key")
+	}
+
+	_, _ = startSession(t, s, ada)
+	s.EndKey(ada.ID)
+	if _, ok := s.Lookup(second); ok {
+		t.Errorf("a session of the key outlived EndKey")
+	}
+	if got, ok := s.Lookup(third); !ok || got.Name != "bob" {
+		t.Errorf("EndKey ended a session of another key")
+	}
+	if len(s.byHash) != 1 {
+		t.Errorf("%d sessions left, want 1", len(s.byHash))
+	}
+}
+
+func TestExpiredSessions(t *testing.T) {
+	s := NewSessions(0)
+	k := testKey(t, "ada", RoleEditor)
+	token, _ := startSession(t, s, k)
+	if _, ok := s.Lookup(token); ok {
+		t.Errorf("an expired session was found")
+	}
+	// Sessions that expire are swept by the next Start, whether or not
+	// anyone looked them up.
+	for range 3 {
+		startSession(t, s, k)
+	}
+	if len(s.byHash) != 1 {
+		t.Errorf("%d sessions kept, want only the newest", len(s.byHash))
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"example-api-server/auth"
+	"example-api-server/snapshot"
+	"example-api-server/sqlstore"
+
+	hd "github.com/mitchellh/go-homedir"
+)
+
+// serverOptions are shared by the subcommands that talk to a running server.
+type serverOptions struct {
+	Server  string        `short:"s" long:"server" description:"Base URL of the running server" default:"http://localhost:8080"`
+	Timeout time.Duration `long:"timeout" description:"How long to wait for the server" default:"5m"`
+	APIKey  string        `long:"api-key" env:"EXAMPLE_API_KEY" description:"API key to authenticate with, if the server requires one"`
+	Book    string        `short:"b" long:"book" description:"Address book to use, the default one if not given"`
+}
+
+// apiPath returns the path of an API route, such as "/admin/snapshot", in
+// the book the options name.
+func (o serverOptions) apiPath(route string) string {
+	if o.Book == "" {
+		return "/api" + route
+	}
+	return "/api/books/" + url.PathEscape(o.Book) + route
+}
+
+func (o serverOptions) post(path string, body io.Reader) ([]byte, error) {
+	client := http.Client{Timeout: o.Timeout}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(o.Server, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.APIKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bts, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(bts, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return bts, nil
+}
+
+// BackupCommand asks a running server for a snapshot and writes it to a
+// file.
+type BackupCommand struct {
+	serverOptions
+	Out string `short:"o" long:"out" description:"File to write the snapshot to" required:"true"`
+}
+
+func (c *BackupCommand) Execute(args []string) error {
+	out, err := hd.Expand(c.Out)
+	if err != nil {
+		return fmt.Errorf("error: could not expand out path[%s]: %v", c.Out, err)
+	}
+	bts, err := c.post(c.apiPath("/admin/snapshot"), nil)
+	if err != nil {
+		return fmt.Errorf("error: could not take snapshot: %v", err)
+	}
+	// Check what we got before it replaces anything on disk.  The data
+	// itself may be encrypted with a key only the server has.
+	info, err := snapshot.Verify(bytes.NewReader(bts))
+	if err != nil {
+		return fmt.Errorf("error: server sent an invalid snapshot: %v", err)
+	}
+	err = writeFileAtomic(out, bts)
+	if err != nil {
+		return fmt.Errorf("error: could not write snapshot[%s]: %v", out, err)
+	}
+	encrypted := ""
+	if info.KeyID != "" {
+		encrypted = fmt.Sprintf(", encrypted with key %q,", info.KeyID)
+	}
+	fmt.Printf("Wrote snapshot taken at %s%s to %s\n", info.CreatedAt.Format(time.RFC3339), encrypted, out)
+	return nil
+}
+
+// RestoreCommand loads a snapshot file into a running server whose address
+// book is empty.
+type RestoreCommand struct {
+	serverOptions
+	In string `short:"i" long:"in" description:"Snapshot file to restore" required:"true"`
+}
+
+func (c *RestoreCommand) Execute(args []string) error {
+	in, err := hd.Expand(c.In)
+	if err != nil {
+		return fmt.Errorf("error: could not expand in path[%s]: %v", c.In, err)
+	}
+	bts, err := os.ReadFile(in)
+	if err != nil {
+		return fmt.Errorf("error: could not read snapshot[%s]: %v", in, err)
+	}
+	// The server checks too, but a corrupt file is better caught here.
+	_, err = snapshot.Verify(bytes.NewReader(bts))
+	if err != nil {
+		return fmt.Errorf("error: invalid snapshot[%s]: %v", in, err)
+	}
+	resp, err := c.post(c.apiPath("/admin/restore"), bytes.NewReader(bts))
+	if err != nil {
+		return fmt.Errorf("error: could not restore snapshot: %v", err)
+	}
+	var r struct {
+		Contacts int `json:"contacts"`
+		Trash    int `json:"trash"`
+	}
+	err = json.Unmarshal(resp, &r)
+	if err != nil {
+		return fmt.Errorf("error: unexpected response from server: %v", err)
+	}
+	fmt.Printf("Restored %d contacts and %d trashed contacts from %s\n", r.Contacts, r.Trash, in)
+	return nil
+}
+
+// APIKeyCommand generates an API key.  The key goes to the client, the hash
+// into the config file.
+type APIKeyCommand struct {
+	Name string `short:"n" long:"name" description:"Name of the client the key is for" default:"client"`
+	Role string `short:"r" long:"role" description:"Role of the key" choice:"viewer" choice:"editor" choice:"admin" default:"viewer"`
+}
+
+func (c *APIKeyCommand) Execute(args []string) error {
+	key, err := auth.GenerateKey()
+	if err != nil {
+		return fmt.Errorf("error: could not generate API key: %v", err)
+	}
+	fmt.Printf("API key: %s\n\n", key)
+	fmt.Printf("Add this to the config file, the key itself is not stored anywhere:\n\n")
+	fmt.Printf("[[auth.api-keys]]\nname = %q\nrole = %q\nhash = %q\n", c.Name, c.Role, auth.Hash(key))
+	return nil
+}
+
+// writeFileAtomic writes data next to path and renames it into place, so a
+// crash never leaves a truncated backup behind.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// dbCommand is embedded by the commands that work on the configured
+// database.
+type dbCommand struct {
+	args *Args
+}
+
+func (c dbCommand) open() (*sql.DB, error) {
+	err := c.args.validate()
+	if err != nil {
+		return nil, err
+	}
+	dc := c.args.config.Database
+	if dc.DSN == "" {
+		return nil, errors.New("error: no database is configured")
+	}
+	db, err := sqlstore.OpenDB(dc.Driver, dc.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("error: could not open database: %v", err)
+	}
+	return db, nil
+}
+
+func (c dbCommand) migrateTo(target int) error {
+	db, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	from, to, err := sqlstore.MigrateTo(db, target)
+	if err != nil {
+		return fmt.Errorf("error: could not migrate database: %v", err)
+	}
+	if from == to {
+		fmt.Printf("Database schema is already at version %d\n", to)
+		return nil
+	}
+	fmt.Printf("Migrated database schema from version %d to %d\n", from, to)
+	return nil
+}
+
+// MigrateCommand brings the schema of the configured database up to date
+// when run without one of its subcommands.
+type MigrateCommand struct {
+	dbCommand
+}
+
+func (c *MigrateCommand) Execute(args []string) error {
+	return c.migrateTo(sqlstore.LatestVersion())
+}
+
+type MigrateStatusCommand struct {
+	dbCommand
+}
+
+func (c *MigrateStatusCommand) Execute(args []string) error {
+	db, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	version, migrations, err := sqlstore.Status(db)
+	if err != nil {
+		return fmt.Errorf("error: could not read schema version: %v", err)
+	}
+	fmt.Printf("Database schema version %d, latest %d\n", version, sqlstore.LatestVersion())
+	if version > sqlstore.LatestVersion() {
+		fmt.Println("The database was migrated by a newer version and cannot be used by this one")
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if m.Applied {
+			state = "applied"
+		}
+		fmt.Printf("%4d  %-7s  %s\n", m.Version, state, m.Name)
+	}
+	return nil
+}
+
+type MigrateUpCommand struct {
+	dbCommand
+	To int `long:"to" description:"Version to migrate up to (default: the latest)" default:"-1"`
+}
+
+func (c *MigrateUpCommand) Execute(args []string) error {
+	if c.To < 0 {
+		c.To = sqlstore.LatestVersion()
+	}
+	return c.migrateTo(c.To)
+}
+
+type MigrateDownCommand struct {
+	dbCommand
+	To int `long:"to" description:"Version to migrate down to (default: one version back)" default:"-1"`
+}
+
+func (c *MigrateDownCommand) Execute(args []string) error {
+	if c.To < 0 {
+		db, err := c.open()
+		if err != nil {
+			return err
+		}
+		version, err := sqlstore.SchemaVersion(db)
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("error: could not read schema version: %v", err)
+		}
+		c.To = max(version-1, 0)
+	}
+	return c.migrateTo(c.To)
+}
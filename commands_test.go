@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"example-api-server/app"
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+	"example-api-server/snapshot"
+	"example-api-server/webapp"
+)
+
+// startServer serves a, with an admin key it returns.
+func startServer(t *testing.T, a appinterface.App) (*httptest.Server, string) {
+	t.Helper()
+	secret, err := auth.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := auth.NewConfiguredKey("backup", string(auth.RoleAdmin), auth.Hash(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := auth.NewStore([]auth.Key{key}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	books := appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: a})
+	handler, err := webapp.NewWebAppWithOptions(books, webapp.Options{APIKeys: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server, secret
+}
+
+func newApp(t *testing.T) appinterface.App {
+	t.Helper()
+	a := app.NewApp(100, time.Second, time.Hour)
+	t.Cleanup(func() {
+		a.Stop()
+		a.Wait()
+	})
+	return a
+}
+
+func contactsOf(t *testing.T, a appinterface.App) []appinterface.Contact {
+	t.Helper()
+	contacts, err := a.GetContacts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contacts
+}
+
+func TestBackupRestore(t *testing.T) {
+	source := newApp(t)
+	for _, c := range []appinterface.Contact{
+		{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"},
+		{FirstName: "Grace", LastName: "Hopper", Email: "grace@example.org"},
+	} {
+		if err := source.AddContact(context.Background(), c.FirstName, c.LastName, c.Email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server, secret := startServer(t, source)
+	path := filepath.Join(t.TempDir(), "backup.json")
+
+	unauthenticated := BackupCommand{serverOptions: serverOptions{Server: server.URL, Timeout: time.Minute}, Out: path}
+	if err := unauthenticated.Execute(nil); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("backup without a key: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("a refused backup wrote a file: %v", err)
+	}
+
+	backup := BackupCommand{serverOptions: serverOptions{Server: server.URL + "/", Timeout: time.Minute, APIKey: secret}, Out: path}
+	if err := backup.Execute(nil); err != nil {
+		t.Fatal(err)
+	}
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snapshot.Verify(bytes.NewReader(bts)); err != nil {
+		t.Errorf("the backup does not verify: %v", err)
+	}
+
+	target := newApp(t)
+	server, secret = startServer(t, target)
+	restore := RestoreCommand{serverOptions: serverOptions{Server: server.URL, Timeout: time.Minute, APIKey: secret}, In: path}
+	if err := restore.Execute(nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contactsOf(t, target), contactsOf(t, source); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %+v, want %+v", got, want)
+	}
+	// The server refuses to restore over what is there now.
+	if err := restore.Execute(nil); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("restoring twice: %v", err)
+	}
+}
+
+// TestBackupKeepsTheOldFile checks that a bad response from the server
+// leaves an earlier backup as it was.
+func TestBackupKeepsTheOldFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"format":"example-api-server-snapshot","formatVersion":2,"checksum":"sha256:00","data":{}}`))
+	}))
+	t.Cleanup(server.Close)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backup.json")
+	if err := os.WriteFile(path, []byte("earlier backup"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	backup := BackupCommand{serverOptions: serverOptions{Server: server.URL, Timeout: time.Minute}, Out: path}
+	if err := backup.Execute(nil); err == nil {
+		t.Errorf("an invalid snapshot was accepted")
+	}
+	if bts, err := os.ReadFile(path); err != nil || string(bts) != "earlier backup" {
+		t.Errorf("the earlier backup is now %q: %v", bts, err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("files left behind: %v %v", entries, err)
+	}
+}
+
+// TestRestoreChecksTheFile checks that a file that is not a valid snapshot
+// never reaches the server.
+func TestRestoreChecksTheFile(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	t.Cleanup(server.Close)
+	dir := t.TempDir()
+	var b bytes.Buffer
+	data := appinterface.SnapshotData{NextID: 2, Contacts: []appinterface.Contact{{ID: 1, Version: 1, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}}}
+	if err := snapshot.Write(&b, data, time.Now(), nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"corrupt.json":   strings.Replace(b.String(), "Lovelace", "Lovelacf", 1),
+		"truncated.json": b.String()[:b.Len()/2],
+		"contacts.csv":   "id,firstName,lastName,email\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		restore := RestoreCommand{serverOptions: serverOptions{Server: server.URL, Timeout: time.Minute}, In: path}
+		if err := restore.Execute(nil); err == nil {
+			t.Errorf("%s was restored", name)
+		}
+	}
+	missing := RestoreCommand{serverOptions: serverOptions{Server: server.URL, Timeout: time.Minute}, In: filepath.Join(dir, "missing.json")}
+	if err := missing.Execute(nil); err == nil {
+		t.Errorf("a missing file was restored")
+	}
+	if requests > 0 {
+		t.Errorf("%d requests reached the server", requests)
+	}
+}
+
+func TestAPIPath(t *testing.T) {
+	for _, test := range []struct {
+		book string
+		want string
+	}{
+		{book: "", want: "/api/admin/snapshot"},
+		{book: "work", want: "/api/books/work/admin/snapshot"},
+		{book: "a/b c", want: "/api/books/a%2Fb%20c/admin/snapshot"},
+	} {
+		if got := (serverOptions{Book: test.book}).apiPath("/admin/snapshot"); got != test.want {
+			t.Errorf("book %q: %q, want %q", test.book, got, test.want)
+		}
+	}
+}
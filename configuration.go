@@ -1,12 +1,201 @@
 package main
 
 import (
+	"time"
+
 	"github.com/BurntSushi/toml"
 )
 
+// LDAPConfig configures the optional read-only LDAP view of the contacts.
+type LDAPConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Address string `toml:"address"`
+	Port    int    `toml:"port"`
+	BaseDN  string `toml:"base-dn"`
+	// BindDN and BindPassword, when set, are the only credentials allowed
+	// to search.  Otherwise the directory is open to anonymous clients,
+	// which auth does not allow.
+	BindDN       string `toml:"bind-dn"`
+	BindPassword string `toml:"bind-password"`
+	// Client is the client a bind acts for when auth is enabled.  LDAP only
+	// serves the contacts it may see, with its visibility rules, and needs
+	// a grant in the default book if that has any.
+	Client string `toml:"client"`
+}
+
+// WALConfig configures the write-ahead log the contacts are persisted to.
+type WALConfig struct {
+	// Path is the log file.  Without one the contacts only live in memory.
+	Path string `toml:"path"`
+	// Fsync is "always", "batch" (every fsync-interval) or "os".
+	Fsync         string        `toml:"fsync"`
+	FsyncInterval time.Duration `toml:"fsync-interval"`
+}
+
+// QueueConfig bounds how many operations wait for an in-memory or WAL
+// address book.  Reads and writes queue separately, and reads go first,
+// but never more than a few of them ahead of a waiting write.
+type QueueConfig struct {
+	// Size is how many reads, and as many writes, may wait at a time.
+	Size int `toml:"size"`
+	// Timeout is how long an operation waits for room in a full queue
+	// before it is refused with 503 Service Unavailable.
+	Timeout time.Duration `toml:"timeout"`
+}
+
+// DatabaseConfig selects the SQL backend instead of the in-memory store.
+type DatabaseConfig struct {
+	// Driver is a database/sql driver name.  "sqlite" is built in.
+	Driver string `toml:"driver"`
+	// DSN is the data source name, e.g. "contacts.db".  Without one the
+	// contacts are kept by the in-memory store.
+	DSN string `toml:"dsn"`
+}
+
+// EncryptionConfig names where the keys persisted contact data is encrypted
+// with come from.  Either holds one key per line as "<id>:<base64 key>",
+// with the last one used for new data; keep older keys listed until the data
+// written with them has been rewritten.
+type EncryptionConfig struct {
+	KeyFile string `toml:"key-file"`
+	KeyEnv  string `toml:"key-env"`
+	// EmailKeyFile or EmailKeyEnv hold a base64 key of at least 32 bytes
+	// that email addresses are encrypted with before they are stored.  The
+	// encryption is deterministic so duplicates are still found, and the key
+	// cannot be rotated without re-importing the contacts.
+	EmailKeyFile string `toml:"email-key-file"`
+	EmailKeyEnv  string `toml:"email-key-env"`
+}
+
+// FieldRulesConfig says how much of each contact field a client sees:
+// "full" (the default), "masked" or "hidden".
+type FieldRulesConfig struct {
+	Email string `toml:"email"`
+}
+
+// VisibilityConfig holds the field rules for clients without rules of their
+// own, and the rules of named clients.
+type VisibilityConfig struct {
+	Email   string                      `toml:"email"`
+	Clients map[string]FieldRulesConfig `toml:"clients"`
+}
+
+// APIKeyConfig is an API key given by its hash, as printed by the api-key
+// command.  Name identifies the client using it, Role is "viewer" (the
+// default), "editor" or "admin".
+type APIKeyConfig struct {
+	Name string `toml:"name"`
+	Role string `toml:"role"`
+	Hash string `toml:"hash"`
+}
+
+// JWTConfig accepts bearer JWTs signed with the keys of a local JWKS file,
+// which is reloaded when it changes.  Only HS256 and RS256 are supported.
+type JWTConfig struct {
+	JWKSFile string `toml:"jwks-file"`
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string `toml:"issuer"`
+	Audience string `toml:"audience"`
+	// NameClaim names the client for the visibility rules, "sub" by
+	// default.
+	NameClaim string `toml:"name-claim"`
+	// RoleClaim holds the role, or a list of them, "role" by default.
+	RoleClaim string `toml:"role-claim"`
+	// Roles maps the values of the role claim onto viewer, editor or
+	// admin.  Without it the values must be role names themselves.
+	Roles  map[string]string `toml:"roles"`
+	Leeway time.Duration     `toml:"leeway"`
+}
+
+// AuthConfig turns on authentication of everything but the login page, the
+// server time and static assets.
+type AuthConfig struct {
+	Enabled bool           `toml:"enabled"`
+	APIKeys []APIKeyConfig `toml:"api-keys"`
+	// KeysFile stores the keys created through the admin endpoint.  Without
+	// one only the configured keys exist.
+	KeysFile        string        `toml:"keys-file"`
+	SessionLifetime time.Duration `toml:"session-lifetime"`
+	// InsecureCookies lets browsers sign in over plain HTTP, which is only
+	// safe for local development.
+	InsecureCookies bool      `toml:"insecure-cookies"`
+	JWT             JWTConfig `toml:"jwt"`
+	// Groups maps group names to the names of their members, so contacts
+	// can be shared with a whole group.
+	Groups map[string][]string `toml:"groups"`
+}
+
+// BookConfig adds an address book besides the default one, or sets the
+// grants of the default book.  Grants map client names, or "*" for every
+// client, to the most they may do in the book: "viewer", "editor" or
+// "admin".  With authentication, a book other than the default one is
+// closed to clients it does not grant.
+type BookConfig struct {
+	Name   string            `toml:"name"`
+	Grants map[string]string `toml:"grants"`
+}
+
+// AuditConfig keeps a tamper-evident log of every change made to the
+// contacts.  With email encryption the log holds the addresses encrypted,
+// as the books store them, and they are decrypted when it is served.  With
+// encryption at rest every entry is sealed with the current key, and the
+// log is sealed again at startup after a rotation.  If
+// an entry cannot be written, the change it records fails and every
+// change after it is refused until the server is restarted.
+type AuditConfig struct {
+	// Path is the log file.  Without one no changes are recorded.
+	Path string `toml:"path"`
+}
+
+// HeadersConfig sets the security headers sent with every response.
+type HeadersConfig struct {
+	// CSPReportOnly only reports violations of the Content-Security-Policy,
+	// to /api/csp-report, instead of blocking them.
+	CSPReportOnly bool `toml:"csp-report-only"`
+	// FrameAncestors may frame the pages, only "'none'" by default.
+	FrameAncestors    []string `toml:"frame-ancestors"`
+	ReferrerPolicy    string   `toml:"referrer-policy"`
+	PermissionsPolicy string   `toml:"permissions-policy"`
+	// HSTSMaxAge is how long browsers that reached the server over TLS stick
+	// to it.
+	HSTSMaxAge time.Duration `toml:"hsts-max-age"`
+}
+
+// RateLimitConfig is a token bucket: Rate requests a second on average, in
+// bursts of up to Burst.
+type RateLimitConfig struct {
+	Rate  float64 `toml:"rate"`
+	Burst int     `toml:"burst"`
+}
+
+// RateLimitsConfig limits the requests of each API key or, for requests
+// without one, each client address.  Reads and writes have separate limits.
+type RateLimitsConfig struct {
+	Enabled bool            `toml:"enabled"`
+	Read    RateLimitConfig `toml:"read"`
+	Write   RateLimitConfig `toml:"write"`
+}
+
 type Config struct {
 	Address string `toml:"address"`
 	Port    int    `toml:"port"`
+	// TrashRetention is how long deleted contacts stay restorable before
+	// they are purged for good, e.g. "720h".
+	TrashRetention time.Duration    `toml:"trash-retention"`
+	LDAP           LDAPConfig       `toml:"ldap"`
+	WAL            WALConfig        `toml:"wal"`
+	Queue          QueueConfig      `toml:"queue"`
+	Database       DatabaseConfig   `toml:"database"`
+	Encryption     EncryptionConfig `toml:"encryption"`
+	Visibility     VisibilityConfig `toml:"visibility"`
+	Auth           AuthConfig       `toml:"auth"`
+	Books          []BookConfig     `toml:"books"`
+	Audit          AuditConfig      `toml:"audit"`
+	Headers        HeadersConfig    `toml:"headers"`
+	RateLimits     RateLimitsConfig `toml:"rate-limits"`
+	// TrustedProxies are the addresses, or CIDR ranges, of the proxies in
+	// front of the server, whose X-Forwarded-For header is believed.
+	TrustedProxies []string `toml:"trusted-proxies"`
 }
 
 func loadConfig(path string) (config *Config, err error) {
@@ -24,5 +213,77 @@ func loadConfig(path string) (config *Config, err error) {
 		config.Address = "0.0.0.0"
 	}
 
+	if config.TrashRetention <= 0 {
+		config.TrashRetention = 30 * 24 * time.Hour
+	}
+
+	if config.WAL.Fsync == "" {
+		config.WAL.Fsync = "always"
+	}
+
+	if config.WAL.FsyncInterval <= 0 {
+		config.WAL.FsyncInterval = 10 * time.Millisecond
+	}
+
+	if config.Queue.Size <= 0 {
+		config.Queue.Size = 100
+	}
+
+	if config.Queue.Timeout <= 0 {
+		config.Queue.Timeout = time.Second
+	}
+
+	if config.Database.Driver == "" {
+		config.Database.Driver = "sqlite"
+	}
+
+	if config.Auth.SessionLifetime <= 0 {
+		config.Auth.SessionLifetime = 12 * time.Hour
+	}
+
+	if config.Headers.FrameAncestors == nil {
+		config.Headers.FrameAncestors = []string{"'none'"}
+	}
+
+	if config.Headers.ReferrerPolicy == "" {
+		config.Headers.ReferrerPolicy = "same-origin"
+	}
+
+	if config.Headers.PermissionsPolicy == "" {
+		config.Headers.PermissionsPolicy = "camera=(), microphone=(), geolocation=(), payment=()"
+	}
+
+	if config.Headers.HSTSMaxAge <= 0 {
+		config.Headers.HSTSMaxAge = 365 * 24 * time.Hour
+	}
+
+	if config.RateLimits.Read.Rate <= 0 {
+		config.RateLimits.Read.Rate = 20
+	}
+
+	if config.RateLimits.Write.Rate <= 0 {
+		config.RateLimits.Write.Rate = 5
+	}
+
+	if config.RateLimits.Read.Burst <= 0 {
+		config.RateLimits.Read.Burst = int(2 * config.RateLimits.Read.Rate)
+	}
+
+	if config.RateLimits.Write.Burst <= 0 {
+		config.RateLimits.Write.Burst = int(2 * config.RateLimits.Write.Rate)
+	}
+
+	if config.LDAP.Port == 0 {
+		config.LDAP.Port = 10389
+	}
+
+	if config.LDAP.Address == "" {
+		config.LDAP.Address = config.Address
+	}
+
+	if config.LDAP.BaseDN == "" {
+		config.LDAP.BaseDN = "ou=contacts,dc=example,dc=com"
+	}
+
 	return config, nil
 }
@@ -0,0 +1,286 @@
+// Package emailcrypt wraps an app so that the email addresses it stores are
+// encrypted deterministically: the same address always encrypts to the same
+// value, so equality lookups and duplicate checks keep working on the
+// encrypted values, while snapshots and logs never hold the addresses
+// themselves.
+//
+// Encryption is AES-GCM with a synthetic nonce, an HMAC-SHA256 of the
+// address, so only identical addresses ever share a nonce.
+package emailcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"example-api-server/appinterface"
+)
+
+// prefix marks an encrypted address.  Addresses stored before encryption was
+// turned on lack it and are passed through as they are.
+const prefix = "enc:v1:"
+
+var ErrDecrypt = errors.New("email address could not be decrypted, the key is wrong or the data was tampered with")
+
+type emailCipher struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// LoadKey reads a base64 key from a file or, if file is empty, the
+// environment variable env.
+func LoadKey(file string, env string) ([]byte, error) {
+	var encoded string
+	if file != "" {
+		bts, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(bts)
+	} else {
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", env)
+		}
+		encoded = v
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid base64: %v", err)
+	}
+	if len(key) < 32 {
+		return nil, errors.New("key must be at least 32 bytes")
+	}
+	return key, nil
+}
+
+// derive makes independent keys for encryption and nonces from one key.
+func derive(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newEmailCipher(key []byte) (*emailCipher, error) {
+	block, err := aes.NewCipher(derive(key, "email encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &emailCipher{aead: aead, macKey: derive(key, "email nonce")}, nil
+}
+
+func (e *emailCipher) encrypt(email string) string {
+	if email == "" {
+		return email
+	}
+	mac := hmac.New(sha256.New, e.macKey)
+	mac.Write([]byte(email))
+	nonce := mac.Sum(nil)[:e.aead.NonceSize()]
+	sealed := e.aead.Seal(nonce, nonce, []byte(email), nil)
+	return prefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (e *emailCipher) decrypt(email string) (string, error) {
+	encoded, ok := strings.CutPrefix(email, prefix)
+	if !ok {
+		return email, nil
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < e.aead.NonceSize() {
+		return "", ErrDecrypt
+	}
+	n := e.aead.NonceSize()
+	plain, err := e.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plain), nil
+}
+
+func (e *emailCipher) encryptContact(c appinterface.Contact) appinterface.Contact {
+	c.Email = e.encrypt(c.Email)
+	return c
+}
+
+func (e *emailCipher) decryptContact(c appinterface.Contact) (appinterface.Contact, error) {
+	var err error
+	c.Email, err = e.decrypt(c.Email)
+	return c, err
+}
+
+func (e *emailCipher) decryptContacts(cs []appinterface.Contact) ([]appinterface.Contact, error) {
+	var err error
+	for i := range cs {
+		cs[i], err = e.decryptContact(cs[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+// Decrypter decrypts the addresses of contacts as an app wrapped with the
+// same key stores them, for records of those contacts kept elsewhere, such
+// as the audit log.
+type Decrypter struct {
+	cipher *emailCipher
+}
+
+func NewDecrypter(key []byte) (*Decrypter, error) {
+	c, err := newEmailCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Decrypter{cipher: c}, nil
+}
+
+// Contact returns c with its address decrypted.
+func (d *Decrypter) Contact(c appinterface.Contact) (appinterface.Contact, error) {
+	return d.cipher.decryptContact(c)
+}
+
+// encryptedApp encrypts emails on their way into the wrapped app and
+// decrypts them on their way out.  Snapshot and Restore pass them through
+// encrypted, so backups never hold them in plaintext either.
+type encryptedApp struct {
+	appinterface.App
+	cipher *emailCipher
+}
+
+// Wrap returns app with its stored email addresses encrypted with key.
+func Wrap(app appinterface.App, key []byte) (appinterface.App, error) {
+	c, err := newEmailCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedApp{App: app, cipher: c}, nil
+}
+
+func (a *encryptedApp) AddContact(ctx context.Context, firstName string, lastName string, email string) error {
+	return a.App.AddContact(ctx, firstName, lastName, a.cipher.encrypt(email))
+}
+
+func (a *encryptedApp) GetContacts(ctx context.Context) ([]appinterface.Contact, error) {
+	cs, err := a.App.GetContacts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return a.cipher.decryptContacts(cs)
+}
+
+// ContactsAfter encrypts the cursor too, since the contacts are ordered by
+// their stored values.
+func (a *encryptedApp) ContactsAfter(ctx context.Context, after appinterface.Contact, limit int) ([]appinterface.Contact, error) {
+	cs, err := a.App.ContactsAfter(ctx, a.cipher.encryptContact(after), limit)
+	if err != nil {
+		return nil, err
+	}
+	return a.cipher.decryptContacts(cs)
+}
+
+func (a *encryptedApp) ContactDetails(ctx context.Context, id int) (appinterface.Contact, error) {
+	c, err := a.App.ContactDetails(ctx, id)
+	if err != nil {
+		return c, err
+	}
+	return a.cipher.decryptContact(c)
+}
+
+func (a *encryptedApp) UpdateContact(ctx context.Context, id int, ifMatch []int, firstName string, lastName string, email string) error {
+	return a.App.UpdateContact(ctx, id, ifMatch, firstName, lastName, a.cipher.encrypt(email))
+}
+
+func (a *encryptedApp) PatchContact(ctx context.Context, id int, ifMatch []int, patch appinterface.ContactPatch) (appinterface.Contact, error) {
+	c, err := a.App.PatchContact(ctx, id, ifMatch, func(current appinterface.Contact) (appinterface.Contact, error) {
+		current, err := a.cipher.decryptContact(current)
+		if err != nil {
+			return current, err
+		}
+		patched, err := patch(current)
+		if err != nil {
+			return patched, err
+		}
+		return a.cipher.encryptContact(patched), nil
+	})
+	if err != nil {
+		return c, err
+	}
+	return a.cipher.decryptContact(c)
+}
+
+func (a *encryptedApp) ShareContact(ctx context.Context, id int, ifMatch []int, shares []appinterface.Share) (appinterface.Contact, error) {
+	c, err := a.App.ShareContact(ctx, id, ifMatch, shares)
+	if err != nil {
+		return c, err
+	}
+	return a.cipher.decryptContact(c)
+}
+
+func (a *encryptedApp) Batch(ctx context.Context, ops []appinterface.BatchOperation) ([]appinterface.BatchResult, error) {
+	encrypted := make([]appinterface.BatchOperation, len(ops))
+	for i, op := range ops {
+		op.Contact = a.cipher.encryptContact(op.Contact)
+		encrypted[i] = op
+	}
+	results, batchErr := a.App.Batch(ctx, encrypted)
+	for i := range results {
+		c, err := a.cipher.decryptContact(results[i].Contact)
+		if err != nil {
+			return nil, err
+		}
+		results[i].Contact = c
+	}
+	return results, batchErr
+}
+
+func (a *encryptedApp) Import(ctx context.Context, contacts []appinterface.Contact, dryRun bool) ([]appinterface.ImportResult, error) {
+	encrypted := make([]appinterface.Contact, len(contacts))
+	for i, c := range contacts {
+		encrypted[i] = a.cipher.encryptContact(c)
+	}
+	results, err := a.App.Import(ctx, encrypted, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Contact, err = a.cipher.decryptContact(results[i].Contact)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func (a *encryptedApp) Changes(ctx context.Context, since int) (appinterface.ChangeSet, error) {
+	cs, err := a.App.Changes(ctx, since)
+	if err != nil {
+		return cs, err
+	}
+	cs.Updated, err = a.cipher.decryptContacts(cs.Updated)
+	return cs, err
+}
+
+func (a *encryptedApp) GetTrash(ctx context.Context) ([]appinterface.TrashedContact, error) {
+	trash, err := a.App.GetTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range trash {
+		trash[i].Contact, err = a.cipher.decryptContact(trash[i].Contact)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return trash, nil
+}
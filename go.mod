@@ -3,8 +3,20 @@ module example-api-server
 go 1.22
 
 require (
-	github.com/BurntSushi/toml v1.3.2 // indirect
-	github.com/jessevdk/go-flags v1.5.0 // indirect
-	github.com/mitchellh/go-homedir v1.1.0 // indirect
-	golang.org/x/sys v0.0.0-20210320140829-1e4c9ba3b0c4 // indirect
+	github.com/BurntSushi/toml v1.3.2
+	github.com/jessevdk/go-flags v1.5.0
+	github.com/mitchellh/go-homedir v1.1.0
+	modernc.org/sqlite v1.34.5
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	modernc.org/libc v1.55.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
 )
@@ -0,0 +1,144 @@
+// Package keyring holds the AES keys persisted data is encrypted with and
+// seals and opens data with AES-GCM.
+//
+// Keys are given one per line as "<id>:<base64 key>".  The last one is the
+// current key, used for everything sealed; the others are kept so data
+// sealed before a rotation can still be opened.
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envelopeVersion is the first byte of every sealed envelope.  It can never
+// be the first byte of a JSON document, which is how sealed data is told
+// apart from plaintext written before encryption was turned on.
+const envelopeVersion = 0x01
+
+var (
+	ErrNoKeys     = errors.New("no encryption keys given")
+	ErrUnknownKey = errors.New("data is encrypted with a key that is not configured")
+	ErrWrongKey   = errors.New("data could not be decrypted, the key is wrong or the data was tampered with")
+	ErrNotSealed  = errors.New("data is not encrypted")
+)
+
+type Keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// Load reads keys from a file or, if file is empty, the environment variable
+// env.
+func Load(file string, env string) (*Keyring, error) {
+	if file != "" {
+		bts, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return Parse(string(bts))
+	}
+	v, ok := os.LookupEnv(env)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", env)
+	}
+	return Parse(v)
+}
+
+// Parse parses keys separated by newlines, commas or spaces.  Blank lines
+// and lines starting with # are ignored.
+func Parse(s string) (*Keyring, error) {
+	k := &Keyring{aeads: map[string]cipher.AEAD{}}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			id, encoded, ok := strings.Cut(entry, ":")
+			if !ok || id == "" || len(id) > 255 {
+				return nil, fmt.Errorf("invalid key entry, expected <id>:<base64 key>")
+			}
+			if _, dup := k.aeads[id]; dup {
+				return nil, fmt.Errorf("key %q is given twice", id)
+			}
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("key %q is not valid base64: %v", id, err)
+			}
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %v", id, err)
+			}
+			aead, err := cipher.NewGCM(block)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %v", id, err)
+			}
+			k.aeads[id] = aead
+			k.current = id
+		}
+	}
+	if k.current == "" {
+		return nil, ErrNoKeys
+	}
+	return k, nil
+}
+
+// Current returns the ID of the key data is sealed with.
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// IsSealed reports whether data looks like a sealed envelope rather than
+// plaintext JSON.
+func IsSealed(data []byte) bool {
+	return len(data) > 0 && data[0] == envelopeVersion
+}
+
+// Seal encrypts plaintext with the current key.  The envelope is the
+// version byte, the length of the key ID, the key ID, the nonce and the
+// ciphertext; everything before the nonce is authenticated too.
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	aead := k.aeads[k.current]
+	header := append([]byte{envelopeVersion, byte(len(k.current))}, k.current...)
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(append(out, header...), nonce...)
+	return aead.Seal(out, nonce, plaintext, header), nil
+}
+
+// Open decrypts an envelope made by Seal and returns the plaintext and the
+// ID of the key it was sealed with.
+func (k *Keyring) Open(envelope []byte) ([]byte, string, error) {
+	if !IsSealed(envelope) || len(envelope) < 2 {
+		return nil, "", ErrNotSealed
+	}
+	idLen := int(envelope[1])
+	if len(envelope) < 2+idLen {
+		return nil, "", ErrWrongKey
+	}
+	header, rest := envelope[:2+idLen], envelope[2+idLen:]
+	id := string(header[2:])
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, id, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, id, ErrWrongKey
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, id, fmt.Errorf("%w (key %q)", ErrWrongKey, id)
+	}
+	return plaintext, id, nil
+}
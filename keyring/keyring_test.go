@@ -0,0 +1,170 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKey is a base64 AES-256 key made of b repeated.
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func mustParse(t *testing.T, s string) *Keyring {
+	t.Helper()
+	k, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestParse(t *testing.T) {
+	k := mustParse(t, "# rotated on 2026-01-01\nold:"+testKey(1)+"\n\n  mid:"+testKey(2)+", new:"+testKey(3)+"\n")
+	if k.Current() != "new" || len(k.aeads) != 3 {
+		t.Errorf("current %q of %d keys", k.Current(), len(k.aeads))
+	}
+	if k := mustParse(t, "aes128:"+base64.StdEncoding.EncodeToString(make([]byte, 16))); k.Current() != "aes128" {
+		t.Errorf("current %q", k.Current())
+	}
+
+	tests := []struct {
+		name string
+		keys string
+		want error
+	}{
+		{name: "nothing", keys: "", want: ErrNoKeys},
+		{name: "only comments", keys: "# none yet\n", want: ErrNoKeys},
+		{name: "no ID", keys: testKey(1)},
+		{name: "empty ID", keys: ":" + testKey(1)},
+		{name: "long ID", keys: strings.Repeat("x", 256) + ":" + testKey(1)},
+		{name: "ID given twice", keys: "a:" + testKey(1) + "\na:" + testKey(2)},
+		{name: "not base64", keys: "a:not-base64!"},
+		{name: "wrong key size", keys: "a:" + base64.StdEncoding.EncodeToString(make([]byte, 10))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(test.keys)
+			if err == nil || test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("file:"+testKey(1)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_KEYRING", "env:"+testKey(2))
+	if k, err := Load(path, "TEST_KEYRING"); err != nil || k.Current() != "file" {
+		t.Errorf("from the file: %v", err)
+	}
+	if k, err := Load("", "TEST_KEYRING"); err != nil || k.Current() != "env" {
+		t.Errorf("from the environment: %v", err)
+	}
+	if _, err := Load("", "TEST_KEYRING_UNSET"); err == nil {
+		t.Errorf("loaded keys from an unset variable")
+	}
+	if _, err := Load(path+".missing", "TEST_KEYRING"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("from a missing file: %v", err)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	k := mustParse(t, "a:"+testKey(1))
+	plaintext := []byte(`{"firstName":"Ada"}`)
+	sealed, err := k.Seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || IsSealed(plaintext) || IsSealed(nil) {
+		t.Errorf("IsSealed cannot tell sealed data from plaintext")
+	}
+	if bytes.Contains(sealed, []byte("Ada")) {
+		t.Errorf("the envelope holds the plaintext")
+	}
+	again, err := k.Seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Errorf("sealing twice gave the same envelope")
+	}
+	opened, id, err := k.Open(sealed)
+	if err != nil || id != "a" || !bytes.Equal(opened, plaintext) {
+		t.Errorf("open: %q %q %v", opened, id, err)
+	}
+	if _, _, err := k.Open(plaintext); !errors.Is(err, ErrNotSealed) {
+		t.Errorf("opening plaintext: %v", err)
+	}
+}
+
+// TestTampering changes each part of an envelope and checks that it no
+// longer opens.
+func TestTampering(t *testing.T) {
+	// "a" and "b" are the same key, so only the authenticated key ID tells
+	// their envelopes apart.
+	k := mustParse(t, "a:"+testKey(1)+"\nb:"+testKey(1))
+	sealed, err := k.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper := func(f func(e []byte) []byte) []byte {
+		return f(bytes.Clone(sealed))
+	}
+	tests := []struct {
+		name     string
+		envelope []byte
+		want     error
+	}{
+		{name: "key ID", envelope: tamper(func(e []byte) []byte { e[2] = 'a'; return e }), want: ErrWrongKey},
+		{name: "nonce", envelope: tamper(func(e []byte) []byte { e[3] ^= 1; return e }), want: ErrWrongKey},
+		{name: "ciphertext", envelope: tamper(func(e []byte) []byte { e[len(e)-1] ^= 1; return e }), want: ErrWrongKey},
+		{name: "truncated", envelope: sealed[:len(sealed)-1], want: ErrWrongKey},
+		{name: "no nonce", envelope: sealed[:5], want: ErrWrongKey},
+		{name: "key ID cut short", envelope: []byte{envelopeVersion, 9, 'b'}, want: ErrWrongKey},
+		{name: "version", envelope: tamper(func(e []byte) []byte { e[0] = 2; return e }), want: ErrNotSealed},
+		{name: "unknown key ID", envelope: tamper(func(e []byte) []byte { e[2] = 'c'; return e }), want: ErrUnknownKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := k.Open(test.envelope); !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	before := mustParse(t, "old:"+testKey(1))
+	sealed, err := before.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, id, err := mustParse(t, "new:"+testKey(2)).Open(sealed); !errors.Is(err, ErrUnknownKey) || id != "old" {
+		t.Errorf("opening without the old key: %q %v", id, err)
+	}
+	// A key given under the old ID but with other bytes is just wrong.
+	if _, _, err := mustParse(t, "old:"+testKey(2)).Open(sealed); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("opening with a wrong old key: %v", err)
+	}
+
+	after := mustParse(t, "old:"+testKey(1)+"\nnew:"+testKey(2))
+	if opened, id, err := after.Open(sealed); err != nil || id != "old" || string(opened) != "secret" {
+		t.Errorf("opening after the rotation: %q %q %v", opened, id, err)
+	}
+	resealed, err := after.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, id, err := mustParse(t, "new:"+testKey(2)).Open(resealed); err != nil || id != "new" {
+		t.Errorf("data sealed after the rotation: %q %v", id, err)
+	}
+}
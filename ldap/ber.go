@@ -0,0 +1,238 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER classes, as found in the top two bits of an identifier octet.
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+)
+
+// Universal tags used by LDAP.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x10
+	tagSet         = 0x11
+)
+
+// maxPacketSize bounds the size of a single message so a client cannot make
+// us allocate arbitrary amounts of memory with a bogus length.
+const maxPacketSize = 1 << 20
+
+var errPacketTooLarge = errors.New("ber: packet too large")
+
+// packet is a decoded BER element.  Primitive elements carry their content
+// in value; constructed ones in children.
+type packet struct {
+	class       byte
+	constructed bool
+	tag         int
+	value       []byte
+	children    []*packet
+}
+
+func (p *packet) is(class byte, tag int) bool {
+	return p.class == class && p.tag == tag
+}
+
+func (p *packet) child(i int) (*packet, error) {
+	if i >= len(p.children) {
+		return nil, fmt.Errorf("ber: missing element %d", i)
+	}
+	return p.children[i], nil
+}
+
+func (p *packet) int() (int64, error) {
+	if p.constructed || len(p.value) == 0 || len(p.value) > 8 {
+		return 0, errors.New("ber: invalid integer")
+	}
+	v := int64(int8(p.value[0]))
+	for _, b := range p.value[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+func (p *packet) bool() (bool, error) {
+	if p.constructed || len(p.value) != 1 {
+		return false, errors.New("ber: invalid boolean")
+	}
+	return p.value[0] != 0, nil
+}
+
+func (p *packet) string() string {
+	return string(p.value)
+}
+
+// readPacket reads one complete element from r.
+func readPacket(r *bufio.Reader) (*packet, error) {
+	p, _, err := readElement(r, maxPacketSize)
+	return p, err
+}
+
+// readElement reads one element of at most limit octets and returns it with
+// the number of octets consumed.
+func readElement(r io.ByteReader, limit int) (*packet, int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+	n := 1
+	p := &packet{
+		class:       b & 0xc0,
+		constructed: b&0x20 != 0,
+		tag:         int(b & 0x1f),
+	}
+	if p.tag == 0x1f {
+		// High tag number form.
+		p.tag = 0
+		for {
+			b, err = r.ReadByte()
+			if err != nil {
+				return nil, n, unexpected(err)
+			}
+			n++
+			if p.tag > 1<<20 {
+				return nil, n, errors.New("ber: tag too large")
+			}
+			p.tag = p.tag<<7 | int(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+	}
+	b, err = r.ReadByte()
+	if err != nil {
+		return nil, n, unexpected(err)
+	}
+	n++
+	length := int(b)
+	if b&0x80 != 0 {
+		octets := int(b & 0x7f)
+		if octets == 0 {
+			return nil, n, errors.New("ber: indefinite lengths are not allowed")
+		}
+		if octets > 4 {
+			return nil, n, errPacketTooLarge
+		}
+		length = 0
+		for i := 0; i < octets; i++ {
+			b, err = r.ReadByte()
+			if err != nil {
+				return nil, n, unexpected(err)
+			}
+			n++
+			length = length<<8 | int(b)
+		}
+	}
+	if length > limit-n {
+		return nil, n, errPacketTooLarge
+	}
+	if !p.constructed {
+		p.value = make([]byte, length)
+		for i := range p.value {
+			p.value[i], err = r.ReadByte()
+			if err != nil {
+				return nil, n, unexpected(err)
+			}
+		}
+		return p, n + length, nil
+	}
+	for read := 0; read < length; {
+		c, m, err := readElement(r, length-read)
+		if err != nil {
+			return nil, n, unexpected(err)
+		}
+		read += m
+		p.children = append(p.children, c)
+	}
+	return p, n + length, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// bytes encodes the element.
+func (p *packet) bytes() []byte {
+	content := p.value
+	if p.constructed {
+		content = nil
+		for _, c := range p.children {
+			content = append(content, c.bytes()...)
+		}
+	}
+	var out []byte
+	id := p.class
+	if p.constructed {
+		id |= 0x20
+	}
+	if p.tag < 0x1f {
+		out = append(out, id|byte(p.tag))
+	} else {
+		out = append(out, id|0x1f)
+		var tag []byte
+		for t := p.tag; t > 0; t >>= 7 {
+			tag = append([]byte{byte(t&0x7f) | 0x80}, tag...)
+		}
+		tag[len(tag)-1] &= 0x7f
+		out = append(out, tag...)
+	}
+	if len(content) < 0x80 {
+		out = append(out, byte(len(content)))
+	} else {
+		var length []byte
+		for l := len(content); l > 0; l >>= 8 {
+			length = append([]byte{byte(l)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, content...)
+}
+
+func newConstructed(class byte, tag int, children ...*packet) *packet {
+	return &packet{class: class, constructed: true, tag: tag, children: children}
+}
+
+func newSequence(children ...*packet) *packet {
+	return newConstructed(classUniversal, tagSequence, children...)
+}
+
+func newSet(children ...*packet) *packet {
+	return newConstructed(classUniversal, tagSet, children...)
+}
+
+func newString(s string) *packet {
+	return &packet{class: classUniversal, tag: tagOctetString, value: []byte(s)}
+}
+
+func encodeInt(v int64) []byte {
+	out := []byte{byte(v)}
+	for v > 127 || v < -128 {
+		v >>= 8
+		out = append([]byte{byte(v)}, out...)
+	}
+	return out
+}
+
+func newInteger(v int64) *packet {
+	return &packet{class: classUniversal, tag: tagInteger, value: encodeInt(v)}
+}
+
+func newEnumerated(v int64) *packet {
+	return &packet{class: classUniversal, tag: tagEnumerated, value: encodeInt(v)}
+}
@@ -0,0 +1,67 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	p := newSequence(
+		newInteger(-129),
+		newInteger(1<<40),
+		newEnumerated(resultNoSuchObject),
+		newString(long),
+		newConstructed(classApplication, opSearchEntry, newString("uid=1")),
+		&packet{class: classContext, tag: 100, value: []byte("high tag")},
+	)
+	got, err := readPacket(bufio.NewReader(bytes.NewReader(p.bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.children) != 6 {
+		t.Fatalf("decoded %d children", len(got.children))
+	}
+	for i, want := range []int64{-129, 1 << 40, resultNoSuchObject} {
+		if v, err := got.children[i].int(); err != nil || v != want {
+			t.Errorf("child %d: %d %v, want %d", i, v, err, want)
+		}
+	}
+	if got.children[3].string() != long {
+		t.Errorf("long string lost its content")
+	}
+	if c := got.children[4]; !c.is(classApplication, opSearchEntry) || !c.constructed || c.children[0].string() != "uid=1" {
+		t.Errorf("application element: %+v", c)
+	}
+	if c := got.children[5]; !c.is(classContext, 100) || c.string() != "high tag" {
+		t.Errorf("high tag element: %+v", c)
+	}
+}
+
+func TestReadPacketRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"indefinite length", []byte{0x30, 0x80, 0x00, 0x00}},
+		{"length over the limit", []byte{0x04, 0x84, 0x7f, 0xff, 0xff, 0xff}},
+		{"length in too many octets", []byte{0x04, 0x85, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		{"truncated content", []byte{0x04, 0x05, 'a', 'b'}},
+		{"child longer than its parent", []byte{0x30, 0x03, 0x04, 0x05, 'a'}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readPacket(bufio.NewReader(bytes.NewReader(test.data)))
+			if err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+	_, err := readPacket(bufio.NewReader(bytes.NewReader([]byte{0x04, 0x84, 0x7f, 0xff, 0xff, 0xff})))
+	if !errors.Is(err, errPacketTooLarge) {
+		t.Errorf("oversized packet: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package ldap
+
+import (
+	"errors"
+	"strings"
+)
+
+// Filter choices from RFC 4511 section 4.5.1.
+const (
+	filterAnd             = 0
+	filterOr              = 1
+	filterNot             = 2
+	filterEqualityMatch   = 3
+	filterSubstrings      = 4
+	filterGreaterOrEqual  = 5
+	filterLessOrEqual     = 6
+	filterPresent         = 7
+	filterApproxMatch     = 8
+	filterExtensibleMatch = 9
+)
+
+// Substring choices.
+const (
+	substringInitial = 0
+	substringAny     = 1
+	substringFinal   = 2
+)
+
+// maxFilterDepth bounds how deeply and/or/not may nest.
+const maxFilterDepth = 32
+
+var errBadFilter = errors.New("ldap: malformed filter")
+
+// normalize folds a value for the case-insensitive matching rules every
+// attribute we serve uses.
+func normalize(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// matchFilter evaluates a search filter against an entry.  Matching rules we
+// do not implement, like extensibleMatch, never match.
+func matchFilter(f *packet, e *entry, depth int) (bool, error) {
+	if depth > maxFilterDepth || f.class != classContext {
+		return false, errBadFilter
+	}
+	switch f.tag {
+	case filterAnd, filterOr:
+		if !f.constructed {
+			return false, errBadFilter
+		}
+		and := f.tag == filterAnd
+		for _, c := range f.children {
+			m, err := matchFilter(c, e, depth+1)
+			if err != nil {
+				return false, err
+			}
+			if m != and {
+				return m, nil
+			}
+		}
+		return and, nil
+	case filterNot:
+		if !f.constructed || len(f.children) != 1 {
+			return false, errBadFilter
+		}
+		m, err := matchFilter(f.children[0], e, depth+1)
+		return !m, err
+	case filterPresent:
+		if f.constructed {
+			return false, errBadFilter
+		}
+		return len(e.values(f.string())) > 0, nil
+	case filterEqualityMatch, filterApproxMatch, filterGreaterOrEqual, filterLessOrEqual:
+		if !f.constructed || len(f.children) != 2 {
+			return false, errBadFilter
+		}
+		want := normalize(f.children[1].string())
+		for _, v := range e.values(f.children[0].string()) {
+			v = normalize(v)
+			switch {
+			case f.tag == filterGreaterOrEqual && v >= want,
+				f.tag == filterLessOrEqual && v <= want,
+				(f.tag == filterEqualityMatch || f.tag == filterApproxMatch) && v == want:
+				return true, nil
+			}
+		}
+		return false, nil
+	case filterSubstrings:
+		if !f.constructed || len(f.children) != 2 || !f.children[1].constructed {
+			return false, errBadFilter
+		}
+		for _, v := range e.values(f.children[0].string()) {
+			if matchSubstrings(normalize(v), f.children[1].children) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case filterExtensibleMatch:
+		return false, nil
+	}
+	return false, errBadFilter
+}
+
+func matchSubstrings(v string, parts []*packet) bool {
+	for i, p := range parts {
+		s := normalize(p.string())
+		switch p.tag {
+		case substringInitial:
+			if i != 0 || !strings.HasPrefix(v, s) {
+				return false
+			}
+			v = v[len(s):]
+		case substringAny:
+			idx := strings.Index(v, s)
+			if idx < 0 {
+				return false
+			}
+			v = v[idx+len(s):]
+		case substringFinal:
+			if i != len(parts)-1 || !strings.HasSuffix(v, s) {
+				return false
+			}
+			v = ""
+		default:
+			return false
+		}
+	}
+	return true
+}
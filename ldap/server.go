@@ -0,0 +1,500 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example-api-server/appinterface"
+)
+
+type Server interface {
+	Start() error
+	Stop(ctx context.Context) error
+	Wait()
+}
+
+// Protocol operations, as APPLICATION tags.
+const (
+	opBindRequest      = 0
+	opBindResponse     = 1
+	opUnbindRequest    = 2
+	opSearchRequest    = 3
+	opSearchEntry      = 4
+	opSearchDone       = 5
+	opModifyRequest    = 6
+	opAddRequest       = 8
+	opDelRequest       = 10
+	opModifyDNRequest  = 12
+	opCompareRequest   = 14
+	opCompareResponse  = 15
+	opAbandonRequest   = 16
+	opExtendedRequest  = 23
+	opExtendedResponse = 24
+)
+
+// Result codes we send.
+const (
+	resultSuccess                 = 0
+	resultProtocolError           = 2
+	resultSizeLimitExceeded       = 4
+	resultCompareFalse            = 5
+	resultCompareTrue             = 6
+	resultAuthMethodNotSupported  = 7
+	resultNoSuchObject            = 32
+	resultInvalidCredentials      = 49
+	resultInsufficientAccessRight = 50
+	resultUnwillingToPerform      = 53
+)
+
+// Search scopes.
+const (
+	scopeBaseObject   = 0
+	scopeSingleLevel  = 1
+	scopeWholeSubtree = 2
+)
+
+// idleTimeout is how long a connection may sit without sending a request.
+const idleTimeout = 5 * time.Minute
+
+type ldapServer struct {
+	address      string
+	port         uint
+	baseDN       string
+	bindDN       string
+	bindPassword string
+	app          appinterface.App
+	options      Options
+	listener     net.Listener
+	wg           *sync.WaitGroup
+	mu           sync.Mutex
+	conns        map[net.Conn]struct{}
+}
+
+// Options are the optional settings of a server.
+type Options struct {
+	// Principal, when set, is who the directory's clients act for, so it
+	// only holds the contacts the principal may see.  Without one it holds
+	// every contact.
+	Principal *appinterface.Principal
+	// View, when set, is applied to every contact before it is served, so
+	// that fields hidden or masked from the principal are here too.
+	View func(appinterface.Contact) appinterface.Contact
+}
+
+// NewServer returns a read-only LDAP directory of the contacts in app, rooted
+// at baseDN.  When bindDN is empty anyone may search; otherwise clients have
+// to bind as bindDN with bindPassword first.
+func NewServer(address string, port uint, baseDN string, bindDN string, bindPassword string, app appinterface.App) Server {
+	return NewServerWithOptions(address, port, baseDN, bindDN, bindPassword, app, Options{})
+}
+
+// NewServerWithOptions returns a server like NewServer does, with options.
+func NewServerWithOptions(address string, port uint, baseDN string, bindDN string, bindPassword string, app appinterface.App, options Options) Server {
+	return &ldapServer{
+		address:      address,
+		port:         port,
+		baseDN:       baseDN,
+		bindDN:       bindDN,
+		bindPassword: bindPassword,
+		app:          app,
+		options:      options,
+		conns:        map[net.Conn]struct{}{},
+	}
+}
+
+func (s *ldapServer) Start() (err error) {
+	log.Printf("Starting LDAP server on %s:%v\n", s.address, s.port)
+	s.listener, err = net.Listen("tcp", net.JoinHostPort(s.address, strconv.Itoa(int(s.port))))
+	if err != nil {
+		return
+	}
+	s.wg = &sync.WaitGroup{}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Error accepting LDAP connection: %v", err)
+				}
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = struct{}{}
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+		}
+	}()
+	return
+}
+
+func (s *ldapServer) Wait() {
+	s.wg.Wait()
+}
+
+func (s *ldapServer) Stop(ctx context.Context) error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// session is the state of one client connection.
+type session struct {
+	conn  net.Conn
+	bound bool
+}
+
+func (s *session) send(id int64, op *packet) error {
+	_, err := s.conn.Write(newSequence(newInteger(id), op).bytes())
+	return err
+}
+
+func (s *session) result(id int64, op int, code int, diagnostic string) error {
+	return s.send(id, newConstructed(classApplication, op, newEnumerated(int64(code)), newString(""), newString(diagnostic)))
+}
+
+func (s *ldapServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	sess := &session{conn: conn, bound: s.bindDN == ""}
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		msg, err := readPacket(r)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading LDAP request from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if !msg.is(classUniversal, tagSequence) || len(msg.children) < 2 {
+			log.Printf("Malformed LDAP message from %s", conn.RemoteAddr())
+			return
+		}
+		id, err := msg.children[0].int()
+		op := msg.children[1]
+		if err != nil || op.class != classApplication {
+			log.Printf("Malformed LDAP message from %s", conn.RemoteAddr())
+			return
+		}
+		switch op.tag {
+		case opBindRequest:
+			err = s.bind(sess, id, op)
+		case opUnbindRequest:
+			return
+		case opSearchRequest:
+			err = s.search(sess, id, op)
+		case opCompareRequest:
+			err = s.compare(sess, id, op)
+		case opModifyRequest, opAddRequest, opDelRequest, opModifyDNRequest:
+			err = sess.result(id, op.tag+1, resultUnwillingToPerform, "this directory is read-only")
+		case opAbandonRequest:
+			// Requests are answered in full before the next is read, so
+			// there is never anything left to abandon.
+		case opExtendedRequest:
+			err = sess.result(id, opExtendedResponse, resultProtocolError, "extended operations are not supported")
+		default:
+			log.Printf("Unknown LDAP operation %d from %s", op.tag, conn.RemoteAddr())
+			return
+		}
+		if err != nil {
+			log.Printf("Error answering LDAP request from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (s *ldapServer) bind(sess *session, id int64, op *packet) error {
+	if len(op.children) != 3 {
+		return sess.result(id, opBindResponse, resultProtocolError, "malformed bind request")
+	}
+	name := op.children[1].string()
+	auth := op.children[2]
+	if !auth.is(classContext, 0) || auth.constructed {
+		return sess.result(id, opBindResponse, resultAuthMethodNotSupported, "only simple binds are supported")
+	}
+	password := auth.value
+	if name == "" && len(password) == 0 {
+		// Anonymous binds always succeed, but only get to search when no
+		// bind DN is configured.
+		sess.bound = s.bindDN == ""
+		return sess.result(id, opBindResponse, resultSuccess, "")
+	}
+	if s.bindDN != "" && normalizeDN(name) == normalizeDN(s.bindDN) &&
+		subtle.ConstantTimeCompare(password, []byte(s.bindPassword)) == 1 {
+		sess.bound = true
+		return sess.result(id, opBindResponse, resultSuccess, "")
+	}
+	sess.bound = s.bindDN == ""
+	return sess.result(id, opBindResponse, resultInvalidCredentials, "")
+}
+
+// normalizeDN lowercases a DN and removes the optional spaces around its
+// separators so DNs can be compared as strings.
+func normalizeDN(dn string) string {
+	rdns := strings.Split(dn, ",")
+	for i, rdn := range rdns {
+		k, v, _ := strings.Cut(rdn, "=")
+		rdns[i] = strings.ToLower(strings.TrimSpace(k)) + "=" + strings.ToLower(strings.TrimSpace(v))
+	}
+	if len(rdns) == 1 && rdns[0] == "=" {
+		return ""
+	}
+	return strings.Join(rdns, ",")
+}
+
+func isDescendant(dn string, base string) bool {
+	return base == "" || strings.HasSuffix(dn, ","+base)
+}
+
+func parentDN(dn string) string {
+	_, parent, _ := strings.Cut(dn, ",")
+	return parent
+}
+
+type attribute struct {
+	name   string
+	values []string
+}
+
+type entry struct {
+	dn    string
+	attrs []attribute
+}
+
+func (e *entry) values(name string) []string {
+	for _, a := range e.attrs {
+		if strings.EqualFold(a.name, name) {
+			return a.values
+		}
+	}
+	return nil
+}
+
+func (s *ldapServer) baseEntry() *entry {
+	k, v, _ := strings.Cut(strings.Split(s.baseDN, ",")[0], "=")
+	return &entry{
+		dn: s.baseDN,
+		attrs: []attribute{
+			{"objectClass", []string{"top", "organizationalUnit"}},
+			{strings.TrimSpace(k), []string{strings.TrimSpace(v)}},
+		},
+	}
+}
+
+func (s *ldapServer) rootDSE() *entry {
+	return &entry{
+		attrs: []attribute{
+			{"objectClass", []string{"top"}},
+			{"namingContexts", []string{s.baseDN}},
+			{"supportedLDAPVersion", []string{"3"}},
+			{"vendorName", []string{"example-api-server"}},
+		},
+	}
+}
+
+// contactEntry maps a contact onto an inetOrgPerson.  A contact whose email
+// is hidden has no mail attribute.
+func (s *ldapServer) contactEntry(c appinterface.Contact) *entry {
+	id := strconv.Itoa(c.ID)
+	e := &entry{
+		dn: "uid=" + id + "," + s.baseDN,
+		attrs: []attribute{
+			{"objectClass", []string{"top", "person", "organizationalPerson", "inetOrgPerson"}},
+			{"uid", []string{id}},
+			{"cn", []string{strings.TrimSpace(c.FirstName + " " + c.LastName)}},
+			{"displayName", []string{strings.TrimSpace(c.FirstName + " " + c.LastName)}},
+			{"givenName", []string{c.FirstName}},
+			{"sn", []string{c.LastName}},
+		},
+	}
+	if c.Email != "" {
+		e.attrs = append(e.attrs, attribute{"mail", []string{c.Email}})
+	}
+	return e
+}
+
+// entries returns the base entry followed by one entry per contact the
+// principal may see, as it may see them.
+func (s *ldapServer) entries() ([]*entry, error) {
+	ctx := context.Background()
+	if s.options.Principal != nil {
+		ctx = appinterface.WithPrincipal(ctx, *s.options.Principal)
+	}
+	contacts, err := s.app.GetContacts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := []*entry{s.baseEntry()}
+	for _, c := range contacts {
+		if s.options.View != nil {
+			c = s.options.View(c)
+		}
+		result = append(result, s.contactEntry(c))
+	}
+	return result, nil
+}
+
+// selectAttributes applies the attribute list of a search request.
+func selectAttributes(e *entry, requested []string, typesOnly bool) *packet {
+	all := len(requested) == 0 || containsFold(requested, "*")
+	if len(requested) == 1 && requested[0] == "1.1" {
+		all = false
+	}
+	attrs := newSequence()
+	for _, a := range e.attrs {
+		if !all && !containsFold(requested, a.name) {
+			continue
+		}
+		vals := newSet()
+		if !typesOnly {
+			for _, v := range a.values {
+				vals.children = append(vals.children, newString(v))
+			}
+		}
+		attrs.children = append(attrs.children, newSequence(newString(a.name), vals))
+	}
+	return attrs
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ldapServer) search(sess *session, id int64, op *packet) error {
+	if !sess.bound {
+		return sess.result(id, opSearchDone, resultInsufficientAccessRight, "bind first")
+	}
+	if len(op.children) != 8 {
+		return sess.result(id, opSearchDone, resultProtocolError, "malformed search request")
+	}
+	base := normalizeDN(op.children[0].string())
+	scope, err1 := op.children[1].int()
+	sizeLimit, err2 := op.children[3].int()
+	typesOnly, err3 := op.children[5].bool()
+	filter := op.children[6]
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return sess.result(id, opSearchDone, resultProtocolError, err.Error())
+	}
+	var requested []string
+	for _, a := range op.children[7].children {
+		requested = append(requested, a.string())
+	}
+
+	var candidates []*entry
+	if base == "" && scope == scopeBaseObject {
+		candidates = []*entry{s.rootDSE()}
+	} else {
+		all, err := s.entries()
+		if err != nil {
+			return sess.result(id, opSearchDone, resultUnwillingToPerform, fmt.Sprintf("error reading contacts: %v", err))
+		}
+		ours := normalizeDN(s.baseDN)
+		found := base == ours || isDescendant(ours, base)
+		for _, e := range all {
+			dn := normalizeDN(e.dn)
+			if dn == base {
+				found = true
+			}
+			var inScope bool
+			switch scope {
+			case scopeBaseObject:
+				inScope = dn == base
+			case scopeSingleLevel:
+				inScope = parentDN(dn) == base
+			case scopeWholeSubtree:
+				inScope = dn == base || isDescendant(dn, base)
+			}
+			if inScope {
+				candidates = append(candidates, e)
+			}
+		}
+		if !found {
+			return sess.result(id, opSearchDone, resultNoSuchObject, "")
+		}
+	}
+
+	sent := int64(0)
+	for _, e := range candidates {
+		m, err := matchFilter(filter, e, 0)
+		if err != nil {
+			return sess.result(id, opSearchDone, resultProtocolError, err.Error())
+		}
+		if !m {
+			continue
+		}
+		if sizeLimit > 0 && sent >= sizeLimit {
+			return sess.result(id, opSearchDone, resultSizeLimitExceeded, "")
+		}
+		err = sess.send(id, newConstructed(classApplication, opSearchEntry, newString(e.dn), selectAttributes(e, requested, typesOnly)))
+		if err != nil {
+			return err
+		}
+		sent++
+	}
+	return sess.result(id, opSearchDone, resultSuccess, "")
+}
+
+func (s *ldapServer) compare(sess *session, id int64, op *packet) error {
+	if !sess.bound {
+		return sess.result(id, opCompareResponse, resultInsufficientAccessRight, "bind first")
+	}
+	if len(op.children) != 2 || len(op.children[1].children) != 2 {
+		return sess.result(id, opCompareResponse, resultProtocolError, "malformed compare request")
+	}
+	dn := normalizeDN(op.children[0].string())
+	attr := op.children[1].children[0].string()
+	want := normalize(op.children[1].children[1].string())
+	all, err := s.entries()
+	if err != nil {
+		return sess.result(id, opCompareResponse, resultUnwillingToPerform, fmt.Sprintf("error reading contacts: %v", err))
+	}
+	for _, e := range all {
+		if normalizeDN(e.dn) != dn {
+			continue
+		}
+		for _, v := range e.values(attr) {
+			if normalize(v) == want {
+				return sess.result(id, opCompareResponse, resultCompareTrue, "")
+			}
+		}
+		return sess.result(id, opCompareResponse, resultCompareFalse, "")
+	}
+	return sess.result(id, opCompareResponse, resultNoSuchObject, "")
+}
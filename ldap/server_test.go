@@ -0,0 +1,320 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"example-api-server/app"
+	"example-api-server/appinterface"
+)
+
+const testBaseDN = "ou=contacts,dc=example,dc=com"
+
+// newBook is a book holding Ada (uid 1), Grace (uid 2) and Alan (uid 3).
+func newBook(t *testing.T) appinterface.App {
+	t.Helper()
+	a := app.NewApp(10, time.Second, time.Hour)
+	t.Cleanup(func() {
+		a.Stop()
+		a.Wait()
+	})
+	for _, c := range []appinterface.Contact{
+		{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"},
+		{FirstName: "Grace", LastName: "Hopper", Email: "grace@navy.example.mil"},
+		{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"},
+	} {
+		if err := a.AddContact(context.Background(), c.FirstName, c.LastName, c.Email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+// startServer serves the directory of a new book on a random port, and
+// returns its address.
+func startServer(t *testing.T, bindDN string, bindPassword string) string {
+	t.Helper()
+	return serveBook(t, newBook(t), bindDN, bindPassword, Options{})
+}
+
+// serveBook serves the directory of a on a random port, and returns its
+// address.
+func serveBook(t *testing.T, a appinterface.App, bindDN string, bindPassword string, options Options) string {
+	t.Helper()
+	s := NewServerWithOptions("127.0.0.1", 0, testBaseDN, bindDN, bindPassword, a, options).(*ldapServer)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Stop(ctx)
+	})
+	return s.listener.Addr().String()
+}
+
+// client speaks LDAP to the test server through the BER codec.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	id   int64
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends op and returns the operations of every response to it, the last
+// of which is the one that ends it.
+func (c *client) do(op *packet) []*packet {
+	c.t.Helper()
+	c.id++
+	_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write(newSequence(newInteger(c.id), op).bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+	var ops []*packet
+	for {
+		msg, err := readPacket(c.r)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if id, err := msg.children[0].int(); err != nil || id != c.id {
+			c.t.Fatalf("response to message %d, want %d", id, c.id)
+		}
+		ops = append(ops, msg.children[1])
+		if msg.children[1].tag != opSearchEntry {
+			return ops
+		}
+	}
+}
+
+// resultCode is the result code of a response operation.
+func (c *client) resultCode(op *packet) int64 {
+	c.t.Helper()
+	code, err := op.children[0].int()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return code
+}
+
+func (c *client) bind(dn string, password string) int64 {
+	c.t.Helper()
+	ops := c.do(newConstructed(classApplication, opBindRequest,
+		newInteger(3), newString(dn), &packet{class: classContext, tag: 0, value: []byte(password)}))
+	return c.resultCode(ops[0])
+}
+
+// search returns the DNs of the entries found and the result code.
+func (c *client) search(base string, scope int64, sizeLimit int64, filter *packet, attrs ...string) ([]string, int64) {
+	c.t.Helper()
+	requested := newSequence()
+	for _, a := range attrs {
+		requested.children = append(requested.children, newString(a))
+	}
+	ops := c.do(newConstructed(classApplication, opSearchRequest,
+		newString(base), newEnumerated(scope), newEnumerated(0), newInteger(sizeLimit), newInteger(0),
+		&packet{class: classUniversal, tag: tagBoolean, value: []byte{0}}, filter, requested))
+	var dns []string
+	for _, op := range ops[:len(ops)-1] {
+		dns = append(dns, op.children[0].string())
+	}
+	return dns, c.resultCode(ops[len(ops)-1])
+}
+
+func present(attr string) *packet {
+	return &packet{class: classContext, tag: filterPresent, value: []byte(attr)}
+}
+
+func equal(attr string, value string) *packet {
+	return newConstructed(classContext, filterEqualityMatch, newString(attr), newString(value))
+}
+
+func substrings(attr string, initial string, any string, final string) *packet {
+	parts := newSequence()
+	for tag, s := range []string{substringInitial: initial, substringAny: any, substringFinal: final} {
+		if s != "" {
+			parts.children = append(parts.children, &packet{class: classContext, tag: tag, value: []byte(s)})
+		}
+	}
+	return newConstructed(classContext, filterSubstrings, newString(attr), parts)
+}
+
+func and(fs ...*packet) *packet { return newConstructed(classContext, filterAnd, fs...) }
+func or(fs ...*packet) *packet  { return newConstructed(classContext, filterOr, fs...) }
+func not(f *packet) *packet     { return newConstructed(classContext, filterNot, f) }
+
+func uid(n string) string {
+	return "uid=" + n + "," + testBaseDN
+}
+
+func TestBind(t *testing.T) {
+	addr := startServer(t, "cn=reader,dc=example,dc=com", "secret")
+	c := dial(t, addr)
+	if _, code := c.search(testBaseDN, scopeWholeSubtree, 0, present("objectClass")); code != resultInsufficientAccessRight {
+		t.Errorf("search before binding: %d", code)
+	}
+	if code := c.bind("cn=reader,dc=example,dc=com", "wrong"); code != resultInvalidCredentials {
+		t.Errorf("bind with a wrong password: %d", code)
+	}
+	if code := c.bind("", ""); code != resultSuccess {
+		t.Errorf("anonymous bind: %d", code)
+	}
+	if _, code := c.search(testBaseDN, scopeWholeSubtree, 0, present("objectClass")); code != resultInsufficientAccessRight {
+		t.Errorf("anonymous search: %d", code)
+	}
+	if code := c.bind("CN=Reader, DC=example, DC=com", "secret"); code != resultSuccess {
+		t.Errorf("bind: %d", code)
+	}
+	if dns, code := c.search(testBaseDN, scopeWholeSubtree, 0, present("objectClass")); code != resultSuccess || len(dns) != 4 {
+		t.Errorf("search after binding: %q %d", dns, code)
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	c := dial(t, startServer(t, "", ""))
+	tests := []struct {
+		name   string
+		filter *packet
+		want   []string
+	}{
+		{"present", present("mail"), []string{uid("1"), uid("2"), uid("3")}},
+		{"equality ignores case", equal("MAIL", "ADA@example.com"), []string{uid("1")}},
+		{"initial substring", substrings("cn", "a", "", ""), []string{uid("1"), uid("3")}},
+		{"any and final substrings", substrings("mail", "", "@", ".org"), []string{uid("3")}},
+		{"and", and(substrings("cn", "a", "", ""), equal("sn", "turing")), []string{uid("3")}},
+		{"or", or(equal("givenName", "grace"), equal("uid", "1")), []string{uid("1"), uid("2")}},
+		{"not", and(present("mail"), not(substrings("mail", "", "", "example.com"))), []string{uid("2"), uid("3")}},
+		{"inetOrgPerson", equal("objectClass", "inetOrgPerson"), []string{uid("1"), uid("2"), uid("3")}},
+		{"no match", equal("mail", "nobody@example.com"), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dns, code := c.search(testBaseDN, scopeSingleLevel, 0, test.filter, "cn", "mail")
+			if code != resultSuccess {
+				t.Fatalf("result %d", code)
+			}
+			slices.Sort(dns)
+			if !slices.Equal(dns, test.want) {
+				t.Errorf("found %q, want %q", dns, test.want)
+			}
+		})
+	}
+
+	deep := present("cn")
+	for range maxFilterDepth + 1 {
+		deep = not(not(deep))
+	}
+	if _, code := c.search(testBaseDN, scopeSingleLevel, 0, deep); code != resultProtocolError {
+		t.Errorf("filter nested too deeply: %d", code)
+	}
+}
+
+func TestSearchScopes(t *testing.T) {
+	c := dial(t, startServer(t, "", ""))
+	if dns, _ := c.search("", scopeBaseObject, 0, present("objectClass"), "namingContexts"); !slices.Equal(dns, []string{""}) {
+		t.Errorf("root DSE: %q", dns)
+	}
+	if dns, _ := c.search(testBaseDN, scopeBaseObject, 0, present("objectClass")); !slices.Equal(dns, []string{testBaseDN}) {
+		t.Errorf("base object: %q", dns)
+	}
+	if dns, _ := c.search(uid("2"), scopeBaseObject, 0, present("objectClass")); !slices.Equal(dns, []string{uid("2")}) {
+		t.Errorf("contact entry: %q", dns)
+	}
+	if dns, _ := c.search(testBaseDN, scopeSingleLevel, 0, present("objectClass")); len(dns) != 3 {
+		t.Errorf("single level: %q", dns)
+	}
+	if dns, _ := c.search("dc=example,dc=com", scopeWholeSubtree, 0, present("objectClass")); len(dns) != 4 {
+		t.Errorf("subtree from above the base: %q", dns)
+	}
+	if _, code := c.search("ou=other,dc=example,dc=com", scopeWholeSubtree, 0, present("objectClass")); code != resultNoSuchObject {
+		t.Errorf("unknown base: %d", code)
+	}
+	if dns, code := c.search(testBaseDN, scopeSingleLevel, 2, present("objectClass")); code != resultSizeLimitExceeded || len(dns) != 2 {
+		t.Errorf("size limit: %q %d", dns, code)
+	}
+}
+
+func (c *client) compare(dn string, attr string, value string) int64 {
+	c.t.Helper()
+	ops := c.do(newConstructed(classApplication, opCompareRequest, newString(dn), newSequence(newString(attr), newString(value))))
+	return c.resultCode(ops[0])
+}
+
+func TestCompareAndWrites(t *testing.T) {
+	c := dial(t, startServer(t, "", ""))
+	compare := c.compare
+	if code := compare(uid("1"), "mail", "Ada@Example.com"); code != resultCompareTrue {
+		t.Errorf("compare of a matching value: %d", code)
+	}
+	if code := compare(uid("1"), "mail", "grace@navy.example.mil"); code != resultCompareFalse {
+		t.Errorf("compare of another value: %d", code)
+	}
+	if code := compare(uid("9"), "mail", "ada@example.com"); code != resultNoSuchObject {
+		t.Errorf("compare of a missing entry: %d", code)
+	}
+	ops := c.do(&packet{class: classApplication, tag: opDelRequest, value: []byte(uid("1"))})
+	if !ops[0].is(classApplication, opDelRequest+1) || c.resultCode(ops[0]) != resultUnwillingToPerform {
+		t.Errorf("delete: %+v", ops[0])
+	}
+	if dns, _ := c.search(testBaseDN, scopeSingleLevel, 0, present("objectClass")); len(dns) != 3 {
+		t.Errorf("delete removed an entry: %q", dns)
+	}
+}
+
+// TestPrincipalAndView checks that the directory only holds the contacts
+// its principal may see, as the view shows them.
+func TestPrincipalAndView(t *testing.T) {
+	a := newBook(t)
+	alice := appinterface.WithPrincipal(context.Background(), appinterface.Principal{Name: "alice"})
+	for _, name := range []string{"Private", "Shared"} {
+		if err := a.AddContact(alice, name, "Contact", strings.ToLower(name)+"@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.ShareContact(alice, 5, nil, []appinterface.Share{{Group: "staff", Access: appinterface.AccessRead}}); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveBook(t, a, "cn=reader,dc=example,dc=com", "secret", Options{
+		Principal: &appinterface.Principal{Name: "bob", Groups: []string{"staff"}},
+		View: func(c appinterface.Contact) appinterface.Contact {
+			c.Email = ""
+			return c
+		},
+	})
+	c := dial(t, addr)
+	if code := c.bind("cn=reader,dc=example,dc=com", "secret"); code != resultSuccess {
+		t.Fatalf("bind: %d", code)
+	}
+	dns, code := c.search(testBaseDN, scopeSingleLevel, 0, present("cn"))
+	slices.Sort(dns)
+	if want := []string{uid("1"), uid("2"), uid("3"), uid("5")}; code != resultSuccess || !slices.Equal(dns, want) {
+		t.Errorf("found %q %d, want %q", dns, code, want)
+	}
+	if _, code := c.search(uid("4"), scopeBaseObject, 0, present("objectClass")); code != resultNoSuchObject {
+		t.Errorf("alice's private contact: %d", code)
+	}
+	if code := c.compare(uid("4"), "cn", "Private Contact"); code != resultNoSuchObject {
+		t.Errorf("compare of alice's private contact: %d", code)
+	}
+	// The view hides every email, so none can be found or guessed.
+	if dns, _ := c.search(testBaseDN, scopeSingleLevel, 0, present("mail")); len(dns) != 0 {
+		t.Errorf("entries with mail: %q", dns)
+	}
+	if code := c.compare(uid("1"), "mail", "ada@example.com"); code != resultCompareFalse {
+		t.Errorf("compare of a hidden email: %d", code)
+	}
+}
@@ -5,8 +5,21 @@ import (
 	"fmt"
 	"log"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"example-api-server/app"
+	"example-api-server/appinterface"
+	"example-api-server/audit"
+	"example-api-server/auth"
+	"example-api-server/emailcrypt"
+	"example-api-server/keyring"
+	"example-api-server/ldap"
+	"example-api-server/sqlstore"
+	"example-api-server/wal"
 	"example-api-server/webapp"
 
 	"github.com/jessevdk/go-flags"
@@ -18,7 +31,20 @@ type Args struct {
 	Address    string `short:"a" long:"address" description:"The address to listen on for HTTP requests" default:"0.0.0.0"`
 	Port       int    `short:"p" long:"port" description:"The port to listen on for HTTP requests"`
 
-	config *Config
+	config     *Config
+	syncPolicy wal.SyncPolicy
+	keys       *keyring.Keyring
+	emailKey   []byte
+	visibility webapp.Visibility
+	// clientVisibility holds the visibility rules of named clients.
+	clientVisibility map[string]webapp.Visibility
+	apiKeys          *auth.Store
+	jwt              *auth.JWTVerifier
+	rateLimits       webapp.RateLimits
+	trustedProxies   []netip.Prefix
+	// books names every address book, the default one first.
+	books  []string
+	grants map[string]map[string]auth.Role
 }
 
 func (a *Args) validate() (err error) {
@@ -51,14 +77,279 @@ func (a *Args) validate() (err error) {
 	if err != nil {
 		return fmt.Errorf("error: invalid address[%s]: %v", a.Address, err)
 	}
+
+	if a.config.WAL.Path != "" {
+		a.config.WAL.Path, err = hd.Expand(a.config.WAL.Path)
+		if err != nil {
+			return fmt.Errorf("error: could not expand wal path[%s]: %v", a.config.WAL.Path, err)
+		}
+		a.syncPolicy, err = wal.ParseSyncPolicy(a.config.WAL.Fsync)
+		if err != nil {
+			return fmt.Errorf("error: invalid wal fsync[%s]: %v", a.config.WAL.Fsync, err)
+		}
+	}
+
+	if a.config.Audit.Path != "" {
+		a.config.Audit.Path, err = hd.Expand(a.config.Audit.Path)
+		if err != nil {
+			return fmt.Errorf("error: could not expand audit path[%s]: %v", a.config.Audit.Path, err)
+		}
+	}
+
+	if a.config.Database.DSN != "" && a.config.WAL.Path != "" {
+		return errors.New("error: only one of database and wal can be configured")
+	}
+
+	if ec := a.config.Encryption; ec.KeyFile != "" || ec.KeyEnv != "" {
+		if a.config.Database.DSN != "" {
+			return errors.New("error: encryption at rest is not supported with a database, only with the wal")
+		}
+		keyFile, err := hd.Expand(ec.KeyFile)
+		if err != nil {
+			return fmt.Errorf("error: could not expand encryption key-file path[%s]: %v", ec.KeyFile, err)
+		}
+		a.keys, err = keyring.Load(keyFile, ec.KeyEnv)
+		if err != nil {
+			return fmt.Errorf("error: could not load encryption keys: %v", err)
+		}
+	}
+
+	if ec := a.config.Encryption; ec.EmailKeyFile != "" || ec.EmailKeyEnv != "" {
+		keyFile, err := hd.Expand(ec.EmailKeyFile)
+		if err != nil {
+			return fmt.Errorf("error: could not expand encryption email-key-file path[%s]: %v", ec.EmailKeyFile, err)
+		}
+		a.emailKey, err = emailcrypt.LoadKey(keyFile, ec.EmailKeyEnv)
+		if err != nil {
+			return fmt.Errorf("error: could not load email encryption key: %v", err)
+		}
+	}
+
+	vc := a.config.Visibility
+	a.visibility.Email, err = webapp.ParseFieldVisibility(vc.Email)
+	if err != nil {
+		return fmt.Errorf("error: invalid visibility email: %v", err)
+	}
+	a.clientVisibility = map[string]webapp.Visibility{}
+	for name, rules := range vc.Clients {
+		var v webapp.Visibility
+		v.Email, err = webapp.ParseFieldVisibility(rules.Email)
+		if err != nil {
+			return fmt.Errorf("error: invalid visibility email for client[%s]: %v", name, err)
+		}
+		a.clientVisibility[name] = v
+	}
+
+	if ac := a.config.Auth; ac.Enabled {
+		var keys []auth.Key
+		for _, kc := range ac.APIKeys {
+			k, err := auth.NewConfiguredKey(kc.Name, kc.Role, kc.Hash)
+			if err != nil {
+				return fmt.Errorf("error: invalid auth api key[%s]: %v", kc.Name, err)
+			}
+			keys = append(keys, k)
+		}
+		keysFile, err := hd.Expand(ac.KeysFile)
+		if err != nil {
+			return fmt.Errorf("error: could not expand auth keys-file path[%s]: %v", ac.KeysFile, err)
+		}
+		a.apiKeys, err = auth.NewStore(keys, keysFile)
+		if err != nil {
+			return fmt.Errorf("error: could not load auth keys: %v", err)
+		}
+		if jc := ac.JWT; jc.JWKSFile != "" {
+			jwksFile, err := hd.Expand(jc.JWKSFile)
+			if err != nil {
+				return fmt.Errorf("error: could not expand auth jwt jwks-file path[%s]: %v", jc.JWKSFile, err)
+			}
+			options := auth.JWTOptions{
+				Issuer:    jc.Issuer,
+				Audience:  jc.Audience,
+				NameClaim: jc.NameClaim,
+				RoleClaim: jc.RoleClaim,
+				Roles:     map[string]auth.Role{},
+				Leeway:    jc.Leeway,
+			}
+			for value, role := range jc.Roles {
+				if role == "" {
+					return fmt.Errorf("error: no auth jwt role given for[%s]", value)
+				}
+				options.Roles[value], err = auth.ParseRole(role)
+				if err != nil {
+					return fmt.Errorf("error: invalid auth jwt role for[%s]: %v", value, err)
+				}
+			}
+			a.jwt, err = auth.NewJWTVerifier(jwksFile, options)
+			if err != nil {
+				return fmt.Errorf("error: could not load auth jwt keys: %v", err)
+			}
+		}
+		if a.apiKeys.Len() == 0 && a.jwt == nil {
+			return errors.New("error: auth is enabled but there are no api keys, create one with the api-key command")
+		}
+	}
+
+	a.books = []string{appinterface.DefaultBook}
+	a.grants = map[string]map[string]auth.Role{}
+	for _, bc := range a.config.Books {
+		err = appinterface.ValidateBookName(bc.Name)
+		if err != nil {
+			return fmt.Errorf("error: invalid book name[%s]: %v", bc.Name, err)
+		}
+		if _, ok := a.grants[bc.Name]; ok {
+			return fmt.Errorf("error: book[%s] is configured twice", bc.Name)
+		}
+		if bc.Name != appinterface.DefaultBook {
+			a.books = append(a.books, bc.Name)
+		}
+		grants := map[string]auth.Role{}
+		for name, role := range bc.Grants {
+			if role == "" {
+				return fmt.Errorf("error: no role granted to[%s] in book[%s]", name, bc.Name)
+			}
+			grants[name], err = auth.ParseRole(role)
+			if err != nil {
+				return fmt.Errorf("error: invalid grant to[%s] in book[%s]: %v", name, bc.Name, err)
+			}
+		}
+		a.grants[bc.Name] = grants
+	}
+
+	if rc := a.config.RateLimits; rc.Enabled {
+		for _, limit := range []RateLimitConfig{rc.Read, rc.Write} {
+			if limit.Burst < 1 {
+				return errors.New("error: rate limit bursts must allow at least one request")
+			}
+		}
+		a.rateLimits = webapp.RateLimits{
+			Read:  webapp.RateLimit{Rate: rc.Read.Rate, Burst: rc.Read.Burst},
+			Write: webapp.RateLimit{Rate: rc.Write.Rate, Burst: rc.Write.Burst},
+		}
+	}
+
+	for _, proxy := range a.config.TrustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(proxy)
+			if aerr != nil {
+				return fmt.Errorf("error: invalid trusted proxy[%s]: %v", proxy, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		a.trustedProxies = append(a.trustedProxies, prefix.Masked())
+	}
+
+	if a.config.LDAP.Enabled {
+		if a.config.LDAP.Port < 0 || a.config.LDAP.Port > 65535 {
+			return errors.New("error: ldap port must be between 0 and 65535")
+		}
+		_, err = netip.ParseAddr(a.config.LDAP.Address)
+		if err != nil {
+			return fmt.Errorf("error: invalid ldap address[%s]: %v", a.config.LDAP.Address, err)
+		}
+		if lc := a.config.LDAP; a.apiKeys != nil {
+			if lc.BindDN == "" {
+				return errors.New("error: auth is enabled, so ldap needs a bind-dn")
+			}
+			if lc.Client == "" {
+				return errors.New("error: auth is enabled, so ldap needs a client to act for")
+			}
+			if grants, ok := a.grants[appinterface.DefaultBook]; ok && grants[lc.Client] == "" && grants["*"] == "" {
+				return fmt.Errorf("error: ldap client[%s] has no grant in the default book", lc.Client)
+			}
+		}
+	}
 	return nil
 }
 
+func addMigrateCommands(parser *flags.Parser, args *Args) error {
+	db := dbCommand{args: args}
+	migrate, err := parser.AddCommand("migrate", "Migrate the database schema",
+		"Brings the schema of the configured database up to date without starting the server, "+
+			"or shows or changes its version with a subcommand.", &MigrateCommand{dbCommand: db})
+	if err != nil {
+		return err
+	}
+	migrate.SubcommandsOptional = true
+	_, err = migrate.AddCommand("status", "Show the schema version and migrations",
+		"Shows the schema version of the configured database and which migrations it has had applied.",
+		&MigrateStatusCommand{dbCommand: db})
+	if err == nil {
+		_, err = migrate.AddCommand("up", "Migrate the schema up",
+			"Applies migrations up to the latest version, or the one given.", &MigrateUpCommand{dbCommand: db})
+	}
+	if err == nil {
+		_, err = migrate.AddCommand("down", "Migrate the schema down",
+			"Reverts migrations down to the version given, or by one version.", &MigrateDownCommand{dbCommand: db})
+	}
+	return err
+}
+
+// openSQLBooks opens the configured database, migrates it to the schema
+// this binary expects and returns the address books kept in it.
+func openSQLBooks(dc DatabaseConfig, names []string, trashRetention time.Duration) (appinterface.Books, error) {
+	db, err := sqlstore.OpenDB(dc.Driver, dc.DSN)
+	if err != nil {
+		return nil, err
+	}
+	from, to, err := sqlstore.Migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if from != to {
+		log.Printf("Migrated database schema from version %d to %d\n", from, to)
+	}
+	books, err := sqlstore.NewBooks(db, names, trashRetention)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return books, nil
+}
+
+// bookWALPath returns the write-ahead log of a book.  The default book
+// keeps the configured path, so existing logs carry on as its own, and
+// other books log next to it, wal-work.log for a book "work" of wal.log.
+func bookWALPath(path string, book string) string {
+	if book == appinterface.DefaultBook {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + book + ext
+}
+
 func main() {
 	var args Args
 	parser := flags.NewParser(&args, flags.Default)
-	_, err := parser.Parse()
+	// Without a subcommand the server is run.
+	parser.SubcommandsOptional = true
+	_, err := parser.AddCommand("backup", "Back up a running server",
+		"Takes a point-in-time snapshot of a running server and writes it to a file.", &BackupCommand{})
+	if err == nil {
+		err = addMigrateCommands(parser, &args)
+	}
+	if err == nil {
+		_, err = parser.AddCommand("api-key", "Generate an API key",
+			"Generates a new API key and prints it along with the hash to list in the auth section of the config file.",
+			&APIKeyCommand{})
+	}
+	if err == nil {
+		_, err = parser.AddCommand("restore", "Restore a backup into a running server",
+			"Loads a snapshot file into a running server whose address book is empty.", &RestoreCommand{})
+	}
 	if err != nil {
+		log.Fatalf("error: %v\n", err)
+		return
+	}
+	_, err = parser.Parse()
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return
+		}
+		os.Exit(1)
+	}
+	if parser.Active != nil {
 		return
 	}
 	err = args.validate()
@@ -67,9 +358,116 @@ func main() {
 		return
 	}
 
-	ap := app.NewApp(100)
-	wapp := webapp.NewWebApp(ap)
+	var books appinterface.Books
+	if wc := args.config.WAL; wc.Path != "" {
+		apps := map[string]appinterface.App{}
+		for _, name := range args.books {
+			path := bookWALPath(wc.Path, name)
+			apps[name], err = app.NewPersistentApp(args.config.Queue.Size, args.config.Queue.Timeout, args.config.TrashRetention, path, args.syncPolicy, wc.FsyncInterval, args.keys)
+			if err != nil {
+				log.Fatalf("error: could not recover from wal[%s]: %v\n", path, err)
+				return
+			}
+		}
+		books = appinterface.NewBooks(args.books, apps)
+	} else if dc := args.config.Database; dc.DSN != "" {
+		books, err = openSQLBooks(dc, args.books, args.config.TrashRetention)
+		if err != nil {
+			log.Fatalf("error: could not open database: %v\n", err)
+			return
+		}
+	} else {
+		apps := map[string]appinterface.App{}
+		for _, name := range args.books {
+			apps[name] = app.NewApp(args.config.Queue.Size, args.config.Queue.Timeout, args.config.TrashRetention)
+		}
+		books = appinterface.NewBooks(args.books, apps)
+	}
+	var auditLog *audit.Log
+	if path := args.config.Audit.Path; path != "" {
+		auditLog, err = audit.Open(path, args.keys)
+		if err != nil {
+			log.Fatalf("error: could not open audit log[%s]: %v\n", path, err)
+			return
+		}
+		// The audit log sits below email encryption so that it never holds
+		// an address the books do not.  The web app decrypts the addresses
+		// of the entries it serves.
+		books, _ = appinterface.WrapBooks(books, func(name string, ap appinterface.App) (appinterface.App, error) {
+			return audit.Wrap(ap, auditLog, name), nil
+		})
+	}
+	var auditContacts func(appinterface.Contact) (appinterface.Contact, error)
+	if args.emailKey != nil {
+		books, err = appinterface.WrapBooks(books, func(_ string, ap appinterface.App) (appinterface.App, error) {
+			return emailcrypt.Wrap(ap, args.emailKey)
+		})
+		if err != nil {
+			log.Fatalf("error: could not set up email encryption: %v\n", err)
+			return
+		}
+		d, err := emailcrypt.NewDecrypter(args.emailKey)
+		if err != nil {
+			log.Fatalf("error: could not set up email encryption: %v\n", err)
+			return
+		}
+		auditContacts = d.Contact
+	}
+	wapp, err := webapp.NewWebAppWithOptions(books, webapp.Options{
+		Keys:             args.keys,
+		Visibility:       args.visibility,
+		ClientVisibility: args.clientVisibility,
+		APIKeys:          args.apiKeys,
+		JWT:              args.jwt,
+		SessionLifetime:  args.config.Auth.SessionLifetime,
+		InsecureCookies:  args.config.Auth.InsecureCookies,
+		Grants:           args.grants,
+		Groups:           args.config.Auth.Groups,
+		Audit:            auditLog,
+		AuditContacts:    auditContacts,
+		RateLimits:       args.rateLimits,
+		TrustedProxies:   args.trustedProxies,
+		Headers: webapp.SecurityHeaders{
+			ReportOnly:        args.config.Headers.CSPReportOnly,
+			FrameAncestors:    args.config.Headers.FrameAncestors,
+			ReferrerPolicy:    args.config.Headers.ReferrerPolicy,
+			PermissionsPolicy: args.config.Headers.PermissionsPolicy,
+			HSTSMaxAge:        args.config.Headers.HSTSMaxAge,
+		},
+	})
+	if err != nil {
+		log.Fatalf("error: %v\n", err)
+		return
+	}
 	srv := webapp.NewServerWithAddress(args.Address, uint(args.Port), wapp)
 	srv.Start()
+	if args.config.LDAP.Enabled {
+		// LDAP has no notion of books and only ever serves the default one.
+		// With auth, a bind acts for the configured client, which is never
+		// an admin, and sees the contacts as that client would.  Without
+		// it, LDAP sees every contact under the default visibility rules.
+		defaultBook, _ := books.Book(appinterface.DefaultBook)
+		lc := args.config.LDAP
+		options := ldap.Options{View: args.visibility.Contact}
+		if args.apiKeys != nil {
+			p := appinterface.Principal{Name: lc.Client}
+			for group, members := range args.config.Auth.Groups {
+				if slices.Contains(members, lc.Client) {
+					p.Groups = append(p.Groups, group)
+				}
+			}
+			slices.Sort(p.Groups)
+			options.Principal = &p
+			if v, ok := args.clientVisibility[lc.Client]; ok {
+				options.View = v.Contact
+			}
+		}
+		ldapSrv := ldap.NewServerWithOptions(lc.Address, uint(lc.Port), lc.BaseDN, lc.BindDN, lc.BindPassword, defaultBook, options)
+		err = ldapSrv.Start()
+		if err != nil {
+			log.Fatalf("error: could not start LDAP server: %v\n", err)
+			return
+		}
+	}
 	srv.Wait()
 }
@@ -0,0 +1,148 @@
+// Package snapshot reads and writes the backup file format: a JSON document
+// carrying a format version and a SHA-256 checksum of the data it wraps,
+// which may be encrypted.
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/keyring"
+)
+
+const (
+	// Format identifies a snapshot file.
+	Format = "example-api-server-snapshot"
+	// FormatVersion is the version written.  Files with a newer version are
+	// rejected rather than half understood.  Version 2 added encryption.
+	FormatVersion = 2
+)
+
+var (
+	ErrNotSnapshot        = errors.New("not a snapshot file")
+	ErrUnsupportedVersion = errors.New("unsupported snapshot format version")
+	ErrChecksumMismatch   = errors.New("snapshot checksum mismatch")
+	ErrEncrypted          = errors.New("snapshot is encrypted and no encryption key is configured")
+)
+
+// file is the document on disk.  The checksum covers the exact bytes of
+// Data, which is why it is kept raw.  When KeyID is set, Data is a base64
+// string holding the data sealed with that key, so a file can be verified
+// without the key.
+type file struct {
+	Format        string          `json:"format"`
+	FormatVersion int             `json:"formatVersion"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	Checksum      string          `json:"checksum"`
+	KeyID         string          `json:"keyId,omitempty"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// Info describes a snapshot file.
+type Info struct {
+	FormatVersion int
+	CreatedAt     time.Time
+	// KeyID is the key the data is encrypted with, empty if it is not.
+	KeyID string
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Write encodes data as a snapshot file, encrypted with the current key of
+// keys unless keys is nil.
+func Write(w io.Writer, data appinterface.SnapshotData, createdAt time.Time, keys *keyring.Keyring) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	f := file{
+		Format:        Format,
+		FormatVersion: FormatVersion,
+		CreatedAt:     createdAt.UTC(),
+	}
+	if keys != nil {
+		sealed, err := keys.Seal(raw)
+		if err != nil {
+			return err
+		}
+		raw, err = json.Marshal(sealed)
+		if err != nil {
+			return err
+		}
+		f.KeyID = keys.Current()
+	}
+	f.Checksum = checksum(raw)
+	f.Data = raw
+	return json.NewEncoder(w).Encode(f)
+}
+
+func readFile(r io.Reader) (file, error) {
+	var f file
+	err := json.NewDecoder(r).Decode(&f)
+	if err != nil {
+		return f, fmt.Errorf("%w: %v", ErrNotSnapshot, err)
+	}
+	if f.Format != Format {
+		return f, ErrNotSnapshot
+	}
+	if f.FormatVersion < 1 || f.FormatVersion > FormatVersion {
+		return f, fmt.Errorf("%w: %d", ErrUnsupportedVersion, f.FormatVersion)
+	}
+	if f.Checksum != checksum(f.Data) {
+		return f, ErrChecksumMismatch
+	}
+	return f, nil
+}
+
+// Verify checks a snapshot file's format and checksum without decoding, or
+// decrypting, its data.
+func Verify(r io.Reader) (Info, error) {
+	f, err := readFile(r)
+	return Info{FormatVersion: f.FormatVersion, CreatedAt: f.CreatedAt, KeyID: f.KeyID}, err
+}
+
+// Read decodes a snapshot file, verifying its checksum and decrypting it
+// with keys if it is encrypted.
+func Read(r io.Reader, keys *keyring.Keyring) (appinterface.SnapshotData, Info, error) {
+	var data appinterface.SnapshotData
+	f, err := readFile(r)
+	info := Info{FormatVersion: f.FormatVersion, CreatedAt: f.CreatedAt, KeyID: f.KeyID}
+	if err != nil {
+		return data, info, err
+	}
+	raw := []byte(f.Data)
+	if f.KeyID != "" {
+		if keys == nil {
+			return data, info, ErrEncrypted
+		}
+		var sealed []byte
+		err = json.Unmarshal(raw, &sealed)
+		if err != nil {
+			return data, info, fmt.Errorf("%w: %v", ErrNotSnapshot, err)
+		}
+		raw, _, err = keys.Open(sealed)
+		if err != nil {
+			return data, info, err
+		}
+	}
+	err = json.Unmarshal(raw, &data)
+	if err != nil {
+		return data, info, fmt.Errorf("%w: %v", ErrNotSnapshot, err)
+	}
+	for _, c := range data.Contacts {
+		err = c.Validate()
+		if err != nil {
+			return data, info, fmt.Errorf("contact %d: %w", c.ID, err)
+		}
+	}
+	return data, info, nil
+}
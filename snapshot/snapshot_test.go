@@ -0,0 +1,177 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/keyring"
+)
+
+var createdAt = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// sampleData is a book holding Ada, with Grace in the trash.
+func sampleData() appinterface.SnapshotData {
+	return appinterface.SnapshotData{
+		NextID:    3,
+		ChangeSeq: 4,
+		Contacts:  []appinterface.Contact{{ID: 1, Version: 2, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}},
+		Trash: []appinterface.TrashedContact{{
+			Contact:   appinterface.Contact{ID: 2, Version: 1, FirstName: "Grace", LastName: "Hopper", Email: "grace@example.org"},
+			DeletedAt: createdAt,
+		}},
+	}
+}
+
+func parseKeys(t *testing.T, ids ...string) *keyring.Keyring {
+	t.Helper()
+	var entries []string
+	for _, id := range ids {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, id+":"+base64.StdEncoding.EncodeToString(key))
+	}
+	k, err := keyring.Parse(strings.Join(entries, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func write(t *testing.T, data appinterface.SnapshotData, keys *keyring.Keyring) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := Write(&b, data, createdAt, keys); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	keys := parseKeys(t, "k")
+	sealed := write(t, sampleData(), keys)
+	if bytes.Contains(sealed, []byte("Lovelace")) {
+		t.Errorf("the snapshot holds contacts in the clear:\n%s", sealed)
+	}
+	// The checksum is of the sealed data, so it verifies without the key.
+	info, err := Verify(bytes.NewReader(sealed))
+	if err != nil || info.KeyID != "k" || info.FormatVersion != FormatVersion || !info.CreatedAt.Equal(createdAt) {
+		t.Errorf("verify: %+v %v", info, err)
+	}
+
+	if _, info, err := Read(bytes.NewReader(sealed), nil); !errors.Is(err, ErrEncrypted) || info.KeyID != "k" {
+		t.Errorf("reading without keys: %+v %v", info, err)
+	}
+	if _, _, err := Read(bytes.NewReader(sealed), parseKeys(t, "other")); !errors.Is(err, keyring.ErrUnknownKey) {
+		t.Errorf("reading without the key: %v", err)
+	}
+	if _, _, err := Read(bytes.NewReader(sealed), parseKeys(t, "k")); !errors.Is(err, keyring.ErrWrongKey) {
+		t.Errorf("reading with a wrong key: %v", err)
+	}
+	data, info, err := Read(bytes.NewReader(sealed), keys)
+	if err != nil || info.KeyID != "k" || !reflect.DeepEqual(data, sampleData()) {
+		t.Errorf("read: %+v %+v %v", data, info, err)
+	}
+
+	// A plaintext snapshot reads the same with keys or without.
+	plain := write(t, sampleData(), nil)
+	for _, k := range []*keyring.Keyring{nil, keys} {
+		if data, info, err := Read(bytes.NewReader(plain), k); err != nil || info.KeyID != "" || !reflect.DeepEqual(data, sampleData()) {
+			t.Errorf("reading a plaintext snapshot: %+v %+v %v", data, info, err)
+		}
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	bts := write(t, sampleData(), nil)
+	var f file
+	if err := json.Unmarshal(bts, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Format != Format || f.FormatVersion != FormatVersion || f.KeyID != "" || f.Checksum != checksum(f.Data) || !strings.HasPrefix(f.Checksum, "sha256:") {
+		t.Errorf("file %+v", f)
+	}
+	data, info, err := Read(bytes.NewReader(bts), nil)
+	if err != nil || !reflect.DeepEqual(data, sampleData()) || info.FormatVersion != FormatVersion || !info.CreatedAt.Equal(createdAt) {
+		t.Errorf("read: %+v %+v %v", data, info, err)
+	}
+	// Write takes any time zone and stores UTC.
+	var b bytes.Buffer
+	if err := Write(&b, sampleData(), createdAt.In(time.FixedZone("CET", 3600)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, info, err := Read(&b, nil); err != nil || info.CreatedAt.Location() != time.UTC || !info.CreatedAt.Equal(createdAt) {
+		t.Errorf("created at %v: %v", info.CreatedAt, err)
+	}
+}
+
+// TestCorruptSnapshots changes a valid snapshot file and checks that both
+// Verify and Read reject it.
+func TestCorruptSnapshots(t *testing.T) {
+	edit := func(f func(f map[string]any)) string {
+		var doc map[string]any
+		if err := json.Unmarshal(write(t, sampleData(), nil), &doc); err != nil {
+			t.Fatal(err)
+		}
+		f(doc)
+		bts, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(bts)
+	}
+	plain := string(write(t, sampleData(), nil))
+	tests := []struct {
+		name string
+		file string
+		want error
+	}{
+		{name: "empty", file: "", want: ErrNotSnapshot},
+		{name: "not JSON", file: "contacts.csv", want: ErrNotSnapshot},
+		{name: "truncated", file: plain[:len(plain)/2], want: ErrNotSnapshot},
+		{name: "other format", file: edit(func(f map[string]any) { f["format"] = "example-api-server-wal" }), want: ErrNotSnapshot},
+		{name: "no format", file: edit(func(f map[string]any) { delete(f, "format") }), want: ErrNotSnapshot},
+		{name: "newer version", file: edit(func(f map[string]any) { f["formatVersion"] = FormatVersion + 1 }), want: ErrUnsupportedVersion},
+		{name: "version 0", file: edit(func(f map[string]any) { f["formatVersion"] = 0 }), want: ErrUnsupportedVersion},
+		{name: "changed data", file: strings.Replace(plain, "Lovelace", "Lovelacf", 1), want: ErrChecksumMismatch},
+		{name: "changed checksum", file: edit(func(f map[string]any) { f["checksum"] = checksum([]byte("{}")) }), want: ErrChecksumMismatch},
+		{name: "no checksum", file: edit(func(f map[string]any) { delete(f, "checksum") }), want: ErrChecksumMismatch},
+		{name: "reformatted data", file: edit(func(f map[string]any) {}), want: ErrChecksumMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Verify(strings.NewReader(test.file)); !errors.Is(err, test.want) {
+				t.Errorf("verify: got %v, want %v", err, test.want)
+			}
+			if _, _, err := Read(strings.NewReader(test.file), nil); !errors.Is(err, test.want) {
+				t.Errorf("read: got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestReadChecksData(t *testing.T) {
+	// Version 1 files, from before encryption, are still read.
+	v1 := strings.Replace(string(write(t, sampleData(), nil)), `"formatVersion":2`, `"formatVersion":1`, 1)
+	if data, info, err := Read(strings.NewReader(v1), nil); err != nil || info.FormatVersion != 1 || !reflect.DeepEqual(data, sampleData()) {
+		t.Errorf("version 1: %+v %v", info, err)
+	}
+	// Data that checks out but is not a valid book is not restored either.
+	invalid := sampleData()
+	invalid.Contacts[0].Email = ""
+	if _, err := Verify(bytes.NewReader(write(t, invalid, nil))); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	if _, _, err := Read(bytes.NewReader(write(t, invalid, nil)), nil); !errors.Is(err, appinterface.ErrInvalidContact) {
+		t.Errorf("read: %v", err)
+	}
+}
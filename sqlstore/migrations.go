@@ -0,0 +1,250 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrSchemaTooNew is returned for a database migrated by a newer binary,
+// whose schema this one does not know how to read or migrate back.
+var ErrSchemaTooNew = errors.New("database schema is newer than this version supports")
+
+// Migration moves the schema from Version-1 to Version with Up, and back
+// with Down.  Data migrations belong here too, as statements that rewrite
+// rows.
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// migrations is the registry of every schema version, in order.  Never
+// change a migration that has shipped, add another instead, along with a
+// database at its version in testdata.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create contacts, change log and counters",
+		Up: []string{
+			`CREATE TABLE contacts (
+				id         INTEGER PRIMARY KEY,
+				first_name TEXT    NOT NULL,
+				last_name  TEXT    NOT NULL,
+				email      TEXT    NOT NULL,
+				version    INTEGER NOT NULL,
+				deleted_at INTEGER
+			)`,
+			// Live contacts are listed, paged through and checked for
+			// duplicates in the actor's sort order.
+			`CREATE INDEX contacts_by_name ON contacts (first_name, last_name, email) WHERE deleted_at IS NULL`,
+			`CREATE INDEX contacts_by_deleted_at ON contacts (deleted_at) WHERE deleted_at IS NOT NULL`,
+			`CREATE TABLE changes (
+				seq        INTEGER PRIMARY KEY,
+				contact_id INTEGER NOT NULL
+			)`,
+			// The counters keep IDs and sync tokens from repeating.
+			`CREATE TABLE counters (
+				name  TEXT    PRIMARY KEY,
+				value INTEGER NOT NULL
+			)`,
+			`INSERT INTO counters (name, value) VALUES ('contact_id', 0), ('change_seq', 0), ('change_log_start', 0)`,
+		},
+		Down: []string{
+			`DROP TABLE counters`,
+			`DROP TABLE changes`,
+			`DROP TABLE contacts`,
+		},
+	}, {
+		Version: 2,
+		Name:    "scope contacts, changes and counters to address books",
+		// SQLite cannot change a primary key, so each table is rebuilt with
+		// the book in its key and the existing rows moved to the default
+		// book.
+		Up: []string{
+			`CREATE TABLE contacts_v2 (
+				book       TEXT    NOT NULL,
+				id         INTEGER NOT NULL,
+				first_name TEXT    NOT NULL,
+				last_name  TEXT    NOT NULL,
+				email      TEXT    NOT NULL,
+				version    INTEGER NOT NULL,
+				deleted_at INTEGER,
+				PRIMARY KEY (book, id)
+			)`,
+			`INSERT INTO contacts_v2 SELECT 'default', id, first_name, last_name, email, version, deleted_at FROM contacts`,
+			`DROP TABLE contacts`,
+			`ALTER TABLE contacts_v2 RENAME TO contacts`,
+			`CREATE INDEX contacts_by_name ON contacts (book, first_name, last_name, email) WHERE deleted_at IS NULL`,
+			`CREATE INDEX contacts_by_deleted_at ON contacts (deleted_at) WHERE deleted_at IS NOT NULL`,
+			`CREATE TABLE changes_v2 (
+				book       TEXT    NOT NULL,
+				seq        INTEGER NOT NULL,
+				contact_id INTEGER NOT NULL,
+				PRIMARY KEY (book, seq)
+			)`,
+			`INSERT INTO changes_v2 SELECT 'default', seq, contact_id FROM changes`,
+			`DROP TABLE changes`,
+			`ALTER TABLE changes_v2 RENAME TO changes`,
+			`CREATE TABLE counters_v2 (
+				book  TEXT    NOT NULL,
+				name  TEXT    NOT NULL,
+				value INTEGER NOT NULL,
+				PRIMARY KEY (book, name)
+			)`,
+			`INSERT INTO counters_v2 SELECT 'default', name, value FROM counters`,
+			`DROP TABLE counters`,
+			`ALTER TABLE counters_v2 RENAME TO counters`,
+		},
+		// Going back keeps only the default book; the others are lost.
+		Down: []string{
+			`CREATE TABLE contacts_v1 (
+				id         INTEGER PRIMARY KEY,
+				first_name TEXT    NOT NULL,
+				last_name  TEXT    NOT NULL,
+				email      TEXT    NOT NULL,
+				version    INTEGER NOT NULL,
+				deleted_at INTEGER
+			)`,
+			`INSERT INTO contacts_v1 SELECT id, first_name, last_name, email, version, deleted_at FROM contacts WHERE book = 'default'`,
+			`DROP TABLE contacts`,
+			`ALTER TABLE contacts_v1 RENAME TO contacts`,
+			`CREATE INDEX contacts_by_name ON contacts (first_name, last_name, email) WHERE deleted_at IS NULL`,
+			`CREATE INDEX contacts_by_deleted_at ON contacts (deleted_at) WHERE deleted_at IS NOT NULL`,
+			`CREATE TABLE changes_v1 (
+				seq        INTEGER PRIMARY KEY,
+				contact_id INTEGER NOT NULL
+			)`,
+			`INSERT INTO changes_v1 SELECT seq, contact_id FROM changes WHERE book = 'default'`,
+			`DROP TABLE changes`,
+			`ALTER TABLE changes_v1 RENAME TO changes`,
+			`CREATE TABLE counters_v1 (
+				name  TEXT    PRIMARY KEY,
+				value INTEGER NOT NULL
+			)`,
+			`INSERT INTO counters_v1 SELECT name, value FROM counters WHERE book = 'default'`,
+			`DROP TABLE counters`,
+			`ALTER TABLE counters_v1 RENAME TO counters`,
+			// A database that never opened the default book still needs
+			// its counters.
+			`INSERT INTO counters (name, value) SELECT 'contact_id', 0 WHERE NOT EXISTS (SELECT 1 FROM counters WHERE name = 'contact_id')`,
+			`INSERT INTO counters (name, value) SELECT 'change_seq', 0 WHERE NOT EXISTS (SELECT 1 FROM counters WHERE name = 'change_seq')`,
+			`INSERT INTO counters (name, value) SELECT 'change_log_start', 0 WHERE NOT EXISTS (SELECT 1 FROM counters WHERE name = 'change_log_start')`,
+		},
+	}, {
+		Version: 3,
+		Name:    "add owners and shares to contacts",
+		// Existing contacts get no owner, which leaves them open to
+		// everyone as they were.
+		Up: []string{
+			`ALTER TABLE contacts ADD COLUMN owner TEXT NOT NULL DEFAULT ''`,
+			// A share names either a user or a group, the other is NULL.
+			`CREATE TABLE shares (
+				book       TEXT    NOT NULL,
+				contact_id INTEGER NOT NULL,
+				user_name  TEXT,
+				group_name TEXT,
+				access     TEXT    NOT NULL
+			)`,
+			`CREATE INDEX shares_by_contact ON shares (book, contact_id)`,
+		},
+		// Going back opens every contact to everyone again.
+		Down: []string{
+			`DROP TABLE shares`,
+			`ALTER TABLE contacts DROP COLUMN owner`,
+		},
+	},
+}
+
+// MigrationStatus is a migration and whether a database has had it applied.
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+// LatestVersion is the schema version this binary expects.
+func LatestVersion() int {
+	return len(migrations)
+}
+
+// SchemaVersion returns the schema version of db, 0 for an empty database.
+func SchemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		_, err = db.Exec(`INSERT INTO schema_version (version) VALUES (0)`)
+		return 0, err
+	}
+	return version, err
+}
+
+// Status returns the schema version of db and every known migration.
+func Status(db *sql.DB) (int, []MigrationStatus, error) {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return 0, nil, err
+	}
+	result := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		result[i] = MigrationStatus{Migration: m, Applied: m.Version <= version}
+	}
+	return version, result, nil
+}
+
+// Migrate applies every migration db has not had yet.
+func Migrate(db *sql.DB) (from int, to int, err error) {
+	return MigrateTo(db, LatestVersion())
+}
+
+// MigrateTo migrates db up or down to target one version at a time, each in
+// its own transaction, and returns the versions it went from and to.  If a
+// step fails, to is the version the database was left at.
+func MigrateTo(db *sql.DB, target int) (from int, to int, err error) {
+	from, err = SchemaVersion(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > LatestVersion() {
+		return from, from, fmt.Errorf("%w: version %d, supported %d", ErrSchemaTooNew, from, LatestVersion())
+	}
+	if target < 0 || target > LatestVersion() {
+		return from, from, fmt.Errorf("no schema version %d, versions go from 0 to %d", target, LatestVersion())
+	}
+	for to = from; to < target; to++ {
+		err = migrateStep(db, migrations[to].Up, to+1)
+		if err != nil {
+			return from, to, fmt.Errorf("migrating up to version %d: %w", to+1, err)
+		}
+	}
+	for ; to > target; to-- {
+		err = migrateStep(db, migrations[to-1].Down, to-1)
+		if err != nil {
+			return from, to, fmt.Errorf("migrating down to version %d: %w", to-1, err)
+		}
+	}
+	return from, to, nil
+}
+
+func migrateStep(db *sql.DB, statements []string, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`UPDATE schema_version SET version = ?`, version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,289 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+)
+
+// openTestDB opens an empty database that is closed when the test ends.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := OpenDB("sqlite", filepath.Join(t.TempDir(), "contacts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// loadFixture returns a database loaded from testdata/v<version>.sql, which
+// holds a database as the migrations up to version left it, with contacts
+// in it.
+func loadFixture(t *testing.T, version int) *sql.DB {
+	t.Helper()
+	dump, err := os.ReadFile(fmt.Sprintf("testdata/v%d.sql", version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t)
+	for _, stmt := range strings.Split(string(dump), ";\n") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("loading v%d: %v\n%s", version, err, stmt)
+		}
+	}
+	return db
+}
+
+// migratedDB returns an empty database migrated up to version.
+func migratedDB(t *testing.T, version int) *sql.DB {
+	t.Helper()
+	db := openTestDB(t)
+	if _, _, err := MigrateTo(db, version); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// schemaOf lists the tables and indexes of db as SQLite records them, but
+// for the quotes SQLite puts around the name of a renamed table.
+func schemaOf(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query(`SELECT type || ' ' || name || ': ' || replace(sql, 'CREATE TABLE "' || name || '"', 'CREATE TABLE ' || name)
+		FROM sqlite_master WHERE sql IS NOT NULL ORDER BY type, name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var schema []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		schema = append(schema, s)
+	}
+	return schema
+}
+
+// rowsOf lists every row of every table in db.
+func rowsOf(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	var tables []string
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	var result []string
+	for _, table := range tables {
+		rows, err := db.Query(`SELECT * FROM ` + table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			values := make([]any, len(columns))
+			pointers := make([]any, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err := rows.Scan(pointers...); err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, fmt.Sprintf("%s %q", table, values))
+		}
+		rows.Close()
+	}
+	slices.Sort(result)
+	return result
+}
+
+// bookContents is what a book of a migrated fixture holds, as
+// "first last #id vversion owner" for each contact.
+type bookContents struct {
+	contacts []string
+	trash    []string
+	shares   map[int][]appinterface.Share
+}
+
+var fixtureBooks = map[int]map[string]bookContents{
+	1: {
+		"default": {contacts: []string{"Ada Lovelace #1 v2 ", "Alan Turing #3 v1 "}, trash: []string{"Grace Hopper #2 v1 "}},
+		"work":    {},
+	},
+	2: {
+		"default": {contacts: []string{"Ada Lovelace #1 v2 ", "Alan Turing #3 v1 "}, trash: []string{"Grace Hopper #2 v1 "}},
+		"work":    {contacts: []string{"Linus Torvalds #1 v1 "}},
+	},
+	3: {
+		"default": {
+			contacts: []string{"Ada Lovelace #1 v2 ", "Alan Turing #3 v1 alice"},
+			trash:    []string{"Grace Hopper #2 v1 "},
+			shares: map[int][]appinterface.Share{3: {
+				{User: "bob", Access: appinterface.AccessRead},
+				{Group: "staff", Access: appinterface.AccessWrite},
+			}},
+		},
+		"work": {contacts: []string{"Linus Torvalds #1 v1 "}},
+	},
+}
+
+func describe(c appinterface.Contact) string {
+	return fmt.Sprintf("%s %s #%d v%d %s", c.FirstName, c.LastName, c.ID, c.Version, c.Owner)
+}
+
+// checkBooks checks that the books of a fixture migrated to the latest
+// schema hold what the fixture did, and go on counting IDs and sync tokens
+// where it left off.
+func checkBooks(t *testing.T, db *sql.DB, want map[string]bookContents) {
+	t.Helper()
+	ctx := context.Background()
+	books, err := NewBooks(db, []string{"default", "work"}, 100*365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		books.Stop()
+		books.Wait()
+	}()
+	for name, want := range want {
+		book, err := books.Book(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contacts, err := book.GetContacts(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range contacts {
+			got = append(got, describe(c))
+			if !slices.Equal(c.Shares, want.shares[c.ID]) {
+				t.Errorf("%s: shares of %d are %+v, want %+v", name, c.ID, c.Shares, want.shares[c.ID])
+			}
+		}
+		if !slices.Equal(got, want.contacts) {
+			t.Errorf("%s: contacts %q, want %q", name, got, want.contacts)
+		}
+		trash, err := book.GetTrash(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = nil
+		for _, c := range trash {
+			got = append(got, describe(c.Contact))
+		}
+		if !slices.Equal(got, want.trash) {
+			t.Errorf("%s: trash %q, want %q", name, got, want.trash)
+		}
+		if name != "default" {
+			continue
+		}
+		// Grace was deleted by change 5, so a client synced up to change 4
+		// learns she is gone.
+		changes, err := book.Changes(ctx, 4)
+		if err != nil || changes.Token != 5 || !slices.Equal(changes.Deleted, []int{2}) || len(changes.Updated) != 0 {
+			t.Errorf("changes since 4: %+v %v", changes, err)
+		}
+		if err := book.AddContact(ctx, "Charles", "Babbage", "charles@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		added, err := book.ContactDetails(ctx, 4)
+		if err != nil || added.FirstName != "Charles" {
+			t.Errorf("the next contact is not number 4: %+v %v", added, err)
+		}
+	}
+}
+
+// TestMigrateFixtures migrates a database of every schema version to the
+// latest one and back, and checks that both ends have the schema the
+// migrations make and the data the database started with.
+func TestMigrateFixtures(t *testing.T) {
+	latest := schemaOf(t, migratedDB(t, LatestVersion()))
+	for version := 1; version <= LatestVersion(); version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			original := loadFixture(t, version)
+			// A fixture that no longer matches its version means a
+			// migration that shipped was changed.
+			if got, want := schemaOf(t, original), schemaOf(t, migratedDB(t, version)); !slices.Equal(got, want) {
+				t.Fatalf("the fixture's schema is not what migrating to %d makes:\n got %q\nwant %q", version, got, want)
+			}
+
+			db := loadFixture(t, version)
+			from, to, err := Migrate(db)
+			if err != nil || from != version || to != LatestVersion() {
+				t.Fatalf("migrating up: from %d to %d: %v", from, to, err)
+			}
+			if got := schemaOf(t, db); !slices.Equal(got, latest) {
+				t.Errorf("schema after migrating up:\n got %q\nwant %q", got, latest)
+			}
+			from, to, err = MigrateTo(db, version)
+			if err != nil || from != LatestVersion() || to != version {
+				t.Fatalf("migrating down: from %d to %d: %v", from, to, err)
+			}
+			if got, want := schemaOf(t, db), schemaOf(t, original); !slices.Equal(got, want) {
+				t.Errorf("schema after migrating back down:\n got %q\nwant %q", got, want)
+			}
+			if got, want := rowsOf(t, db), rowsOf(t, original); !slices.Equal(got, want) {
+				t.Errorf("rows after migrating up and back down:\n got %q\nwant %q", got, want)
+			}
+
+			if _, _, err := Migrate(db); err != nil {
+				t.Fatal(err)
+			}
+			checkBooks(t, db, fixtureBooks[version])
+		})
+	}
+}
+
+func TestMigrateDownToEmpty(t *testing.T) {
+	db := loadFixture(t, LatestVersion())
+	if _, to, err := MigrateTo(db, 0); err != nil || to != 0 {
+		t.Fatalf("migrating down to 0: %d %v", to, err)
+	}
+	if got := schemaOf(t, db); len(got) != 1 || !strings.HasPrefix(got[0], "table schema_version:") {
+		t.Errorf("schema left behind: %q", got)
+	}
+	if _, _, err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := schemaOf(t, db), schemaOf(t, migratedDB(t, LatestVersion())); !slices.Equal(got, want) {
+		t.Errorf("schema after migrating up again:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	db := migratedDB(t, LatestVersion())
+	if _, err := db.Exec(`UPDATE schema_version SET version = ?`, LatestVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Migrate(db); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("migrating a newer schema: %v", err)
+	}
+	if _, err := NewBooks(db, []string{"default"}, time.Hour); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("opening a newer schema: %v", err)
+	}
+}
@@ -0,0 +1,972 @@
+// Package sqlstore implements appinterface.App on top of database/sql.  The
+// SQL is kept to what SQLite understands, and SQLite, through a pure Go
+// driver, is the default.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"example-api-server/appinterface"
+
+	_ "modernc.org/sqlite"
+)
+
+// maxChangeLog is how many changes are remembered for sync tokens, as in the
+// in-memory app.
+const maxChangeLog = 10000
+
+// purgeInterval is how often the trash is checked for contacts that have
+// outlived the retention period.  Tests shorten it.
+var purgeInterval = time.Minute
+
+const contactColumns = `id, first_name, last_name, email, version, owner`
+
+const nameOrder = `ORDER BY first_name, last_name, email, id`
+
+// querier is what *sql.DB and *sql.Tx have in common.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// bookTx scopes the queries of the helpers below to one book.
+type bookTx struct {
+	querier
+	book string
+}
+
+func (s *store) on(q querier) bookTx {
+	return bookTx{querier: q, book: s.book}
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// books owns the database and the purge goroutine shared by its books.
+type books struct {
+	db             *sql.DB
+	names          []string
+	byName         map[string]*store
+	trashRetention time.Duration
+	stop           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// store is one address book.  Every query it runs is scoped to the book, so
+// the contacts, IDs and change log of one book never mix with another's.
+type store struct {
+	db   *sql.DB
+	book string
+}
+
+// OpenDB opens a database.  It is limited to a single connection, which
+// serialises transactions the way the actor serialises commands and keeps
+// SQLite from ever reporting that it is busy.
+func OpenDB(driver string, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// NewBooks returns the address books names backed by db, which must
+// already be migrated to the latest schema version.  The books own db and
+// close it when stopped.
+func NewBooks(db *sql.DB, names []string, trashRetention time.Duration) (appinterface.Books, error) {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version > LatestVersion() {
+		return nil, fmt.Errorf("%w: version %d, supported %d", ErrSchemaTooNew, version, LatestVersion())
+	}
+	if version < LatestVersion() {
+		return nil, fmt.Errorf("database schema is at version %d, expected %d", version, LatestVersion())
+	}
+	b := &books{
+		db:             db,
+		names:          names,
+		byName:         map[string]*store{},
+		trashRetention: trashRetention,
+		stop:           make(chan struct{}),
+	}
+	for _, name := range names {
+		// A book's counters are created the first time it is opened.
+		for _, counter := range []string{"contact_id", "change_seq", "change_log_start"} {
+			_, err = db.Exec(`INSERT INTO counters (book, name, value) VALUES (?, ?, 0) ON CONFLICT DO NOTHING`, name, counter)
+			if err != nil {
+				return nil, err
+			}
+		}
+		b.byName[name] = &store{db: db, book: name}
+	}
+	b.wg.Add(1)
+	go b.purgeTrash()
+	return b, nil
+}
+
+func (b *books) Book(name string) (appinterface.App, error) {
+	s, ok := b.byName[name]
+	if !ok {
+		return nil, appinterface.ErrNoSuchBook
+	}
+	return s, nil
+}
+
+func (b *books) Names() []string {
+	return slices.Clone(b.names)
+}
+
+func (b *books) purgeTrash() {
+	defer b.wg.Done()
+	defer b.db.Close()
+	purge := time.NewTicker(purgeInterval)
+	defer purge.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case now := <-purge.C:
+			// A failed purge is simply retried on the next tick.
+			_ = b.purge(now.Add(-b.trashRetention))
+		}
+	}
+}
+
+// purge deletes the contacts trashed before cutoff, and their shares.
+func (b *books) purge(cutoff time.Time) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM shares WHERE EXISTS (SELECT 1 FROM contacts
+		WHERE contacts.book = shares.book AND contacts.id = shares.contact_id
+		AND contacts.deleted_at IS NOT NULL AND contacts.deleted_at <= ?)`, cutoff.UnixNano())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM contacts WHERE deleted_at IS NOT NULL AND deleted_at <= ?`, cutoff.UnixNano())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *books) Stop() {
+	close(b.stop)
+}
+
+func (b *books) Wait() {
+	b.wg.Wait()
+}
+
+func scanContact(row scanner) (appinterface.Contact, error) {
+	var c appinterface.Contact
+	err := row.Scan(&c.ID, &c.FirstName, &c.LastName, &c.Email, &c.Version, &c.Owner)
+	return c, err
+}
+
+// principalOf returns the principal ctx carries, or nil if it carries none.
+func principalOf(ctx context.Context) *appinterface.Principal {
+	if p, ok := appinterface.PrincipalFrom(ctx); ok {
+		return &p
+	}
+	return nil
+}
+
+func canRead(p *appinterface.Principal, c appinterface.Contact) bool {
+	return p == nil || p.CanRead(c)
+}
+
+// readable returns a condition, and its arguments, that only lets through
+// the contacts p may see.  It is empty for a p that may see every contact.
+func readable(p *appinterface.Principal) (string, []any) {
+	if p == nil || p.All {
+		return "", nil
+	}
+	cond := ` AND (contacts.owner = '' OR contacts.owner = ? OR EXISTS (SELECT 1 FROM shares
+		WHERE shares.book = contacts.book AND shares.contact_id = contacts.id AND (shares.user_name = ?`
+	args := []any{p.Name, p.Name}
+	if len(p.Groups) > 0 {
+		cond += ` OR shares.group_name IN (?` + strings.Repeat(`, ?`, len(p.Groups)-1) + `)`
+		for _, g := range p.Groups {
+			args = append(args, g)
+		}
+	}
+	return cond + `)))`, args
+}
+
+// shareMap returns the shares of the contacts ids, by contact.  For more
+// than one contact it reads the shares of the whole book, which is cheaper
+// than naming every contact.
+func shareMap(q bookTx, ids []int) (map[int][]appinterface.Share, error) {
+	result := map[int][]appinterface.Share{}
+	if len(ids) == 0 {
+		return result, nil
+	}
+	query := `SELECT contact_id, user_name, group_name, access FROM shares WHERE book = ?`
+	args := []any{q.book}
+	if len(ids) == 1 {
+		query += ` AND contact_id = ?`
+		args = append(args, ids[0])
+	}
+	rows, err := q.Query(query+` ORDER BY rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var user, group sql.NullString
+		var share appinterface.Share
+		err = rows.Scan(&id, &user, &group, &share.Access)
+		if err != nil {
+			return nil, err
+		}
+		share.User, share.Group = user.String, group.String
+		result[id] = append(result[id], share)
+	}
+	return result, rows.Err()
+}
+
+// withShares fills in the shares of contacts.
+func withShares(q bookTx, contacts []appinterface.Contact) ([]appinterface.Contact, error) {
+	ids := make([]int, len(contacts))
+	for i, c := range contacts {
+		ids[i] = c.ID
+	}
+	shares, err := shareMap(q, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range contacts {
+		contacts[i].Shares = shares[contacts[i].ID]
+	}
+	return contacts, nil
+}
+
+func queryContacts(q bookTx, query string, args ...any) ([]appinterface.Contact, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	result := []appinterface.Contact{}
+	for rows.Next() {
+		c, err := scanContact(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return withShares(q, result)
+}
+
+// oneContact returns the contact a query selects, with its shares, or
+// io.EOF if it selects none.
+func oneContact(q bookTx, query string, args ...any) (appinterface.Contact, error) {
+	c, err := scanContact(q.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return c, io.EOF
+	}
+	if err != nil {
+		return c, err
+	}
+	shares, err := shareMap(q, []int{c.ID})
+	c.Shares = shares[c.ID]
+	return c, err
+}
+
+// liveContact returns a contact that is not in the trash, or io.EOF.
+func liveContact(q bookTx, id int) (appinterface.Contact, error) {
+	return oneContact(q, `SELECT `+contactColumns+` FROM contacts WHERE book = ? AND id = ? AND deleted_at IS NULL`, q.book, id)
+}
+
+// writable returns the live contact id for p to change.  Contacts p may not
+// see are not found, so their IDs cannot be probed.
+func writable(q bookTx, p *appinterface.Principal, id int) (appinterface.Contact, error) {
+	c, err := liveContact(q, id)
+	if err != nil {
+		return c, err
+	}
+	if !canRead(p, c) {
+		return appinterface.Contact{}, io.EOF
+	}
+	if p != nil && !p.CanWrite(c) {
+		return c, appinterface.ErrReadOnly
+	}
+	return c, nil
+}
+
+// liveDuplicate returns the live contact with the same content as c, if
+// there is one.
+func liveDuplicate(q bookTx, c appinterface.Contact) (appinterface.Contact, bool, error) {
+	d, err := oneContact(q, `SELECT `+contactColumns+` FROM contacts
+		WHERE book = ? AND deleted_at IS NULL AND first_name = ? AND last_name = ? AND email = ?`,
+		q.book, c.FirstName, c.LastName, c.Email)
+	if err == io.EOF {
+		return d, false, nil
+	}
+	return d, err == nil, err
+}
+
+func counter(q bookTx, name string) (int, error) {
+	var v int
+	err := q.QueryRow(`SELECT value FROM counters WHERE book = ? AND name = ?`, q.book, name).Scan(&v)
+	return v, err
+}
+
+func setCounter(q bookTx, name string, value int) error {
+	_, err := q.Exec(`UPDATE counters SET value = ? WHERE book = ? AND name = ?`, value, q.book, name)
+	return err
+}
+
+func nextCounter(q bookTx, name string) (int, error) {
+	_, err := q.Exec(`UPDATE counters SET value = value + 1 WHERE book = ? AND name = ?`, q.book, name)
+	if err != nil {
+		return 0, err
+	}
+	return counter(q, name)
+}
+
+// changed records a change to a contact in the change log, forgetting the
+// oldest change once the log is full.
+func changed(q bookTx, id int) error {
+	seq, err := nextCounter(q, "change_seq")
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`INSERT INTO changes (book, seq, contact_id) VALUES (?, ?, ?)`, q.book, seq, id)
+	if err != nil {
+		return err
+	}
+	start, err := counter(q, "change_log_start")
+	if err != nil {
+		return err
+	}
+	if seq-maxChangeLog <= start {
+		return nil
+	}
+	_, err = q.Exec(`DELETE FROM changes WHERE book = ? AND seq <= ?`, q.book, seq-maxChangeLog)
+	if err != nil {
+		return err
+	}
+	return setCounter(q, "change_log_start", seq-maxChangeLog)
+}
+
+// versionMatches implements the If-Match check: an empty list matches any
+// version.
+func versionMatches(version int, ifMatch []int) bool {
+	return len(ifMatch) == 0 || slices.Contains(ifMatch, version)
+}
+
+// addContact adds a contact owned by p.
+func addContact(q bookTx, p *appinterface.Principal, firstName string, lastName string, email string) (appinterface.Contact, error) {
+	contact := appinterface.Contact{
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     email,
+	}
+	if p != nil {
+		contact.Owner = p.Name
+	}
+	if err := contact.Validate(); err != nil {
+		return contact, err
+	}
+	_, found, err := liveDuplicate(q, contact)
+	if err != nil {
+		return contact, err
+	}
+	if found {
+		return contact, appinterface.ErrDuplicateContact
+	}
+	contact.ID, err = nextCounter(q, "contact_id")
+	if err != nil {
+		return contact, err
+	}
+	contact.Version = 1
+	_, err = q.Exec(`INSERT INTO contacts (book, `+contactColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		q.book, contact.ID, contact.FirstName, contact.LastName, contact.Email, contact.Version, contact.Owner)
+	if err != nil {
+		return contact, err
+	}
+	return contact, changed(q, contact.ID)
+}
+
+// writeContact stores new content for a live contact, as p changed it, and
+// bumps its version.  Only ShareContact changes who a contact belongs to or
+// is shared with.
+func writeContact(q bookTx, p *appinterface.Principal, current appinterface.Contact, updated appinterface.Contact) (appinterface.Contact, error) {
+	updated.ID = current.ID
+	updated.Owner = current.Owner
+	updated.Shares = current.Shares
+	if p != nil && p.KeepEmails {
+		updated.Email = current.Email
+	}
+	updated.Version = current.Version + 1
+	if err := updated.Validate(); err != nil {
+		return updated, err
+	}
+	_, err := q.Exec(`UPDATE contacts SET first_name = ?, last_name = ?, email = ?, version = ? WHERE book = ? AND id = ?`,
+		updated.FirstName, updated.LastName, updated.Email, updated.Version, q.book, updated.ID)
+	if err != nil {
+		return updated, err
+	}
+	return updated, changed(q, updated.ID)
+}
+
+func updateContact(q bookTx, p *appinterface.Principal, id int, ifMatch []int, firstName string, lastName string, email string) (appinterface.Contact, error) {
+	current, err := writable(q, p, id)
+	if err != nil {
+		return current, err
+	}
+	if !versionMatches(current.Version, ifMatch) {
+		return current, appinterface.ErrVersionMismatch
+	}
+	return writeContact(q, p, current, appinterface.Contact{
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     email,
+	})
+}
+
+func deleteContact(q bookTx, p *appinterface.Principal, id int, ifMatch []int) (appinterface.Contact, error) {
+	current, err := writable(q, p, id)
+	if err != nil {
+		return current, err
+	}
+	if !versionMatches(current.Version, ifMatch) {
+		return current, appinterface.ErrVersionMismatch
+	}
+	_, err = q.Exec(`UPDATE contacts SET deleted_at = ? WHERE book = ? AND id = ?`, time.Now().UnixNano(), q.book, id)
+	if err != nil {
+		return current, err
+	}
+	return current, changed(q, id)
+}
+
+// inTx runs fn in a transaction and commits it if fn succeeds.
+func (s *store) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *store) AddContact(ctx context.Context, firstName string, lastName string, email string) error {
+	err := s.inTx(func(tx *sql.Tx) error {
+		_, err := addContact(s.on(tx), principalOf(ctx), firstName, lastName, email)
+		return err
+	})
+	// Like the actor, which never answers an add, invalid and duplicate
+	// contacts are dropped quietly.
+	if errors.Is(err, appinterface.ErrInvalidContact) || err == appinterface.ErrDuplicateContact {
+		return nil
+	}
+	return err
+}
+
+// liveContacts returns the live contacts p may see, in name order.
+func liveContacts(q bookTx, p *appinterface.Principal) ([]appinterface.Contact, error) {
+	cond, args := readable(p)
+	return queryContacts(q, `SELECT `+contactColumns+` FROM contacts WHERE book = ? AND deleted_at IS NULL`+cond+` `+nameOrder,
+		append([]any{q.book}, args...)...)
+}
+
+func (s *store) GetContacts(ctx context.Context) (result []appinterface.Contact, err error) {
+	err = s.inTx(func(tx *sql.Tx) error {
+		result, err = liveContacts(s.on(tx), principalOf(ctx))
+		return err
+	})
+	return result, err
+}
+
+func (s *store) ContactsAfter(ctx context.Context, after appinterface.Contact, limit int) (result []appinterface.Contact, err error) {
+	cond, args := readable(principalOf(ctx))
+	err = s.inTx(func(tx *sql.Tx) error {
+		result, err = queryContacts(s.on(tx), `SELECT `+contactColumns+` FROM contacts
+			WHERE book = ? AND deleted_at IS NULL AND (first_name, last_name, email) > (?, ?, ?)`+cond+` `+nameOrder+` LIMIT ?`,
+			slices.Concat([]any{s.book, after.FirstName, after.LastName, after.Email}, args, []any{max(limit, 0)})...)
+		return err
+	})
+	return result, err
+}
+
+func (s *store) ContactDetails(ctx context.Context, id int) (c appinterface.Contact, err error) {
+	err = s.inTx(func(tx *sql.Tx) error {
+		c, err = liveContact(s.on(tx), id)
+		if err == nil && !canRead(principalOf(ctx), c) {
+			c, err = appinterface.Contact{}, io.EOF
+		}
+		return err
+	})
+	return c, err
+}
+
+func (s *store) DeleteContact(ctx context.Context, id int, ifMatch []int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := deleteContact(s.on(tx), principalOf(ctx), id, ifMatch)
+		return err
+	})
+}
+
+func (s *store) UpdateContact(ctx context.Context, id int, ifMatch []int, firstName string, lastName string, email string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := updateContact(s.on(tx), principalOf(ctx), id, ifMatch, firstName, lastName, email)
+		return err
+	})
+}
+
+// PatchContact runs patch inside the transaction that writes its result, so
+// nothing can change the contact in between.
+func (s *store) PatchContact(ctx context.Context, id int, ifMatch []int, patch appinterface.ContactPatch) (result appinterface.Contact, err error) {
+	p := principalOf(ctx)
+	err = s.inTx(func(tx *sql.Tx) error {
+		current, err := writable(s.on(tx), p, id)
+		if err != nil {
+			return err
+		}
+		if !versionMatches(current.Version, ifMatch) {
+			return appinterface.ErrVersionMismatch
+		}
+		patched, err := patch(current)
+		if err != nil {
+			return err
+		}
+		result, err = writeContact(s.on(tx), p, current, patched)
+		return err
+	})
+	return result, err
+}
+
+func (s *store) ShareContact(ctx context.Context, id int, ifMatch []int, shares []appinterface.Share) (result appinterface.Contact, err error) {
+	p := principalOf(ctx)
+	err = s.inTx(func(tx *sql.Tx) error {
+		q := s.on(tx)
+		current, err := liveContact(q, id)
+		if err != nil {
+			return err
+		}
+		if !canRead(p, current) {
+			return io.EOF
+		}
+		if p != nil && !p.Owns(current) {
+			return appinterface.ErrNotOwner
+		}
+		if !versionMatches(current.Version, ifMatch) {
+			return appinterface.ErrVersionMismatch
+		}
+		_, err = tx.Exec(`DELETE FROM shares WHERE book = ? AND contact_id = ?`, s.book, id)
+		if err != nil {
+			return err
+		}
+		for _, share := range shares {
+			err = share.Validate()
+			if err == nil {
+				err = insertShare(q, id, share)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		result = current
+		result.Shares = slices.Clone(shares)
+		result.Version++
+		_, err = tx.Exec(`UPDATE contacts SET version = ? WHERE book = ? AND id = ?`, result.Version, s.book, id)
+		if err != nil {
+			return err
+		}
+		return changed(q, id)
+	})
+	return result, err
+}
+
+func insertShare(q bookTx, id int, share appinterface.Share) error {
+	var user, group sql.NullString
+	user.String, user.Valid = share.User, share.User != ""
+	group.String, group.Valid = share.Group, share.Group != ""
+	_, err := q.Exec(`INSERT INTO shares (book, contact_id, user_name, group_name, access) VALUES (?, ?, ?, ?, ?)`,
+		q.book, id, user, group, share.Access)
+	return err
+}
+
+func batchOperation(q bookTx, p *appinterface.Principal, op appinterface.BatchOperation) (appinterface.Contact, error) {
+	var ifMatch []int
+	if op.Version > 0 {
+		ifMatch = []int{op.Version}
+	}
+	switch op.Op {
+	case appinterface.BatchCreate:
+		return addContact(q, p, op.FirstName, op.LastName, op.Email)
+	case appinterface.BatchUpdate:
+		c, err := updateContact(q, p, op.ID, ifMatch, op.FirstName, op.LastName, op.Email)
+		if err != nil {
+			return op.Contact, err
+		}
+		return c, nil
+	case appinterface.BatchDelete:
+		c, err := deleteContact(q, p, op.ID, ifMatch)
+		if err == io.EOF || err == appinterface.ErrReadOnly {
+			return op.Contact, err
+		}
+		return c, err
+	}
+	return op.Contact, appinterface.ErrUnknownBatchOperation
+}
+
+// Batch applies every operation in one transaction, or none of them.
+func (s *store) Batch(ctx context.Context, ops []appinterface.BatchOperation) ([]appinterface.BatchResult, error) {
+	p := principalOf(ctx)
+	results := make([]appinterface.BatchResult, len(ops))
+	failed := -1
+	err := s.inTx(func(tx *sql.Tx) error {
+		for i, op := range ops {
+			contact, err := batchOperation(s.on(tx), p, op)
+			if err != nil {
+				failed = i
+				return err
+			}
+			results[i] = appinterface.BatchResult{Contact: contact}
+		}
+		return nil
+	})
+	if err == nil {
+		return results, nil
+	}
+	if failed < 0 {
+		return nil, err
+	}
+	for j := range results {
+		results[j] = appinterface.BatchResult{Err: appinterface.ErrBatchRolledBack}
+	}
+	results[failed] = appinterface.BatchResult{Contact: ops[failed].Contact, Err: err}
+	return results, err
+}
+
+// importContact creates, updates or skips a single imported contact, with
+// the same rules as the in-memory app.  Only database errors are returned;
+// everything else is reported in the result.  imported holds the IDs of the
+// contacts the import has created so far, which no later contact names: they
+// are only the IDs this book happened to give them.
+func importContact(q bookTx, p *appinterface.Principal, contact appinterface.Contact, imported map[int]bool) (appinterface.ImportResult, error) {
+	failed := func(err error) (appinterface.ImportResult, error) {
+		if err == io.EOF || err == appinterface.ErrDuplicateContact || err == appinterface.ErrReadOnly || errors.Is(err, appinterface.ErrInvalidContact) {
+			return appinterface.ImportResult{Action: appinterface.ImportFailed, Contact: contact, Err: err}, nil
+		}
+		return appinterface.ImportResult{}, err
+	}
+	if err := contact.Validate(); err != nil {
+		return failed(err)
+	}
+	existing, found, err := liveDuplicate(q, contact)
+	if err != nil {
+		return failed(err)
+	}
+	if found && !canRead(p, existing) {
+		return failed(appinterface.ErrDuplicateContact)
+	}
+	if found {
+		return appinterface.ImportResult{Action: appinterface.ImportSkipped, Contact: existing}, nil
+	}
+	current, err := appinterface.Contact{}, io.EOF
+	if contact.ID != 0 && !imported[contact.ID] {
+		current, err = writable(q, p, contact.ID)
+	}
+	// A contact whose ID names none here, as one exported from another
+	// instance does, is new.
+	if err == io.EOF {
+		created, err := addContact(q, p, contact.FirstName, contact.LastName, contact.Email)
+		if err != nil {
+			return failed(err)
+		}
+		imported[created.ID] = true
+		return appinterface.ImportResult{Action: appinterface.ImportCreated, Contact: created}, nil
+	}
+	if err != nil {
+		return failed(err)
+	}
+	updated, err := writeContact(q, p, current, appinterface.Contact{
+		FirstName: contact.FirstName,
+		LastName:  contact.LastName,
+		Email:     contact.Email,
+	})
+	if err != nil {
+		return failed(err)
+	}
+	return appinterface.ImportResult{Action: appinterface.ImportUpdated, Contact: updated}, nil
+}
+
+func (s *store) Import(ctx context.Context, contacts []appinterface.Contact, dryRun bool) ([]appinterface.ImportResult, error) {
+	p := principalOf(ctx)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	results := make([]appinterface.ImportResult, len(contacts))
+	imported := map[int]bool{}
+	for i, c := range contacts {
+		results[i], err = importContact(s.on(tx), p, c, imported)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dryRun {
+		return results, nil
+	}
+	return results, tx.Commit()
+}
+
+// Changes reports contacts the caller may no longer see as deleted, so a
+// contact unshared from it leaves its clients too.
+func (s *store) Changes(ctx context.Context, since int) (result appinterface.ChangeSet, err error) {
+	p := principalOf(ctx)
+	err = s.inTx(func(tx *sql.Tx) error {
+		q := s.on(tx)
+		result.Token, err = counter(q, "change_seq")
+		if err != nil {
+			return err
+		}
+		if since == 0 {
+			result.Updated, err = liveContacts(q, p)
+			return err
+		}
+		start, err := counter(q, "change_log_start")
+		if err != nil {
+			return err
+		}
+		if since < start || since > result.Token {
+			return appinterface.ErrSyncTokenExpired
+		}
+		rows, err := tx.Query(`SELECT contact_id FROM changes WHERE book = ? AND seq > ? GROUP BY contact_id ORDER BY MIN(seq)`, s.book, since)
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			err = rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			c, err := liveContact(q, id)
+			if err == nil && !canRead(p, c) {
+				err = io.EOF
+			}
+			switch err {
+			case nil:
+				result.Updated = append(result.Updated, c)
+			case io.EOF:
+				result.Deleted = append(result.Deleted, id)
+			default:
+				return err
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// queryTrash returns the trashed contacts p may see.
+func queryTrash(q bookTx, p *appinterface.Principal) ([]appinterface.TrashedContact, error) {
+	cond, args := readable(p)
+	rows, err := q.Query(`SELECT `+contactColumns+`, deleted_at FROM contacts
+		WHERE book = ? AND deleted_at IS NOT NULL`+cond+` ORDER BY deleted_at, id`, append([]any{q.book}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	result := []appinterface.TrashedContact{}
+	var ids []int
+	for rows.Next() {
+		var t appinterface.TrashedContact
+		var deletedAt int64
+		err = rows.Scan(&t.ID, &t.FirstName, &t.LastName, &t.Email, &t.Version, &t.Owner, &deletedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t.DeletedAt = time.Unix(0, deletedAt)
+		result = append(result, t)
+		ids = append(ids, t.ID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	shares, err := shareMap(q, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		result[i].Shares = shares[result[i].ID]
+	}
+	return result, nil
+}
+
+func (s *store) GetTrash(ctx context.Context) (result []appinterface.TrashedContact, err error) {
+	err = s.inTx(func(tx *sql.Tx) error {
+		result, err = queryTrash(s.on(tx), principalOf(ctx))
+		return err
+	})
+	return result, err
+}
+
+func (s *store) RestoreContact(ctx context.Context, id int) error {
+	p := principalOf(ctx)
+	return s.inTx(func(tx *sql.Tx) error {
+		q := s.on(tx)
+		c, err := oneContact(q, `SELECT `+contactColumns+` FROM contacts WHERE book = ? AND id = ? AND deleted_at IS NOT NULL`, s.book, id)
+		if err != nil {
+			return err
+		}
+		if !canRead(p, c) {
+			return io.EOF
+		}
+		if p != nil && !p.CanWrite(c) {
+			return appinterface.ErrReadOnly
+		}
+		_, found, err := liveDuplicate(q, c)
+		if err != nil {
+			return err
+		}
+		if found {
+			return appinterface.ErrDuplicateContact
+		}
+		_, err = tx.Exec(`UPDATE contacts SET deleted_at = NULL, version = version + 1 WHERE book = ? AND id = ?`, s.book, id)
+		if err != nil {
+			return err
+		}
+		return changed(q, id)
+	})
+}
+
+func (s *store) Snapshot() (data appinterface.SnapshotData, err error) {
+	err = s.inTx(func(tx *sql.Tx) error {
+		q := s.on(tx)
+		nextID, err := counter(q, "contact_id")
+		if err != nil {
+			return err
+		}
+		data.NextID = nextID + 1
+		data.ChangeSeq, err = counter(q, "change_seq")
+		if err != nil {
+			return err
+		}
+		data.Contacts, err = liveContacts(q, nil)
+		if err != nil {
+			return err
+		}
+		data.Trash, err = queryTrash(q, nil)
+		return err
+	})
+	return data, err
+}
+
+// Restore loads a snapshot into an empty database.  As with the in-memory
+// app, sync tokens handed out before the restore are no longer accepted.
+func (s *store) Restore(ctx context.Context, data appinterface.SnapshotData) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		q := s.on(tx)
+		var n int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM contacts WHERE book = ?`, s.book).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return appinterface.ErrNotEmpty
+		}
+		lastID, err := counter(q, "contact_id")
+		if err != nil {
+			return err
+		}
+		lastID = max(lastID, data.NextID-1)
+		insert := func(c appinterface.Contact, deletedAt any) error {
+			lastID = max(lastID, c.ID)
+			_, err := tx.Exec(`INSERT INTO contacts (book, `+contactColumns+`, deleted_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				s.book, c.ID, c.FirstName, c.LastName, c.Email, c.Version, c.Owner, deletedAt)
+			if err != nil {
+				return err
+			}
+			for _, share := range c.Shares {
+				err = insertShare(q, c.ID, share)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for _, c := range data.Contacts {
+			err = insert(c, nil)
+			if err != nil {
+				return err
+			}
+		}
+		for _, t := range data.Trash {
+			err = insert(t.Contact, t.DeletedAt.UnixNano())
+			if err != nil {
+				return err
+			}
+		}
+		err = setCounter(q, "contact_id", lastID)
+		if err != nil {
+			return err
+		}
+		seq, err := counter(q, "change_seq")
+		if err != nil {
+			return err
+		}
+		seq = max(seq, data.ChangeSeq) + 1
+		_, err = tx.Exec(`DELETE FROM changes WHERE book = ?`, s.book)
+		if err == nil {
+			err = setCounter(q, "change_seq", seq)
+		}
+		if err == nil {
+			err = setCounter(q, "change_log_start", seq)
+		}
+		return err
+	})
+}
+
+// Stop and Wait do nothing for a single book, the database is shared by all
+// of them and stopped with them.
+func (s *store) Stop() {
+}
+
+func (s *store) Wait() {
+}
@@ -0,0 +1,96 @@
+package sqlstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/appinterface/apptest"
+)
+
+// openStore returns the default book of a new database, whose books are
+// stopped when the test ends.
+func openStore(t *testing.T) appinterface.App {
+	t.Helper()
+	books, err := NewBooks(migratedDB(t, LatestVersion()), []string{appinterface.DefaultBook}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		books.Stop()
+		books.Wait()
+	})
+	a, err := books.Book(appinterface.DefaultBook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestStore(t *testing.T) {
+	apptest.TestApp(t, openStore)
+}
+
+// TestPurgeTrash checks that the trash is emptied of contacts deleted longer
+// ago than the retention period, along with their shares, and only of
+// those.
+func TestPurgeTrash(t *testing.T) {
+	interval := purgeInterval
+	purgeInterval = time.Millisecond
+	t.Cleanup(func() { purgeInterval = interval })
+	ctx := context.Background()
+	db := migratedDB(t, LatestVersion())
+	books, err := NewBooks(db, []string{"kept", "purged"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		books.Stop()
+		books.Wait()
+	})
+	for _, name := range []string{"kept", "purged"} {
+		a, err := books.Book(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.AddContact(ctx, "Ada", "Lovelace", "ada@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.ShareContact(ctx, 1, nil, []appinterface.Share{{User: "grace", Access: appinterface.AccessRead}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.DeleteContact(ctx, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Back-date one deletion past the retention period.
+	if _, err := db.Exec(`UPDATE contacts SET deleted_at = ? WHERE book = 'purged'`, time.Now().Add(-2*time.Hour).UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	count := func(query, book string) int {
+		var n int
+		if err := db.QueryRow(query, book).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for count(`SELECT count(*) FROM contacts WHERE book = ?`, "purged") > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the purge")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := count(`SELECT count(*) FROM shares WHERE book = ?`, "purged"); n != 0 {
+		t.Errorf("%d shares of purged contacts left", n)
+	}
+	for query, want := range map[string]int{
+		`SELECT count(*) FROM contacts WHERE book = ? AND deleted_at IS NOT NULL`: 1,
+		`SELECT count(*) FROM shares WHERE book = ?`:                              1,
+	} {
+		if n := count(query, "kept"); n != want {
+			t.Errorf("%s in the retention period: %d, want %d", query, n, want)
+		}
+	}
+}
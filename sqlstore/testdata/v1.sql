@@ -0,0 +1,33 @@
+-- A database at schema version 1, as migrations 1 to 1 left it, holding
+-- Ada and Alan, and Grace in the trash.
+CREATE TABLE schema_version (version INTEGER NOT NULL);
+CREATE TABLE contacts (
+				id         INTEGER PRIMARY KEY,
+				first_name TEXT    NOT NULL,
+				last_name  TEXT    NOT NULL,
+				email      TEXT    NOT NULL,
+				version    INTEGER NOT NULL,
+				deleted_at INTEGER
+			);
+CREATE INDEX contacts_by_name ON contacts (first_name, last_name, email) WHERE deleted_at IS NULL;
+CREATE INDEX contacts_by_deleted_at ON contacts (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE TABLE changes (
+				seq        INTEGER PRIMARY KEY,
+				contact_id INTEGER NOT NULL
+			);
+CREATE TABLE counters (
+				name  TEXT    PRIMARY KEY,
+				value INTEGER NOT NULL
+			);
+INSERT INTO schema_version VALUES (1);
+INSERT INTO contacts VALUES (1, 'Ada', 'Lovelace', 'ada@example.com', 2, NULL);
+INSERT INTO contacts VALUES (2, 'Grace', 'Hopper', 'grace@example.com', 1, 1767312000000000000);
+INSERT INTO contacts VALUES (3, 'Alan', 'Turing', 'alan@example.org', 1, NULL);
+INSERT INTO changes VALUES (1, 1);
+INSERT INTO changes VALUES (2, 2);
+INSERT INTO changes VALUES (3, 3);
+INSERT INTO changes VALUES (4, 1);
+INSERT INTO changes VALUES (5, 2);
+INSERT INTO counters VALUES ('contact_id', 3);
+INSERT INTO counters VALUES ('change_seq', 5);
+INSERT INTO counters VALUES ('change_log_start', 0);
@@ -0,0 +1,45 @@
+-- A database at schema version 2, as migrations 1 to 2 left it, holding
+-- Ada and Alan, and Grace in the trash, in the default book, and Linus in
+-- the work book.
+CREATE TABLE schema_version (version INTEGER NOT NULL);
+CREATE TABLE "contacts" (
+				book       TEXT    NOT NULL,
+				id         INTEGER NOT NULL,
+				first_name TEXT    NOT NULL,
+				last_name  TEXT    NOT NULL,
+				email      TEXT    NOT NULL,
+				version    INTEGER NOT NULL,
+				deleted_at INTEGER,
+				PRIMARY KEY (book, id)
+			);
+CREATE INDEX contacts_by_name ON contacts (book, first_name, last_name, email) WHERE deleted_at IS NULL;
+CREATE INDEX contacts_by_deleted_at ON contacts (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE TABLE "changes" (
+				book       TEXT    NOT NULL,
+				seq        INTEGER NOT NULL,
+				contact_id INTEGER NOT NULL,
+				PRIMARY KEY (book, seq)
+			);
+CREATE TABLE "counters" (
+				book  TEXT    NOT NULL,
+				name  TEXT    NOT NULL,
+				value INTEGER NOT NULL,
+				PRIMARY KEY (book, name)
+			);
+INSERT INTO schema_version VALUES (2);
+INSERT INTO contacts VALUES ('default', 1, 'Ada', 'Lovelace', 'ada@example.com', 2, NULL);
+INSERT INTO contacts VALUES ('default', 2, 'Grace', 'Hopper', 'grace@example.com', 1, 1767312000000000000);
+INSERT INTO contacts VALUES ('default', 3, 'Alan', 'Turing', 'alan@example.org', 1, NULL);
+INSERT INTO contacts VALUES ('work', 1, 'Linus', 'Torvalds', 'linus@example.org', 1, NULL);
+INSERT INTO changes VALUES ('default', 1, 1);
+INSERT INTO changes VALUES ('default', 2, 2);
+INSERT INTO changes VALUES ('default', 3, 3);
+INSERT INTO changes VALUES ('default', 4, 1);
+INSERT INTO changes VALUES ('default', 5, 2);
+INSERT INTO changes VALUES ('work', 1, 1);
+INSERT INTO counters VALUES ('default', 'contact_id', 3);
+INSERT INTO counters VALUES ('default', 'change_seq', 5);
+INSERT INTO counters VALUES ('default', 'change_log_start', 0);
+INSERT INTO counters VALUES ('work', 'contact_id', 1);
+INSERT INTO counters VALUES ('work', 'change_seq', 1);
+INSERT INTO counters VALUES ('work', 'change_log_start', 0);
@@ -0,0 +1,384 @@
+// Package wal implements an append-only write-ahead log of opaque records.
+//
+// Each record is framed as a little-endian uint32 payload length, a CRC-32C
+// of the payload and the payload itself.  On open the log is replayed and
+// anything after the last intact record, such as a write torn by a crash, is
+// truncated away.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when appended records are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every record.
+	SyncAlways SyncPolicy = iota
+	// SyncBatch fsyncs every interval and holds back each record's
+	// acknowledgement until the fsync that covers it.
+	SyncBatch
+	// SyncOS never fsyncs and leaves flushing to the operating system.
+	// Records are acknowledged as soon as they are written and can be lost
+	// if the machine, not just the process, goes down.
+	SyncOS
+)
+
+// ParseSyncPolicy parses "always", "batch" or "os".
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "batch":
+		return SyncBatch, nil
+	case "os":
+		return SyncOS, nil
+	}
+	return SyncAlways, fmt.Errorf("unknown sync policy %q", s)
+}
+
+const headerSize = 8
+
+// maxRecordSize bounds a record's length so a corrupt header cannot make
+// recovery allocate arbitrary amounts of memory.
+const maxRecordSize = 1 << 30
+
+var (
+	ErrClosed         = errors.New("wal: log is closed")
+	ErrCorrupt        = errors.New("wal: corrupt record")
+	ErrRecordTooLarge = errors.New("wal: record too large")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Log is an open write-ahead log.  Append and Rewrite may be called from one
+// goroutine while a second one flushes batched records in the background.
+type Log struct {
+	path     string
+	policy   SyncPolicy
+	interval time.Duration
+
+	// syncMu is held for the duration of every fsync and file swap so the
+	// file cannot be replaced under a flush in progress.
+	syncMu sync.Mutex
+	// mu guards everything below.
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	waiting []func(error)
+	// err is sticky: after a failed write or fsync nothing more can be
+	// appended, since what made it to disk is no longer known.
+	err error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the log at path, creating it if needed, and passes every intact
+// record to replay in order before returning.  interval is only used by
+// SyncBatch.
+func Open(path string, policy SyncPolicy, interval time.Duration, replay func(payload []byte) error) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	size, err := replayFile(f, replay)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	_, err = f.Seek(size, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l := &Log{
+		path:     path,
+		policy:   policy,
+		interval: interval,
+		f:        f,
+		size:     size,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if policy == SyncBatch {
+		if l.interval <= 0 {
+			l.interval = 10 * time.Millisecond
+		}
+		go l.flusher()
+	} else {
+		close(l.done)
+	}
+	return l, nil
+}
+
+// replayFile replays f and truncates it after the last intact record,
+// returning the resulting size.
+func replayFile(f *os.File, replay func(payload []byte) error) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReaderSize(f, 1<<16)
+	var good int64
+	header := make([]byte, headerSize)
+	for {
+		_, err = io.ReadFull(r, header)
+		if err == io.EOF {
+			return good, nil
+		}
+		if err != nil {
+			break
+		}
+		length := binary.LittleEndian.Uint32(header)
+		if length > maxRecordSize || int64(length) > info.Size()-good-headerSize {
+			break
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(r, payload)
+		if err != nil {
+			break
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+			// A torn write can only damage the last record.  A bad one
+			// with more behind it means the log itself is damaged, and
+			// truncating it would throw away acknowledged records.
+			if good+headerSize+int64(length) < info.Size() {
+				return 0, fmt.Errorf("%w at offset %d", ErrCorrupt, good)
+			}
+			break
+		}
+		err = replay(payload)
+		if err != nil {
+			return 0, fmt.Errorf("wal: replaying record at offset %d: %w", good, err)
+		}
+		good += headerSize + int64(length)
+	}
+	// Running out of file part way through a record is a torn write; any
+	// other read error is a real one.
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	log.Printf("wal: discarding %d bytes of torn or corrupt records at the end of %s\n", info.Size()-good, f.Name())
+	err = f.Truncate(good)
+	if err == nil {
+		err = f.Sync()
+	}
+	return good, err
+}
+
+func frame(payload []byte) []byte {
+	b := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(b, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(payload, crcTable))
+	copy(b[headerSize:], payload)
+	return b
+}
+
+// Append writes a record and calls done once it is as durable as the policy
+// makes it, or with the error that prevented that.  Under SyncBatch done is
+// called later from another goroutine; otherwise it is called before Append
+// returns.
+func (l *Log) Append(payload []byte, done func(error)) {
+	if len(payload) > maxRecordSize {
+		done(ErrRecordTooLarge)
+		return
+	}
+	l.mu.Lock()
+	err := l.err
+	if err == nil {
+		err = l.write(frame(payload))
+	}
+	if err == nil && l.policy == SyncBatch {
+		l.waiting = append(l.waiting, done)
+		l.mu.Unlock()
+		return
+	}
+	if err == nil && l.policy == SyncAlways {
+		err = l.f.Sync()
+		if err != nil {
+			l.fail(err)
+		}
+	}
+	l.mu.Unlock()
+	done(err)
+}
+
+// write writes a framed record, failing the log if it could not be written
+// whole.  Must be called with mu held.
+func (l *Log) write(b []byte) error {
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		l.fail(err)
+	}
+	return err
+}
+
+// fail makes err sticky and fails every record still waiting for an fsync.
+// Must be called with mu held.
+func (l *Log) fail(err error) {
+	if l.err == nil {
+		l.err = err
+	}
+	for _, done := range l.waiting {
+		done(err)
+	}
+	l.waiting = nil
+}
+
+// Err returns the error that failed the log, if any.
+func (l *Log) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Size returns the size of the log in bytes.
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+func (l *Log) flusher() {
+	defer close(l.done)
+	t := time.NewTicker(l.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			l.flush()
+		}
+	}
+}
+
+// flush fsyncs the log and acknowledges every record waiting for it.
+// Records appended while the fsync runs wait for the next one.
+func (l *Log) flush() {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	waiting, f := l.waiting, l.f
+	l.waiting = nil
+	l.mu.Unlock()
+	if len(waiting) == 0 {
+		return
+	}
+	err := f.Sync()
+	if err != nil {
+		l.mu.Lock()
+		l.fail(err)
+		l.mu.Unlock()
+	}
+	for _, done := range waiting {
+		done(err)
+	}
+}
+
+// Rewrite atomically replaces the whole log with a single record, typically a
+// snapshot of the state every earlier record built up.  Records still waiting
+// for an fsync are acknowledged once the new log is durable, since the
+// snapshot covers them.  If Rewrite fails before the new log replaces the old
+// one the old log stays in use.
+func (l *Log) Rewrite(payload []byte) error {
+	if len(payload) > maxRecordSize {
+		return ErrRecordTooLarge
+	}
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".compact*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	b := frame(payload)
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = os.Rename(tmp.Name(), l.path)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	// From here on the old file is gone, so any failure fails the log.
+	err = syncDir(filepath.Dir(l.path))
+	if err != nil {
+		tmp.Close()
+		l.fail(err)
+		return err
+	}
+	l.f.Close()
+	l.f = tmp
+	l.size = int64(len(b))
+	for _, done := range l.waiting {
+		done(nil)
+	}
+	l.waiting = nil
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close flushes and closes the log.
+func (l *Log) Close() error {
+	select {
+	case <-l.stop:
+		return ErrClosed
+	default:
+	}
+	close(l.stop)
+	<-l.done
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.err
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		l.fail(err)
+	} else {
+		for _, done := range l.waiting {
+			done(nil)
+		}
+		l.waiting = nil
+	}
+	l.err = ErrClosed
+	closeErr := l.f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package webapp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/keyring"
+	"example-api-server/snapshot"
+)
+
+// maxSnapshotBody bounds the size of a snapshot uploaded for restore.
+const maxSnapshotBody = 1 << 30
+
+type restoreResponseJson struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Contacts  int       `json:"contacts"`
+	Trash     int       `json:"trash"`
+}
+
+// snapshot returns a point-in-time snapshot of the whole store.  The actor
+// copies its state between two commands, so writes carry on while the copy
+// is encoded and sent.
+func (w *webApp) snapshot(response http.ResponseWriter, request *http.Request) {
+	data, err := w.book(request).Snapshot()
+	if err != nil {
+		if w.sendOverloaded(err, response) {
+			return
+		}
+		r := errorJson{
+			Error: fmt.Sprintf("Error taking snapshot: %v", err),
+		}
+		w.sendErrorJson(r, "Error marshalling error: %v", response)
+		return
+	}
+	now := time.Now()
+	var b bytes.Buffer
+	err = snapshot.Write(&b, data, now, w.options.Keys)
+	if err != nil {
+		r := errorJson{
+			Error: fmt.Sprintf("Error encoding snapshot: %v", err),
+		}
+		w.sendErrorJson(r, "Error marshalling error: %v", response)
+		return
+	}
+	standardHeaders("application/json", response)
+	response.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="snapshot-%s.json"`, now.UTC().Format("20060102T150405Z")))
+	_, err = response.Write(b.Bytes())
+	if err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
+
+// restoreSnapshot loads an uploaded snapshot into an empty store.
+func (w *webApp) restoreSnapshot(response http.ResponseWriter, request *http.Request) {
+	request.Body = http.MaxBytesReader(response, request.Body, maxSnapshotBody)
+	data, info, err := snapshot.Read(request.Body, w.options.Keys)
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, appinterface.ErrInvalidContact),
+			errors.Is(err, snapshot.ErrEncrypted),
+			errors.Is(err, keyring.ErrUnknownKey),
+			errors.Is(err, keyring.ErrWrongKey):
+			status = http.StatusUnprocessableEntity
+		}
+		r := errorJson{
+			Error: fmt.Sprintf("Invalid snapshot: %v", err),
+		}
+		w.sendStatusJson(r, status, "Error marshalling error: %v", response)
+		return
+	}
+	err = w.book(request).Restore(request.Context(), data)
+	if err != nil {
+		if w.sendOverloaded(err, response) {
+			return
+		}
+		if errors.Is(err, appinterface.ErrNotEmpty) {
+			r := errorJson{
+				Error: "Snapshots can only be restored into an empty address book",
+			}
+			w.sendStatusJson(r, http.StatusConflict, "Error marshalling error: %v", response)
+			return
+		}
+		r := errorJson{
+			Error: fmt.Sprintf("Error restoring snapshot: %v", err),
+		}
+		w.sendErrorJson(r, "Error marshalling error: %v", response)
+		return
+	}
+	r := restoreResponseJson{
+		CreatedAt: info.CreatedAt,
+		Contacts:  len(data.Contacts),
+		Trash:     len(data.Trash),
+	}
+	w.sendJson(r, "Error marshalling restore response: %v", response)
+}
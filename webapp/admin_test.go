@@ -0,0 +1,100 @@
+package webapp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"example-api-server/appinterface"
+)
+
+// takeSnapshot returns a snapshot of a book holding Ada and Alan, with Grace
+// in the trash.
+func takeSnapshot(t *testing.T) (appinterface.App, string) {
+	t.Helper()
+	a := newBatchBook(t)
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"}})
+	if err := a.DeleteContact(context.Background(), 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	response := serve(NewWebApp(a), http.MethodPost, "/api/admin/snapshot", "", nil)
+	if response.Code != http.StatusOK || !strings.HasPrefix(response.Header().Get("Content-Disposition"), `attachment; filename="snapshot-`) {
+		t.Fatalf("snapshot: %d %s", response.Code, response.Body)
+	}
+	return a, response.Body.String()
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	source, snapshot := takeSnapshot(t)
+	a := newTestApp(t)
+	handler := NewWebApp(a)
+	response := serve(handler, http.MethodPost, "/api/admin/restore", snapshot, jsonType)
+	var restored restoreResponseJson
+	if err := json.Unmarshal(response.Body.Bytes(), &restored); response.Code != http.StatusOK || err != nil || restored.Contacts != 2 || restored.Trash != 1 {
+		t.Fatalf("restore: %d %s", response.Code, response.Body)
+	}
+	if got, want := getContacts(t, a), getContacts(t, source); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored contacts:\n%+v\nwant\n%+v", got, want)
+	}
+	// Times only come back equal, not identical, from a snapshot.
+	got, _ := json.Marshal(getTrash(t, a))
+	want, _ := json.Marshal(getTrash(t, source))
+	if string(got) != string(want) {
+		t.Errorf("restored trash:\n%s\nwant\n%s", got, want)
+	}
+	// The ID sequence carries over, so Grace's ID is not handed out again.
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Edsger", LastName: "Dijkstra", Email: "edsger@example.org"}})
+	for _, c := range getContacts(t, a) {
+		if c.FirstName == "Edsger" && c.ID != 4 {
+			t.Errorf("contact added after the restore: %+v", c)
+		}
+	}
+
+	// A second restore would clobber what is there now.
+	before, trashBefore := getContacts(t, a), getTrash(t, a)
+	if response := serve(handler, http.MethodPost, "/api/admin/restore", snapshot, jsonType); response.Code != http.StatusConflict {
+		t.Errorf("restoring into a book with contacts: %d %s", response.Code, response.Body)
+	}
+	if !reflect.DeepEqual(getContacts(t, a), before) || !reflect.DeepEqual(getTrash(t, a), trashBefore) {
+		t.Errorf("the refused restore changed the book")
+	}
+
+	// A book with only trash in it is not empty either.
+	trashOnly := newTestApp(t)
+	addContacts(t, trashOnly, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+	if err := trashOnly.DeleteContact(context.Background(), 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if response := serve(NewWebApp(trashOnly), http.MethodPost, "/api/admin/restore", snapshot, jsonType); response.Code != http.StatusConflict {
+		t.Errorf("restoring into a book with trash: %d %s", response.Code, response.Body)
+	}
+}
+
+func TestRestoreRejectsBadSnapshots(t *testing.T) {
+	_, snapshot := takeSnapshot(t)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "not a snapshot", body: `{"contacts":[]}`, status: http.StatusBadRequest},
+		{name: "not JSON", body: "BEGIN:VCARD", status: http.StatusBadRequest},
+		{name: "changed data", body: strings.Replace(snapshot, "Lovelace", "Lovelacf", 1), status: http.StatusBadRequest},
+		{name: "newer version", body: strings.Replace(snapshot, `"formatVersion":2`, `"formatVersion":3`, 1), status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestApp(t)
+			response := serve(NewWebApp(a), http.MethodPost, "/api/admin/restore", test.body, jsonType)
+			if response.Code != test.status {
+				t.Errorf("got %d %s, want %d", response.Code, response.Body, test.status)
+			}
+			if len(getContacts(t, a)) > 0 || len(getTrash(t, a)) > 0 {
+				t.Errorf("the refused snapshot was restored")
+			}
+		})
+	}
+}
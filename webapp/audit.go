@@ -0,0 +1,234 @@
+package webapp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/audit"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// maxRequestID bounds the length of a request ID a client sends.
+	maxRequestID = 128
+	// defaultAuditLimit and maxAuditLimit bound how many entries a query of
+	// the audit log returns; the export has no limit.
+	defaultAuditLimit = 1000
+	maxAuditLimit     = 10000
+)
+
+// requestIDContextKey is the request context key holding the ID of the
+// request, which ties its audit entries to the logs of whatever sent it.
+type requestIDContextKey struct{}
+
+func requestID(request *http.Request) string {
+	id, _ := request.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// validRequestID only accepts IDs that are safe to log and echo back.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.' || r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID gives every request an ID, the one the client sent in
+// X-Request-ID if it is valid or a new one otherwise, and sends it back.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		response.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(request.Context(), requestIDContextKey{}, id)
+		next.ServeHTTP(response, request.WithContext(ctx))
+	})
+}
+
+// auditRequest tells the audited app who is behind the changes made under
+// ctx.
+func (w *webApp) auditRequest(ctx context.Context, request *http.Request, c client) context.Context {
+	if w.options.Audit == nil {
+		return ctx
+	}
+	return audit.WithRequest(ctx, audit.Request{
+		Actor: c.Name,
+		IP:    w.clientIP(request),
+		ID:    requestID(request),
+	})
+}
+
+// auditFilter reads the entries a query asks for from its parameters.  The
+// entries are always those of the book the request is for.
+func auditFilter(request *http.Request) (audit.Filter, error) {
+	q := request.URL.Query()
+	f := audit.Filter{
+		Book:  bookName(request),
+		Actor: q.Get("actor"),
+	}
+	if since := q.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return f, fmt.Errorf("since must be an RFC 3339 time: %v", err)
+		}
+		f.Since = t
+	}
+	if contact := q.Get("contact"); contact != "" {
+		id, err := strconv.Atoi(contact)
+		if err != nil || id <= 0 {
+			return f, fmt.Errorf("contact must be a contact ID, not %q", contact)
+		}
+		f.ContactID = id
+	}
+	return f, nil
+}
+
+// visibleEntry turns the contacts of e into the ones the books serve and
+// applies the client's field rules to them.
+func (w *webApp) visibleEntry(request *http.Request, e audit.Entry) (audit.Entry, error) {
+	v := w.visibility(request)
+	for _, contact := range []**appinterface.Contact{&e.Before, &e.After} {
+		if *contact == nil {
+			continue
+		}
+		c := **contact
+		if w.options.AuditContacts != nil {
+			var err error
+			c, err = w.options.AuditContacts(c)
+			if err != nil {
+				return e, err
+			}
+		}
+		c = v.Contact(c)
+		*contact = &c
+	}
+	return e, nil
+}
+
+func (w *webApp) badAuditQuery(err error, response http.ResponseWriter) {
+	r := errorJson{
+		Error: fmt.Sprintf("Invalid audit query: %v", err),
+	}
+	w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+}
+
+func (w *webApp) auditLogError(err error, response http.ResponseWriter) {
+	r := errorJson{
+		Error: fmt.Sprintf("Error reading audit log: %v", err),
+	}
+	w.sendErrorJson(r, "Error marshalling error: %v", response)
+}
+
+// auditLog returns the oldest entries of the book that match the query, up
+// to limit of them.
+func (w *webApp) auditLog(response http.ResponseWriter, request *http.Request) {
+	f, err := auditFilter(request)
+	if err != nil {
+		w.badAuditQuery(err, response)
+		return
+	}
+	limit := defaultAuditLimit
+	if l := request.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxAuditLimit {
+			w.badAuditQuery(fmt.Errorf("limit must be between 1 and %d", maxAuditLimit), response)
+			return
+		}
+	}
+	entries := []audit.Entry{}
+	var verr error
+	err = w.options.Audit.Query(f, func(e audit.Entry) bool {
+		e, verr = w.visibleEntry(request, e)
+		if verr != nil {
+			return false
+		}
+		entries = append(entries, e)
+		return len(entries) < limit
+	})
+	if err == nil {
+		err = verr
+	}
+	if err != nil {
+		w.auditLogError(err, response)
+		return
+	}
+	w.sendJson(entries, "Error marshalling audit entries: %v", response)
+}
+
+// exportAudit streams every entry of the book that matches the query as
+// JSON Lines.
+func (w *webApp) exportAudit(response http.ResponseWriter, request *http.Request) {
+	f, err := auditFilter(request)
+	if err != nil {
+		w.badAuditQuery(err, response)
+		return
+	}
+	standardHeaders("application/jsonl; charset=utf-8", response)
+	response.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	out := bufio.NewWriter(response)
+	enc := json.NewEncoder(out)
+	err = w.options.Audit.Query(f, func(e audit.Entry) bool {
+		e, err := w.visibleEntry(request, e)
+		if err != nil {
+			log.Printf("Error reading audit entry %d for export: %v\n", e.Seq, err)
+			return false
+		}
+		err = enc.Encode(e)
+		if err != nil {
+			log.Printf("Error writing audit export: %v\n", err)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		// Headers are long gone, so all we can do is cut the stream short.
+		log.Printf("Error reading audit log for export: %v\n", err)
+		return
+	}
+	if err := out.Flush(); err != nil {
+		log.Printf("Error writing audit export: %v\n", err)
+	}
+}
+
+type auditVerifyJson struct {
+	OK bool `json:"ok"`
+	audit.Verification
+	Error string `json:"error,omitempty"`
+}
+
+// verifyAudit checks the hash chain of the whole log, across every book.
+func (w *webApp) verifyAudit(response http.ResponseWriter, request *http.Request) {
+	v, err := w.options.Audit.Verify()
+	if err != nil && !errors.Is(err, audit.ErrTampered) {
+		w.auditLogError(err, response)
+		return
+	}
+	r := auditVerifyJson{OK: err == nil, Verification: v}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	w.sendJson(r, "Error marshalling audit verification: %v", response)
+}
@@ -0,0 +1,71 @@
+package webapp
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example-api-server/appinterface"
+	"example-api-server/audit"
+	"example-api-server/auth"
+	"example-api-server/emailcrypt"
+)
+
+// TestAuditServesDecryptedEmails checks that the audit log of books with
+// encrypted email addresses holds them encrypted and serves them decrypted,
+// under the client's field rules.
+func TestAuditServesDecryptedEmails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := audit.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	key := make([]byte, 32)
+	d, err := emailcrypt.NewDecrypter(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := emailcrypt.Wrap(audit.Wrap(newTestApp(t), l, appinterface.DefaultBook), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+	log, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(log), "ada@example.com") {
+		t.Fatalf("the audit log holds an address in plaintext: %s", log)
+	}
+
+	options := Options{
+		Audit:            l,
+		AuditContacts:    d.Contact,
+		ClientVisibility: map[string]Visibility{"bob": {Email: FieldMasked}},
+	}
+	keys := withKeys(t, &options, map[string]auth.Role{"alice": auth.RoleAdmin, "bob": auth.RoleAdmin})
+	handler, err := NewWebAppWithOptions(appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: a}), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for client, want := range map[string]string{"alice": "ada@example.com", "bob": "a***@example.com"} {
+		response := serve(handler, http.MethodGet, "/api/admin/audit", "", keys[client])
+		var entries []audit.Entry
+		if err := json.Unmarshal(response.Body.Bytes(), &entries); err != nil || len(entries) != 1 || entries[0].After.Email != want {
+			t.Errorf("%s's audit log: %s %v", client, response.Body, err)
+		}
+		response = serve(handler, http.MethodGet, "/api/admin/audit/export.jsonl", "", keys[client])
+		lines := bufio.NewScanner(response.Body)
+		for lines.Scan() {
+			var e audit.Entry
+			if err := json.Unmarshal(lines.Bytes(), &e); err != nil || e.After.Email != want {
+				t.Errorf("%s's audit export: %s %v", client, lines.Text(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package webapp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"example-api-server/auth"
+)
+
+// sessionCookie holds the session token of a signed in browser.
+const sessionCookie = "session"
+
+type loginData struct {
+	Error string
+}
+
+type apiKeyJson struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Role       auth.Role  `json:"role"`
+	CreatedAt  *time.Time `json:"createdAt,omitempty"`
+	Configured bool       `json:"configured"`
+	// Key is only sent once, when the key is created.
+	Key string `json:"key,omitempty"`
+}
+
+type createAPIKeyJson struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// problemJson is an RFC 9457 problem details document.
+type problemJson struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// client is who made a request, as established by requireAuth.
+type client struct {
+	Name string
+	Role auth.Role
+	// CSRFToken is set for browsers signed in with a session cookie, which
+	// must send it back with every change.
+	CSRFToken string
+	// Bearer is set for clients that sent a bearer token, which browsers
+	// never add to a request on their own.
+	Bearer bool
+}
+
+// clientContextKey is the request context key holding the client making
+// the request, which selects its visibility rules and what it may do.
+type clientContextKey struct{}
+
+func requestClient(request *http.Request) client {
+	c, _ := request.Context().Value(clientContextKey{}).(client)
+	return c
+}
+
+// publicPath reports whether path is served without authentication: the
+// login page itself, the server time and the static assets the login page
+// needs.
+func publicPath(path string) bool {
+	switch path {
+	case "/login", "/logout", "/api/server-time", "/.well-known/carddav", cspReportPath:
+		return true
+	}
+	for _, prefix := range []string{"/js/", "/css/", "/img/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the client that made a request.  A client proves
+// who it is with a bearer token, which is an API key or a JWT, with a
+// password over HTTP basic authentication, as CardDAV clients do, or with
+// the session cookie of a browser that signed in.  presented is true if the
+// request carried any credentials.
+func (w *webApp) authenticate(request *http.Request) (c client, presented bool, ok bool) {
+	if header := request.Header.Get("Authorization"); header != "" {
+		scheme, token, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			var found bool
+			_, token, found = request.BasicAuth()
+			if !found {
+				return client{}, true, false
+			}
+		}
+		bearer := strings.EqualFold(scheme, "Bearer")
+		token = strings.TrimSpace(token)
+		if w.options.JWT != nil && auth.LooksLikeJWT(token) {
+			name, role, err := w.options.JWT.Verify(token)
+			return client{Name: name, Role: role, Bearer: bearer}, true, err == nil
+		}
+		key, ok := w.options.APIKeys.Lookup(token)
+		return client{Name: key.Name, Role: key.Role, Bearer: bearer}, true, ok
+	}
+	if cookie, err := request.Cookie(sessionCookie); err == nil {
+		session, ok := w.sessions.Lookup(cookie.Value)
+		return client{Name: session.Name, Role: session.Role, CSRFToken: session.CSRFToken}, true, ok
+	}
+	return client{}, false, false
+}
+
+// requireAuth only passes on requests for public paths and those that
+// authenticate, noting the client they came from in their context.
+// Changes must also pass the CSRF checks.
+func (w *webApp) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if publicPath(request.URL.Path) {
+			if reason := csrfRefusal(client{}, request); reason != "" {
+				w.csrfForbidden(reason, response)
+				return
+			}
+			next.ServeHTTP(response, request)
+			return
+		}
+		c, presented, ok := w.authenticate(request)
+		if !ok {
+			// Failed attempts count against the address they came from, so
+			// keys cannot be guessed any faster than the limits allow.
+			if !w.allowRequest("ip:"+w.clientIP(request), response, request) {
+				return
+			}
+			w.unauthorized(presented, response, request)
+			return
+		}
+		if reason := csrfRefusal(c, request); reason != "" {
+			w.csrfForbidden(reason, response)
+			return
+		}
+		ctx := context.WithValue(request.Context(), clientContextKey{}, c)
+		next.ServeHTTP(response, request.WithContext(ctx))
+	})
+}
+
+// can reports whether the client making request is allowed p.  Without
+// authentication everyone is allowed everything.
+func (w *webApp) can(request *http.Request, p auth.Permission) bool {
+	return w.options.APIKeys == nil || requestClient(request).Role.Can(p)
+}
+
+// allow only lets clients allowed p reach handler, so no request is ever
+// passed on to the app for an operation its role does not permit.
+func (w *webApp) allow(p auth.Permission, handler http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if !w.can(request, p) {
+			w.forbidden(p, response, request)
+			return
+		}
+		handler(response, request)
+	}
+}
+
+func (w *webApp) forbidden(p auth.Permission, response http.ResponseWriter, request *http.Request) {
+	c := requestClient(request)
+	r := problemJson{
+		Type:   "about:blank",
+		Title:  http.StatusText(http.StatusForbidden),
+		Status: http.StatusForbidden,
+		Detail: fmt.Sprintf("The %s role may not %s", c.Role, p),
+	}
+	bts, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Error marshalling problem: %v\n", err)
+		w.errorPage("ERROR", renderError(err), http.StatusInternalServerError, response)
+		return
+	}
+	standardHeaders("application/problem+json", response)
+	response.WriteHeader(http.StatusForbidden)
+	_, err = response.Write(bts)
+	if err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
+
+// unauthorized sends browsers to the login page and tells API and CardDAV
+// clients how to authenticate.
+func (w *webApp) unauthorized(presented bool, response http.ResponseWriter, request *http.Request) {
+	path := request.URL.Path
+	switch {
+	case path == "/" && request.Method == http.MethodGet:
+		http.Redirect(response, request, "/login", http.StatusSeeOther)
+	case strings.HasPrefix(path, "/dav/"):
+		response.Header().Set("WWW-Authenticate", `Basic realm="contacts", charset="UTF-8"`)
+		http.Error(response, "Authentication required", http.StatusUnauthorized)
+	default:
+		challenge := "Bearer"
+		if presented {
+			challenge = `Bearer error="invalid_token"`
+		}
+		response.Header().Set("WWW-Authenticate", challenge)
+		r := errorJson{
+			Error: "Authentication required",
+		}
+		w.sendStatusJson(r, http.StatusUnauthorized, "Error marshalling error: %v", response)
+	}
+}
+
+func (w *webApp) renderLogin(data loginData, status int, response http.ResponseWriter) {
+	htmlHeader(response)
+	response.WriteHeader(status)
+	id := wrapperData{
+		Title: "Sign in",
+		Body:  templateToHTML(login, &data),
+	}
+	err := wrapper.Execute(response, &id)
+	if err != nil {
+		log.Printf("Error generating page: %v\n", err)
+	}
+}
+
+func (w *webApp) loginPage(response http.ResponseWriter, request *http.Request) {
+	w.renderLogin(loginData{}, http.StatusOK, response)
+}
+
+// login starts a session for a browser that signs in with an API key.
+func (w *webApp) login(response http.ResponseWriter, request *http.Request) {
+	request.Body = http.MaxBytesReader(response, request.Body, 4096)
+	err := request.ParseForm()
+	if err != nil {
+		w.renderLogin(loginData{Error: "Could not read the form"}, http.StatusBadRequest, response)
+		return
+	}
+	key, ok := w.options.APIKeys.Lookup(strings.TrimSpace(request.PostForm.Get("apiKey")))
+	if !ok {
+		w.renderLogin(loginData{Error: "Unknown API key"}, http.StatusUnauthorized, response)
+		return
+	}
+	token, session, err := w.sessions.Start(key)
+	if err != nil {
+		log.Printf("Error starting session: %v\n", err)
+		w.errorPage("ERROR", renderError(err), http.StatusInternalServerError, response)
+		return
+	}
+	http.SetCookie(response, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.Expires,
+		Secure:   !w.options.InsecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(response, request, "/", http.StatusSeeOther)
+}
+
+// logout signs a browser out.  Being public, it checks the CSRF token
+// itself, which the sign out form sends as a field.
+func (w *webApp) logout(response http.ResponseWriter, request *http.Request) {
+	if cookie, err := request.Cookie(sessionCookie); err == nil {
+		if session, ok := w.sessions.Lookup(cookie.Value); ok {
+			request.Body = http.MaxBytesReader(response, request.Body, 4096)
+			if !validCSRFToken(request.PostFormValue(csrfField), session.CSRFToken) {
+				w.csrfForbidden("Missing or invalid CSRF token", response)
+				return
+			}
+		}
+		w.sessions.End(cookie.Value)
+	}
+	http.SetCookie(response, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   !w.options.InsecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(response, request, "/login", http.StatusSeeOther)
+}
+
+func toAPIKeyJson(k auth.Key) apiKeyJson {
+	r := apiKeyJson{ID: k.ID, Name: k.Name, Role: k.Role, Configured: k.Configured}
+	if !k.CreatedAt.IsZero() {
+		r.CreatedAt = &k.CreatedAt
+	}
+	return r
+}
+
+func (w *webApp) apiKeys(response http.ResponseWriter, request *http.Request) {
+	keys := w.options.APIKeys.Keys()
+	r := make([]apiKeyJson, len(keys))
+	for i, k := range keys {
+		r[i] = toAPIKeyJson(k)
+	}
+	w.sendJson(r, "Error marshalling API keys: %v", response)
+}
+
+// createAPIKey creates a key and returns it.  This is the only time the key
+// itself is seen; the server only keeps its hash.
+func (w *webApp) createAPIKey(response http.ResponseWriter, request *http.Request) {
+	request.Body = http.MaxBytesReader(response, request.Body, 4096)
+	var body createAPIKeyJson
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		r := errorJson{
+			Error: fmt.Sprintf("Error parsing request: %v", err),
+		}
+		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		return
+	}
+	role, err := auth.ParseRole(body.Role)
+	if err != nil {
+		r := errorJson{
+			Error: err.Error(),
+		}
+		w.sendStatusJson(r, http.StatusUnprocessableEntity, "Error marshalling error: %v", response)
+		return
+	}
+	key, secret, err := w.options.APIKeys.Create(strings.TrimSpace(body.Name), role)
+	if err != nil {
+		status, message := apiKeyErrorStatus("Error creating API key: %v", err)
+		w.sendStatusJson(errorJson{Error: message}, status, "Error marshalling error: %v", response)
+		return
+	}
+	r := toAPIKeyJson(key)
+	r.Key = secret
+	w.sendStatusJson(r, http.StatusCreated, "Error marshalling API key: %v", response)
+}
+
+// deleteAPIKey deletes a key and signs out the browsers that signed in
+// with it.
+func (w *webApp) deleteAPIKey(response http.ResponseWriter, request *http.Request) {
+	id := request.PathValue("id")
+	err := w.options.APIKeys.Delete(id)
+	if err != nil {
+		status, message := apiKeyErrorStatus("Error deleting API key: %v", err)
+		w.sendStatusJson(errorJson{Error: message}, status, "Error marshalling error: %v", response)
+		return
+	}
+	w.sessions.EndKey(id)
+}
+
+func apiKeyErrorStatus(format string, err error) (int, string) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidName):
+		return http.StatusUnprocessableEntity, err.Error()
+	case errors.Is(err, auth.ErrKeyNotFound):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, auth.ErrConfiguredKey):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, auth.ErrNoKeysFile):
+		return http.StatusNotImplemented, err.Error()
+	}
+	return http.StatusInternalServerError, fmt.Sprintf(format, err)
+}
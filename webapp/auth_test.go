@@ -0,0 +1,239 @@
+package webapp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+// newAuthWebApp serves a book holding Ada (ID 1) to the admin "root", the
+// editor "ed" and the viewer "vi", with a keys file to create keys in.
+func newAuthWebApp(t *testing.T, options Options) (http.Handler, map[string]map[string]string) {
+	t.Helper()
+	a := newTestApp(t)
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+	options.SessionLifetime = time.Hour
+	keys := withKeys(t, &options, map[string]auth.Role{"root": auth.RoleAdmin, "ed": auth.RoleEditor, "vi": auth.RoleViewer})
+	store, err := auth.NewStore(options.APIKeys.Keys(), filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.APIKeys = store
+	handler, err := NewWebAppWithOptions(appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: a}), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler, keys
+}
+
+func TestAuthenticate(t *testing.T) {
+	handler, keys := newAuthWebApp(t, Options{})
+	session, _ := signIn(t, handler, secretOf(keys["ed"]))
+	secret := secretOf(keys["ed"])
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		header    map[string]string
+		status    int
+		challenge string
+		location  string
+	}{
+		{name: "bearer", header: keys["ed"], status: http.StatusOK},
+		{name: "lower case bearer", header: map[string]string{"Authorization": "bearer " + secret}, status: http.StatusOK},
+		{name: "basic", header: basicAuth("anyone", secret), status: http.StatusOK},
+		{name: "cookie", header: session, status: http.StatusOK},
+		{name: "nothing", status: http.StatusUnauthorized, challenge: "Bearer"},
+		{name: "wrong bearer", header: map[string]string{"Authorization": "Bearer " + secret + "x"}, status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "wrong basic password", header: basicAuth("ed", "wrong"), status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "malformed basic", header: map[string]string{"Authorization": "Basic !!!"}, status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "unknown scheme", header: map[string]string{"Authorization": "Token " + secret}, status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "unknown cookie", header: map[string]string{"Cookie": sessionCookie + "=nope"}, status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "change without credentials", method: http.MethodPost, path: "/api/add-contact", status: http.StatusUnauthorized, challenge: "Bearer"},
+		// Browsers are sent to sign in, CardDAV clients asked for a password.
+		{name: "home page", path: "/", status: http.StatusSeeOther, location: "/login"},
+		{name: "home page with an unknown cookie", path: "/", header: map[string]string{"Cookie": sessionCookie + "=nope"}, status: http.StatusSeeOther, location: "/login"},
+		{name: "CardDAV", method: "PROPFIND", path: bookPath, status: http.StatusUnauthorized, challenge: `Basic realm="contacts", charset="UTF-8"`},
+		{name: "home page by cookie", path: "/", header: session, status: http.StatusOK},
+		{name: "CardDAV by basic", method: "PROPFIND", path: bookPath, header: with(basicAuth("ed", secret), "Depth", "0"), status: http.StatusMultiStatus},
+		// Public paths need no credentials, and ignore wrong ones.
+		{name: "login page", path: "/login", status: http.StatusOK},
+		{name: "server time", path: "/api/server-time", header: map[string]string{"Authorization": "Bearer wrong"}, status: http.StatusOK},
+		{name: "CardDAV discovery", path: "/.well-known/carddav", status: http.StatusMovedPermanently},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method, path := test.method, test.path
+			if method == "" {
+				method = http.MethodGet
+			}
+			if path == "" {
+				path = "/api/contact/1"
+			}
+			response := serve(handler, method, path, "", test.header)
+			if response.Code != test.status {
+				t.Fatalf("got %d %s, want %d", response.Code, response.Body, test.status)
+			}
+			if got := response.Header().Get("WWW-Authenticate"); got != test.challenge {
+				t.Errorf("challenge %q, want %q", got, test.challenge)
+			}
+			if got := response.Header().Get("Location"); test.location != "" && got != test.location {
+				t.Errorf("sent to %q, want %q", got, test.location)
+			}
+		})
+	}
+}
+
+func TestPublicPath(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/login":               true,
+		"/logout":              true,
+		"/api/server-time":     true,
+		"/.well-known/carddav": true,
+		cspReportPath:          true,
+		"/js/app.js":           true,
+		"/css/app.css":         true,
+		"/img/logo.png":        true,
+		"/":                    false,
+		"/login/x":             false,
+		"/api/contacts":        false,
+		"/dav/":                false,
+		"/jsx/app.js":          false,
+		"/api/js/app.js":       false,
+	} {
+		if got := publicPath(path); got != want {
+			t.Errorf("publicPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	form := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	for _, insecure := range []bool{false, true} {
+		handler, keys := newAuthWebApp(t, Options{InsecureCookies: insecure})
+		response := serve(handler, http.MethodPost, "/login", "apiKey=wrong", form)
+		if response.Code != http.StatusUnauthorized || !strings.Contains(response.Body.String(), "Unknown API key") || len(response.Result().Cookies()) != 0 {
+			t.Errorf("sign in with a wrong key: %d %s", response.Code, response.Body)
+		}
+
+		response = serve(handler, http.MethodPost, "/login", "apiKey="+url.QueryEscape(" "+secretOf(keys["vi"])+" "), form)
+		if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/" {
+			t.Fatalf("sign in: %d %s", response.Code, response.Body)
+		}
+		cookies := response.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("cookies: %v", cookies)
+		}
+		c := cookies[0]
+		if c.Name != sessionCookie || c.Value == "" || c.Path != "/" || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode || c.Secure == insecure {
+			t.Errorf("session cookie with InsecureCookies %v: %+v", insecure, c)
+		}
+		if d := time.Until(c.Expires); d < 59*time.Minute || d > time.Hour {
+			t.Errorf("session cookie expires in %v", d)
+		}
+		if strings.Contains(c.Value, secretOf(keys["vi"])) {
+			t.Errorf("the cookie holds the API key")
+		}
+
+		// The session acts with the role of the key it signed in with.
+		session, token := signIn(t, handler, secretOf(keys["vi"]))
+		response = serve(handler, http.MethodPut, "/api/contact/1", "firstName=Augusta&lastName=King&email=ada%40example.com",
+			with(session, "Content-Type", "application/x-www-form-urlencoded", csrfHeader, token))
+		if response.Code != http.StatusForbidden {
+			t.Errorf("viewer session's change: %d", response.Code)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	handler, keys := newAuthWebApp(t, Options{})
+	create := func(header map[string]string, body string) (int, apiKeyJson) {
+		t.Helper()
+		response := serve(handler, http.MethodPost, "/api/admin/api-keys", body, with(header, "Content-Type", "application/json"))
+		var key apiKeyJson
+		if response.Code == http.StatusCreated {
+			if err := json.Unmarshal(response.Body.Bytes(), &key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return response.Code, key
+	}
+
+	for _, bad := range []struct {
+		body   string
+		status int
+	}{
+		{body: `{"name":"ci","role":"owner"}`, status: http.StatusUnprocessableEntity},
+		{body: `{"name":" ","role":"editor"}`, status: http.StatusUnprocessableEntity},
+		{body: `{"name":`, status: http.StatusBadRequest},
+	} {
+		if status, _ := create(keys["root"], bad.body); status != bad.status {
+			t.Errorf("creating %s: %d, want %d", bad.body, status, bad.status)
+		}
+	}
+	if status, _ := create(keys["ed"], `{"name":"ci","role":"editor"}`); status != http.StatusForbidden {
+		t.Errorf("editor creating a key: %d", status)
+	}
+
+	status, key := create(keys["root"], `{"name":"ci","role":"editor"}`)
+	if status != http.StatusCreated || key.Key == "" || key.ID == "" || key.Name != "ci" || key.Role != auth.RoleEditor || key.Configured || key.CreatedAt == nil {
+		t.Fatalf("creating a key: %d %+v", status, key)
+	}
+	bearer := map[string]string{"Authorization": "Bearer " + key.Key}
+	if response := serve(handler, http.MethodGet, "/api/contact/1", "", bearer); response.Code != http.StatusOK {
+		t.Errorf("the new key: %d", response.Code)
+	}
+	response := serve(handler, http.MethodGet, "/api/admin/api-keys", "", keys["root"])
+	var listed []apiKeyJson
+	if err := json.Unmarshal(response.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 4 || listed[3].ID != key.ID || listed[3].Key != "" {
+		t.Errorf("keys listed: %+v", listed)
+	}
+
+	session, _ := signIn(t, handler, key.Key)
+	rootSession, _ := signIn(t, handler, secretOf(keys["root"]))
+	for _, test := range []struct {
+		id     string
+		status int
+	}{
+		{id: "unknown", status: http.StatusNotFound},
+		{id: listed[0].ID, status: http.StatusConflict},
+		{id: key.ID, status: http.StatusOK},
+		{id: key.ID, status: http.StatusNotFound},
+	} {
+		if response := serve(handler, http.MethodDelete, "/api/admin/api-keys/"+test.id, "", keys["root"]); response.Code != test.status {
+			t.Errorf("deleting %s: %d %s, want %d", test.id, response.Code, response.Body, test.status)
+		}
+	}
+	// Deleting a key locks out its sessions too, and only those.
+	for name, header := range map[string]map[string]string{"key": bearer, "session": session} {
+		if response := serve(handler, http.MethodGet, "/api/contact/1", "", header); response.Code != http.StatusUnauthorized {
+			t.Errorf("the deleted key's %s: %d", name, response.Code)
+		}
+	}
+	if response := serve(handler, http.MethodGet, "/api/contact/1", "", rootSession); response.Code != http.StatusOK {
+		t.Errorf("another key's session: %d", response.Code)
+	}
+}
+
+func TestAPIKeysWithoutKeysFile(t *testing.T) {
+	var options Options
+	keys := withKeys(t, &options, map[string]auth.Role{"root": auth.RoleAdmin})
+	handler, err := NewWebAppWithOptions(appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: newTestApp(t)}), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := serve(handler, http.MethodPost, "/api/admin/api-keys", `{"name":"ci","role":"editor"}`, with(keys["root"], "Content-Type", "application/json"))
+	if response.Code != http.StatusNotImplemented {
+		t.Errorf("creating a key: %d %s", response.Code, response.Body)
+	}
+}
@@ -0,0 +1,84 @@
+package webapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+const (
+	// maxBatchBody bounds the size of a batch request body.
+	maxBatchBody = 1 << 20
+	// maxBatchOperations bounds the number of operations in one batch.
+	maxBatchOperations = 1000
+)
+
+type batchResultJson struct {
+	Status  int                   `json:"status"`
+	Contact *appinterface.Contact `json:"contact,omitempty"`
+	Error   string                `json:"error,omitempty"`
+}
+
+type batchResponseJson struct {
+	Applied bool              `json:"applied"`
+	Results []batchResultJson `json:"results"`
+}
+
+func (w *webApp) batch(response http.ResponseWriter, request *http.Request) {
+	request.Body = http.MaxBytesReader(response, request.Body, maxBatchBody)
+	var ops []appinterface.BatchOperation
+	err := json.NewDecoder(request.Body).Decode(&ops)
+	if err != nil {
+		r := errorJson{
+			Error: fmt.Sprintf("Error parsing batch: %v", err),
+		}
+		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		return
+	}
+	if len(ops) > maxBatchOperations {
+		r := errorJson{
+			Error: fmt.Sprintf("Too many operations: at most %d are allowed", maxBatchOperations),
+		}
+		w.sendStatusJson(r, http.StatusRequestEntityTooLarge, "Error marshalling error: %v", response)
+		return
+	}
+	for _, op := range ops {
+		if op.Op == appinterface.BatchDelete && !w.can(request, auth.PermDelete) {
+			w.forbidden(auth.PermDelete, response, request)
+			return
+		}
+	}
+	results, batchErr := w.book(request).Batch(request.Context(), ops)
+	if batchErr != nil && results == nil {
+		w.sendMutationError("Error applying batch: %v", batchErr, response)
+		return
+	}
+	body := batchResponseJson{
+		Applied: batchErr == nil,
+		Results: make([]batchResultJson, len(results)),
+	}
+	status := http.StatusOK
+	v := w.visibility(request)
+	for i, result := range results {
+		if result.Err == nil {
+			contact := v.Contact(result.Contact)
+			body.Results[i] = batchResultJson{
+				Status:  http.StatusOK,
+				Contact: &contact,
+			}
+			continue
+		}
+		s, message := mutationErrorStatus("Error applying operation: %v", result.Err)
+		if result.Err != appinterface.ErrBatchRolledBack {
+			status = s
+		}
+		body.Results[i] = batchResultJson{
+			Status: s,
+			Error:  message,
+		}
+	}
+	w.sendStatusJson(body, status, "Error marshalling batch results: %v", response)
+}
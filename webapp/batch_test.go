@@ -0,0 +1,208 @@
+package webapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+var jsonType = map[string]string{"Content-Type": "application/json"}
+
+// newBatchBook is a book holding Ada (ID 1) and Grace (ID 2).
+func newBatchBook(t *testing.T) appinterface.App {
+	t.Helper()
+	a := newTestApp(t)
+	addContacts(t, a, []appinterface.Contact{
+		{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"},
+		{FirstName: "Grace", LastName: "Hopper", Email: "grace@example.org"},
+	})
+	return a
+}
+
+func batchResults(t *testing.T, body []byte) batchResponseJson {
+	t.Helper()
+	var r batchResponseJson
+	if err := json.Unmarshal(body, &r); err != nil {
+		t.Fatalf("batch response %s: %v", body, err)
+	}
+	return r
+}
+
+func TestBatch(t *testing.T) {
+	alan := `{"op":"create","firstName":"Alan","lastName":"Turing","email":"alan@example.org"}`
+	augusta := `{"op":"update","id":1,"version":1,"firstName":"Augusta","lastName":"King","email":"ada@example.com"}`
+	tests := []struct {
+		name   string
+		ops    []string
+		status int
+		// statuses is the status of each operation.
+		statuses []int
+	}{
+		{name: "all applied", ops: []string{alan, augusta, `{"op":"delete","id":2}`}, status: http.StatusOK, statuses: []int{200, 200, 200}},
+		{name: "empty", status: http.StatusOK, statuses: []int{}},
+		{name: "unknown contact", ops: []string{alan, augusta, `{"op":"delete","id":9}`}, status: http.StatusNotFound, statuses: []int{424, 424, 404}},
+		{name: "stale version", ops: []string{alan, augusta, `{"op":"update","id":1,"version":1,"firstName":"Ada","lastName":"King","email":"ada@example.com"}`},
+			status: http.StatusPreconditionFailed, statuses: []int{424, 424, 412}},
+		{name: "duplicate of a contact the batch created", ops: []string{alan, augusta, alan}, status: http.StatusConflict, statuses: []int{424, 424, 409}},
+		{name: "deleted twice", ops: []string{alan, `{"op":"delete","id":2}`, `{"op":"delete","id":2}`}, status: http.StatusNotFound, statuses: []int{424, 424, 404}},
+		{name: "invalid contact", ops: []string{alan, augusta, `{"op":"create","firstName":"Mallory"}`}, status: http.StatusUnprocessableEntity, statuses: []int{424, 424, 422}},
+		{name: "unknown op", ops: []string{alan, augusta, `{"op":"merge","id":1}`}, status: http.StatusBadRequest, statuses: []int{424, 424, 400}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newBatchBook(t)
+			handler := NewWebApp(a)
+			before, trashBefore := getContacts(t, a), getTrash(t, a)
+			response := serve(handler, http.MethodPost, "/api/batch", "["+strings.Join(test.ops, ",")+"]", jsonType)
+			if response.Code != test.status {
+				t.Fatalf("got %d %s, want %d", response.Code, response.Body, test.status)
+			}
+			r := batchResults(t, response.Body.Bytes())
+			statuses := make([]int, len(r.Results))
+			for i, result := range r.Results {
+				statuses[i] = result.Status
+				if (result.Status == http.StatusOK) != (result.Contact != nil) || (result.Status == http.StatusOK) == (result.Error != "") {
+					t.Errorf("result %d: %+v", i, result)
+				}
+			}
+			if !reflect.DeepEqual(statuses, test.statuses) || r.Applied != (test.status == http.StatusOK) {
+				t.Fatalf("applied %v with statuses %v, want %v", r.Applied, statuses, test.statuses)
+			}
+			if !r.Applied {
+				if after := getContacts(t, a); !reflect.DeepEqual(after, before) {
+					t.Errorf("the failed batch changed the contacts:\n%+v\n%+v", before, after)
+				}
+				if after := getTrash(t, a); !reflect.DeepEqual(after, trashBefore) {
+					t.Errorf("the failed batch changed the trash:\n%+v\n%+v", trashBefore, after)
+				}
+				// Nor does it use up the IDs of the contacts it created.
+				addContacts(t, a, []appinterface.Contact{{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"}})
+				for _, c := range getContacts(t, a) {
+					if c.FirstName == "Alan" && c.ID != 3 {
+						t.Errorf("contact added after the failed batch: %+v", c)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestBatchResults checks the contact each operation of an applied batch
+// reports, and that the book holds what they say.
+func TestBatchResults(t *testing.T) {
+	a := newBatchBook(t)
+	response := serve(NewWebApp(a), http.MethodPost, "/api/batch", `[
+		{"op":"create","firstName":"Alan","lastName":"Turing","email":"alan@example.org"},
+		{"op":"update","id":1,"version":1,"firstName":"Augusta","lastName":"King","email":"ada@example.com"},
+		{"op":"update","id":3,"firstName":"Alan","lastName":"Turing","email":"turing@example.org"},
+		{"op":"delete","id":2,"version":1}
+	]`, jsonType)
+	if response.Code != http.StatusOK {
+		t.Fatalf("got %d %s", response.Code, response.Body)
+	}
+	want := []appinterface.Contact{
+		{ID: 3, Version: 1, FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"},
+		{ID: 1, Version: 2, FirstName: "Augusta", LastName: "King", Email: "ada@example.com"},
+		{ID: 3, Version: 2, FirstName: "Alan", LastName: "Turing", Email: "turing@example.org"},
+		{ID: 2, Version: 1, FirstName: "Grace", LastName: "Hopper", Email: "grace@example.org"},
+	}
+	r := batchResults(t, response.Body.Bytes())
+	if !r.Applied || len(r.Results) != len(want) {
+		t.Fatalf("got %+v", r)
+	}
+	for i, result := range r.Results {
+		if result.Status != http.StatusOK || result.Contact == nil || !reflect.DeepEqual(*result.Contact, want[i]) {
+			t.Errorf("result %d: %+v, want %+v", i, result, want[i])
+		}
+	}
+	contacts := getContacts(t, a)
+	if !reflect.DeepEqual(names(contacts), names([]appinterface.Contact{want[1], want[2]})) {
+		t.Errorf("contacts after the batch: %+v", contacts)
+	}
+	if trash := getTrash(t, a); len(trash) != 1 || trash[0].ID != 2 {
+		t.Errorf("trash after the batch: %+v", trash)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	ops := func(n int) string {
+		op := make([]string, n)
+		for i := range op {
+			op[i] = fmt.Sprintf(`{"op":"create","firstName":"C%d","lastName":"Number","email":"c%d@example.com"}`, i, i)
+		}
+		return "[" + strings.Join(op, ",") + "]"
+	}
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		added  int
+	}{
+		{name: "at the limit", body: ops(maxBatchOperations), status: http.StatusOK, added: maxBatchOperations},
+		{name: "over the limit", body: ops(maxBatchOperations + 1), status: http.StatusRequestEntityTooLarge},
+		{name: "body too large", body: `[{"op":"create","firstName":"` + strings.Repeat("x", maxBatchBody) + `"}]`, status: http.StatusBadRequest},
+		{name: "not a list", body: `{"op":"delete","id":1}`, status: http.StatusBadRequest},
+		{name: "malformed", body: `[{"op":"delete",`, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newBatchBook(t)
+			response := serve(NewWebApp(a), http.MethodPost, "/api/batch", test.body, jsonType)
+			if response.Code != test.status {
+				t.Fatalf("got %d, want %d", response.Code, test.status)
+			}
+			if got := len(getContacts(t, a)); got != 2+test.added {
+				t.Errorf("%d contacts after the batch, want %d", got, 2+test.added)
+			}
+		})
+	}
+}
+
+// TestBatchDeleteNeedsDeletePermission checks that a batch that deletes is
+// refused as a whole to a client that may not delete, and the rest of it
+// not applied.
+func TestBatchDeleteNeedsDeletePermission(t *testing.T) {
+	const deletes = `[{"op":"update","id":1,"firstName":"Augusta","lastName":"King","email":"ada@example.com"},{"op":"delete","id":2}]`
+	const updates = `[{"op":"update","id":1,"firstName":"Augusta","lastName":"King","email":"ada@example.com"}]`
+	tests := []struct {
+		client string
+		body   string
+		status int
+	}{
+		{client: "ed", body: deletes, status: http.StatusForbidden},
+		{client: "ed", body: updates, status: http.StatusOK},
+		{client: "root", body: deletes, status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.client+" "+test.body, func(t *testing.T) {
+			a := newBatchBook(t)
+			var options Options
+			keys := withKeys(t, &options, map[string]auth.Role{"ed": auth.RoleEditor, "root": auth.RoleAdmin})
+			books := appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: a})
+			handler, err := NewWebAppWithOptions(books, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := getContacts(t, a)
+			response := serve(handler, http.MethodPost, "/api/batch", test.body, with(keys[test.client], "Content-Type", "application/json"))
+			if response.Code != test.status {
+				t.Fatalf("got %d %s, want %d", response.Code, response.Body, test.status)
+			}
+			if test.status != http.StatusForbidden {
+				return
+			}
+			if !strings.Contains(response.Body.String(), "may not "+auth.PermDelete.String()) {
+				t.Errorf("problem %s", response.Body)
+			}
+			if after := getContacts(t, a); !reflect.DeepEqual(after, before) {
+				t.Errorf("the refused batch changed the book:\n%+v\n%+v", before, after)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package webapp
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+// bookContextKey is the request context key holding the app of the address
+// book a request is for.
+type bookContextKey struct{}
+
+type bookJson struct {
+	Name string    `json:"name"`
+	Role auth.Role `json:"role,omitempty"`
+}
+
+// book returns the address book a request is for, as resolved by inBook.
+// Handlers only ever reach contacts through it, so they cannot reach
+// another book's.
+func (w *webApp) book(request *http.Request) appinterface.App {
+	return request.Context().Value(bookContextKey{}).(appinterface.App)
+}
+
+// bookName returns the name of the book a request is for: the one in its
+// path, or the default book for routes without one.
+func bookName(request *http.Request) string {
+	if name := request.PathValue("book"); name != "" {
+		return name
+	}
+	return appinterface.DefaultBook
+}
+
+// bookRole returns the role a client has in a book.  A book with grants
+// only lets in the clients it names, or every client if it names "*", at
+// the lower of their own role and the grant.  A book without grants lets
+// in every client at its own role if it is the default book, and nobody
+// otherwise.
+func (w *webApp) bookRole(c client, name string) (auth.Role, bool) {
+	grants, ok := w.options.Grants[name]
+	if !ok {
+		return c.Role, name == appinterface.DefaultBook
+	}
+	grant, ok := grants[c.Name]
+	if !ok {
+		grant, ok = grants["*"]
+	}
+	if !ok {
+		return "", false
+	}
+	return auth.MinRole(c.Role, grant), true
+}
+
+// inBook resolves the book named in the path, or the default book for
+// routes without one, and only lets clients allowed p in it reach handler.
+// The client's role in the book replaces its own for the rest of the
+// request, and the app is told who the client is so that it only shows it
+// the contacts it may see, and records it as the one behind its changes.
+func (w *webApp) inBook(p auth.Permission, handler http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		name := bookName(request)
+		app, err := w.books.Book(name)
+		ctx := request.Context()
+		c := requestClient(request)
+		if err == nil && w.options.APIKeys != nil {
+			var ok bool
+			c.Role, ok = w.bookRole(c, name)
+			// A book the client has no grant for is not found, so book
+			// names cannot be probed.
+			if !ok {
+				err = appinterface.ErrNoSuchBook
+			}
+			ctx = context.WithValue(ctx, clientContextKey{}, c)
+			ctx = appinterface.WithPrincipal(ctx, w.principal(c))
+		} else if !w.clientVisibility(c.Name).full() {
+			// Without authentication the app acts for nobody in
+			// particular, but every client is shown the same masked or
+			// hidden email addresses, which it must not write back.
+			ctx = appinterface.WithPrincipal(ctx, appinterface.Principal{All: true, KeepEmails: true})
+		}
+		ctx = w.auditRequest(ctx, request, c)
+		if err != nil {
+			r := errorJson{
+				Error: "Address book not found",
+			}
+			w.sendStatusJson(r, http.StatusNotFound, "Error marshalling error: %v", response)
+			return
+		}
+		request = request.WithContext(context.WithValue(ctx, bookContextKey{}, app))
+		if !w.can(request, p) {
+			w.forbidden(p, response, request)
+			return
+		}
+		handler(response, request)
+	}
+}
+
+// handleBook registers handler for a route of the default book, such as
+// "GET /api/contacts", and for the same route of every book, such as
+// "GET /api/books/{book}/contacts".
+func (w *webApp) handleBook(method string, path string, p auth.Permission, handler http.HandlerFunc) {
+	w.mux.HandleFunc(method+" "+path, w.inBook(p, handler))
+	w.mux.HandleFunc(method+" /api/books/{book}/"+strings.TrimPrefix(path, "/api/"), w.inBook(p, handler))
+}
+
+// listBooks returns the books the client may use, and its role in each.
+func (w *webApp) listBooks(response http.ResponseWriter, request *http.Request) {
+	r := []bookJson{}
+	for _, name := range w.books.Names() {
+		if w.options.APIKeys == nil {
+			r = append(r, bookJson{Name: name})
+			continue
+		}
+		if role, ok := w.bookRole(requestClient(request), name); ok {
+			r = append(r, bookJson{Name: name, Role: role})
+		}
+	}
+	w.sendJson(r, "Error marshalling books: %v", response)
+}
@@ -0,0 +1,271 @@
+package webapp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"example-api-server/appinterface"
+	"example-api-server/audit"
+	"example-api-server/auth"
+)
+
+// tenants serves the books "default" and "work", that each hold Ada (ID 1)
+// and Alan (ID 3), with Grace (ID 2) in the trash, and the empty book
+// "archive", and audits every change to them.  Alice is an admin of the
+// work book only and bob of the default and archive books only.
+type tenants struct {
+	handler http.Handler
+	apps    map[string]appinterface.App
+	log     *audit.Log
+	keys    map[string]map[string]string
+}
+
+func newTenants(t *testing.T) *tenants {
+	t.Helper()
+	l, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	tn := &tenants{apps: map[string]appinterface.App{}, log: l}
+	names := []string{appinterface.DefaultBook, "work", "archive"}
+	for _, name := range names {
+		a := newTestApp(t)
+		tn.apps[name] = a
+		if name == "archive" {
+			continue
+		}
+		addContacts(t, a, []appinterface.Contact{
+			{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"},
+			{FirstName: "Grace", LastName: "Hopper", Email: "grace@example.org"},
+			{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"},
+		})
+		if err := a.DeleteContact(context.Background(), 2, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	books, err := appinterface.WrapBooks(appinterface.NewBooks(names, tn.apps), func(name string, a appinterface.App) (appinterface.App, error) {
+		return audit.Wrap(a, l, name), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := Options{
+		Audit: l,
+		Grants: map[string]map[string]auth.Role{
+			appinterface.DefaultBook: {"bob": auth.RoleAdmin},
+			"archive":                {"bob": auth.RoleAdmin},
+			"work":                   {"alice": auth.RoleAdmin},
+		},
+	}
+	tn.keys = withKeys(t, &options, map[string]auth.Role{"alice": auth.RoleAdmin, "bob": auth.RoleAdmin})
+	tn.handler, err = NewWebAppWithOptions(books, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tn
+}
+
+// bookState is everything a book holds.
+type bookState struct {
+	contacts []appinterface.Contact
+	trash    []appinterface.TrashedContact
+	token    int
+}
+
+func (tn *tenants) state(t *testing.T, book string) bookState {
+	t.Helper()
+	ctx := context.Background()
+	a := tn.apps[book]
+	trash, err := a.GetTrash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := a.Changes(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bookState{contacts: getContacts(t, a), trash: trash, token: changes.Token}
+}
+
+// auditBooks lists the book of every entry in the audit log.
+func (tn *tenants) auditBooks(t *testing.T) []string {
+	t.Helper()
+	var books []string
+	err := tn.log.Query(audit.Filter{}, func(e audit.Entry) bool {
+		books = append(books, e.Book)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return books
+}
+
+// bookRequest is a request to a route of a book that succeeds for an admin
+// of the book.  path follows "/api/" or "/api/books/{book}/".
+type bookRequest struct {
+	method      string
+	path        string
+	body        string
+	contentType string
+}
+
+// bookRequests covers every route of a book but restoring a snapshot, which
+// only an empty book takes.
+func bookRequests(t *testing.T) []bookRequest {
+	t.Helper()
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	for _, field := range [][2]string{{"firstName", "Mallory"}, {"lastName", "Martin"}, {"email", "mallory@example.com"}} {
+		if err := mw.WriteField(field[0], field[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return []bookRequest{
+		{method: http.MethodGet, path: "contacts"},
+		{method: http.MethodGet, path: "contact/1"},
+		{method: http.MethodGet, path: "contacts/export.csv"},
+		{method: http.MethodGet, path: "contacts/export.vcf"},
+		{method: http.MethodGet, path: "contacts/export.jsonl"},
+		{method: http.MethodGet, path: "trash"},
+		{method: http.MethodPost, path: "admin/snapshot"},
+		{method: http.MethodGet, path: "admin/audit"},
+		{method: http.MethodGet, path: "admin/audit/export.jsonl"},
+		{method: http.MethodPost, path: "add-contact", body: form.String(), contentType: mw.FormDataContentType()},
+		{method: http.MethodPut, path: "contact/1", body: "firstName=Mallory&lastName=Martin&email=mallory%40example.com", contentType: "application/x-www-form-urlencoded"},
+		{method: http.MethodPatch, path: "contact/1", body: `{"email":"mallory@example.com"}`, contentType: mergePatchType},
+		{method: http.MethodPut, path: "contact/1/shares", body: `[{"user":"mallory","access":"write"}]`, contentType: "application/json"},
+		{method: http.MethodPost, path: "batch", body: `[{"op":"update","id":3,"firstName":"Mallory","lastName":"Martin","email":"mallory@example.com"}]`, contentType: "application/json"},
+		{method: http.MethodPost, path: "contacts/import", body: "firstName,lastName,email\r\nMallory,Martin,mallory@example.com\r\n", contentType: "text/csv"},
+		{method: http.MethodPost, path: "contacts/import.vcf", body: "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Martin;Mallory;;;\r\nEMAIL:mallory@example.com\r\nEND:VCARD\r\n", contentType: vcardType},
+		{method: http.MethodPost, path: "contacts/import.jsonl", body: `{"id":1,"firstName":"Mallory","lastName":"Martin","email":"mallory@example.com"}` + "\n", contentType: "application/jsonl"},
+		{method: http.MethodPost, path: "trash/2/restore"},
+		{method: http.MethodDelete, path: "contact/3"},
+	}
+}
+
+func (tn *tenants) serve(client string, r bookRequest, path string) *httptest.ResponseRecorder {
+	return serve(tn.handler, r.method, path, r.body, with(tn.keys[client], "Content-Type", r.contentType))
+}
+
+// bookNotFound reports whether a response is the one for a book the client has
+// no grant for.
+func bookNotFound(response *httptest.ResponseRecorder) bool {
+	return response.Code == http.StatusNotFound && strings.Contains(response.Body.String(), "Address book not found")
+}
+
+// TestBooksAreIsolated checks that a client granted one book cannot read or
+// change another through any of its routes, and that each book's audit log
+// only ever shows its own entries.
+func TestBooksAreIsolated(t *testing.T) {
+	tn := newTenants(t)
+	// Alice's snapshot of her book, which she must not be able to restore
+	// into bob's.
+	response := serve(tn.handler, http.MethodPost, "/api/books/work/admin/snapshot", "", tn.keys["alice"])
+	if response.Code != http.StatusOK {
+		t.Fatalf("snapshot: %d %s", response.Code, response.Body)
+	}
+	restore := bookRequest{method: http.MethodPost, path: "admin/restore", body: response.Body.String(), contentType: "application/json"}
+	requests := bookRequests(t)
+	before := map[string]bookState{}
+	for book := range tn.apps {
+		before[book] = tn.state(t, book)
+	}
+
+	for _, r := range requests {
+		for _, denied := range []struct{ client, path string }{
+			{"alice", "/api/" + r.path},
+			{"alice", "/api/books/default/" + r.path},
+			{"bob", "/api/books/work/" + r.path},
+			{"alice", "/api/books/nowhere/" + r.path},
+		} {
+			if response := tn.serve(denied.client, r, denied.path); !bookNotFound(response) {
+				t.Errorf("%s %s %s: %d %s", denied.client, r.method, denied.path, response.Code, response.Body)
+			}
+		}
+	}
+	for _, path := range []string{"/api/admin/restore", "/api/books/archive/admin/restore"} {
+		if response := tn.serve("alice", restore, path); !bookNotFound(response) {
+			t.Errorf("alice POST %s: %d %s", path, response.Code, response.Body)
+		}
+	}
+	// CardDAV and the home page only ever serve the default book.
+	for _, r := range []bookRequest{
+		{method: http.MethodGet, path: "/"},
+		{method: "PROPFIND", path: bookPath, body: propfindETag, contentType: "application/xml"},
+		{method: "REPORT", path: bookPath, body: syncReport(""), contentType: "application/xml"},
+		{method: http.MethodGet, path: bookPath + "1.vcf"},
+		{method: http.MethodPut, path: bookPath + "1.vcf", body: davCard, contentType: vcardType},
+		{method: http.MethodDelete, path: bookPath + "3.vcf"},
+	} {
+		if response := tn.serve("alice", r, r.path); !bookNotFound(response) {
+			t.Errorf("alice %s %s: %d %s", r.method, r.path, response.Code, response.Body)
+		}
+	}
+	for book, want := range before {
+		if got := tn.state(t, book); !reflect.DeepEqual(got, want) {
+			t.Errorf("book %s was changed:\n got %+v\nwant %+v", book, got, want)
+		}
+	}
+	if books := tn.auditBooks(t); len(books) > 0 {
+		t.Errorf("refused requests were audited in %q", books)
+	}
+	response = serve(tn.handler, http.MethodGet, "/api/books", "", tn.keys["alice"])
+	var listed []bookJson
+	if err := json.Unmarshal(response.Body.Bytes(), &listed); err != nil || !slices.Equal(listed, []bookJson{{Name: "work", Role: auth.RoleAdmin}}) {
+		t.Errorf("alice's books: %s %v", response.Body, err)
+	}
+
+	// The same requests succeed in the client's own book, so it is the book
+	// that refuses them and not the request.
+	for _, r := range requests {
+		for _, allowed := range []struct{ client, path string }{
+			{"alice", "/api/books/work/" + r.path},
+			{"bob", "/api/" + r.path},
+		} {
+			if response := tn.serve(allowed.client, r, allowed.path); response.Code >= http.StatusMultipleChoices {
+				t.Errorf("%s %s %s: %d %s", allowed.client, r.method, allowed.path, response.Code, response.Body)
+			}
+		}
+	}
+	if response := tn.serve("bob", restore, "/api/books/archive/admin/restore"); response.Code != http.StatusOK {
+		t.Errorf("bob restoring into the archive: %d %s", response.Code, response.Body)
+	}
+	for _, own := range []struct{ client, book, path string }{
+		{"alice", "work", "/api/books/work/admin/audit"},
+		{"bob", appinterface.DefaultBook, "/api/admin/audit"},
+	} {
+		response := serve(tn.handler, http.MethodGet, own.path, "", tn.keys[own.client])
+		var entries []audit.Entry
+		if err := json.Unmarshal(response.Body.Bytes(), &entries); err != nil || len(entries) == 0 {
+			t.Fatalf("%s's audit log: %s %v", own.client, response.Body, err)
+		}
+		for _, e := range entries {
+			if e.Book != own.book {
+				t.Errorf("%s sees an entry of book %s", own.client, e.Book)
+			}
+		}
+		response = serve(tn.handler, http.MethodGet, own.path+"/export.jsonl", "", tn.keys[own.client])
+		lines := bufio.NewScanner(response.Body)
+		for lines.Scan() {
+			var e audit.Entry
+			if err := json.Unmarshal(lines.Bytes(), &e); err != nil || e.Book != own.book {
+				t.Errorf("%s's audit export holds %s %v", own.client, lines.Text(), err)
+			}
+		}
+	}
+}
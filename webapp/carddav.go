@@ -0,0 +1,691 @@
+package webapp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+// The CardDAV tree is fixed: one principal owning one address book.
+const (
+	davRoot       = "/dav/"
+	principalPath = "/dav/principals/me/"
+	homePath      = "/dav/addressbooks/"
+	bookPath      = "/dav/addressbooks/contacts/"
+
+	syncTokenPrefix = "http://example-api-server/ns/sync/"
+	// maxCardBody bounds the size of a vCard uploaded with PUT.
+	maxCardBody = 64 << 10
+	// maxDAVBody bounds the size of PROPFIND and REPORT bodies.
+	maxDAVBody = 1 << 20
+)
+
+type davKind int
+
+const (
+	davRootKind davKind = iota
+	davPrincipalKind
+	davHomeKind
+	davBookKind
+	davCardKind
+)
+
+type davResource struct {
+	href    string
+	kind    davKind
+	contact appinterface.Contact
+	// etag is the ETag of a card as the client sees it.
+	etag string
+}
+
+func davName(space string, local string) xml.Name {
+	return xml.Name{Space: space, Local: local}
+}
+
+var (
+	propResourceType         = davName(davNS, "resourcetype")
+	propDisplayName          = davName(davNS, "displayname")
+	propETag                 = davName(davNS, "getetag")
+	propContentType          = davName(davNS, "getcontenttype")
+	propCurrentUserPrincipal = davName(davNS, "current-user-principal")
+	propPrincipalURL         = davName(davNS, "principal-URL")
+	propSyncToken            = davName(davNS, "sync-token")
+	propSupportedReportSet   = davName(davNS, "supported-report-set")
+	propHomeSet              = davName(carddavNS, "addressbook-home-set")
+	propAddressData          = davName(carddavNS, "address-data")
+	propSupportedAddressData = davName(carddavNS, "supported-address-data")
+	propMaxResourceSize      = davName(carddavNS, "max-resource-size")
+	propCTag                 = davName(calendarServerNS, "getctag")
+)
+
+// allProps is what allprop returns.  address-data is deliberately left out,
+// as RFC 6352 asks.
+var allProps = []xml.Name{
+	propResourceType,
+	propDisplayName,
+	propETag,
+	propContentType,
+	propCurrentUserPrincipal,
+	propSyncToken,
+	propCTag,
+}
+
+type cardDAV struct {
+	webApp *webApp
+}
+
+func (w *webApp) newCardDAVHandler() http.Handler {
+	return &cardDAV{webApp: w}
+}
+
+func syncToken(token int) string {
+	return syncTokenPrefix + strconv.Itoa(token)
+}
+
+func parseSyncToken(token string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(token, syncTokenPrefix))
+	if err != nil || n < 0 || !strings.HasPrefix(token, syncTokenPrefix) {
+		return 0, false
+	}
+	return n, true
+}
+
+func cardHref(contact appinterface.Contact) string {
+	return fmt.Sprintf("%s%d.vcf", bookPath, contact.ID)
+}
+
+// cardID extracts the contact ID from the path of a card.
+func cardID(path string) (int, bool) {
+	name, ok := strings.CutPrefix(path, bookPath)
+	if !ok {
+		return 0, false
+	}
+	name, ok = strings.CutSuffix(name, ".vcf")
+	if !ok || strings.Contains(name, "/") {
+		return 0, false
+	}
+	id, err := strconv.Atoi(name)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+func cardData(contact appinterface.Contact, version string) string {
+	var b bytes.Buffer
+	_ = writeVCard(&b, contact, version)
+	return b.String()
+}
+
+// propValue renders a property of res.  ok is false when res does not have
+// the property.
+func (d *cardDAV) propValue(res davResource, prop davElement, token int) (string, bool) {
+	collection := "<d:collection/>"
+	switch prop.XMLName {
+	case propResourceType:
+		switch res.kind {
+		case davPrincipalKind:
+			return collection + "<d:principal/>", true
+		case davBookKind:
+			return collection + "<card:addressbook/>", true
+		case davCardKind:
+			return "", true
+		}
+		return collection, true
+	case propCurrentUserPrincipal:
+		return davHref(principalPath), true
+	case propDisplayName:
+		switch res.kind {
+		case davPrincipalKind:
+			return "me", true
+		case davBookKind:
+			return "Contacts", true
+		case davCardKind:
+			return davEscape(strings.TrimSpace(res.contact.FirstName + " " + res.contact.LastName)), true
+		}
+	case propPrincipalURL:
+		if res.kind == davPrincipalKind {
+			return davHref(principalPath), true
+		}
+	case propHomeSet:
+		if res.kind == davPrincipalKind {
+			return davHref(homePath), true
+		}
+	case propSyncToken:
+		if res.kind == davBookKind {
+			return davEscape(syncToken(token)), true
+		}
+	case propCTag:
+		if res.kind == davBookKind {
+			return strconv.Itoa(token), true
+		}
+	case propSupportedReportSet:
+		if res.kind == davBookKind {
+			var b strings.Builder
+			for _, r := range []string{"card:addressbook-query", "card:addressbook-multiget", "d:sync-collection"} {
+				b.WriteString("<d:supported-report><d:report><" + r + "/></d:report></d:supported-report>")
+			}
+			return b.String(), true
+		}
+	case propSupportedAddressData:
+		if res.kind == davBookKind {
+			return `<card:address-data-type content-type="text/vcard" version="3.0"/>` +
+				`<card:address-data-type content-type="text/vcard" version="4.0"/>`, true
+		}
+	case propMaxResourceSize:
+		if res.kind == davBookKind {
+			return strconv.Itoa(maxCardBody), true
+		}
+	case propETag:
+		if res.kind == davCardKind {
+			return davEscape(res.etag), true
+		}
+	case propContentType:
+		if res.kind == davCardKind {
+			return davEscape(vcardType), true
+		}
+	case propAddressData:
+		if res.kind == davCardKind {
+			version := prop.attr("version")
+			if version != "4.0" {
+				version = "3.0"
+			}
+			return davEscape(cardData(res.contact, version)), true
+		}
+	}
+	return "", false
+}
+
+// propResponse builds the response for res listing the properties asked for,
+// or every property in allProps when props is nil.
+func (d *cardDAV) propResponse(res davResource, props []davElement, token int) davResponse {
+	r := davResponse{href: res.href}
+	if props == nil {
+		for _, name := range allProps {
+			props = append(props, davElement{XMLName: name})
+		}
+		props = slices.DeleteFunc(props, func(p davElement) bool {
+			_, ok := d.propValue(res, p, token)
+			return !ok
+		})
+	}
+	for _, p := range props {
+		value, ok := d.propValue(res, p, token)
+		if ok {
+			r.found = append(r.found, davProp{name: p.XMLName, inner: value})
+		} else {
+			r.missing = append(r.missing, p.XMLName)
+		}
+	}
+	return r
+}
+
+// readDAVRequest decodes a PROPFIND or REPORT body.  An empty body is an
+// allprop request.
+func readDAVRequest(response http.ResponseWriter, request *http.Request) (*davRequest, error) {
+	request.Body = http.MaxBytesReader(response, request.Body, maxDAVBody)
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+	req := &davRequest{}
+	if len(bytes.TrimSpace(body)) == 0 {
+		req.AllProp = &struct{}{}
+		return req, nil
+	}
+	err = xml.Unmarshal(body, req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// requestedProps is nil for allprop and the named properties otherwise.
+func (req *davRequest) requestedProps() []davElement {
+	if req.Prop == nil {
+		return nil
+	}
+	return req.Prop.Props
+}
+
+func (d *cardDAV) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	path := request.URL.Path
+	response.Header().Set("DAV", "1, 3, addressbook")
+	perm := auth.PermRead
+	switch request.Method {
+	case http.MethodPut:
+		perm = auth.PermWrite
+	case http.MethodDelete:
+		perm = auth.PermDelete
+	}
+	if !d.webApp.can(request, perm) {
+		d.webApp.forbidden(perm, response, request)
+		return
+	}
+	switch request.Method {
+	case http.MethodOptions:
+		response.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+		response.WriteHeader(http.StatusOK)
+	case "PROPFIND":
+		d.propfind(response, request)
+	case "REPORT":
+		if path != bookPath {
+			http.Error(response, "REPORT is only supported on the address book", http.StatusMethodNotAllowed)
+			return
+		}
+		d.report(response, request)
+	case http.MethodGet, http.MethodHead:
+		d.getCard(response, request)
+	case http.MethodPut:
+		d.putCard(response, request)
+	case http.MethodDelete:
+		d.deleteCard(response, request)
+	default:
+		http.Error(response, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *cardDAV) appError(response http.ResponseWriter, err error) {
+	status, message := mutationErrorStatus("Error accessing contacts: %v", err)
+	if status == http.StatusInternalServerError {
+		log.Println(message)
+	}
+	if status == http.StatusServiceUnavailable {
+		response.Header().Set("Retry-After", strconv.Itoa(overloadRetryAfter))
+	}
+	http.Error(response, message, status)
+}
+
+func (d *cardDAV) propfind(response http.ResponseWriter, request *http.Request) {
+	req, err := readDAVRequest(response, request)
+	if err != nil {
+		http.Error(response, fmt.Sprintf("Error parsing PROPFIND: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.PropName != nil {
+		http.Error(response, "propname is not supported", http.StatusNotImplemented)
+		return
+	}
+	depth := request.Header.Get("Depth")
+	if depth == "" {
+		depth = "infinity"
+	}
+	props := req.requestedProps()
+
+	// Everything below the root is answered from one consistent change set,
+	// which is also where the address book's sync token comes from.
+	changes, err := d.webApp.book(request).Changes(request.Context(), 0)
+	if err != nil {
+		d.appError(response, err)
+		return
+	}
+	v := d.webApp.visibility(request)
+	changes.Updated = v.contacts(changes.Updated)
+	var resources []davResource
+	path := request.URL.Path
+	switch path {
+	case davRoot:
+		resources = append(resources, davResource{href: davRoot, kind: davRootKind})
+		if depth != "0" {
+			resources = append(resources,
+				davResource{href: davRoot + "principals/", kind: davRootKind},
+				davResource{href: homePath, kind: davHomeKind})
+		}
+	case davRoot + "principals/":
+		resources = append(resources, davResource{href: path, kind: davRootKind})
+		if depth != "0" {
+			resources = append(resources, davResource{href: principalPath, kind: davPrincipalKind})
+		}
+	case principalPath:
+		resources = append(resources, davResource{href: path, kind: davPrincipalKind})
+	case homePath:
+		resources = append(resources, davResource{href: path, kind: davHomeKind})
+		if depth != "0" {
+			resources = append(resources, davResource{href: bookPath, kind: davBookKind})
+		}
+	case bookPath:
+		resources = append(resources, davResource{href: path, kind: davBookKind})
+		if depth != "0" {
+			for _, c := range changes.Updated {
+				resources = append(resources, davResource{href: cardHref(c), kind: davCardKind, contact: c, etag: contactETag(c, v)})
+			}
+		}
+	default:
+		id, ok := cardID(path)
+		if !ok {
+			http.NotFound(response, request)
+			return
+		}
+		found := false
+		for _, c := range changes.Updated {
+			if c.ID == id {
+				resources = append(resources, davResource{href: path, kind: davCardKind, contact: c, etag: contactETag(c, v)})
+				found = true
+			}
+		}
+		if !found {
+			http.NotFound(response, request)
+			return
+		}
+	}
+	responses := make([]davResponse, len(resources))
+	for i, res := range resources {
+		responses[i] = d.propResponse(res, props, changes.Token)
+	}
+	writeMultistatus(response, responses, "")
+}
+
+func (d *cardDAV) report(response http.ResponseWriter, request *http.Request) {
+	req, err := readDAVRequest(response, request)
+	if err != nil {
+		http.Error(response, fmt.Sprintf("Error parsing REPORT: %v", err), http.StatusBadRequest)
+		return
+	}
+	req.book = d.webApp.book(request)
+	req.visibility = d.webApp.visibility(request)
+	switch req.XMLName {
+	case davName(carddavNS, "addressbook-multiget"):
+		d.multiget(request.Context(), response, req)
+	case davName(carddavNS, "addressbook-query"):
+		d.query(request.Context(), response, req)
+	case davName(davNS, "sync-collection"):
+		d.syncCollection(request.Context(), response, req)
+	default:
+		writeDAVError(response, http.StatusForbidden, davName(davNS, "supported-report"))
+	}
+}
+
+func (d *cardDAV) multiget(ctx context.Context, response http.ResponseWriter, req *davRequest) {
+	changes, err := req.book.Changes(ctx, 0)
+	if err != nil {
+		d.appError(response, err)
+		return
+	}
+	byID := map[int]appinterface.Contact{}
+	for _, c := range req.visibility.contacts(changes.Updated) {
+		byID[c.ID] = c
+	}
+	var responses []davResponse
+	for _, href := range req.Hrefs {
+		href = strings.TrimSpace(href)
+		path := href
+		if u, err := url.Parse(href); err == nil {
+			path = u.Path
+		}
+		id, ok := cardID(path)
+		contact, found := byID[id]
+		if !ok || !found {
+			responses = append(responses, davResponse{href: href, status: http.StatusNotFound})
+			continue
+		}
+		res := davResource{href: href, kind: davCardKind, contact: contact, etag: contactETag(contact, req.visibility)}
+		responses = append(responses, d.propResponse(res, req.requestedProps(), changes.Token))
+	}
+	writeMultistatus(response, responses, "")
+}
+
+// textMatches implements a CardDAV text-match against a single value.
+func textMatches(m davTextMatch, value string) bool {
+	text := strings.TrimSpace(m.Text)
+	if m.Collation != "i;octet" {
+		text = strings.ToLower(text)
+		value = strings.ToLower(value)
+	}
+	var match bool
+	switch m.MatchType {
+	case "equals":
+		match = value == text
+	case "starts-with":
+		match = strings.HasPrefix(value, text)
+	case "ends-with":
+		match = strings.HasSuffix(value, text)
+	default:
+		match = strings.Contains(value, text)
+	}
+	if m.Negate == "yes" {
+		return !match
+	}
+	return match
+}
+
+// contactPropertyValues lists the values a vCard property of contact has for
+// the purpose of filtering.  Properties we do not store have none.
+func contactPropertyValues(contact appinterface.Contact, name string) []string {
+	switch strings.ToUpper(name) {
+	case "FN":
+		return []string{strings.TrimSpace(contact.FirstName + " " + contact.LastName)}
+	case "N":
+		return []string{contact.LastName + ";" + contact.FirstName + ";;;", contact.LastName, contact.FirstName}
+	case "EMAIL":
+		return []string{contact.Email}
+	case "UID":
+		return []string{contactUID(contact)}
+	}
+	return nil
+}
+
+func propFilterMatches(f davPropFilter, contact appinterface.Contact) bool {
+	values := contactPropertyValues(contact, f.Name)
+	if f.IsNotDefined != nil {
+		return len(values) == 0
+	}
+	if len(f.TextMatches) == 0 {
+		return len(values) > 0
+	}
+	allOf := f.Test == "allof"
+	for _, m := range f.TextMatches {
+		matched := false
+		for _, v := range values {
+			if textMatches(m, v) {
+				matched = true
+				break
+			}
+		}
+		if allOf && !matched {
+			return false
+		}
+		if !allOf && matched {
+			return true
+		}
+	}
+	return allOf
+}
+
+func filterMatches(f *davFilter, contact appinterface.Contact) bool {
+	if f == nil || len(f.PropFilters) == 0 {
+		return true
+	}
+	allOf := f.Test == "allof"
+	for _, pf := range f.PropFilters {
+		matched := propFilterMatches(pf, contact)
+		if allOf && !matched {
+			return false
+		}
+		if !allOf && matched {
+			return true
+		}
+	}
+	return allOf
+}
+
+func (d *cardDAV) query(ctx context.Context, response http.ResponseWriter, req *davRequest) {
+	changes, err := req.book.Changes(ctx, 0)
+	if err != nil {
+		d.appError(response, err)
+		return
+	}
+	var responses []davResponse
+	// Filters see only what the client may, so they cannot be used to probe
+	// a masked field.
+	for _, c := range req.visibility.contacts(changes.Updated) {
+		if !filterMatches(req.Filter, c) {
+			continue
+		}
+		if req.Limit != nil && req.Limit.NResults > 0 && len(responses) >= req.Limit.NResults {
+			// RFC 6352 asks for a 507 response for the request URI when the
+			// result has been truncated.
+			responses = append(responses, davResponse{href: bookPath, status: http.StatusInsufficientStorage})
+			break
+		}
+		res := davResource{href: cardHref(c), kind: davCardKind, contact: c, etag: contactETag(c, req.visibility)}
+		responses = append(responses, d.propResponse(res, req.requestedProps(), changes.Token))
+	}
+	writeMultistatus(response, responses, "")
+}
+
+func (d *cardDAV) syncCollection(ctx context.Context, response http.ResponseWriter, req *davRequest) {
+	since := 0
+	if req.SyncToken != "" {
+		var ok bool
+		since, ok = parseSyncToken(strings.TrimSpace(req.SyncToken))
+		if !ok {
+			writeDAVError(response, http.StatusForbidden, davName(davNS, "valid-sync-token"))
+			return
+		}
+	}
+	changes, err := req.book.Changes(ctx, since)
+	if errors.Is(err, appinterface.ErrSyncTokenExpired) {
+		writeDAVError(response, http.StatusForbidden, davName(davNS, "valid-sync-token"))
+		return
+	}
+	if err != nil {
+		d.appError(response, err)
+		return
+	}
+	var responses []davResponse
+	for _, c := range req.visibility.contacts(changes.Updated) {
+		res := davResource{href: cardHref(c), kind: davCardKind, contact: c, etag: contactETag(c, req.visibility)}
+		responses = append(responses, d.propResponse(res, req.requestedProps(), changes.Token))
+	}
+	for _, id := range changes.Deleted {
+		href := cardHref(appinterface.Contact{ID: id})
+		responses = append(responses, davResponse{href: href, status: http.StatusNotFound})
+	}
+	writeMultistatus(response, responses, syncToken(changes.Token))
+}
+
+func (d *cardDAV) getCard(response http.ResponseWriter, request *http.Request) {
+	id, ok := cardID(request.URL.Path)
+	if !ok {
+		http.NotFound(response, request)
+		return
+	}
+	contact, err := d.webApp.book(request).ContactDetails(request.Context(), id)
+	if err != nil {
+		d.appError(response, err)
+		return
+	}
+	v := d.webApp.visibility(request)
+	etag := contactETag(contact, v)
+	response.Header().Set("ETag", etag)
+	varyByClient(response)
+	if notModified(request, etag) {
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+	standardHeaders(vcardType, response)
+	if request.Method == http.MethodHead {
+		return
+	}
+	_, err = io.WriteString(response, cardData(v.Contact(contact), "3.0"))
+	if err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
+
+// putCard stores an uploaded vCard over the contact its card names.  Cards
+// are named after contact IDs, which the app hands out, so a new card could
+// only be created under another name than the one the client chose, and
+// clients would lose track of it.  New cards are refused instead; contacts
+// are added through the API and show up at the next sync.
+func (d *cardDAV) putCard(response http.ResponseWriter, request *http.Request) {
+	path := request.URL.Path
+	if !strings.HasPrefix(path, bookPath) || strings.Contains(strings.TrimPrefix(path, bookPath), "/") || path == bookPath {
+		http.Error(response, "Cards can only be stored in the address book", http.StatusForbidden)
+		return
+	}
+	id, ok := cardID(path)
+	if !ok {
+		http.Error(response, "New cards cannot be created over CardDAV", http.StatusForbidden)
+		return
+	}
+	request.Body = http.MaxBytesReader(response, request.Body, maxCardBody)
+	cards, err := parseVCards(request.Body)
+	if err == nil && len(cards) != 1 {
+		err = errors.New("expected exactly one vCard")
+	}
+	if err == nil {
+		err = cards[0].Err
+	}
+	var contact appinterface.Contact
+	if err == nil {
+		contact, err = vcardToContact(cards[0].Card)
+	}
+	if err != nil {
+		writeDAVError(response, http.StatusForbidden, davName(carddavNS, "valid-address-data"))
+		return
+	}
+
+	ifMatch, conditional := ifMatchVersions(request, d.webApp.visibility(request))
+	if conditional && len(ifMatch) == 0 {
+		http.Error(response, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	book := d.webApp.book(request)
+	_, err = book.ContactDetails(request.Context(), id)
+	if err == io.EOF {
+		http.Error(response, "New cards cannot be created over CardDAV", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		d.appError(response, err)
+		return
+	}
+	if request.Header.Get("If-None-Match") == "*" {
+		http.Error(response, "Card already exists", http.StatusPreconditionFailed)
+		return
+	}
+	err = book.UpdateContact(request.Context(), id, ifMatch, contact.FirstName, contact.LastName, contact.Email)
+	if err != nil {
+		d.appError(response, err)
+		return
+	}
+	// The stored card is not byte-for-byte what was uploaded, so no ETag is
+	// returned and clients will fetch it again.
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (d *cardDAV) deleteCard(response http.ResponseWriter, request *http.Request) {
+	id, ok := cardID(request.URL.Path)
+	if !ok {
+		http.Error(response, "Only cards can be deleted", http.StatusForbidden)
+		return
+	}
+	ifMatch, conditional := ifMatchVersions(request, d.webApp.visibility(request))
+	if conditional && len(ifMatch) == 0 {
+		http.Error(response, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	err := d.webApp.book(request).DeleteContact(request.Context(), id, ifMatch)
+	if err != nil {
+		d.appError(response, err)
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (w *webApp) wellKnownCardDAV(response http.ResponseWriter, request *http.Request) {
+	http.Redirect(response, request, davRoot, http.StatusMovedPermanently)
+}
@@ -0,0 +1,300 @@
+package webapp
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+// multistatus is what the tests read of a 207 response.
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Status   string `xml:"status"`
+		Propstat []struct {
+			Prop struct {
+				ETag        string `xml:"getetag"`
+				DisplayName string `xml:"displayname"`
+				AddressData string `xml:"address-data"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+	SyncToken string `xml:"sync-token"`
+}
+
+func (m multistatus) hrefs() []string {
+	var result []string
+	for _, r := range m.Responses {
+		result = append(result, r.Href)
+	}
+	slices.Sort(result)
+	return result
+}
+
+// status returns the status of the response for href, or of its first
+// propstat when the response has none of its own.
+func (m multistatus) status(href string) string {
+	for _, r := range m.Responses {
+		if r.Href != href {
+			continue
+		}
+		if r.Status != "" || len(r.Propstat) == 0 {
+			return r.Status
+		}
+		return r.Propstat[0].Status
+	}
+	return ""
+}
+
+func (m multistatus) etag(href string) string {
+	for _, r := range m.Responses {
+		for _, p := range r.Propstat {
+			if r.Href == href && p.Prop.ETag != "" {
+				return p.Prop.ETag
+			}
+		}
+	}
+	return ""
+}
+
+func dav(t *testing.T, handler http.Handler, method string, path string, body string, header map[string]string) multistatus {
+	t.Helper()
+	response := serve(handler, method, path, body, with(header, "Content-Type", "application/xml"))
+	if response.Code != http.StatusMultiStatus {
+		t.Fatalf("%s %s: %d %s", method, path, response.Code, response.Body)
+	}
+	var m multistatus
+	if err := xml.Unmarshal(response.Body.Bytes(), &m); err != nil {
+		t.Fatalf("%s %s: %v\n%s", method, path, err, response.Body)
+	}
+	return m
+}
+
+const (
+	propfindETag = `<?xml version="1.0"?><d:propfind xmlns:d="DAV:"><d:prop><d:getetag/><d:displayname/></d:prop></d:propfind>`
+	davReportNS  = `xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav"`
+)
+
+func syncReport(token string) string {
+	return `<d:sync-collection ` + davReportNS + `><d:sync-token>` + token + `</d:sync-token><d:sync-level>1</d:sync-level><d:prop><d:getetag/></d:prop></d:sync-collection>`
+}
+
+// newDAVBook is a book with a contact for each of Ada, Grace and Alan, in
+// that order of IDs, served without authentication.
+func newDAVBook(t *testing.T) (appinterface.App, http.Handler) {
+	t.Helper()
+	a := newTestApp(t)
+	addContacts(t, a, []appinterface.Contact{
+		{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"},
+		{FirstName: "Grace", LastName: "Hopper", Email: "grace@example.org"},
+		{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"},
+	})
+	return a, NewWebApp(a)
+}
+
+func TestCardDAVPropfind(t *testing.T) {
+	_, handler := newDAVBook(t)
+	m := dav(t, handler, "PROPFIND", bookPath, propfindETag, map[string]string{"Depth": "1"})
+	want := []string{bookPath, bookPath + "1.vcf", bookPath + "2.vcf", bookPath + "3.vcf"}
+	if got := m.hrefs(); !slices.Equal(got, want) {
+		t.Errorf("depth 1 lists %q, want %q", got, want)
+	}
+	if got := m.etag(bookPath + "1.vcf"); got != `"v1"` {
+		t.Errorf("ETag of a card is %q", got)
+	}
+
+	m = dav(t, handler, "PROPFIND", bookPath, propfindETag, map[string]string{"Depth": "0"})
+	if got := m.hrefs(); !slices.Equal(got, []string{bookPath}) {
+		t.Errorf("depth 0 lists %q", got)
+	}
+
+	m = dav(t, handler, "PROPFIND", bookPath+"2.vcf", propfindETag, map[string]string{"Depth": "0"})
+	if len(m.Responses) != 1 || m.Responses[0].Propstat[0].Prop.DisplayName != "Grace Hopper" {
+		t.Errorf("card: %+v", m)
+	}
+
+	response := serve(handler, "PROPFIND", bookPath+"9.vcf", propfindETag, map[string]string{"Depth": "0"})
+	if response.Code != http.StatusNotFound {
+		t.Errorf("PROPFIND of a missing card: %d", response.Code)
+	}
+}
+
+func TestCardDAVMultigetAndQuery(t *testing.T) {
+	_, handler := newDAVBook(t)
+	multiget := `<card:addressbook-multiget ` + davReportNS + `><d:prop><d:getetag/><card:address-data/></d:prop>` +
+		`<d:href>` + bookPath + `1.vcf</d:href><d:href>` + bookPath + `9.vcf</d:href></card:addressbook-multiget>`
+	m := dav(t, handler, "REPORT", bookPath, multiget, nil)
+	if m.status(bookPath+"9.vcf") != "HTTP/1.1 404 Not Found" {
+		t.Errorf("missing card: %+v", m)
+	}
+	if len(m.Responses) != 2 || !strings.Contains(m.Responses[0].Propstat[0].Prop.AddressData, "EMAIL;TYPE=INTERNET:ada@example.com") {
+		t.Errorf("multiget: %+v", m)
+	}
+
+	query := `<card:addressbook-query ` + davReportNS + `><d:prop><d:getetag/></d:prop><card:filter>` +
+		`<card:prop-filter name="EMAIL"><card:text-match match-type="ends-with">example.org</card:text-match></card:prop-filter>` +
+		`</card:filter></card:addressbook-query>`
+	m = dav(t, handler, "REPORT", bookPath, query, nil)
+	if got, want := m.hrefs(), []string{bookPath + "2.vcf", bookPath + "3.vcf"}; !slices.Equal(got, want) {
+		t.Errorf("query found %q, want %q", got, want)
+	}
+
+	response := serve(handler, "REPORT", bookPath, `<d:unknown-report xmlns:d="DAV:"/>`, nil)
+	if response.Code != http.StatusForbidden || !strings.Contains(response.Body.String(), "supported-report") {
+		t.Errorf("unknown report: %d %s", response.Code, response.Body)
+	}
+}
+
+func TestCardDAVSyncCollection(t *testing.T) {
+	a, handler := newDAVBook(t)
+	initial := dav(t, handler, "REPORT", bookPath, syncReport(""), nil)
+	if len(initial.Responses) != 3 || initial.SyncToken == "" {
+		t.Fatalf("initial sync: %+v", initial)
+	}
+
+	unchanged := dav(t, handler, "REPORT", bookPath, syncReport(initial.SyncToken), nil)
+	if len(unchanged.Responses) != 0 || unchanged.SyncToken != initial.SyncToken {
+		t.Errorf("sync without changes: %+v", unchanged)
+	}
+
+	ctx := context.Background()
+	if err := a.UpdateContact(ctx, 1, nil, "Augusta Ada", "Lovelace", "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DeleteContact(ctx, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	changed := dav(t, handler, "REPORT", bookPath, syncReport(initial.SyncToken), nil)
+	if got, want := changed.hrefs(), []string{bookPath + "1.vcf", bookPath + "3.vcf"}; !slices.Equal(got, want) {
+		t.Errorf("sync after changes reports %q, want %q", got, want)
+	}
+	if changed.etag(bookPath+"1.vcf") != `"v2"` || changed.status(bookPath+"3.vcf") != "HTTP/1.1 404 Not Found" {
+		t.Errorf("sync after changes: %+v", changed)
+	}
+	if changed.SyncToken == initial.SyncToken {
+		t.Errorf("sync token did not move on")
+	}
+
+	for _, token := range []string{"bogus", syncTokenPrefix + "999"} {
+		response := serve(handler, "REPORT", bookPath, syncReport(token), nil)
+		if response.Code != http.StatusForbidden || !strings.Contains(response.Body.String(), "valid-sync-token") {
+			t.Errorf("sync token %q: %d %s", token, response.Code, response.Body)
+		}
+	}
+}
+
+const davCard = "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Hopper;Grace Brewster;;;\r\nEMAIL:grace@example.org\r\nEND:VCARD\r\n"
+
+func TestCardDAVPut(t *testing.T) {
+	a, handler := newDAVBook(t)
+	vcard := map[string]string{"Content-Type": vcardType}
+
+	response := serve(handler, http.MethodPut, bookPath+"2.vcf", davCard, with(vcard, "If-Match", `"v7"`))
+	if response.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with a stale If-Match: %d", response.Code)
+	}
+	response = serve(handler, http.MethodPut, bookPath+"2.vcf", davCard, with(vcard, "If-None-Match", "*"))
+	if response.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT over an existing card with If-None-Match: %d", response.Code)
+	}
+	response = serve(handler, http.MethodPut, bookPath+"2.vcf", davCard, with(vcard, "If-Match", `"v1"`))
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", response.Code, response.Body)
+	}
+	contact, err := a.ContactDetails(context.Background(), 2)
+	if err != nil || contact.FirstName != "Grace Brewster" || contact.Version != 2 {
+		t.Errorf("contact after PUT: %+v %v", contact, err)
+	}
+
+	// Clients name the cards they create, and a card the server stored
+	// under another name would be lost to them.
+	for _, path := range []string{bookPath + "new-card-uid.vcf", bookPath + "99.vcf"} {
+		response = serve(handler, http.MethodPut, path, davCard, with(vcard, "If-None-Match", "*"))
+		if response.Code != http.StatusForbidden {
+			t.Errorf("PUT of a new card at %s: %d", path, response.Code)
+		}
+	}
+	if n := len(getContacts(t, a)); n != 3 {
+		t.Errorf("new cards created %d contacts", n-3)
+	}
+
+	response = serve(handler, http.MethodPut, bookPath+"1.vcf", "BEGIN:VCARD\r\nVERSION:3.0\r\nEND:VCARD\r\n", vcard)
+	if response.Code != http.StatusForbidden || !strings.Contains(response.Body.String(), "valid-address-data") {
+		t.Errorf("PUT of an invalid card: %d %s", response.Code, response.Body)
+	}
+}
+
+func TestCardDAVGetAndDelete(t *testing.T) {
+	_, handler := newDAVBook(t)
+	response := serve(handler, http.MethodGet, bookPath+"1.vcf", "", nil)
+	if response.Code != http.StatusOK || response.Header().Get("ETag") != `"v1"` || !strings.Contains(response.Body.String(), "N:Lovelace;Ada;;;") {
+		t.Fatalf("GET: %d %v %s", response.Code, response.Header(), response.Body)
+	}
+	response = serve(handler, http.MethodGet, bookPath+"1.vcf", "", map[string]string{"If-None-Match": `"v1"`})
+	if response.Code != http.StatusNotModified {
+		t.Errorf("GET with a matching If-None-Match: %d", response.Code)
+	}
+
+	response = serve(handler, http.MethodDelete, bookPath+"1.vcf", "", map[string]string{"If-Match": `"v2"`})
+	if response.Code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with a stale If-Match: %d", response.Code)
+	}
+	response = serve(handler, http.MethodDelete, bookPath+"1.vcf", "", map[string]string{"If-Match": `"v1"`})
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", response.Code, response.Body)
+	}
+	response = serve(handler, http.MethodGet, bookPath+"1.vcf", "", nil)
+	if response.Code != http.StatusNotFound {
+		t.Errorf("GET of a deleted card: %d", response.Code)
+	}
+	response = serve(handler, http.MethodDelete, bookPath, "", nil)
+	if response.Code != http.StatusForbidden {
+		t.Errorf("DELETE of the address book: %d", response.Code)
+	}
+}
+
+// TestCardDAVPrincipal checks that CardDAV only shows and changes what the
+// client may, like the API does.
+func TestCardDAVPrincipal(t *testing.T) {
+	a := newTestApp(t)
+	if err := a.AddContact(asUser("alice"), "Private", "Contact", "private@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddContact(asUser("bob"), "Bobs", "Contact", "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	options := Options{}
+	keys := withKeys(t, &options, map[string]auth.Role{"alice": auth.RoleEditor, "bob": auth.RoleEditor})
+	handler, err := NewWebAppWithOptions(appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: a}), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := dav(t, handler, "PROPFIND", bookPath, propfindETag, with(keys["bob"], "Depth", "1"))
+	if got, want := m.hrefs(), []string{bookPath, bookPath + "2.vcf"}; !slices.Equal(got, want) {
+		t.Errorf("bob sees %q, want %q", got, want)
+	}
+	m = dav(t, handler, "REPORT", bookPath, syncReport(""), keys["bob"])
+	if got, want := m.hrefs(), []string{bookPath + "2.vcf"}; !slices.Equal(got, want) {
+		t.Errorf("bob syncs %q, want %q", got, want)
+	}
+	response := serve(handler, http.MethodGet, bookPath+"1.vcf", "", keys["bob"])
+	if response.Code != http.StatusNotFound {
+		t.Errorf("bob gets alice's card: %d", response.Code)
+	}
+	response = serve(handler, http.MethodPut, bookPath+"1.vcf", davCard, with(keys["bob"], "Content-Type", vcardType))
+	if response.Code == http.StatusNoContent {
+		t.Errorf("bob changed alice's card")
+	}
+	response = serve(handler, http.MethodGet, bookPath+"1.vcf", "", keys["alice"])
+	if response.Code != http.StatusOK {
+		t.Errorf("alice gets her own card: %d", response.Code)
+	}
+}
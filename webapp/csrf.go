@@ -0,0 +1,87 @@
+package webapp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// csrfHeader carries the CSRF token of a session on the requests the
+	// home page makes, and csrfField on the forms it submits.
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrfToken"
+)
+
+// safeMethod reports whether method only ever reads, which CSRF cannot be
+// used to abuse.  PROPFIND and REPORT are CardDAV's reads.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND", "REPORT":
+		return true
+	}
+	return false
+}
+
+// crossSite reports whether a browser says it sent request on behalf of
+// another site.  Clients that are not browsers send neither header.
+func crossSite(request *http.Request) bool {
+	switch request.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	// An opaque origin is sent as "null", which has no host to match.
+	u, err := url.Parse(origin)
+	return err != nil || u.Host == "" || !strings.EqualFold(u.Host, request.Host)
+}
+
+func validCSRFToken(sent string, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(want)) == 1
+}
+
+// csrfRefusal returns why a change c asked for is refused, or "" if it is
+// not.  Browsers send cookies and basic credentials along with requests
+// made by any site, so changes that rely on them must not come from another
+// site, and those of sessions must carry the session's CSRF token too.
+// Bearer tokens are only ever sent by clients that hold them.
+func csrfRefusal(c client, request *http.Request) string {
+	if safeMethod(request.Method) || c.Bearer {
+		return ""
+	}
+	if crossSite(request) {
+		return "Cross-site requests may not make changes"
+	}
+	if c.CSRFToken != "" && !validCSRFToken(request.Header.Get(csrfHeader), c.CSRFToken) {
+		return "Missing or invalid CSRF token"
+	}
+	return ""
+}
+
+func (w *webApp) csrfForbidden(reason string, response http.ResponseWriter) {
+	r := problemJson{
+		Type:   "about:blank",
+		Title:  http.StatusText(http.StatusForbidden),
+		Status: http.StatusForbidden,
+		Detail: reason,
+	}
+	bts, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Error marshalling problem: %v\n", err)
+		w.errorPage("ERROR", renderError(err), http.StatusInternalServerError, response)
+		return
+	}
+	standardHeaders("application/problem+json", response)
+	response.WriteHeader(http.StatusForbidden)
+	_, err = response.Write(bts)
+	if err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
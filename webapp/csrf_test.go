@@ -0,0 +1,159 @@
+package webapp
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+// csrfMeta is where the pages rendered for a session carry its CSRF token.
+var csrfMeta = regexp.MustCompile(`<meta name="csrf-token" content="([^"]+)">`)
+
+// secretOf returns the API key in the "Authorization" header withKeys made.
+func secretOf(header map[string]string) string {
+	return strings.TrimPrefix(header["Authorization"], "Bearer ")
+}
+
+// basicAuth returns the "Authorization" header of HTTP basic authentication
+// with the API key secret as the password, as CardDAV clients send.
+func basicAuth(name string, secret string) map[string]string {
+	return map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(name+":"+secret))}
+}
+
+// signIn signs a browser in with the API key secret and returns the
+// "Cookie" header of its session and the session's CSRF token, read off the
+// home page as the browser would.
+func signIn(t *testing.T, handler http.Handler, secret string) (map[string]string, string) {
+	t.Helper()
+	response := serve(handler, http.MethodPost, "/login", "apiKey="+url.QueryEscape(secret),
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	if response.Code != http.StatusSeeOther {
+		t.Fatalf("sign in: %d %s", response.Code, response.Body)
+	}
+	var cookie *http.Cookie
+	for _, c := range response.Result().Cookies() {
+		if c.Name == sessionCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("sign in set no session cookie: %v", response.Header())
+	}
+	session := map[string]string{"Cookie": cookie.Name + "=" + cookie.Value}
+	home := serve(handler, http.MethodGet, "/", "", session)
+	m := csrfMeta.FindStringSubmatch(home.Body.String())
+	if home.Code != http.StatusOK || m == nil {
+		t.Fatalf("home page of the session: %d %s", home.Code, home.Body)
+	}
+	return session, m[1]
+}
+
+// newSignedInBook serves a book holding Ada (ID 1) to the editor "ed" and
+// returns the handler, ed's bearer header, and the cookie and CSRF token of
+// a session ed signed in to.
+func newSignedInBook(t *testing.T) (http.Handler, map[string]string, map[string]string, string) {
+	t.Helper()
+	a := newTestApp(t)
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+	options := Options{SessionLifetime: time.Hour}
+	keys := withKeys(t, &options, map[string]auth.Role{"ed": auth.RoleEditor})
+	handler, err := NewWebAppWithOptions(appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: a}), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, token := signIn(t, handler, secretOf(keys["ed"]))
+	return handler, keys["ed"], session, token
+}
+
+func TestCSRF(t *testing.T) {
+	handler, bearer, session, token := newSignedInBook(t)
+	basic := basicAuth("ed", secretOf(bearer))
+	withToken := with(session, csrfHeader, token)
+	const change = "firstName=Augusta&lastName=King&email=ada%40example.com"
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header map[string]string
+		status int
+	}{
+		{name: "session with its token", header: withToken, status: http.StatusOK},
+		{name: "session from the same origin", header: with(withToken, "Sec-Fetch-Site", "same-origin", "Origin", "http://example.com"), status: http.StatusOK},
+		{name: "session without a token", header: session, status: http.StatusForbidden},
+		{name: "session with a wrong token", header: with(session, csrfHeader, token+"x"), status: http.StatusForbidden},
+		{name: "session with another session's token", header: with(session, csrfHeader, "c2Vzc2lvbg"), status: http.StatusForbidden},
+		{name: "cross-site session", header: with(withToken, "Sec-Fetch-Site", "cross-site"), status: http.StatusForbidden},
+		{name: "same-site session", header: with(withToken, "Sec-Fetch-Site", "same-site"), status: http.StatusForbidden},
+		{name: "session from another origin", header: with(withToken, "Origin", "https://evil.example"), status: http.StatusForbidden},
+		{name: "session from an opaque origin", header: with(withToken, "Origin", "null"), status: http.StatusForbidden},
+		{name: "session reading cross-site", method: http.MethodGet, path: "/api/contact/1", header: with(session, "Sec-Fetch-Site", "cross-site"), status: http.StatusOK},
+		{name: "bearer token", header: bearer, status: http.StatusOK},
+		{name: "cross-site bearer token", header: with(bearer, "Sec-Fetch-Site", "cross-site", "Origin", "https://evil.example"), status: http.StatusOK},
+		{name: "basic credentials", header: basic, status: http.StatusOK},
+		{name: "basic credentials from another site", header: with(basic, "Sec-Fetch-Site", "cross-site"), status: http.StatusForbidden},
+		{name: "basic credentials from another origin", header: with(basic, "Origin", "https://evil.example"), status: http.StatusForbidden},
+		{name: "public path", method: http.MethodPost, path: cspReportPath, body: "{}", status: http.StatusNoContent},
+		{name: "public path from another site", method: http.MethodPost, path: cspReportPath, body: "{}", header: map[string]string{"Sec-Fetch-Site": "cross-site"}, status: http.StatusForbidden},
+		{name: "sign in from another origin", method: http.MethodPost, path: "/login", body: "apiKey=" + url.QueryEscape(secretOf(bearer)),
+			header: map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Origin": "https://evil.example"}, status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method, path, body := http.MethodPut, "/api/contact/1", change
+			header := with(test.header, "Content-Type", "application/x-www-form-urlencoded")
+			if test.method != "" {
+				method, path, body, header = test.method, test.path, test.body, test.header
+			}
+			response := serve(handler, method, path, body, header)
+			if response.Code != test.status {
+				t.Fatalf("got %d %s, want %d", response.Code, response.Body, test.status)
+			}
+			if response.Code == http.StatusForbidden && response.Header().Get("Content-Type") != "application/problem+json" {
+				t.Errorf("refusal sent as %q", response.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestLogoutNeedsCSRFToken(t *testing.T) {
+	handler, _, session, token := newSignedInBook(t)
+	form := with(session, "Content-Type", "application/x-www-form-urlencoded")
+	for _, body := range []string{"", csrfField + "=wrong"} {
+		response := serve(handler, http.MethodPost, "/logout", body, form)
+		if response.Code != http.StatusForbidden {
+			t.Errorf("sign out with %q: %d", body, response.Code)
+		}
+	}
+	response := serve(handler, http.MethodPost, "/logout", csrfField+"="+token, with(form, "Sec-Fetch-Site", "cross-site"))
+	if response.Code != http.StatusForbidden {
+		t.Errorf("cross-site sign out: %d", response.Code)
+	}
+	if response := serve(handler, http.MethodGet, "/api/contact/1", "", session); response.Code != http.StatusOK {
+		t.Fatalf("the refused sign outs ended the session: %d", response.Code)
+	}
+
+	response = serve(handler, http.MethodPost, "/logout", csrfField+"="+url.QueryEscape(token), form)
+	if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/login" {
+		t.Errorf("sign out: %d %v", response.Code, response.Header())
+	}
+	if cookies := response.Result().Cookies(); len(cookies) != 1 || cookies[0].Name != sessionCookie || cookies[0].MaxAge >= 0 {
+		t.Errorf("sign out left the cookie: %v", cookies)
+	}
+	if response := serve(handler, http.MethodGet, "/api/contact/1", "", session); response.Code != http.StatusUnauthorized {
+		t.Errorf("the session outlived its sign out: %d", response.Code)
+	}
+
+	// A browser whose session is gone can still sign out.
+	response = serve(handler, http.MethodPost, "/logout", "", form)
+	if response.Code != http.StatusSeeOther {
+		t.Errorf("sign out of an ended session: %d", response.Code)
+	}
+}
@@ -0,0 +1,312 @@
+package webapp
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"example-api-server/appinterface"
+)
+
+const (
+	// maxImportBody bounds the size of an uploaded CSV file.
+	maxImportBody = 10 << 20
+	// maxImportRows bounds the number of contacts in one import.
+	maxImportRows = 10000
+)
+
+var csvHeader = []string{"id", "firstName", "lastName", "email"}
+
+// csvColumnAliases maps normalized header names onto contact fields.  Besides
+// our own export format it covers the headers written by Google Contacts and
+// Outlook.
+var csvColumnAliases = map[string]string{
+	"id":                  "id",
+	"firstname":           "firstName",
+	"first":               "firstName",
+	"givenname":           "firstName",
+	"lastname":            "lastName",
+	"last":                "lastName",
+	"familyname":          "lastName",
+	"surname":             "lastName",
+	"email":               "email",
+	"emailaddress":        "email",
+	"email1value":         "email",
+	"primaryemail":        "email",
+	"emailaddress1":       "email",
+	"email1emailaddress":  "email",
+	"defaultemailaddress": "email",
+}
+
+// normalizeColumn lowercases a header and strips everything but letters and
+// digits so "E-mail 1 - Value" and "email1value" compare equal.
+func normalizeColumn(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// csvColumns works out which column holds each contact field.  Explicit
+// mappings, given as query parameters like ?email=Work%20Email, win over the
+// aliases.
+func csvColumns(header []string, mapping map[string]string) (map[string]int, error) {
+	columns := map[string]int{}
+	for i, name := range header {
+		field, ok := csvColumnAliases[normalizeColumn(name)]
+		if _, taken := columns[field]; ok && !taken {
+			columns[field] = i
+		}
+	}
+	for field, name := range mapping {
+		idx := -1
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), strings.TrimSpace(name)) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("column %q mapped to %s is not in the header", name, field)
+		}
+		columns[field] = idx
+	}
+	for _, field := range []string{"firstName", "lastName", "email"} {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("no column found for %s", field)
+		}
+	}
+	return columns, nil
+}
+
+type importRowJson struct {
+	Row     int                       `json:"row"`
+	Action  appinterface.ImportAction `json:"action"`
+	Contact *appinterface.Contact     `json:"contact,omitempty"`
+	Error   string                    `json:"error,omitempty"`
+}
+
+type importResponseJson struct {
+	DryRun  bool            `json:"dryRun"`
+	Created int             `json:"created"`
+	Updated int             `json:"updated"`
+	Skipped int             `json:"skipped"`
+	Failed  int             `json:"failed"`
+	Rows    []importRowJson `json:"rows"`
+}
+
+func (r *importResponseJson) add(row importRowJson) {
+	switch row.Action {
+	case appinterface.ImportCreated:
+		r.Created++
+	case appinterface.ImportUpdated:
+		r.Updated++
+	case appinterface.ImportSkipped:
+		r.Skipped++
+	case appinterface.ImportFailed:
+		r.Failed++
+	}
+	r.Rows = append(r.Rows, row)
+}
+
+// importResultRow turns the app's verdict on one contact into a report row,
+// showing the contact as v allows.
+func importResultRow(row int, result appinterface.ImportResult, v Visibility) importRowJson {
+	r := importRowJson{
+		Row:    row,
+		Action: result.Action,
+	}
+	if result.Err != nil {
+		_, r.Error = mutationErrorStatus("%v", result.Err)
+	}
+	if result.Action != appinterface.ImportFailed {
+		contact := v.Contact(result.Contact)
+		r.Contact = &contact
+	}
+	return r
+}
+
+func (w *webApp) exportCSV(response http.ResponseWriter, request *http.Request) {
+	contacts, err := w.book(request).GetContacts(request.Context())
+	if err != nil {
+		if w.sendOverloaded(err, response) {
+			return
+		}
+		r := errorJson{
+			Error: fmt.Sprintf("Error getting contacts: %v", err),
+		}
+		w.sendErrorJson(r, "Error marshalling error: %v", response)
+		return
+	}
+	standardHeaders("text/csv; charset=utf-8", response)
+	response.Header().Set("Content-Disposition", `attachment; filename="contacts.csv"`)
+	cw := csv.NewWriter(response)
+	err = cw.Write(csvHeader)
+	for _, c := range w.visibility(request).contacts(contacts) {
+		if err != nil {
+			break
+		}
+		err = cw.Write([]string{strconv.Itoa(c.ID), c.FirstName, c.LastName, c.Email})
+	}
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		log.Printf("Error writing CSV export: %v\n", err)
+	}
+}
+
+// importReader finds the CSV data in the request: either the "file" part of
+// a multipart upload or the raw body.
+func importReader(request *http.Request) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return request.Body, nil
+	}
+	err := request.ParseMultipartForm(maxImportBody)
+	if err != nil {
+		return nil, err
+	}
+	file, _, err := request.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// importCSV imports the rows of a CSV file.  The "id" column is ignored, so
+// an export imports as new contacts wherever it came from, unless "matchIds"
+// is set, when a row with the ID of an existing contact updates it.
+func (w *webApp) importCSV(response http.ResponseWriter, request *http.Request) {
+	request.Body = http.MaxBytesReader(response, request.Body, maxImportBody)
+	query := request.URL.Query()
+	dryRun, _ := strconv.ParseBool(query.Get("dryRun"))
+	matchIDs, _ := strconv.ParseBool(query.Get("matchIds"))
+	mapping := map[string]string{}
+	for _, field := range csvHeader {
+		if name := query.Get(field); name != "" {
+			mapping[field] = name
+		}
+	}
+
+	in, err := importReader(request)
+	if err != nil {
+		r := errorJson{
+			Error: fmt.Sprintf("Error reading upload: %v", err),
+		}
+		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		return
+	}
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err == nil {
+		// Excel likes to start UTF-8 files with a byte order mark.
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	var columns map[string]int
+	if err == nil {
+		columns, err = csvColumns(header, mapping)
+	}
+	if err != nil {
+		r := errorJson{
+			Error: fmt.Sprintf("Error reading CSV header: %v", err),
+		}
+		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		return
+	}
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	// Rows that cannot even be turned into a contact are reported here; the
+	// rest are handed to the app in one go so the whole import is judged
+	// against a single, consistent view of the contacts.
+	body := importResponseJson{DryRun: dryRun}
+	var contacts []appinterface.Contact
+	var rowNumbers []int
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var pe *csv.ParseError
+			if !errors.As(err, &pe) {
+				r := errorJson{
+					Error: fmt.Sprintf("Error reading CSV: %v", err),
+				}
+				w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+				return
+			}
+			body.add(importRowJson{Row: row, Action: appinterface.ImportFailed, Error: pe.Err.Error()})
+			continue
+		}
+		if len(contacts) >= maxImportRows {
+			r := errorJson{
+				Error: fmt.Sprintf("Too many rows: at most %d are allowed", maxImportRows),
+			}
+			w.sendStatusJson(r, http.StatusRequestEntityTooLarge, "Error marshalling error: %v", response)
+			return
+		}
+		contact := appinterface.Contact{
+			FirstName: field(record, "firstName"),
+			LastName:  field(record, "lastName"),
+			Email:     field(record, "email"),
+		}
+		if id := field(record, "id"); id != "" {
+			contact.ID, err = strconv.Atoi(id)
+			if err != nil || contact.ID <= 0 {
+				body.add(importRowJson{Row: row, Action: appinterface.ImportFailed, Error: fmt.Sprintf("Invalid ID %q", id)})
+				continue
+			}
+			if !matchIDs {
+				contact.ID = 0
+			}
+		}
+		contacts = append(contacts, contact)
+		rowNumbers = append(rowNumbers, row)
+	}
+
+	w.finishImport(body, contacts, rowNumbers, response, request)
+}
+
+// finishImport hands the contacts that could be read to the app and sends the
+// combined report.  body already holds the rows that failed to parse and
+// rowNumbers gives the row of each contact.
+func (w *webApp) finishImport(body importResponseJson, contacts []appinterface.Contact, rowNumbers []int, response http.ResponseWriter, request *http.Request) {
+	results, err := w.book(request).Import(request.Context(), contacts, body.DryRun)
+	if err != nil {
+		if w.sendOverloaded(err, response) {
+			return
+		}
+		r := errorJson{
+			Error: fmt.Sprintf("Error importing contacts: %v", err),
+		}
+		w.sendErrorJson(r, "Error marshalling error: %v", response)
+		return
+	}
+	for i, result := range results {
+		body.add(importResultRow(rowNumbers[i], result, w.visibility(request)))
+	}
+	slices.SortFunc(body.Rows, func(a, b importRowJson) int {
+		return a.Row - b.Row
+	})
+	w.sendJson(body, "Error marshalling import results: %v", response)
+}
@@ -0,0 +1,223 @@
+package webapp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"example-api-server/appinterface"
+)
+
+func importCSVReport(t *testing.T, handler http.Handler, path string, body string) importResponseJson {
+	t.Helper()
+	response := serve(handler, http.MethodPost, path, body, map[string]string{"Content-Type": "text/csv"})
+	if response.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", response.Code, response.Body)
+	}
+	var report importResponseJson
+	if err := json.Unmarshal(response.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestCSVExportImportRoundTrip(t *testing.T) {
+	a := newTestApp(t)
+	addContacts(t, a, roundTripContacts)
+	handler := NewWebApp(a)
+	want := names(getContacts(t, a))
+	exported := serve(handler, http.MethodGet, "/api/contacts/export.csv", "", nil)
+	if exported.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", exported.Code, exported.Body)
+	}
+
+	report := importCSVReport(t, handler, "/api/contacts/import", exported.Body.String())
+	if report.Skipped != len(roundTripContacts) {
+		t.Errorf("re-import of an unchanged book: %+v", report)
+	}
+
+	// Rows carry the contact's ID, so importing the export with matchIds
+	// undoes changes made since.
+	for _, c := range getContacts(t, a) {
+		err := a.UpdateContact(context.Background(), c.ID, nil, "Changed", c.LastName, c.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	report = importCSVReport(t, handler, "/api/contacts/import?matchIds=true", exported.Body.String())
+	if report.Updated != len(roundTripContacts) || report.Failed != 0 {
+		t.Errorf("import over changed contacts: %+v", report)
+	}
+	if got := names(getContacts(t, a)); !slices.Equal(got, want) {
+		t.Errorf("contacts after import differ:\n got %q\nwant %q", got, want)
+	}
+}
+
+// TestCSVImportIntoFreshBook imports an export into another book and checks
+// that every row becomes a new contact, leaving the contacts that book
+// already has under the same IDs alone.
+func TestCSVImportIntoFreshBook(t *testing.T) {
+	source := newTestApp(t)
+	addContacts(t, source, roundTripContacts)
+	exported := serve(NewWebApp(source), http.MethodGet, "/api/contacts/export.csv", "", nil)
+	if exported.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", exported.Code, exported.Body)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		book  []appinterface.Contact
+	}{
+		{name: "IDs ignored", book: []appinterface.Contact{{FirstName: "Mallory", LastName: "Martin", Email: "mallory@example.com"}}},
+		{name: "IDs matched", query: "?matchIds=true"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fresh := newTestApp(t)
+			addContacts(t, fresh, test.book)
+			report := importCSVReport(t, NewWebApp(fresh), "/api/contacts/import"+test.query, exported.Body.String())
+			if report.Created != len(roundTripContacts) || report.Updated != 0 || report.Failed != 0 {
+				t.Errorf("report: %+v", report)
+			}
+			want := names(append(getContacts(t, source), test.book...))
+			if got := names(getContacts(t, fresh)); !slices.Equal(got, want) {
+				t.Errorf("contacts after import differ:\n got %q\nwant %q", got, want)
+			}
+		})
+	}
+}
+
+func TestImportCSVMatchesIDsOnRequest(t *testing.T) {
+	csv := "id,firstName,lastName,email\n1,Augusta,King,ada@example.com\n"
+	tests := []struct {
+		query  string
+		action appinterface.ImportAction
+		first  string
+	}{
+		{query: "", action: appinterface.ImportCreated, first: "Ada"},
+		{query: "?matchIds=false", action: appinterface.ImportCreated, first: "Ada"},
+		{query: "?matchIds=true", action: appinterface.ImportUpdated, first: "Augusta"},
+	}
+	for _, test := range tests {
+		a := newTestApp(t)
+		addContacts(t, a, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+		report := importCSVReport(t, NewWebApp(a), "/api/contacts/import"+test.query, csv)
+		if len(report.Rows) != 1 || report.Rows[0].Action != test.action {
+			t.Errorf("import%s: %+v", test.query, report)
+		}
+		if c := ada(t, a); c.FirstName != test.first {
+			t.Errorf("import%s left Ada as %+v", test.query, c)
+		}
+	}
+}
+
+func TestImportCSVDryRun(t *testing.T) {
+	a := newTestApp(t)
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+	csv := "id,firstName,lastName,email\n1,Augusta,King,ada@example.com\n,Grace,Hopper,grace@example.com\n,Grace,Hopper,grace@example.com\n"
+	report := importCSVReport(t, NewWebApp(a), "/api/contacts/import?dryRun=true&matchIds=true", csv)
+	if !report.DryRun || report.Updated != 1 || report.Created != 1 || report.Skipped != 1 {
+		t.Errorf("report: %+v", report)
+	}
+	if got := getContacts(t, a); len(got) != 1 || got[0].FirstName != "Ada" || got[0].Version != 1 {
+		t.Errorf("the dry run changed the book: %+v", got)
+	}
+}
+
+func TestImportCSVRefusesBadUploads(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		csv    string
+		status int
+	}{
+		{name: "no email column", csv: "firstName,lastName\nAda,Lovelace\n", status: http.StatusBadRequest},
+		{name: "mapping to a missing column", query: "?email=Work", csv: "firstName,lastName,email\nAda,Lovelace,ada@example.com\n", status: http.StatusBadRequest},
+		{name: "empty body", csv: "", status: http.StatusBadRequest},
+		{name: "too many rows", csv: "firstName,lastName,email\n" + strings.Repeat("Ada,Lovelace,ada@example.com\n", maxImportRows+1), status: http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestApp(t)
+			response := serve(NewWebApp(a), http.MethodPost, "/api/contacts/import"+test.query, test.csv, map[string]string{"Content-Type": "text/csv"})
+			if response.Code != test.status {
+				t.Errorf("got %d %s, want %d", response.Code, response.Body, test.status)
+			}
+			if got := getContacts(t, a); len(got) != 0 {
+				t.Errorf("the refused upload added %+v", got)
+			}
+		})
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		csv   string
+		want  []appinterface.Contact
+	}{
+		{
+			name: "quoted fields",
+			csv:  "firstName,lastName,email\r\n\"Smith, Jr.\",\"O\"\"Neil\",\"a@example.com\"\r\n\"Two\nLines\",Break,b@example.com\r\n",
+			want: []appinterface.Contact{
+				{FirstName: "Smith, Jr.", LastName: `O"Neil`, Email: "a@example.com"},
+				{FirstName: "Two\nLines", LastName: "Break", Email: "b@example.com"},
+			},
+		},
+		{
+			name: "byte order mark and non-ASCII names",
+			csv:  "\ufefffirstName,lastName,email\nZoë,Ångström,zoe@example.com\n小龙,李,li@example.cn\n",
+			want: []appinterface.Contact{
+				{FirstName: "Zoë", LastName: "Ångström", Email: "zoe@example.com"},
+				{FirstName: "小龙", LastName: "李", Email: "li@example.cn"},
+			},
+		},
+		{
+			name: "Google Contacts headers",
+			csv:  "Given Name,Family Name,E-mail 1 - Value,Notes\nGrace,Hopper,grace@example.com,\"likes, commas\"\n",
+			want: []appinterface.Contact{
+				{FirstName: "Grace", LastName: "Hopper", Email: "grace@example.com"},
+			},
+		},
+		{
+			name:  "explicit column mapping",
+			query: "?email=Work%20Address",
+			csv:   "first,last,Home Address,Work Address\nAlan,Turing,home@example.com,work@example.com\n",
+			want: []appinterface.Contact{
+				{FirstName: "Alan", LastName: "Turing", Email: "work@example.com"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestApp(t)
+			report := importCSVReport(t, NewWebApp(a), "/api/contacts/import"+test.query, test.csv)
+			if report.Created != len(test.want) || report.Failed != 0 {
+				t.Errorf("report: %+v", report)
+			}
+			if got, want := names(getContacts(t, a)), names(test.want); !slices.Equal(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestImportCSVReportsBadRows(t *testing.T) {
+	a := newTestApp(t)
+	csv := strings.Join([]string{
+		"id,firstName,lastName,email",
+		",Ada,Lovelace,ada@example.com",
+		"x,Bad,Id,bad@example.com",
+		",Missing,,missing@example.com",
+		`,"Unterminated,Quote,q@example.com`,
+	}, "\n")
+	report := importCSVReport(t, NewWebApp(a), "/api/contacts/import", csv)
+	if report.Created != 1 || report.Failed != 3 {
+		t.Errorf("report: %+v", report)
+	}
+}
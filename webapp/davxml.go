@@ -0,0 +1,187 @@
+package webapp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"example-api-server/appinterface"
+)
+
+const (
+	davNS            = "DAV:"
+	carddavNS        = "urn:ietf:params:xml:ns:carddav"
+	calendarServerNS = "http://calendarserver.org/ns/"
+)
+
+// davPrefixes are the namespace prefixes declared on every multistatus we
+// write.  Properties in other namespaces declare their own.
+var davPrefixes = map[string]string{
+	davNS:            "d",
+	carddavNS:        "card",
+	calendarServerNS: "cs",
+}
+
+// davElement is any element in a request body; we only ever care about its
+// name and attributes.
+type davElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+func (e davElement) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+type davPropList struct {
+	Props []davElement `xml:",any"`
+}
+
+type davTextMatch struct {
+	Collation string `xml:"collation,attr"`
+	MatchType string `xml:"match-type,attr"`
+	Negate    string `xml:"negate-condition,attr"`
+	Text      string `xml:",chardata"`
+}
+
+type davPropFilter struct {
+	Name         string         `xml:"name,attr"`
+	Test         string         `xml:"test,attr"`
+	IsNotDefined *struct{}      `xml:"urn:ietf:params:xml:ns:carddav is-not-defined"`
+	TextMatches  []davTextMatch `xml:"urn:ietf:params:xml:ns:carddav text-match"`
+}
+
+type davFilter struct {
+	Test        string          `xml:"test,attr"`
+	PropFilters []davPropFilter `xml:"urn:ietf:params:xml:ns:carddav prop-filter"`
+}
+
+// davRequest covers the bodies of PROPFIND and of every REPORT we support;
+// XMLName tells them apart.
+type davRequest struct {
+	XMLName   xml.Name
+	AllProp   *struct{}    `xml:"DAV: allprop"`
+	PropName  *struct{}    `xml:"DAV: propname"`
+	Prop      *davPropList `xml:"DAV: prop"`
+	Hrefs     []string     `xml:"DAV: href"`
+	SyncToken string       `xml:"DAV: sync-token"`
+	SyncLevel string       `xml:"DAV: sync-level"`
+	Filter    *davFilter   `xml:"urn:ietf:params:xml:ns:carddav filter"`
+	// book is the address book reported on, and visibility what the client
+	// may see of its contacts.
+	book       appinterface.App
+	visibility Visibility
+	Limit      *struct {
+		NResults int `xml:"urn:ietf:params:xml:ns:carddav nresults"`
+	} `xml:"urn:ietf:params:xml:ns:carddav limit"`
+}
+
+// davProp is a property value.  inner is XML that has already been escaped.
+type davProp struct {
+	name  xml.Name
+	inner string
+}
+
+// davResponse is one <response> of a multistatus.  A non-zero status means
+// the resource itself could not be served and no properties are listed.
+type davResponse struct {
+	href    string
+	found   []davProp
+	missing []xml.Name
+	status  int
+}
+
+func davEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func davHref(href string) string {
+	return "<d:href>" + davEscape(href) + "</d:href>"
+}
+
+// davTag returns the opening and closing tag names for an element, with an
+// inline namespace declaration when its namespace has no prefix of its own.
+func davTag(name xml.Name) (string, string) {
+	if prefix, ok := davPrefixes[name.Space]; ok {
+		return prefix + ":" + name.Local, prefix + ":" + name.Local
+	}
+	if name.Space == "" {
+		return name.Local, name.Local
+	}
+	return fmt.Sprintf(`x:%s xmlns:x="%s"`, name.Local, davEscape(name.Space)), "x:" + name.Local
+}
+
+func davStatusLine(status int) string {
+	return fmt.Sprintf("<d:status>HTTP/1.1 %d %s</d:status>", status, http.StatusText(status))
+}
+
+func writeDAVProp(b *bytes.Buffer, p davProp) {
+	open, closing := davTag(p.name)
+	if p.inner == "" {
+		b.WriteString("<" + open + "/>")
+		return
+	}
+	b.WriteString("<" + open + ">" + p.inner + "</" + closing + ">")
+}
+
+// writeMultistatus sends a 207 listing responses, followed by a sync token
+// when one is given.
+func writeMultistatus(response http.ResponseWriter, responses []davResponse, syncToken string) {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:card="` + carddavNS + `" xmlns:cs="` + calendarServerNS + `">`)
+	for _, r := range responses {
+		b.WriteString("<d:response>")
+		b.WriteString(davHref(r.href))
+		if r.status != 0 {
+			b.WriteString(davStatusLine(r.status))
+		}
+		if len(r.found) > 0 {
+			b.WriteString("<d:propstat><d:prop>")
+			for _, p := range r.found {
+				writeDAVProp(&b, p)
+			}
+			b.WriteString("</d:prop>" + davStatusLine(http.StatusOK) + "</d:propstat>")
+		}
+		if len(r.missing) > 0 {
+			b.WriteString("<d:propstat><d:prop>")
+			for _, n := range r.missing {
+				writeDAVProp(&b, davProp{name: n})
+			}
+			b.WriteString("</d:prop>" + davStatusLine(http.StatusNotFound) + "</d:propstat>")
+		}
+		b.WriteString("</d:response>")
+	}
+	if syncToken != "" {
+		b.WriteString("<d:sync-token>" + davEscape(syncToken) + "</d:sync-token>")
+	}
+	b.WriteString("</d:multistatus>")
+	standardHeaders(`application/xml; charset="utf-8"`, response)
+	response.WriteHeader(http.StatusMultiStatus)
+	_, err := response.Write(b.Bytes())
+	if err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
+
+// writeDAVError sends a DAV error body naming the precondition that failed.
+func writeDAVError(response http.ResponseWriter, status int, condition xml.Name) {
+	open, _ := davTag(condition)
+	body := xml.Header + `<d:error xmlns:d="DAV:" xmlns:card="` + carddavNS + `"><` + open + `/></d:error>`
+	standardHeaders(`application/xml; charset="utf-8"`, response)
+	response.WriteHeader(status)
+	_, err := response.Write([]byte(body))
+	if err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
@@ -0,0 +1,135 @@
+package webapp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"example-api-server/appinterface"
+)
+
+// contactETag builds the strong ETag of a single contact from its version,
+// as served under the visibility rules v.  A masked or hidden email makes a
+// different representation of the same version, so it gets a tag of its own.
+func contactETag(contact appinterface.Contact, v Visibility) string {
+	return fmt.Sprintf(`"v%d%s"`, contact.Version, etagSuffix(v))
+}
+
+// etagSuffix tells the representations of a contact under v apart from
+// the others of the same version.
+func etagSuffix(v Visibility) string {
+	if v.full() {
+		return ""
+	}
+	return "-" + string(v.Email)
+}
+
+// varyByClient tells caches that the response depends on who asked for it,
+// since the visibility rules are the client's.
+func varyByClient(response http.ResponseWriter) {
+	response.Header().Add("Vary", "Authorization, Cookie")
+}
+
+// bodyETag builds an ETag from a response body for resources, like the
+// contact list, that do not carry a version of their own.
+func bodyETag(bts []byte) string {
+	sum := sha256.Sum256(bts)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagList splits an If-Match or If-None-Match header into its entity tags.
+func etagList(header string) []string {
+	var result []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// ifMatchVersions turns the If-Match header into the list of contact versions
+// the client will accept.  present is false when there is no precondition at
+// all (or it is "*"); a present header with no usable versions can never
+// match.  Only the tags of the representation v serves can match, so a tag
+// of a masked copy is no precondition on the contact a full client sees.
+func ifMatchVersions(request *http.Request, v Visibility) (versions []int, present bool) {
+	header := request.Header.Get("If-Match")
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return nil, false
+	}
+	// If-Match uses the strong comparison, so weak tags never match.
+	for _, tag := range etagList(header) {
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		version, ok := strings.CutSuffix(strings.TrimPrefix(strings.Trim(tag, `"`), "v"), etagSuffix(v))
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(version)
+		if err != nil || n <= 0 {
+			continue
+		}
+		versions = append(versions, n)
+	}
+	return versions, true
+}
+
+// notModified reports whether the If-None-Match header matches etag.
+func notModified(request *http.Request, etag string) bool {
+	header := request.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	// If-None-Match uses the weak comparison.
+	for _, tag := range etagList(header) {
+		if strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *webApp) preconditionFailed(response http.ResponseWriter) {
+	r := errorJson{
+		Error: "Contact has been modified",
+	}
+	w.sendStatusJson(r, http.StatusPreconditionFailed, "Error marshalling error: %v", response)
+}
+
+// sendJsonWithETag is sendJson for cacheable resources.  When etag is empty
+// one is derived from the body.  A matching If-None-Match gets a 304.
+func (w *webApp) sendJsonWithETag(value any, etag string, request *http.Request, errorString string, response http.ResponseWriter) {
+	bts, err := json.Marshal(value)
+	if err != nil {
+		log.Printf(errorString, err)
+		w.errorPage("ERROR", renderError(err), http.StatusInternalServerError, response)
+		return
+	}
+	if etag == "" {
+		etag = bodyETag(bts)
+	}
+	response.Header().Set("ETag", etag)
+	varyByClient(response)
+	if notModified(request, etag) {
+		response.Header().Add("Cache-Control", "no-cache")
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+	jsonHeader("", response)
+	response.WriteHeader(http.StatusOK)
+	_, err = response.Write(bts)
+	if err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
@@ -0,0 +1,136 @@
+package webapp
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"example-api-server/appinterface"
+)
+
+const formType = "application/x-www-form-urlencoded"
+
+func TestContactETag(t *testing.T) {
+	a := newBatchBook(t)
+	handler := NewWebApp(a)
+	response := serve(handler, http.MethodGet, "/api/contact/1", "", nil)
+	if response.Code != http.StatusOK || response.Header().Get("ETag") != `"v1"` {
+		t.Fatalf("got %d with ETag %q", response.Code, response.Header().Get("ETag"))
+	}
+	if vary := response.Header().Values("Vary"); len(vary) == 0 {
+		t.Errorf("no Vary header")
+	}
+	update := serve(handler, http.MethodPut, "/api/contact/1", "firstName=Augusta&lastName=King&email=ada@example.com", map[string]string{"Content-Type": formType})
+	if update.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", update.Code, update.Body)
+	}
+	if etag := serve(handler, http.MethodGet, "/api/contact/1", "", nil).Header().Get("ETag"); etag != `"v2"` {
+		t.Errorf("ETag after an update: %q", etag)
+	}
+
+	tests := []struct {
+		ifNoneMatch string
+		status      int
+	}{
+		{ifNoneMatch: `"v2"`, status: http.StatusNotModified},
+		{ifNoneMatch: `W/"v2"`, status: http.StatusNotModified},
+		{ifNoneMatch: `"v1", "v2"`, status: http.StatusNotModified},
+		{ifNoneMatch: `*`, status: http.StatusNotModified},
+		{ifNoneMatch: `"v1"`, status: http.StatusOK},
+		{ifNoneMatch: `"v2-masked"`, status: http.StatusOK},
+	}
+	for _, test := range tests {
+		response := serve(handler, http.MethodGet, "/api/contact/1", "", map[string]string{"If-None-Match": test.ifNoneMatch})
+		if response.Code != test.status || response.Header().Get("ETag") != `"v2"` {
+			t.Errorf("If-None-Match %s: got %d with ETag %q, want %d", test.ifNoneMatch, response.Code, response.Header().Get("ETag"), test.status)
+		}
+		if test.status == http.StatusNotModified && response.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: 304 with a body", test.ifNoneMatch)
+		}
+	}
+	if response := serve(handler, http.MethodGet, "/api/contact/9", "", map[string]string{"If-None-Match": "*"}); response.Code != http.StatusNotFound {
+		t.Errorf("unknown contact: %d", response.Code)
+	}
+}
+
+func TestContactsETag(t *testing.T) {
+	a := newBatchBook(t)
+	handler := NewWebApp(a)
+	first := serve(handler, http.MethodGet, "/api/contacts", "", nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got %d with ETag %q", first.Code, etag)
+	}
+	if again := serve(handler, http.MethodGet, "/api/contacts", "", nil); again.Header().Get("ETag") != etag {
+		t.Errorf("the ETag of an unchanged list changed: %q, %q", etag, again.Header().Get("ETag"))
+	}
+	cached := serve(handler, http.MethodGet, "/api/contacts", "", map[string]string{"If-None-Match": etag})
+	if cached.Code != http.StatusNotModified || cached.Body.Len() != 0 || cached.Header().Get("ETag") != etag {
+		t.Errorf("If-None-Match of the current list: %d %q", cached.Code, cached.Header().Get("ETag"))
+	}
+
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"}})
+	changed := serve(handler, http.MethodGet, "/api/contacts", "", map[string]string{"If-None-Match": etag})
+	if changed.Code != http.StatusOK || changed.Header().Get("ETag") == etag {
+		t.Errorf("If-None-Match after a change: %d %q", changed.Code, changed.Header().Get("ETag"))
+	}
+	// Each view of the list is a resource of its own.
+	if filtered := serve(handler, http.MethodGet, "/api/contacts?view=shared", "", map[string]string{"If-None-Match": changed.Header().Get("ETag")}); filtered.Code != http.StatusOK {
+		t.Errorf("If-None-Match of another view: %d", filtered.Code)
+	}
+}
+
+// TestIfMatch sends conditional changes to Ada, who has been updated once so
+// her ETag is "v2", and checks which go through.
+func TestIfMatch(t *testing.T) {
+	requests := []struct {
+		method      string
+		body        string
+		contentType string
+	}{
+		{method: http.MethodPut, body: "firstName=Augusta&lastName=King&email=ada@example.com", contentType: formType},
+		{method: http.MethodPatch, body: `{"firstName":"Augusta"}`, contentType: mergePatchType},
+		{method: http.MethodDelete},
+	}
+	tests := []struct {
+		ifMatch string
+		status  int
+	}{
+		{ifMatch: "", status: http.StatusOK},
+		{ifMatch: `"v2"`, status: http.StatusOK},
+		{ifMatch: `*`, status: http.StatusOK},
+		{ifMatch: `"v1", "v2"`, status: http.StatusOK},
+		{ifMatch: `"v1"`, status: http.StatusPreconditionFailed},
+		{ifMatch: `"v3"`, status: http.StatusPreconditionFailed},
+		{ifMatch: `W/"v2"`, status: http.StatusPreconditionFailed},
+		{ifMatch: `"v2-masked"`, status: http.StatusPreconditionFailed},
+		{ifMatch: `"not a version"`, status: http.StatusPreconditionFailed},
+	}
+	for _, r := range requests {
+		for _, test := range tests {
+			t.Run(r.method+" "+test.ifMatch, func(t *testing.T) {
+				a := newBatchBook(t)
+				handler := NewWebApp(a)
+				if err := a.UpdateContact(context.Background(), 1, nil, "Ada", "King", "ada@example.com"); err != nil {
+					t.Fatal(err)
+				}
+				before := getContacts(t, a)
+				response := serve(handler, r.method, "/api/contact/1", r.body, map[string]string{"Content-Type": r.contentType, "If-Match": test.ifMatch})
+				if response.Code != test.status {
+					t.Fatalf("got %d %s, want %d", response.Code, response.Body, test.status)
+				}
+				if test.status == http.StatusPreconditionFailed {
+					if after := getContacts(t, a); !reflect.DeepEqual(after, before) {
+						t.Errorf("the refused request changed the book:\n%+v\n%+v", before, after)
+					}
+				}
+			})
+		}
+		// "*" only matches a contact that exists.
+		a := newBatchBook(t)
+		if response := serve(NewWebApp(a), r.method, "/api/contact/9", r.body, map[string]string{"Content-Type": r.contentType, "If-Match": "*"}); response.Code != http.StatusNotFound {
+			t.Errorf("%s of an unknown contact with If-Match *: %d", r.method, response.Code)
+		}
+	}
+}
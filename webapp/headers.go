@@ -0,0 +1,119 @@
+package webapp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	cspReportPath = "/api/csp-report"
+	// maxCSPReport bounds the size of a violation report.
+	maxCSPReport = 16 << 10
+)
+
+// SecurityHeaders configures the headers sent with every response.
+type SecurityHeaders struct {
+	// ReportOnly only reports violations of the Content-Security-Policy
+	// instead of blocking them, to try a policy out.
+	ReportOnly bool
+	// FrameAncestors are the sources allowed to frame the pages, such as
+	// "'none'" or "'self'".  Without any the pages may be framed by anyone.
+	FrameAncestors    []string
+	ReferrerPolicy    string
+	PermissionsPolicy string
+	// HSTSMaxAge, when set, is sent in Strict-Transport-Security on
+	// requests made over TLS.
+	HSTSMaxAge time.Duration
+}
+
+// cspNonceContextKey is the request context key holding the nonce that
+// inline scripts of the page served for the request need to run.
+type cspNonceContextKey struct{}
+
+func cspNonce(request *http.Request) string {
+	nonce, _ := request.Context().Value(cspNonceContextKey{}).(string)
+	return nonce
+}
+
+// contentSecurityPolicy only lets pages load what the server itself serves,
+// and run inline scripts that carry nonce.
+func (h SecurityHeaders) contentSecurityPolicy(nonce string) string {
+	directives := []string{
+		"default-src 'self'",
+		fmt.Sprintf("script-src 'self' 'nonce-%s'", nonce),
+		"img-src 'self' data:",
+		"object-src 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+	}
+	if len(h.FrameAncestors) > 0 {
+		directives = append(directives, "frame-ancestors "+strings.Join(h.FrameAncestors, " "))
+	}
+	directives = append(directives, "report-uri "+cspReportPath, "report-to csp")
+	return strings.Join(directives, "; ")
+}
+
+// withSecurityHeaders sends the security headers with every response, and
+// gives every request a fresh nonce for the inline scripts of its page.
+func (w *webApp) withSecurityHeaders(next http.Handler) http.Handler {
+	h := w.options.Headers
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		b := make([]byte, 16)
+		rand.Read(b)
+		nonce := base64.StdEncoding.EncodeToString(b)
+		header := response.Header()
+		csp := "Content-Security-Policy"
+		if h.ReportOnly {
+			csp = "Content-Security-Policy-Report-Only"
+		}
+		header.Set(csp, h.contentSecurityPolicy(nonce))
+		header.Set("Reporting-Endpoints", fmt.Sprintf(`csp="%s"`, cspReportPath))
+		header.Set("X-Content-Type-Options", "nosniff")
+		if h.ReferrerPolicy != "" {
+			header.Set("Referrer-Policy", h.ReferrerPolicy)
+		}
+		if h.PermissionsPolicy != "" {
+			header.Set("Permissions-Policy", h.PermissionsPolicy)
+		}
+		if request.TLS != nil && h.HSTSMaxAge > 0 {
+			header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int(h.HSTSMaxAge.Seconds())))
+		}
+		ctx := context.WithValue(request.Context(), cspNonceContextKey{}, nonce)
+		next.ServeHTTP(response, request.WithContext(ctx))
+	})
+}
+
+// cspReport logs the policy violations browsers report, either as a
+// report-uri document or as a Reporting API list of reports.
+func (w *webApp) cspReport(response http.ResponseWriter, request *http.Request) {
+	request.Body = http.MaxBytesReader(response, request.Body, maxCSPReport)
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		r := errorJson{
+			Error: fmt.Sprintf("Error reading report: %v", err),
+		}
+		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		return
+	}
+	// Reports are logged on one line each, so a report cannot pass itself
+	// off as other log lines.
+	var compact bytes.Buffer
+	if json.Compact(&compact, body) != nil {
+		r := errorJson{
+			Error: "Reports must be JSON",
+		}
+		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		return
+	}
+	log.Printf("Content-Security-Policy violation reported from %s: %s\n", w.clientIP(request), compact.String())
+	response.WriteHeader(http.StatusNoContent)
+}
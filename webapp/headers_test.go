@@ -0,0 +1,177 @@
+package webapp
+
+import (
+	"crypto/tls"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+)
+
+var (
+	cspNoncePattern  = regexp.MustCompile(`'nonce-([^']+)'`)
+	pageNoncePattern = regexp.MustCompile(`<script[^>]* nonce="([^"]+)"`)
+)
+
+func newHeadersWebApp(t *testing.T, headers SecurityHeaders) http.Handler {
+	t.Helper()
+	books := appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: newTestApp(t)})
+	handler, err := NewWebAppWithOptions(books, Options{Headers: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+// TestCSPNonce checks that the home page's inline script carries the nonce
+// its policy allows, and that every request gets a fresh one.
+func TestCSPNonce(t *testing.T) {
+	handler := newHeadersWebApp(t, SecurityHeaders{})
+	seen := map[string]bool{}
+	for range 3 {
+		response := serve(handler, http.MethodGet, "/", "", nil)
+		if response.Code != http.StatusOK {
+			t.Fatalf("home page: %d", response.Code)
+		}
+		header := cspNoncePattern.FindStringSubmatch(response.Header().Get("Content-Security-Policy"))
+		page := pageNoncePattern.FindStringSubmatch(response.Body.String())
+		if header == nil || page == nil {
+			t.Fatalf("no nonce in the policy %q or the page", response.Header().Get("Content-Security-Policy"))
+		}
+		if got := html.UnescapeString(page[1]); got != header[1] {
+			t.Errorf("the page's nonce %q is not the policy's %q", got, header[1])
+		}
+		if seen[header[1]] {
+			t.Errorf("nonce %q was used twice", header[1])
+		}
+		seen[header[1]] = true
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers SecurityHeaders
+		tls     bool
+		want    map[string]string
+		// policy holds what the Content-Security-Policy must and, prefixed
+		// with "!", must not contain.
+		policy []string
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{
+				"X-Content-Type-Options":              "nosniff",
+				"Reporting-Endpoints":                 `csp="` + cspReportPath + `"`,
+				"Content-Security-Policy-Report-Only": "",
+				"Strict-Transport-Security":           "",
+				"Referrer-Policy":                     "",
+				"Permissions-Policy":                  "",
+			},
+			policy: []string{"default-src 'self'", "object-src 'none'", "report-uri " + cspReportPath, "report-to csp", "!frame-ancestors", "!unsafe-inline"},
+		},
+		{
+			name:    "report only",
+			headers: SecurityHeaders{ReportOnly: true},
+			want:    map[string]string{"Content-Security-Policy": ""},
+		},
+		{
+			name:    "frame ancestors",
+			headers: SecurityHeaders{FrameAncestors: []string{"'self'", "https://intranet.example"}},
+			policy:  []string{"frame-ancestors 'self' https://intranet.example"},
+		},
+		{
+			name:    "frame ancestors none",
+			headers: SecurityHeaders{FrameAncestors: []string{"'none'"}},
+			policy:  []string{"frame-ancestors 'none'"},
+		},
+		{
+			name:    "policies",
+			headers: SecurityHeaders{ReferrerPolicy: "no-referrer", PermissionsPolicy: "camera=()"},
+			want:    map[string]string{"Referrer-Policy": "no-referrer", "Permissions-Policy": "camera=()"},
+		},
+		{
+			name:    "HSTS over plain HTTP",
+			headers: SecurityHeaders{HSTSMaxAge: 24 * time.Hour},
+			want:    map[string]string{"Strict-Transport-Security": ""},
+		},
+		{
+			name:    "HSTS over TLS",
+			headers: SecurityHeaders{HSTSMaxAge: 24 * time.Hour},
+			tls:     true,
+			want:    map[string]string{"Strict-Transport-Security": "max-age=86400"},
+		},
+		{
+			name: "TLS without HSTS",
+			tls:  true,
+			want: map[string]string{"Strict-Transport-Security": ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newHeadersWebApp(t, test.headers)
+			// The headers go out with pages, API responses and errors alike.
+			for _, path := range []string{"/", "/api/contacts", "/no-such-page"} {
+				request := httptest.NewRequest(http.MethodGet, path, nil)
+				if test.tls {
+					request.TLS = &tls.ConnectionState{}
+				}
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, request)
+				header := response.Header()
+				for name, want := range test.want {
+					if got := header.Get(name); got != want {
+						t.Errorf("%s: %s is %q, want %q", path, name, got, want)
+					}
+				}
+				name := "Content-Security-Policy"
+				if test.headers.ReportOnly {
+					name = "Content-Security-Policy-Report-Only"
+				}
+				policy := header.Get(name)
+				if policy == "" {
+					t.Errorf("%s: no %s", path, name)
+				}
+				for _, p := range test.policy {
+					if absent, ok := strings.CutPrefix(p, "!"); ok == strings.Contains(policy, absent) {
+						t.Errorf("%s: policy %q, want %q", path, policy, p)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCSPReport(t *testing.T) {
+	handler := newHeadersWebApp(t, SecurityHeaders{})
+	// A JSON string exactly as long as the limit allows.
+	largest := `"` + strings.Repeat("x", maxCSPReport-2) + `"`
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "report-uri", body: `{"csp-report":{"document-uri":"https://contacts.example/","violated-directive":"script-src"}}`, status: http.StatusNoContent},
+		{name: "Reporting API", body: `[{"type":"csp-violation","body":{"blockedURL":"inline"}}]`, status: http.StatusNoContent},
+		{name: "at the size limit", body: largest, status: http.StatusNoContent},
+		{name: "over the size limit", body: largest + " ", status: http.StatusBadRequest},
+		{name: "not JSON", body: "blocked\nfake log line", status: http.StatusBadRequest},
+		{name: "empty", body: "", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(handler, http.MethodPost, cspReportPath, test.body, map[string]string{"Content-Type": "application/csp-report"})
+			if response.Code != test.status {
+				t.Errorf("got %d %s, want %d", response.Code, response.Body, test.status)
+			}
+		})
+	}
+	if response := serve(handler, http.MethodGet, cspReportPath, "", nil); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: %d", response.Code)
+	}
+}
@@ -1,6 +1,7 @@
 // Path: /app.js
 
 const timeDelta = 2000;
+const toastDelta = 8000;
 
 function bID(name) {
     return document.getElementById(name);
@@ -20,6 +21,13 @@ function tableCell(row, body, cls) {
     return c;
 }
 
+// csrfHeaders returns the headers that prove a change comes from this
+// page, which only pages of a signed in browser need.
+function csrfHeaders() {
+    let meta = document.querySelector('meta[name="csrf-token"]');
+    return meta ? {'X-CSRF-Token': meta.content} : {};
+}
+
 function deleteTableCell(row, id, cls) {
     let c = document.createElement("td");
     c.className = cls;
@@ -28,10 +36,12 @@ function deleteTableCell(row, id, cls) {
     b.innerHTML = "Delete";
     b.onclick = function () {
         fetch(`/api/contact/${id}`, {
-            method: 'DELETE'
+            method: 'DELETE',
+            headers: csrfHeaders()
         }).then(response => {
             if (response.status === 200) {
                 renderHomePage();
+                showUndoToast(id);
             }
         });
     };
@@ -40,6 +50,56 @@ function deleteTableCell(row, id, cls) {
     return c;
 }
 
+let toastTimer = null;
+
+function hideToast() {
+    let t = bID('toast');
+    clearTimeout(toastTimer);
+    t.className = '';
+    clearElement(t);
+}
+
+function showUndoToast(id) {
+    let t = bID('toast');
+    hideToast();
+    let msg = document.createElement("span");
+    msg.innerText = "Contact deleted.";
+    let b = document.createElement("button");
+    b.className = "undo-button";
+    b.innerText = "Undo";
+    b.onclick = function () {
+        hideToast();
+        fetch(`/api/trash/${id}/restore`, {
+            method: 'POST',
+            headers: csrfHeaders()
+        }).then(response => {
+            if (response.status === 200) {
+                renderHomePage();
+            } else {
+                response.json().then(j => {
+                    let status = bID('status');
+                    status.className = 'error';
+                    status.innerText = 'Error: ' + j.error;
+                });
+            }
+        });
+    };
+    t.appendChild(msg);
+    t.appendChild(b);
+    t.className = 'visible';
+    toastTimer = setTimeout(hideToast, toastDelta);
+}
+
+// checkSignedIn sends the browser back to the login page once its session
+// has expired.
+function checkSignedIn(response) {
+    if (response.status === 401) {
+        window.location.href = '/login';
+        throw new Error('Signed out');
+    }
+    return response;
+}
+
 function generateConnectionError(parent, msg) {
     clearElement(parent);
     parent.innerHTML = msg;
@@ -52,7 +112,14 @@ function generateContactRow(row, data) {
     tableCell(row, data.firstName, null);
     tableCell(row, data.lastName, null);
     tableCell(row, data.email, null);
-    deleteTableCell(row, data.id, null);
+    if (bID('contacts').dataset.showOwner === 'true') {
+        tableCell(row, data.owner || '', null);
+    }
+    // Only roles allowed to delete get the button; the server refuses
+    // everyone else anyway.
+    if (bID('contacts').dataset.canDelete === 'true') {
+        deleteTableCell(row, data.id, null);
+    }
 }
 
 function generateContacts(parent, data) {
@@ -97,12 +164,18 @@ function renderServerTimeLoop() {
 function renderHomePage() {
     let dp = bID('dashboard-parent');
     let contactsBody = bID('contacts-body');
-    fetch("/api/contacts")
+    let view = bID('view');
+    let url = "/api/contacts";
+    if (view) {
+        url += "?view=" + encodeURIComponent(view.value);
+    }
+    fetch(url)
         .catch(function (error) {
             console.log("Could not get data from server");
             generateConnectionError(dp, "Could not get data from server");
             throw error;
-        }).then(response => response.json())
+        }).then(checkSignedIn)
+        .then(response => response.json())
         .then(j => {
             generateContacts(contactsBody, j);
         });
@@ -115,6 +188,14 @@ function renderHomePageLoop() {
     renderHomePageNext();
 }
 
+// prepView switches between all contacts, the user's own and those shared
+// with them.
+function prepView() {
+    bID('view').onchange = function () {
+        renderHomePage();
+    };
+}
+
 function prepForm() {
     let submitButton = bID('submit-button');
     let form = bID('add-contact-form');
@@ -123,6 +204,9 @@ function prepForm() {
         let formData = new FormData(form);
         let xhr = new XMLHttpRequest();
         xhr.open('POST', '/api/add-contact', true);
+        for (const [name, value] of Object.entries(csrfHeaders())) {
+            xhr.setRequestHeader(name, value);
+        }
         xhr.onload = function() {
             if (xhr.status === 200) {
                 // Clear the form fields
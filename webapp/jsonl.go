@@ -0,0 +1,183 @@
+package webapp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"example-api-server/appinterface"
+)
+
+const (
+	// jsonlPageSize is how many contacts are fetched from the app at a time
+	// while exporting, and how many lines are imported at a time.
+	jsonlPageSize = 500
+	// maxJSONLLine bounds the length of a single imported line.
+	maxJSONLLine = 64 << 10
+)
+
+func (w *webApp) exportJSONL(response http.ResponseWriter, request *http.Request) {
+	rc := http.NewResponseController(response)
+	out := bufio.NewWriter(response)
+	enc := json.NewEncoder(out)
+	v := w.visibility(request)
+	var after appinterface.Contact
+	for started := false; ; started = true {
+		page, err := w.book(request).ContactsAfter(request.Context(), after, jsonlPageSize)
+		if err != nil {
+			// Until the first page is out a busy app can still be
+			// reported; after that the headers are long gone, so all
+			// we can do is cut the stream short where a reader will
+			// notice it.
+			if !started && w.sendOverloaded(err, response) {
+				return
+			}
+			log.Printf("Error getting contacts for export: %v\n", err)
+			return
+		}
+		if !started {
+			standardHeaders("application/jsonl; charset=utf-8", response)
+			response.Header().Set("Content-Disposition", `attachment; filename="contacts.jsonl"`)
+		}
+		for _, c := range v.contacts(page) {
+			err = enc.Encode(c)
+			if err != nil {
+				log.Printf("Error writing JSON Lines export: %v\n", err)
+				return
+			}
+		}
+		if len(page) < jsonlPageSize {
+			break
+		}
+		after = page[len(page)-1]
+		if err = out.Flush(); err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			log.Printf("Error writing JSON Lines export: %v\n", err)
+			return
+		}
+	}
+	if err := out.Flush(); err != nil {
+		log.Printf("Error writing JSON Lines export: %v\n", err)
+	}
+}
+
+type jsonlStatus struct {
+	Line    int                       `json:"line"`
+	Action  appinterface.ImportAction `json:"action"`
+	Contact *appinterface.Contact     `json:"contact,omitempty"`
+	Error   string                    `json:"error,omitempty"`
+}
+
+// importJSONL imports a body of any size, one contact per line, writing one
+// status line back per input line as it goes.  Unlike the other importers
+// nothing is held in memory beyond the current page of lines.
+//
+// The IDs of the lines are ignored, so an export imports as new contacts
+// wherever it came from, unless "matchIds" is set, when a line with the ID
+// of an existing contact updates it.
+func (w *webApp) importJSONL(response http.ResponseWriter, request *http.Request) {
+	matchIDs, _ := strconv.ParseBool(request.URL.Query().Get("matchIds"))
+	rc := http.NewResponseController(response)
+	// The status lines are written while the body is still being read.
+	err := rc.EnableFullDuplex()
+	if err != nil {
+		log.Printf("Error enabling full duplex: %v\n", err)
+	}
+	out := bufio.NewWriter(response)
+	enc := json.NewEncoder(out)
+
+	v := w.visibility(request)
+	var pending []jsonlStatus
+	var contacts []appinterface.Contact
+	var lines []int
+	// The status and headers are left implicit until the first page is
+	// written, since answering before reading would refuse a body sent
+	// with "Expect: 100-continue", and so a busy app can still be
+	// reported until then.
+	started := false
+	// flush imports the buffered contacts and writes the statuses of every
+	// line read so far, in line order.
+	flush := func() error {
+		if len(contacts) > 0 {
+			results, err := w.book(request).Import(request.Context(), contacts, false)
+			if err != nil {
+				return err
+			}
+			for i, result := range results {
+				row := importResultRow(lines[i], result, v)
+				pending = append(pending, jsonlStatus{Line: row.Row, Action: row.Action, Contact: row.Contact, Error: row.Error})
+			}
+		}
+		slices.SortFunc(pending, func(a, b jsonlStatus) int {
+			return a.Line - b.Line
+		})
+		if !started {
+			standardHeaders("application/jsonl; charset=utf-8", response)
+			started = true
+		}
+		for _, s := range pending {
+			if err := enc.Encode(s); err != nil {
+				return err
+			}
+		}
+		pending, contacts, lines = pending[:0], contacts[:0], lines[:0]
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	scanner := bufio.NewScanner(request.Body)
+	scanner.Buffer(make([]byte, 4096), maxJSONLLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var contact appinterface.Contact
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&contact)
+		if err == nil && dec.More() {
+			err = errors.New("more than one value on the line")
+		}
+		if err != nil {
+			pending = append(pending, jsonlStatus{Line: line, Action: appinterface.ImportFailed, Error: fmt.Sprintf("Error parsing line: %v", err)})
+		} else {
+			contact.Version = 0
+			if !matchIDs {
+				contact.ID = 0
+			}
+			contacts = append(contacts, contact)
+			lines = append(lines, line)
+		}
+		if len(contacts)+len(pending) >= jsonlPageSize {
+			if err := flush(); err != nil {
+				if !started && w.sendOverloaded(err, response) {
+					return
+				}
+				log.Printf("Error importing JSON Lines: %v\n", err)
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		pending = append(pending, jsonlStatus{Line: line + 1, Action: appinterface.ImportFailed, Error: fmt.Sprintf("Error reading body: %v", err)})
+	}
+	if err := flush(); err != nil {
+		if !started && w.sendOverloaded(err, response) {
+			return
+		}
+		log.Printf("Error importing JSON Lines: %v\n", err)
+	}
+}
@@ -0,0 +1,108 @@
+package webapp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"example-api-server/appinterface"
+)
+
+// importJSONLStatuses imports body into handler and returns the status line
+// written back for each line.
+func importJSONLStatuses(t *testing.T, handler http.Handler, path string, body string) []jsonlStatus {
+	t.Helper()
+	response := serve(handler, http.MethodPost, path, body, map[string]string{"Content-Type": "application/jsonl"})
+	if response.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", response.Code, response.Body)
+	}
+	var statuses []jsonlStatus
+	dec := json.NewDecoder(bytes.NewReader(response.Body.Bytes()))
+	for dec.More() {
+		var s jsonlStatus
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+func actions(statuses []jsonlStatus) map[appinterface.ImportAction]int {
+	counts := map[appinterface.ImportAction]int{}
+	for _, s := range statuses {
+		counts[s.Action]++
+	}
+	return counts
+}
+
+// TestJSONLExportImportRoundTrip imports an export into a fresh book and
+// checks that every line becomes a new contact: when the book's own contacts
+// have the same IDs as the exported ones, none of them is touched, and when
+// IDs are matched, those that name no contact are created.
+func TestJSONLExportImportRoundTrip(t *testing.T) {
+	source := newTestApp(t)
+	addContacts(t, source, roundTripContacts)
+	exported := serve(NewWebApp(source), http.MethodGet, "/api/contacts/export.jsonl", "", nil)
+	if exported.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", exported.Code, exported.Body)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		book  []appinterface.Contact
+	}{
+		{name: "IDs ignored", book: []appinterface.Contact{{FirstName: "Mallory", LastName: "Martin", Email: "mallory@example.com"}}},
+		{name: "IDs matched", query: "?matchIds=true"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fresh := newTestApp(t)
+			addContacts(t, fresh, test.book)
+			handler := NewWebApp(fresh)
+			statuses := importJSONLStatuses(t, handler, "/api/contacts/import.jsonl"+test.query, exported.Body.String())
+			if got := actions(statuses); got[appinterface.ImportCreated] != len(roundTripContacts) || len(got) != 1 {
+				t.Errorf("import into a fresh book: %v", statuses)
+			}
+			want := names(append(getContacts(t, source), test.book...))
+			if got := names(getContacts(t, fresh)); !slices.Equal(got, want) {
+				t.Errorf("contacts after import differ:\n got %q\nwant %q", got, want)
+			}
+
+			// A second import of the same lines changes nothing.
+			statuses = importJSONLStatuses(t, handler, "/api/contacts/import.jsonl"+test.query, exported.Body.String())
+			if got := actions(statuses); got[appinterface.ImportSkipped] != len(roundTripContacts) || len(got) != 1 {
+				t.Errorf("re-import: %v", statuses)
+			}
+		})
+	}
+}
+
+func TestJSONLImportMatchesIDsOnRequest(t *testing.T) {
+	a := newTestApp(t)
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+	handler := NewWebApp(a)
+	line := `{"id":1,"firstName":"Augusta","lastName":"King","email":"ada@example.com"}` + "\n"
+
+	statuses := importJSONLStatuses(t, handler, "/api/contacts/import.jsonl", line)
+	if len(statuses) != 1 || statuses[0].Action != appinterface.ImportCreated {
+		t.Errorf("import without matchIds: %v", statuses)
+	}
+	if c := ada(t, a); c.FirstName != "Ada" || c.Version != 1 {
+		t.Errorf("Ada was changed: %+v", c)
+	}
+
+	a = newTestApp(t)
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+	handler = NewWebApp(a)
+	statuses = importJSONLStatuses(t, handler, "/api/contacts/import.jsonl?matchIds=true", line)
+	if len(statuses) != 1 || statuses[0].Action != appinterface.ImportUpdated {
+		t.Errorf("import with matchIds: %v", statuses)
+	}
+	if c := ada(t, a); c.FirstName != "Augusta" || c.LastName != "King" {
+		t.Errorf("Ada was not updated: %+v", c)
+	}
+}
@@ -0,0 +1,105 @@
+package webapp
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"example-api-server/appinterface"
+)
+
+// overloadedApp is an app too busy for anything.
+type overloadedApp struct {
+	appinterface.App
+}
+
+func (overloadedApp) AddContact(context.Context, string, string, string) error {
+	return appinterface.ErrOverloaded
+}
+
+func (overloadedApp) GetContacts(context.Context) ([]appinterface.Contact, error) {
+	return nil, appinterface.ErrOverloaded
+}
+
+func (overloadedApp) ContactsAfter(context.Context, appinterface.Contact, int) ([]appinterface.Contact, error) {
+	return nil, appinterface.ErrOverloaded
+}
+
+func (overloadedApp) ContactDetails(context.Context, int) (appinterface.Contact, error) {
+	return appinterface.Contact{}, appinterface.ErrOverloaded
+}
+
+func (overloadedApp) DeleteContact(context.Context, int, []int) error {
+	return appinterface.ErrOverloaded
+}
+
+func (overloadedApp) UpdateContact(context.Context, int, []int, string, string, string) error {
+	return appinterface.ErrOverloaded
+}
+
+func (overloadedApp) PatchContact(context.Context, int, []int, appinterface.ContactPatch) (appinterface.Contact, error) {
+	return appinterface.Contact{}, appinterface.ErrOverloaded
+}
+
+func (overloadedApp) ShareContact(context.Context, int, []int, []appinterface.Share) (appinterface.Contact, error) {
+	return appinterface.Contact{}, appinterface.ErrOverloaded
+}
+
+func (overloadedApp) Batch(context.Context, []appinterface.BatchOperation) ([]appinterface.BatchResult, error) {
+	return nil, appinterface.ErrOverloaded
+}
+
+func (overloadedApp) Import(context.Context, []appinterface.Contact, bool) ([]appinterface.ImportResult, error) {
+	return nil, appinterface.ErrOverloaded
+}
+
+func (overloadedApp) Changes(context.Context, int) (appinterface.ChangeSet, error) {
+	return appinterface.ChangeSet{}, appinterface.ErrOverloaded
+}
+
+func (overloadedApp) Snapshot() (appinterface.SnapshotData, error) {
+	return appinterface.SnapshotData{}, appinterface.ErrOverloaded
+}
+
+func (overloadedApp) Restore(context.Context, appinterface.SnapshotData) error {
+	return appinterface.ErrOverloaded
+}
+
+func (overloadedApp) GetTrash(context.Context) ([]appinterface.TrashedContact, error) {
+	return nil, appinterface.ErrOverloaded
+}
+
+func (overloadedApp) RestoreContact(context.Context, int) error {
+	return appinterface.ErrOverloaded
+}
+
+// TestOverloaded checks that every route tells a client the app is too busy
+// for to try again in a second.
+func TestOverloaded(t *testing.T) {
+	_, snapshot := takeSnapshot(t)
+	handler := NewWebApp(overloadedApp{newTestApp(t)})
+	var requests []bookRequest
+	for _, r := range bookRequests(t) {
+		// Without an audit log there are no audit routes.
+		if r.path == "admin/audit" || r.path == "admin/audit/export.jsonl" {
+			continue
+		}
+		r.path = "/api/" + r.path
+		requests = append(requests, r)
+	}
+	requests = append(requests,
+		bookRequest{method: http.MethodGet, path: "/api/contact/1.vcf"},
+		bookRequest{method: http.MethodPost, path: "/api/admin/restore", body: snapshot, contentType: "application/json"},
+		bookRequest{method: "PROPFIND", path: bookPath, body: propfindETag},
+		bookRequest{method: "REPORT", path: bookPath, body: syncReport("")},
+		bookRequest{method: http.MethodGet, path: bookPath + "1.vcf"},
+		bookRequest{method: http.MethodPut, path: bookPath + "1.vcf", body: davCard, contentType: vcardType},
+		bookRequest{method: http.MethodDelete, path: bookPath + "1.vcf"},
+	)
+	for _, r := range requests {
+		response := serve(handler, r.method, r.path, r.body, map[string]string{"Content-Type": r.contentType, "Depth": "1"})
+		if response.Code != http.StatusServiceUnavailable || response.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s %s: got %d with Retry-After %q, want 503 with 1", r.method, r.path, response.Code, response.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package webapp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"example-api-server/appinterface"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// patchError is an error from applying a patch document that maps onto a
+// specific HTTP status.
+type patchError struct {
+	status  int
+	message string
+}
+
+func (e *patchError) Error() string {
+	return e.message
+}
+
+func unprocessable(format string, args ...any) error {
+	return &patchError{
+		status:  http.StatusUnprocessableEntity,
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
+// contactToDocument turns a contact into the generic JSON value that patch
+// documents operate on.
+func contactToDocument(contact appinterface.Contact) (any, error) {
+	bts, err := json.Marshal(contact)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	err = json.Unmarshal(bts, &doc)
+	return doc, err
+}
+
+// documentToContact is the inverse of contactToDocument.  Fields the contact
+// does not have are rejected rather than silently dropped, and the read-only
+// fields must come back unchanged.  Owner and shares are among them, as only
+// the shares endpoint changes who a contact belongs to or is shared with.
+func documentToContact(doc any, current appinterface.Contact) (appinterface.Contact, error) {
+	var result appinterface.Contact
+	bts, err := json.Marshal(doc)
+	if err != nil {
+		return result, unprocessable("Patched document is not valid JSON: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(bts))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&result)
+	if err != nil {
+		return result, unprocessable("Patched document is not a contact: %v", err)
+	}
+	if result.ID != current.ID || result.Version != current.Version {
+		return result, unprocessable("The id and version fields are read-only")
+	}
+	if result.Owner != current.Owner || !slices.Equal(result.Shares, current.Shares) {
+		return result, unprocessable("The owner and shares fields are read-only")
+	}
+	return result, nil
+}
+
+// mergePatch applies an RFC 7396 JSON Merge Patch to target.
+func mergePatch(target any, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+func newMergePatch(body []byte) (appinterface.ContactPatch, error) {
+	var patch any
+	err := json.Unmarshal(body, &patch)
+	if err != nil {
+		return nil, &patchError{status: http.StatusBadRequest, message: fmt.Sprintf("Error parsing merge patch: %v", err)}
+	}
+	return func(current appinterface.Contact) (appinterface.Contact, error) {
+		doc, err := contactToDocument(current)
+		if err != nil {
+			return current, err
+		}
+		return documentToContact(mergePatch(doc, patch), current)
+	}, nil
+}
+
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func newJSONPatch(body []byte) (appinterface.ContactPatch, error) {
+	var ops []jsonPatchOperation
+	err := json.Unmarshal(body, &ops)
+	if err != nil {
+		return nil, &patchError{status: http.StatusBadRequest, message: fmt.Sprintf("Error parsing JSON patch: %v", err)}
+	}
+	for i, op := range ops {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, &patchError{status: http.StatusBadRequest, message: fmt.Sprintf("Operation %d (%s) is missing a value", i, op.Op)}
+			}
+		case "remove", "move", "copy":
+		default:
+			return nil, &patchError{status: http.StatusBadRequest, message: fmt.Sprintf("Operation %d has unknown op %q", i, op.Op)}
+		}
+	}
+	return func(current appinterface.Contact) (appinterface.Contact, error) {
+		doc, err := contactToDocument(current)
+		if err != nil {
+			return current, err
+		}
+		for i, op := range ops {
+			doc, err = applyJSONPatchOperation(doc, op)
+			if err != nil {
+				if pe, ok := err.(*patchError); ok {
+					pe.message = fmt.Sprintf("Operation %d (%s %s): %s", i, op.Op, op.Path, pe.message)
+				}
+				return current, err
+			}
+		}
+		return documentToContact(doc, current)
+	}, nil
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, unprocessable("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex resolves a reference token against an array of length n.  When
+// forInsert is set the index may be n, or "-" meaning the end of the array.
+func arrayIndex(token string, n int, forInsert bool) (int, error) {
+	if forInsert && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, unprocessable("invalid array index %q", token)
+	}
+	if i > n || (i == n && !forInsert) {
+		return 0, unprocessable("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func getPointer(doc any, tokens []string) (any, error) {
+	for _, t := range tokens {
+		switch d := doc.(type) {
+		case map[string]any:
+			v, ok := d[t]
+			if !ok {
+				return nil, unprocessable("path member %q does not exist", t)
+			}
+			doc = v
+		case []any:
+			i, err := arrayIndex(t, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, unprocessable("path member %q does not exist", t)
+		}
+	}
+	return doc, nil
+}
+
+// updateAt walks to the container holding the last token and calls apply on
+// it, replacing each container along the way with whatever apply returns.
+func updateAt(doc any, tokens []string, apply func(container any, token string) (any, error)) (any, error) {
+	if len(tokens) == 1 {
+		return apply(doc, tokens[0])
+	}
+	switch d := doc.(type) {
+	case map[string]any:
+		child, ok := d[tokens[0]]
+		if !ok {
+			return nil, unprocessable("path member %q does not exist", tokens[0])
+		}
+		updated, err := updateAt(child, tokens[1:], apply)
+		if err != nil {
+			return nil, err
+		}
+		d[tokens[0]] = updated
+		return d, nil
+	case []any:
+		i, err := arrayIndex(tokens[0], len(d), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := updateAt(d[i], tokens[1:], apply)
+		if err != nil {
+			return nil, err
+		}
+		d[i] = updated
+		return d, nil
+	}
+	return nil, unprocessable("path member %q does not exist", tokens[0])
+}
+
+func addValue(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return updateAt(doc, tokens, func(container any, token string) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			c[token] = value
+			return c, nil
+		case []any:
+			i, err := arrayIndex(token, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, unprocessable("cannot add to a scalar value")
+	})
+}
+
+func removeValue(doc any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	return updateAt(doc, tokens, func(container any, token string) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			if _, ok := c[token]; !ok {
+				return nil, unprocessable("path member %q does not exist", token)
+			}
+			delete(c, token)
+			return c, nil
+		case []any:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, unprocessable("path member %q does not exist", token)
+	})
+}
+
+// deepCopy copies a value decoded by encoding/json.
+func deepCopy(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		r := make(map[string]any, len(v))
+		for k, e := range v {
+			r[k] = deepCopy(e)
+		}
+		return r
+	case []any:
+		r := make([]any, len(v))
+		for i, e := range v {
+			r[i] = deepCopy(e)
+		}
+		return r
+	}
+	return value
+}
+
+func applyJSONPatchOperation(doc any, op jsonPatchOperation) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	if op.Value != nil {
+		err = json.Unmarshal(op.Value, &value)
+		if err != nil {
+			return nil, unprocessable("invalid value: %v", err)
+		}
+	}
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, value)
+	case "remove":
+		return removeValue(doc, path)
+	case "replace":
+		if _, err := getPointer(doc, path); err != nil {
+			return nil, err
+		}
+		doc, err = removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		v, err := getPointer(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if op.Path != op.From && strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, unprocessable("cannot move a value into one of its children")
+			}
+			doc, err = removeValue(doc, from)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			v = deepCopy(v)
+		}
+		return addValue(doc, path, v)
+	case "test":
+		v, err := getPointer(doc, path)
+		if err != nil {
+			return nil, &patchError{status: http.StatusConflict, message: err.Error()}
+		}
+		if !reflect.DeepEqual(v, value) {
+			return nil, &patchError{status: http.StatusConflict, message: "test failed"}
+		}
+		return doc, nil
+	}
+	return nil, unprocessable("unknown op %q", op.Op)
+}
@@ -0,0 +1,182 @@
+package webapp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"example-api-server/appinterface"
+)
+
+// TestJSONPatchOperations applies patches to a document with escaped member
+// names, an array and a nested object, and checks the document they leave
+// or the status they fail with.
+func TestJSONPatchOperations(t *testing.T) {
+	const doc = `{"a/b":1,"m~n":2,"list":[1,2,3],"obj":{"x":1}}`
+	tests := []struct {
+		name  string
+		patch string
+		// want is the patched document, unless status is set.
+		want   string
+		status int
+	}{
+		{name: "add a member", patch: `[{"op":"add","path":"/obj/y","value":2}]`, want: `{"a/b":1,"m~n":2,"list":[1,2,3],"obj":{"x":1,"y":2}}`},
+		{name: "add replaces a member", patch: `[{"op":"add","path":"/obj/x","value":5}]`, want: `{"a/b":1,"m~n":2,"list":[1,2,3],"obj":{"x":5}}`},
+		{name: "add to the front", patch: `[{"op":"add","path":"/list/0","value":0}]`, want: `{"a/b":1,"m~n":2,"list":[0,1,2,3],"obj":{"x":1}}`},
+		{name: "add at the length", patch: `[{"op":"add","path":"/list/3","value":4}]`, want: `{"a/b":1,"m~n":2,"list":[1,2,3,4],"obj":{"x":1}}`},
+		{name: "add to the end", patch: `[{"op":"add","path":"/list/-","value":4}]`, want: `{"a/b":1,"m~n":2,"list":[1,2,3,4],"obj":{"x":1}}`},
+		{name: "add past the end", patch: `[{"op":"add","path":"/list/4","value":4}]`, status: http.StatusUnprocessableEntity},
+		{name: "add at a negative index", patch: `[{"op":"add","path":"/list/-1","value":4}]`, status: http.StatusUnprocessableEntity},
+		{name: "add at a leading zero index", patch: `[{"op":"add","path":"/list/01","value":4}]`, status: http.StatusUnprocessableEntity},
+		{name: "add under a missing member", patch: `[{"op":"add","path":"/missing/x","value":1}]`, status: http.StatusUnprocessableEntity},
+		{name: "add to a scalar", patch: `[{"op":"add","path":"/obj/x/y","value":1}]`, status: http.StatusUnprocessableEntity},
+		{name: "add the whole document", patch: `[{"op":"add","path":"","value":{"z":1}}]`, want: `{"z":1}`},
+		{name: "remove a member", patch: `[{"op":"remove","path":"/obj/x"}]`, want: `{"a/b":1,"m~n":2,"list":[1,2,3],"obj":{}}`},
+		{name: "remove an element", patch: `[{"op":"remove","path":"/list/1"}]`, want: `{"a/b":1,"m~n":2,"list":[1,3],"obj":{"x":1}}`},
+		{name: "remove past the end", patch: `[{"op":"remove","path":"/list/3"}]`, status: http.StatusUnprocessableEntity},
+		{name: "remove the end", patch: `[{"op":"remove","path":"/list/-"}]`, status: http.StatusUnprocessableEntity},
+		{name: "remove a missing member", patch: `[{"op":"remove","path":"/obj/y"}]`, status: http.StatusUnprocessableEntity},
+		{name: "replace", patch: `[{"op":"replace","path":"/list/2","value":"three"}]`, want: `{"a/b":1,"m~n":2,"list":[1,2,"three"],"obj":{"x":1}}`},
+		{name: "replace a missing member", patch: `[{"op":"replace","path":"/obj/y","value":1}]`, status: http.StatusUnprocessableEntity},
+		{name: "escaped slash", patch: `[{"op":"remove","path":"/a~1b"}]`, want: `{"m~n":2,"list":[1,2,3],"obj":{"x":1}}`},
+		{name: "escaped tilde", patch: `[{"op":"replace","path":"/m~0n","value":3}]`, want: `{"a/b":1,"m~n":3,"list":[1,2,3],"obj":{"x":1}}`},
+		{name: "escapes are undone once", patch: `[{"op":"add","path":"/~01","value":3}]`, want: `{"a/b":1,"m~n":2,"list":[1,2,3],"obj":{"x":1},"~1":3}`},
+		{name: "not a pointer", patch: `[{"op":"remove","path":"obj"}]`, status: http.StatusUnprocessableEntity},
+		{name: "move", patch: `[{"op":"move","from":"/obj/x","path":"/list/0"}]`, want: `{"a/b":1,"m~n":2,"list":[1,1,2,3],"obj":{}}`},
+		{name: "move within an array", patch: `[{"op":"move","from":"/list/0","path":"/list/-"}]`, want: `{"a/b":1,"m~n":2,"list":[2,3,1],"obj":{"x":1}}`},
+		{name: "move into its own child", patch: `[{"op":"move","from":"/obj","path":"/obj/inner"}]`, status: http.StatusUnprocessableEntity},
+		{name: "move onto itself", patch: `[{"op":"move","from":"/obj","path":"/obj"}]`, want: doc},
+		{name: "move to a sibling with the same prefix", patch: `[{"op":"move","from":"/obj","path":"/objects"}]`, want: `{"a/b":1,"m~n":2,"list":[1,2,3],"objects":{"x":1}}`},
+		{name: "move a missing member", patch: `[{"op":"move","from":"/obj/y","path":"/y"}]`, status: http.StatusUnprocessableEntity},
+		{name: "copy", patch: `[{"op":"copy","from":"/obj","path":"/copy"}]`, want: `{"a/b":1,"m~n":2,"list":[1,2,3],"obj":{"x":1},"copy":{"x":1}}`},
+		{name: "copies are deep", patch: `[{"op":"copy","from":"/list","path":"/copy"},{"op":"add","path":"/copy/-","value":4}]`, want: `{"a/b":1,"m~n":2,"list":[1,2,3],"obj":{"x":1},"copy":[1,2,3,4]}`},
+		{name: "test", patch: `[{"op":"test","path":"/list","value":[1,2,3]},{"op":"test","path":"/a~1b","value":1}]`, want: doc},
+		{name: "failed test", patch: `[{"op":"test","path":"/obj/x","value":2}]`, status: http.StatusConflict},
+		{name: "test of a missing member", patch: `[{"op":"test","path":"/obj/y","value":1}]`, status: http.StatusConflict},
+		{name: "failed test after changes", patch: `[{"op":"remove","path":"/obj/x"},{"op":"test","path":"/obj","value":{"x":1}}]`, status: http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ops []jsonPatchOperation
+			var got any
+			if err := json.Unmarshal([]byte(test.patch), &ops); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(doc), &got); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			for _, op := range ops {
+				if got, err = applyJSONPatchOperation(got, op); err != nil {
+					break
+				}
+			}
+			var pe *patchError
+			if test.status != 0 {
+				if !errors.As(err, &pe) || pe.status != test.status {
+					t.Errorf("got %v, want status %d", err, test.status)
+				}
+				return
+			}
+			var want any
+			if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v %v, want %v", got, err, want)
+			}
+		})
+	}
+}
+
+// TestPatchContact sends patches to Ada (ID 1), who has no owner, and Grace
+// (ID 2), whom "ed" owns and shares with "vi", and checks what they leave.
+func TestPatchContact(t *testing.T) {
+	tests := []struct {
+		name        string
+		id          string
+		contentType string
+		patch       string
+		status      int
+		// want is the patched contact when the patch succeeds.
+		want appinterface.Contact
+	}{
+		{name: "merge patch", id: "1", contentType: mergePatchType, patch: `{"firstName":"Augusta"}`, status: http.StatusOK,
+			want: appinterface.Contact{ID: 1, Version: 2, FirstName: "Augusta", LastName: "Lovelace", Email: "ada@example.com"}},
+		{name: "merge patch with parameters", id: "1", contentType: mergePatchType + "; charset=utf-8", patch: `{"lastName":"King"}`, status: http.StatusOK,
+			want: appinterface.Contact{ID: 1, Version: 2, FirstName: "Ada", LastName: "King", Email: "ada@example.com"}},
+		{name: "JSON patch", id: "1", contentType: jsonPatchType, patch: `[{"op":"test","path":"/firstName","value":"Ada"},{"op":"copy","from":"/lastName","path":"/firstName"}]`, status: http.StatusOK,
+			want: appinterface.Contact{ID: 1, Version: 2, FirstName: "Lovelace", LastName: "Lovelace", Email: "ada@example.com"}},
+		{name: "owned contact", id: "2", contentType: mergePatchType, patch: `{"firstName":"Amazing Grace"}`, status: http.StatusOK,
+			want: appinterface.Contact{ID: 2, Version: 3, FirstName: "Amazing Grace", LastName: "Hopper", Email: "grace@example.org",
+				Owner: "ed", Shares: []appinterface.Share{{User: "vi", Access: appinterface.AccessRead}}}},
+		{name: "failed test", id: "1", contentType: jsonPatchType, patch: `[{"op":"test","path":"/firstName","value":"Augusta"},{"op":"replace","path":"/firstName","value":"Augusta"}]`, status: http.StatusConflict},
+		{name: "removing a required field", id: "1", contentType: mergePatchType, patch: `{"email":null}`, status: http.StatusUnprocessableEntity},
+		{name: "unknown field", id: "1", contentType: mergePatchType, patch: `{"nickname":"Countess"}`, status: http.StatusUnprocessableEntity},
+		{name: "unknown field by JSON patch", id: "1", contentType: jsonPatchType, patch: `[{"op":"add","path":"/nickname","value":"Countess"}]`, status: http.StatusUnprocessableEntity},
+		{name: "changing the id", id: "1", contentType: mergePatchType, patch: `{"id":3}`, status: http.StatusUnprocessableEntity},
+		{name: "changing the version", id: "1", contentType: jsonPatchType, patch: `[{"op":"replace","path":"/version","value":9}]`, status: http.StatusUnprocessableEntity},
+		{name: "removing the id", id: "1", contentType: jsonPatchType, patch: `[{"op":"remove","path":"/id"}]`, status: http.StatusUnprocessableEntity},
+		{name: "setting an owner", id: "1", contentType: mergePatchType, patch: `{"owner":"mallory"}`, status: http.StatusUnprocessableEntity},
+		{name: "changing the owner", id: "2", contentType: jsonPatchType, patch: `[{"op":"replace","path":"/owner","value":"mallory"}]`, status: http.StatusUnprocessableEntity},
+		{name: "adding a share", id: "1", contentType: jsonPatchType, patch: `[{"op":"add","path":"/shares","value":[{"user":"mallory","access":"write"}]}]`, status: http.StatusUnprocessableEntity},
+		{name: "changing a share", id: "2", contentType: jsonPatchType, patch: `[{"op":"replace","path":"/shares/0/access","value":"write"}]`, status: http.StatusUnprocessableEntity},
+		{name: "removing the shares", id: "2", contentType: mergePatchType, patch: `{"shares":null}`, status: http.StatusUnprocessableEntity},
+		{name: "index out of range", id: "2", contentType: jsonPatchType, patch: `[{"op":"remove","path":"/shares/1"}]`, status: http.StatusUnprocessableEntity},
+		{name: "malformed merge patch", id: "1", contentType: mergePatchType, patch: `{"firstName":`, status: http.StatusBadRequest},
+		{name: "malformed JSON patch", id: "1", contentType: jsonPatchType, patch: `{"op":"remove","path":"/email"}`, status: http.StatusBadRequest},
+		{name: "unknown op", id: "1", contentType: jsonPatchType, patch: `[{"op":"rename","path":"/email"}]`, status: http.StatusBadRequest},
+		{name: "missing value", id: "1", contentType: jsonPatchType, patch: `[{"op":"add","path":"/email"}]`, status: http.StatusBadRequest},
+		{name: "unknown contact", id: "9", contentType: mergePatchType, patch: `{"firstName":"Augusta"}`, status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestApp(t)
+			addContacts(t, a, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+			if err := a.AddContact(asUser("ed"), "Grace", "Hopper", "grace@example.org"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.ShareContact(asUser("ed"), 2, nil, []appinterface.Share{{User: "vi", Access: appinterface.AccessRead}}); err != nil {
+				t.Fatal(err)
+			}
+			before := getContacts(t, a)
+			response := serve(NewWebApp(a), http.MethodPatch, "/api/contact/"+test.id, test.patch, map[string]string{"Content-Type": test.contentType})
+			if response.Code != test.status {
+				t.Fatalf("got %d %s, want %d", response.Code, response.Body, test.status)
+			}
+			if test.status != http.StatusOK {
+				if after := getContacts(t, a); !reflect.DeepEqual(after, before) {
+					t.Errorf("the failed patch changed the book:\n%+v\n%+v", before, after)
+				}
+				return
+			}
+			var got appinterface.Contact
+			if err := json.Unmarshal(response.Body.Bytes(), &got); err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v %v, want %+v", got, err, test.want)
+			}
+			if etag := response.Header().Get("ETag"); etag == "" {
+				t.Errorf("no ETag")
+			}
+		})
+	}
+}
+
+func TestPatchContentType(t *testing.T) {
+	a := newTestApp(t)
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+	handler := NewWebApp(a)
+	for _, contentType := range []string{"", "application/json", "text/plain"} {
+		response := serve(handler, http.MethodPatch, "/api/contact/1", `{"firstName":"Augusta"}`, map[string]string{"Content-Type": contentType})
+		if response.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%q: got %d %s", contentType, response.Code, response.Body)
+		}
+		if got := response.Header().Get("Accept-Patch"); got != mergePatchType+", "+jsonPatchType {
+			t.Errorf("%q: Accept-Patch %q", contentType, got)
+		}
+	}
+	if got := getContacts(t, a); got[0].FirstName != "Ada" {
+		t.Errorf("an unsupported patch changed the contact: %+v", got[0])
+	}
+}
@@ -0,0 +1,200 @@
+package webapp
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttledRequests counts the requests refused for going over a rate
+// limit, by "read" and "write".
+var throttledRequests = expvar.NewMap("throttled_requests")
+
+// RateLimit is a token bucket: Rate requests a second on average, in bursts
+// of up to Burst.  A zero Rate does not limit at all.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits limits every client, by API key or, for requests without one,
+// by address.  Reads and writes are limited separately, so a client that
+// is writing can still read.
+type RateLimits struct {
+	Read  RateLimit
+	Write RateLimit
+}
+
+// bucketSweepInterval is how often buckets that have filled up again, and
+// so are no different from new ones, are dropped.
+const bucketSweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type limiter struct {
+	limit RateLimit
+	mu    sync.Mutex
+	// buckets are keyed by client.
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	// now is the clock the buckets fill by.
+	now func() time.Time
+}
+
+func newLimiter(limit RateLimit) *limiter {
+	return &limiter{limit: limit, buckets: map[string]*bucket{}, lastSweep: time.Now(), now: time.Now}
+}
+
+// take takes a token from the bucket of key if it has one, and returns how
+// many are left and how long until the bucket is full again or, if it was
+// empty, until it has a token.
+func (l *limiter) take(key string, now time.Time) (ok bool, remaining int, reset time.Duration, retryAfter time.Duration) {
+	burst := float64(l.limit.Burst)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= bucketSweepInterval {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retryAfter = seconds((1 - b.tokens) / l.limit.Rate)
+	}
+	reset = seconds((burst - b.tokens) / l.limit.Rate)
+	return ok, int(b.tokens), reset, retryAfter
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// rateLimitKey is who a request counts against: the client that made it
+// or, if it did not authenticate, the address it came from.
+func (w *webApp) rateLimitKey(request *http.Request) string {
+	if c := requestClient(request); c.Name != "" {
+		return "client:" + c.Name
+	}
+	return "ip:" + w.clientIP(request)
+}
+
+// allowRequest counts request against its client's limit and tells it how
+// much of that is left, or refuses it with 429 if there is none.
+func (w *webApp) allowRequest(key string, response http.ResponseWriter, request *http.Request) bool {
+	l, kind := w.writeLimiter, "write"
+	if safeMethod(request.Method) {
+		l, kind = w.readLimiter, "read"
+	}
+	if l == nil {
+		return true
+	}
+	ok, remaining, reset, retryAfter := l.take(key, l.now())
+	header := response.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(l.limit.Burst))
+	header.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	if ok {
+		return true
+	}
+	throttledRequests.Add(kind, 1)
+	header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	r := problemJson{
+		Type:   "about:blank",
+		Title:  http.StatusText(http.StatusTooManyRequests),
+		Status: http.StatusTooManyRequests,
+		Detail: fmt.Sprintf("Too many %ss, try again in %s", kind, retryAfter.Round(time.Second)),
+	}
+	bts, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Error marshalling problem: %v\n", err)
+		w.errorPage("ERROR", renderError(err), http.StatusInternalServerError, response)
+		return false
+	}
+	standardHeaders("application/problem+json", response)
+	response.WriteHeader(http.StatusTooManyRequests)
+	_, err = response.Write(bts)
+	if err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+	return false
+}
+
+// rateLimit only passes on the requests their client's limits allow.
+func (w *webApp) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !w.allowRequest(w.rateLimitKey(request), response, request) {
+			return
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// trustedProxy reports whether addr is one of the proxies whose
+// X-Forwarded-For is believed.
+func (w *webApp) trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(strings.TrimSpace(addr))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range w.options.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address the request came from.  Requests relayed
+// by trusted proxies came from the last address in X-Forwarded-For that is
+// not a trusted proxy itself; anything before it could have been made up
+// by the client.
+func (w *webApp) clientIP(request *http.Request) string {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+	if !w.trustedProxy(ip) {
+		return ip
+	}
+	var hops []string
+	for _, header := range request.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// The rest cannot be told apart from what the client sent.
+			break
+		}
+		ip = hop
+		if !w.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,237 @@
+package webapp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+// newLimitedWebApp serves an empty book under options, with the rate limits
+// reading the time off the clock returned rather than the wall.
+func newLimitedWebApp(t *testing.T, options Options) (*webApp, *time.Time) {
+	t.Helper()
+	books := appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: newTestApp(t)})
+	handler, err := NewWebAppWithOptions(books, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := handler.(*webApp)
+	clock := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, l := range []*limiter{w.readLimiter, w.writeLimiter} {
+		if l != nil {
+			l.now = func() time.Time { return clock }
+		}
+	}
+	return w, &clock
+}
+
+// serveFrom is serve for a request that came from the address remote.
+func serveFrom(handler http.Handler, remote string, method string, path string, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, nil)
+	request.RemoteAddr = remote
+	for k, v := range header {
+		request.Header.Set(k, v)
+	}
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+func TestLimiterTake(t *testing.T) {
+	l := newLimiter(RateLimit{Rate: 2, Burst: 3})
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		after      time.Duration
+		ok         bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}{
+		{after: 0, ok: true, remaining: 2, reset: 500 * time.Millisecond},
+		{after: 0, ok: true, remaining: 1, reset: time.Second},
+		{after: 0, ok: true, remaining: 0, reset: 1500 * time.Millisecond},
+		{after: 0, ok: false, remaining: 0, reset: 1500 * time.Millisecond, retryAfter: 500 * time.Millisecond},
+		{after: 250 * time.Millisecond, ok: false, remaining: 0, reset: 1250 * time.Millisecond, retryAfter: 250 * time.Millisecond},
+		{after: 500 * time.Millisecond, ok: true, remaining: 0, reset: 1500 * time.Millisecond},
+		// A bucket never holds more than the burst.
+		{after: time.Hour, ok: true, remaining: 2, reset: 500 * time.Millisecond},
+	}
+	for i, test := range tests {
+		ok, remaining, reset, retryAfter := l.take("k", start.Add(test.after))
+		if ok != test.ok || remaining != test.remaining || reset != test.reset || retryAfter != test.retryAfter {
+			t.Errorf("take %d: %v %d %v %v, want %v %d %v %v", i, ok, remaining, reset, retryAfter,
+				test.ok, test.remaining, test.reset, test.retryAfter)
+		}
+	}
+	if ok, remaining, _, _ := l.take("other", start); !ok || remaining != 2 {
+		t.Errorf("another key shares the bucket: %v %d", ok, remaining)
+	}
+}
+
+func TestRateLimitResponses(t *testing.T) {
+	w, clock := newLimitedWebApp(t, Options{RateLimits: RateLimits{
+		Read:  RateLimit{Rate: 1, Burst: 2},
+		Write: RateLimit{Rate: 0.5, Burst: 1},
+	}})
+	const remote = "192.0.2.1:1234"
+	for i, remaining := range []string{"1", "0"} {
+		response := serveFrom(w, remote, http.MethodGet, "/api/contacts", nil)
+		header := response.Header()
+		if response.Code != http.StatusOK || header.Get("RateLimit-Limit") != "2" || header.Get("RateLimit-Remaining") != remaining {
+			t.Errorf("read %d: %d %v", i, response.Code, header)
+		}
+	}
+	response := serveFrom(w, remote, http.MethodGet, "/api/contacts", nil)
+	header := response.Header()
+	if response.Code != http.StatusTooManyRequests || header.Get("Retry-After") != "1" || header.Get("RateLimit-Remaining") != "0" || header.Get("RateLimit-Reset") != "2" {
+		t.Fatalf("read over the limit: %d %v", response.Code, header)
+	}
+	var problem problemJson
+	if err := json.Unmarshal(response.Body.Bytes(), &problem); err != nil || header.Get("Content-Type") != "application/problem+json" || problem.Status != http.StatusTooManyRequests {
+		t.Errorf("refusal: %s %v", response.Body, err)
+	}
+
+	// Writes have a bucket of their own, which the reads have not touched.
+	write := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	response = serveFrom(w, remote, http.MethodPost, "/api/trash/1/restore", write)
+	if response.Code == http.StatusTooManyRequests || response.Header().Get("RateLimit-Limit") != "1" {
+		t.Errorf("first write: %d %v", response.Code, response.Header())
+	}
+	response = serveFrom(w, remote, http.MethodPost, "/api/trash/1/restore", write)
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") != "2" {
+		t.Errorf("second write: %d %v", response.Code, response.Header())
+	}
+
+	// The buckets fill up again as time passes.
+	*clock = clock.Add(time.Second)
+	if response := serveFrom(w, remote, http.MethodGet, "/api/contacts", nil); response.Code != http.StatusOK {
+		t.Errorf("read a second later: %d", response.Code)
+	}
+	if response := serveFrom(w, remote, http.MethodPost, "/api/trash/1/restore", write); response.Code != http.StatusTooManyRequests {
+		t.Errorf("write a second later: %d", response.Code)
+	}
+	*clock = clock.Add(time.Second)
+	if response := serveFrom(w, remote, http.MethodPost, "/api/trash/1/restore", write); response.Code == http.StatusTooManyRequests {
+		t.Errorf("write two seconds later: %d", response.Code)
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	options := Options{RateLimits: RateLimits{Read: RateLimit{Rate: 1, Burst: 1}}}
+	keys := withKeys(t, &options, map[string]auth.Role{"a": auth.RoleViewer, "b": auth.RoleViewer})
+	w, _ := newLimitedWebApp(t, options)
+	tests := []struct {
+		name   string
+		remote string
+		header map[string]string
+		status int
+	}{
+		{name: "a", remote: "192.0.2.1:1", header: keys["a"], status: http.StatusOK},
+		{name: "a again", remote: "192.0.2.1:1", header: keys["a"], status: http.StatusTooManyRequests},
+		{name: "a from elsewhere", remote: "192.0.2.2:1", header: keys["a"], status: http.StatusTooManyRequests},
+		{name: "b from a's address", remote: "192.0.2.1:1", header: keys["b"], status: http.StatusOK},
+		// Requests without credentials count against their address.
+		{name: "anonymous", remote: "192.0.2.1:1", status: http.StatusOK},
+		{name: "anonymous again", remote: "192.0.2.1:2", status: http.StatusTooManyRequests},
+		{name: "anonymous from elsewhere", remote: "192.0.2.2:1", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		path := "/api/contacts"
+		if test.header == nil {
+			path = "/api/server-time"
+		}
+		if response := serveFrom(w, test.remote, http.MethodGet, path, test.header); response.Code != test.status {
+			t.Errorf("%s: %d, want %d", test.name, response.Code, test.status)
+		}
+	}
+}
+
+func TestFailedAuthenticationIsThrottled(t *testing.T) {
+	options := Options{RateLimits: RateLimits{Read: RateLimit{Rate: 1, Burst: 2}}}
+	keys := withKeys(t, &options, map[string]auth.Role{"a": auth.RoleViewer})
+	w, clock := newLimitedWebApp(t, options)
+	wrong := map[string]string{"Authorization": "Bearer wrong"}
+	for i, status := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if response := serveFrom(w, "192.0.2.1:1", http.MethodGet, "/api/contacts", wrong); response.Code != status {
+			t.Errorf("guess %d: %d, want %d", i, response.Code, status)
+		}
+	}
+	// Only the guesses' address is throttled, and not clients that sign
+	// in from it.
+	if response := serveFrom(w, "192.0.2.2:1", http.MethodGet, "/api/contacts", wrong); response.Code != http.StatusUnauthorized {
+		t.Errorf("guess from elsewhere: %d", response.Code)
+	}
+	if response := serveFrom(w, "192.0.2.1:1", http.MethodGet, "/api/contacts", keys["a"]); response.Code != http.StatusOK {
+		t.Errorf("a from the guesses' address: %d", response.Code)
+	}
+	*clock = clock.Add(time.Second)
+	if response := serveFrom(w, "192.0.2.1:1", http.MethodGet, "/api/contacts", wrong); response.Code != http.StatusUnauthorized {
+		t.Errorf("guess a second later: %d", response.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	w := &webApp{options: Options{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{name: "direct", remote: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "untrusted proxy", remote: "192.0.2.1:1234", forwarded: []string{"198.51.100.1"}, want: "192.0.2.1"},
+		{name: "trusted proxy", remote: "10.0.0.1:1234", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "trusted proxy without the header", remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "spoofed leading hops", remote: "10.0.0.1:1234", forwarded: []string{"203.0.113.9, 203.0.113.8, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "chain of trusted proxies", remote: "10.0.0.1:1234", forwarded: []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "several headers", remote: "10.0.0.1:1234", forwarded: []string{"203.0.113.9", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "garbage before the client", remote: "10.0.0.1:1234", forwarded: []string{"not an address, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "garbage after the client", remote: "10.0.0.1:1234", forwarded: []string{"198.51.100.1, not an address"}, want: "10.0.0.1"},
+		{name: "only trusted proxies", remote: "10.0.0.1:1234", forwarded: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "IPv4-mapped trusted proxy", remote: "[::ffff:10.0.0.1]:1234", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "IPv6 client", remote: "10.0.0.1:1234", forwarded: []string{"2001:db8::1"}, want: "2001:db8::1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = test.remote
+			for _, f := range test.forwarded {
+				request.Header.Add("X-Forwarded-For", f)
+			}
+			if got := w.clientIP(request); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// TestSpoofedForwardingIsNotANewClient checks that a client cannot dodge its
+// limit by sending a different X-Forwarded-For with each request.
+func TestSpoofedForwardingIsNotANewClient(t *testing.T) {
+	w, _ := newLimitedWebApp(t, Options{
+		RateLimits:     RateLimits{Read: RateLimit{Rate: 1, Burst: 1}},
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	tests := []struct {
+		remote    string
+		forwarded string
+		status    int
+	}{
+		{remote: "192.0.2.1:1", forwarded: "203.0.113.1", status: http.StatusOK},
+		{remote: "192.0.2.1:1", forwarded: "203.0.113.2", status: http.StatusTooManyRequests},
+		{remote: "10.0.0.1:1", forwarded: "203.0.113.1, 198.51.100.1", status: http.StatusOK},
+		{remote: "10.0.0.1:1", forwarded: "203.0.113.2, 198.51.100.1", status: http.StatusTooManyRequests},
+	}
+	for i, test := range tests {
+		response := serveFrom(w, test.remote, http.MethodGet, "/api/server-time", map[string]string{"X-Forwarded-For": test.forwarded})
+		if response.Code != test.status {
+			t.Errorf("request %d: %d, want %d", i, response.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package webapp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"example-api-server/appinterface"
+	"example-api-server/audit"
+	"example-api-server/auth"
+)
+
+// roleBook is a book holding Ada (ID 1), whom the editor "ed" owns and
+// shares with the viewer "vi", and Alan (ID 3), with Grace (ID 2) in the
+// trash, served with an audit log to vi, ed and the admin "root".
+type roleBook struct {
+	app     appinterface.App
+	handler http.Handler
+	keys    map[string]map[string]string
+}
+
+func newRoleBook(t *testing.T) roleBook {
+	t.Helper()
+	l, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	a := newTestApp(t)
+	if err := a.AddContact(asUser("ed"), "Ada", "Lovelace", "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	addContacts(t, a, []appinterface.Contact{
+		{FirstName: "Grace", LastName: "Hopper", Email: "grace@example.org"},
+		{FirstName: "Alan", LastName: "Turing", Email: "alan@example.org"},
+	})
+	if _, err := a.ShareContact(asUser("ed"), 1, nil, []appinterface.Share{{User: "vi", Access: appinterface.AccessRead}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DeleteContact(context.Background(), 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	options := Options{Audit: l, SessionLifetime: time.Hour}
+	keys := withKeys(t, &options, map[string]auth.Role{"vi": auth.RoleViewer, "ed": auth.RoleEditor, "root": auth.RoleAdmin})
+	options.APIKeys, err = auth.NewStore(options.APIKeys.Keys(), filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	books := appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: audit.Wrap(a, l, appinterface.DefaultBook)})
+	handler, err := NewWebAppWithOptions(books, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return roleBook{app: a, handler: handler, keys: keys}
+}
+
+// TestRoleMatrix sends every route to a viewer, an editor and an admin and
+// checks that the roles allowed the route's permission get through and the
+// others get a 403 problem that leaves the book as it was.  A batch names the
+// first permission the role lacks, which for a viewer is changing contacts.
+func TestRoleMatrix(t *testing.T) {
+	rb := newRoleBook(t)
+	snapshot := serve(rb.handler, http.MethodPost, "/api/admin/snapshot", "", rb.keys["root"])
+	if snapshot.Code != http.StatusOK {
+		t.Fatalf("snapshot: %d %s", snapshot.Code, snapshot.Body)
+	}
+	const card = "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Martin;Mallory;;;\r\nEMAIL:mallory@example.com\r\nEND:VCARD\r\n"
+	var routes []struct {
+		bookRequest
+		perm auth.Permission
+		// status is what the roles allowed get, any success if zero.
+		status int
+	}
+	add := func(perm auth.Permission, status int, r bookRequest) {
+		routes = append(routes, struct {
+			bookRequest
+			perm   auth.Permission
+			status int
+		}{r, perm, status})
+	}
+	perms := map[string]auth.Permission{
+		"GET contacts":                 auth.PermRead,
+		"GET contact/1":                auth.PermRead,
+		"GET contacts/export.csv":      auth.PermRead,
+		"GET contacts/export.vcf":      auth.PermRead,
+		"GET contacts/export.jsonl":    auth.PermRead,
+		"GET trash":                    auth.PermWrite,
+		"POST admin/snapshot":          auth.PermAdmin,
+		"GET admin/audit":              auth.PermAdmin,
+		"GET admin/audit/export.jsonl": auth.PermAdmin,
+		"POST add-contact":             auth.PermWrite,
+		"PUT contact/1":                auth.PermWrite,
+		"PATCH contact/1":              auth.PermWrite,
+		"PUT contact/1/shares":         auth.PermWrite,
+		"POST batch":                   auth.PermWrite,
+		"POST contacts/import":         auth.PermWrite,
+		"POST contacts/import.vcf":     auth.PermWrite,
+		"POST contacts/import.jsonl":   auth.PermWrite,
+		"POST trash/2/restore":         auth.PermWrite,
+		"DELETE contact/3":             auth.PermDelete,
+	}
+	for _, r := range bookRequests(t) {
+		perm, ok := perms[r.method+" "+r.path]
+		if !ok {
+			t.Fatalf("no permission listed for %s %s", r.method, r.path)
+		}
+		r.path = "/api/" + r.path
+		add(perm, 0, r)
+	}
+	// A snapshot only restores into an empty book, which this one is not.
+	add(auth.PermAdmin, http.StatusConflict, bookRequest{method: http.MethodPost, path: "/api/admin/restore", body: snapshot.Body.String(), contentType: "application/json"})
+	add(auth.PermDelete, 0, bookRequest{method: http.MethodPost, path: "/api/batch", body: `[{"op":"delete","id":3}]`, contentType: "application/json"})
+	add(auth.PermDelete, 0, bookRequest{method: http.MethodPost, path: "/api/batch", body: `[{"op":"update","id":1,"firstName":"Mallory","lastName":"Martin","email":"mallory@example.com"},{"op":"delete","id":3}]`, contentType: "application/json"})
+	add(auth.PermRead, 0, bookRequest{method: http.MethodGet, path: "/api/books"})
+	add(auth.PermAdmin, 0, bookRequest{method: http.MethodGet, path: "/api/admin/metrics"})
+	add(auth.PermAdmin, 0, bookRequest{method: http.MethodGet, path: "/api/admin/audit/verify"})
+	add(auth.PermAdmin, 0, bookRequest{method: http.MethodGet, path: "/api/admin/api-keys"})
+	add(auth.PermAdmin, 0, bookRequest{method: http.MethodPost, path: "/api/admin/api-keys", body: `{"name":"ci","role":"viewer"}`, contentType: "application/json"})
+	add(auth.PermAdmin, http.StatusNotFound, bookRequest{method: http.MethodDelete, path: "/api/admin/api-keys/unknown"})
+	add(auth.PermRead, 0, bookRequest{method: http.MethodOptions, path: bookPath})
+	add(auth.PermRead, 0, bookRequest{method: "PROPFIND", path: bookPath, body: propfindETag})
+	add(auth.PermRead, 0, bookRequest{method: "REPORT", path: bookPath, body: syncReport("")})
+	add(auth.PermRead, 0, bookRequest{method: http.MethodGet, path: bookPath + "1.vcf"})
+	add(auth.PermWrite, 0, bookRequest{method: http.MethodPut, path: bookPath + "1.vcf", body: card, contentType: vcardType})
+	add(auth.PermDelete, 0, bookRequest{method: http.MethodDelete, path: bookPath + "3.vcf"})
+
+	roles := map[string]auth.Role{"vi": auth.RoleViewer, "ed": auth.RoleEditor, "root": auth.RoleAdmin}
+	for _, r := range routes {
+		for client, role := range roles {
+			t.Run(string(role)+" "+r.method+" "+r.path, func(t *testing.T) {
+				rb := newRoleBook(t)
+				before := getContacts(t, rb.app)
+				response := serve(rb.handler, r.method, r.path, r.body, with(rb.keys[client], "Content-Type", r.contentType, "Depth", "1"))
+				if !role.Can(r.perm) {
+					denied := r.perm
+					if r.path == "/api/batch" && !role.Can(auth.PermWrite) {
+						denied = auth.PermWrite
+					}
+					var problem problemJson
+					err := json.Unmarshal(response.Body.Bytes(), &problem)
+					if response.Code != http.StatusForbidden || response.Header().Get("Content-Type") != "application/problem+json" || err != nil ||
+						problem.Status != http.StatusForbidden || problem.Detail != "The "+string(role)+" role may not "+denied.String() {
+						t.Errorf("got %d %s, want 403 problem", response.Code, response.Body)
+					}
+					if after := getContacts(t, rb.app); !reflect.DeepEqual(after, before) {
+						t.Errorf("the refused request changed the book:\n%+v\n%+v", before, after)
+					}
+					return
+				}
+				if r.status != 0 && response.Code != r.status || r.status == 0 && (response.Code < 200 || response.Code > 299) {
+					t.Errorf("got %d %s", response.Code, response.Body)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package webapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+// maxSharesBody bounds the size of the list of shares of a contact.
+const maxSharesBody = 64 << 10
+
+// principal is who the app acts for on behalf of a client: the client, the
+// groups it is in and, for admins of the book, every contact.  A client not
+// shown email addresses as they are cannot change them.
+func (w *webApp) principal(c client) appinterface.Principal {
+	p := appinterface.Principal{Name: c.Name, All: c.Role == auth.RoleAdmin, KeepEmails: !w.clientVisibility(c.Name).full()}
+	for group, members := range w.options.Groups {
+		if slices.Contains(members, c.Name) {
+			p.Groups = append(p.Groups, group)
+		}
+	}
+	slices.Sort(p.Groups)
+	return p
+}
+
+func validView(view string) bool {
+	switch view {
+	case "", "all", "mine", "shared":
+		return true
+	}
+	return false
+}
+
+// inView keeps the contacts of a view of the contacts list: "mine" are
+// those the client owns and "shared" those others have shared with it.
+func inView(view string, request *http.Request, contacts []appinterface.Contact) []appinterface.Contact {
+	if view == "" || view == "all" {
+		return contacts
+	}
+	p, _ := appinterface.PrincipalFrom(request.Context())
+	out := []appinterface.Contact{}
+	for _, c := range contacts {
+		mine := c.Owner == p.Name
+		if (view == "mine" && mine) || (view == "shared" && !mine && p.SharedWith(c) != "") {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// shareContact replaces who a contact is shared with by the list of shares
+// in the body, so an empty list makes it private again.
+func (w *webApp) shareContact(response http.ResponseWriter, request *http.Request) {
+	id, ok := w.pathID(response, request)
+	if !ok {
+		return
+	}
+	request.Body = http.MaxBytesReader(response, request.Body, maxSharesBody)
+	var shares []appinterface.Share
+	err := json.NewDecoder(request.Body).Decode(&shares)
+	if err != nil {
+		r := errorJson{
+			Error: fmt.Sprintf("Error parsing shares: %v", err),
+		}
+		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		return
+	}
+	v := w.visibility(request)
+	ifMatch, conditional := ifMatchVersions(request, v)
+	if conditional && len(ifMatch) == 0 {
+		w.preconditionFailed(response)
+		return
+	}
+	contact, err := w.book(request).ShareContact(request.Context(), id, ifMatch, shares)
+	if err != nil {
+		w.sendMutationError("Error sharing contact: %v", err, response)
+		return
+	}
+	w.sendJsonWithETag(v.Contact(contact), contactETag(contact, v), request, "Error marshalling contact: %v", response)
+}
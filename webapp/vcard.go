@@ -0,0 +1,537 @@
+package webapp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/quotedprintable"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"example-api-server/appinterface"
+)
+
+const (
+	vcardType = "text/vcard; charset=utf-8"
+	// vcardLineLength is the number of octets after which lines are folded.
+	vcardLineLength = 75
+	// maxVCardLine bounds the length of a single unfolded content line.
+	maxVCardLine = 64 << 10
+)
+
+// vcardProperty is one unfolded content line of a vCard, with its value
+// decoded to UTF-8 but not yet unescaped.
+type vcardProperty struct {
+	Name   string
+	Params map[string][]string
+	Value  string
+}
+
+func (p vcardProperty) hasParam(name string, value string) bool {
+	for _, v := range p.Params[name] {
+		for _, v := range strings.Split(v, ",") {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// vcard is a parsed vCard.  Line is where its BEGIN:VCARD was found.
+type vcard struct {
+	Line       int
+	Properties []vcardProperty
+}
+
+func (c *vcard) all(name string) []vcardProperty {
+	var result []vcardProperty
+	for _, p := range c.Properties {
+		if p.Name == name {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func (c *vcard) first(name string) (vcardProperty, bool) {
+	for _, p := range c.Properties {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return vcardProperty{}, false
+}
+
+// vcardEscape escapes a text value.
+func vcardEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// vcardSplit splits a value on unescaped occurrences of sep and unescapes
+// each component.
+func vcardSplit(value string, sep byte) []string {
+	var result []string
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && i+1 < len(value):
+			i++
+			switch value[i] {
+			case 'n', 'N':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(value[i])
+			}
+		case c == sep:
+			result = append(result, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return append(result, b.String())
+}
+
+// vcardUnescape unescapes a single text value.
+func vcardUnescape(value string) string {
+	return vcardSplit(value, 0)[0]
+}
+
+// vcardDecodeCharset converts a value from the charset named in a CHARSET
+// parameter to UTF-8.
+func vcardDecodeCharset(value []byte, charset string) (string, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		if !utf8.Valid(value) {
+			return "", errors.New("value is not valid UTF-8")
+		}
+		return string(value), nil
+	case "iso-8859-1", "latin1", "latin-1", "windows-1252", "cp1252":
+		// windows-1252 only differs from latin1 in the C1 range, which
+		// does not show up in names or email addresses.
+		runes := make([]rune, len(value))
+		for i, b := range value {
+			runes[i] = rune(b)
+		}
+		return string(runes), nil
+	}
+	return "", fmt.Errorf("unsupported charset %q", charset)
+}
+
+// parseVCardLine splits an unfolded content line into its name, parameters
+// and value, handling the ENCODING and CHARSET parameters of older vCards.
+func parseVCardLine(line string) (vcardProperty, error) {
+	p := vcardProperty{Params: map[string][]string{}}
+	// The name and parameters end at the first colon outside of quotes.
+	end := -1
+	quoted := false
+	for i := 0; i < len(line) && end < 0; i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if !quoted {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return p, fmt.Errorf("missing ':' in %q", line)
+	}
+	head := line[:end]
+	value := line[end+1:]
+
+	var parts []string
+	start := 0
+	quoted = false
+	for i := 0; i < len(head); i++ {
+		switch head[i] {
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				parts = append(parts, head[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, head[start:])
+
+	name := parts[0]
+	if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+		// Drop the group, e.g. "item1.EMAIL".
+		name = name[dot+1:]
+	}
+	p.Name = strings.ToUpper(name)
+	if p.Name == "" {
+		return p, fmt.Errorf("missing property name in %q", line)
+	}
+	for _, param := range parts[1:] {
+		k, v, ok := strings.Cut(param, "=")
+		if !ok {
+			// vCard 2.1 allows bare types like EMAIL;INTERNET;PREF.
+			k, v = "TYPE", param
+		}
+		p.Params[strings.ToUpper(k)] = append(p.Params[strings.ToUpper(k)], strings.Trim(v, `"`))
+	}
+
+	raw := []byte(value)
+	var encoding, charset string
+	if e := p.Params["ENCODING"]; len(e) > 0 {
+		encoding = strings.ToUpper(e[0])
+	}
+	if c := p.Params["CHARSET"]; len(c) > 0 {
+		charset = c[0]
+	}
+	switch encoding {
+	case "":
+	case "QUOTED-PRINTABLE":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(value)))
+		if err != nil {
+			return p, fmt.Errorf("bad quoted-printable value in %s: %v", p.Name, err)
+		}
+		raw = decoded
+	case "B", "BASE64":
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return p, fmt.Errorf("bad base64 value in %s: %v", p.Name, err)
+		}
+		raw = decoded
+	default:
+		return p, fmt.Errorf("unsupported encoding %q in %s", encoding, p.Name)
+	}
+	decoded, err := vcardDecodeCharset(raw, charset)
+	if err != nil {
+		return p, fmt.Errorf("%s: %v", p.Name, err)
+	}
+	p.Value = decoded
+	return p, nil
+}
+
+// vcardLines reads unfolded content lines, along with the line number each
+// one started on.
+func vcardLines(r io.Reader, yield func(line string, number int) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxVCardLine)
+	var current strings.Builder
+	start, number := 0, 0
+	softBreak := false
+	flush := func() error {
+		if current.Len() == 0 {
+			return nil
+		}
+		line := current.String()
+		current.Reset()
+		return yield(line, start)
+	}
+	for scanner.Scan() {
+		number++
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		switch {
+		case softBreak:
+			// A quoted-printable soft line break continues on the next line
+			// without the usual leading whitespace.
+			current.WriteString(text)
+		case len(text) > 0 && (text[0] == ' ' || text[0] == '\t'):
+			current.WriteString(text[1:])
+		default:
+			if err := flush(); err != nil {
+				return err
+			}
+			start = number
+			current.WriteString(text)
+		}
+		if current.Len() > maxVCardLine {
+			return fmt.Errorf("line %d: content line too long", start)
+		}
+		upper := strings.ToUpper(current.String())
+		softBreak = strings.HasSuffix(text, "=") && strings.Contains(upper, "QUOTED-PRINTABLE")
+		if softBreak {
+			s := current.String()
+			current.Reset()
+			current.WriteString(s[:len(s)-1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// vcardResult is one card from parseVCards, or the reason it could not be
+// read.
+type vcardResult struct {
+	Card *vcard
+	Err  error
+}
+
+// parseVCards reads every vCard in r.  A malformed card is reported in its
+// result and parsing carries on with the next card; only an unreadable
+// stream is returned as an error.
+func parseVCards(r io.Reader) ([]vcardResult, error) {
+	var results []vcardResult
+	var card *vcard
+	var cardErr error
+	err := vcardLines(r, func(line string, number int) error {
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+		p, err := parseVCardLine(line)
+		switch {
+		case err == nil && p.Name == "BEGIN" && strings.EqualFold(p.Value, "VCARD"):
+			if card != nil {
+				results = append(results, vcardResult{Card: card, Err: errors.New("missing END:VCARD")})
+			}
+			card = &vcard{Line: number}
+			cardErr = nil
+		case card == nil:
+			return fmt.Errorf("line %d: content outside of a vCard", number)
+		case err != nil:
+			if cardErr == nil {
+				cardErr = fmt.Errorf("line %d: %v", number, err)
+			}
+		case p.Name == "END" && strings.EqualFold(p.Value, "VCARD"):
+			results = append(results, vcardResult{Card: card, Err: cardErr})
+			card = nil
+		default:
+			card.Properties = append(card.Properties, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return results, err
+	}
+	if card != nil {
+		results = append(results, vcardResult{Card: card, Err: errors.New("missing END:VCARD")})
+	}
+	return results, nil
+}
+
+// vcardToContact maps a vCard onto a contact.  The preferred EMAIL wins when
+// there are several; TEL and other properties we do not store are ignored.
+func vcardToContact(card *vcard) (appinterface.Contact, error) {
+	var contact appinterface.Contact
+	if n, ok := card.first("N"); ok {
+		parts := vcardSplit(n.Value, ';')
+		contact.LastName = strings.TrimSpace(parts[0])
+		if len(parts) > 1 {
+			contact.FirstName = strings.TrimSpace(parts[1])
+		}
+	}
+	if contact.FirstName == "" && contact.LastName == "" {
+		if fn, ok := card.first("FN"); ok {
+			name := strings.TrimSpace(vcardUnescape(fn.Value))
+			if i := strings.LastIndexByte(name, ' '); i >= 0 {
+				contact.FirstName, contact.LastName = strings.TrimSpace(name[:i]), name[i+1:]
+			} else {
+				contact.FirstName = name
+			}
+		}
+	}
+	emails := card.all("EMAIL")
+	best := -1
+	bestPref := 101
+	for i, e := range emails {
+		pref := 100
+		if e.hasParam("TYPE", "pref") {
+			pref = 1
+		}
+		if v := e.Params["PREF"]; len(v) > 0 {
+			if n, err := strconv.Atoi(v[0]); err == nil {
+				pref = n
+			}
+		}
+		if pref < bestPref {
+			best, bestPref = i, pref
+		}
+	}
+	if best >= 0 {
+		contact.Email = strings.TrimSpace(vcardUnescape(emails[best].Value))
+	}
+	return contact, contact.Validate()
+}
+
+// writeVCardLine writes a content line, folding it so that no physical line
+// is longer than vcardLineLength octets and no UTF-8 sequence is split.
+func writeVCardLine(w io.Writer, line string) error {
+	var b bytes.Buffer
+	limit := vcardLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// Continuation lines lose one octet to the leading space.
+		limit = vcardLineLength - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// contactUID is the UID given to a contact in the vCards we produce.
+func contactUID(contact appinterface.Contact) string {
+	return fmt.Sprintf("contact-%d", contact.ID)
+}
+
+// writeVCard writes contact as a vCard of the given version, "3.0" or "4.0".
+func writeVCard(w io.Writer, contact appinterface.Contact, version string) error {
+	email := "EMAIL;TYPE=INTERNET:"
+	if version == "4.0" {
+		email = "EMAIL:"
+	}
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:" + version,
+		"UID:" + contactUID(contact),
+		"N:" + vcardEscape(contact.LastName) + ";" + vcardEscape(contact.FirstName) + ";;;",
+		"FN:" + vcardEscape(strings.TrimSpace(contact.FirstName+" "+contact.LastName)),
+		email + vcardEscape(contact.Email),
+		"END:VCARD",
+	}
+	for _, line := range lines {
+		if err := writeVCardLine(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vcardVersion picks the vCard version requested with ?version=, defaulting
+// to 3.0 which nearly every address book understands.
+func vcardVersion(request *http.Request) (string, bool) {
+	switch v := request.URL.Query().Get("version"); v {
+	case "", "3", "3.0":
+		return "3.0", true
+	case "4", "4.0":
+		return "4.0", true
+	}
+	return "", false
+}
+
+func (w *webApp) badVCardVersion(response http.ResponseWriter) {
+	r := errorJson{
+		Error: "Unsupported vCard version: use 3.0 or 4.0",
+	}
+	w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+}
+
+func (w *webApp) contactVCard(response http.ResponseWriter, request *http.Request) {
+	request.SetPathValue("id", strings.TrimSuffix(request.PathValue("id"), ".vcf"))
+	id, ok := w.pathID(response, request)
+	if !ok {
+		return
+	}
+	version, ok := vcardVersion(request)
+	if !ok {
+		w.badVCardVersion(response)
+		return
+	}
+	contact, err := w.book(request).ContactDetails(request.Context(), id)
+	if err != nil {
+		w.sendMutationError("Error getting contact: %v", err, response)
+		return
+	}
+	standardHeaders(vcardType, response)
+	response.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="contact-%d.vcf"`, id))
+	v := w.visibility(request)
+	response.Header().Set("ETag", contactETag(contact, v))
+	varyByClient(response)
+	err = writeVCard(response, v.Contact(contact), version)
+	if err != nil {
+		log.Printf("Error writing vCard: %v\n", err)
+	}
+}
+
+func (w *webApp) exportVCards(response http.ResponseWriter, request *http.Request) {
+	version, ok := vcardVersion(request)
+	if !ok {
+		w.badVCardVersion(response)
+		return
+	}
+	contacts, err := w.book(request).GetContacts(request.Context())
+	if err != nil {
+		if w.sendOverloaded(err, response) {
+			return
+		}
+		r := errorJson{
+			Error: fmt.Sprintf("Error getting contacts: %v", err),
+		}
+		w.sendErrorJson(r, "Error marshalling error: %v", response)
+		return
+	}
+	standardHeaders(vcardType, response)
+	response.Header().Set("Content-Disposition", `attachment; filename="contacts.vcf"`)
+	out := bufio.NewWriter(response)
+	for _, c := range w.visibility(request).contacts(contacts) {
+		err = writeVCard(out, c, version)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		log.Printf("Error writing vCard export: %v\n", err)
+	}
+}
+
+func (w *webApp) importVCards(response http.ResponseWriter, request *http.Request) {
+	request.Body = http.MaxBytesReader(response, request.Body, maxImportBody)
+	dryRun, _ := strconv.ParseBool(request.URL.Query().Get("dryRun"))
+	in, err := importReader(request)
+	if err != nil {
+		r := errorJson{
+			Error: fmt.Sprintf("Error reading upload: %v", err),
+		}
+		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		return
+	}
+	cards, err := parseVCards(in)
+	if err != nil {
+		r := errorJson{
+			Error: fmt.Sprintf("Error reading vCards: %v", err),
+		}
+		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		return
+	}
+	if len(cards) > maxImportRows {
+		r := errorJson{
+			Error: fmt.Sprintf("Too many cards: at most %d are allowed", maxImportRows),
+		}
+		w.sendStatusJson(r, http.StatusRequestEntityTooLarge, "Error marshalling error: %v", response)
+		return
+	}
+
+	// Rows are numbered by card, starting at 1.
+	body := importResponseJson{DryRun: dryRun}
+	var contacts []appinterface.Contact
+	var rowNumbers []int
+	for i, card := range cards {
+		err := card.Err
+		var contact appinterface.Contact
+		if err == nil {
+			contact, err = vcardToContact(card.Card)
+		}
+		if err != nil {
+			body.add(importRowJson{Row: i + 1, Action: appinterface.ImportFailed, Error: fmt.Sprintf("card starting on line %d: %v", card.Card.Line, err)})
+			continue
+		}
+		contacts = append(contacts, contact)
+		rowNumbers = append(rowNumbers, i+1)
+	}
+	w.finishImport(body, contacts, rowNumbers, response, request)
+}
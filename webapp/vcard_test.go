@@ -0,0 +1,140 @@
+package webapp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"example-api-server/appinterface"
+)
+
+// roundTripContacts are contacts whose names need escaping, quoting or
+// folding in at least one of the export formats.
+var roundTripContacts = []appinterface.Contact{
+	{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"},
+	{FirstName: "Jean, Jr.", LastName: "O'Brien; Smith", Email: "jean@example.com"},
+	{FirstName: `Back\slash`, LastName: `"Quoted"`, Email: "quoted@example.com"},
+	{FirstName: "Two\nLines", LastName: "Break", Email: "lines@example.com"},
+	{FirstName: "Zoë", LastName: "Ångström", Email: "zoe@example.com"},
+	{FirstName: "小龙", LastName: "李", Email: "li@example.cn"},
+	{FirstName: "Party 🎉", LastName: "Émile", Email: "émile@exämple.org"},
+	{FirstName: strings.Repeat("Ünïcødé ", 12) + "Long", LastName: strings.Repeat("界", 40), Email: "long@example.com"},
+}
+
+func TestWriteVCardRoundTrip(t *testing.T) {
+	for _, version := range []string{"3.0", "4.0"} {
+		for _, want := range roundTripContacts {
+			var b bytes.Buffer
+			if err := writeVCard(&b, want, version); err != nil {
+				t.Fatalf("writing %q: %v", want.FirstName, err)
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n") {
+				if len(line) > vcardLineLength {
+					t.Errorf("version %s: line of %d octets: %q", version, len(line), line)
+				}
+				if !utf8.ValidString(line) {
+					t.Errorf("version %s: fold splits a UTF-8 sequence: %q", version, line)
+				}
+			}
+			cards, err := parseVCards(&b)
+			if err != nil || len(cards) != 1 || cards[0].Err != nil {
+				t.Fatalf("version %s: parsing %q: %v %+v", version, want.FirstName, err, cards)
+			}
+			got, err := vcardToContact(cards[0].Card)
+			if err != nil {
+				t.Fatalf("version %s: mapping %q: %v", version, want.FirstName, err)
+			}
+			if !sameContent(got, want) {
+				t.Errorf("version %s: got %+v, want %+v", version, got, want)
+			}
+		}
+	}
+}
+
+func TestParseVCard(t *testing.T) {
+	tests := []struct {
+		name string
+		card string
+		want appinterface.Contact
+	}{
+		{
+			name: "escaped separators",
+			card: "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Smith\\; Jones;Anne\\, Marie;;;\r\nEMAIL:anne@example.com\r\nEND:VCARD\r\n",
+			want: appinterface.Contact{FirstName: "Anne, Marie", LastName: "Smith; Jones", Email: "anne@example.com"},
+		},
+		{
+			name: "folded with a space and a tab",
+			card: "BEGIN:VCARD\nVERSION:4.0\nN:Ström;Bj\n ör\n\tn;;;\nEMAIL:bjorn@example.se\nEND:VCARD\n",
+			want: appinterface.Contact{FirstName: "Björn", LastName: "Ström", Email: "bjorn@example.se"},
+		},
+		{
+			name: "quoted-printable latin1 with a soft break",
+			card: "BEGIN:VCARD\r\nVERSION:2.1\r\nN;CHARSET=ISO-8859-1;ENCODING=QUOTED-PRINTABLE:M=FC=\r\nller;J=F6rg;;;\r\nEMAIL;INTERNET:jorg@example.de\r\nEND:VCARD\r\n",
+			want: appinterface.Contact{FirstName: "Jörg", LastName: "Müller", Email: "jorg@example.de"},
+		},
+		{
+			name: "name from FN and the preferred email",
+			card: "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Marie Curie\r\nEMAIL:other@example.fr\r\nEMAIL;PREF=1:marie@example.fr\r\nEND:VCARD\r\n",
+			want: appinterface.Contact{FirstName: "Marie", LastName: "Curie", Email: "marie@example.fr"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cards, err := parseVCards(strings.NewReader(test.card))
+			if err != nil || len(cards) != 1 || cards[0].Err != nil {
+				t.Fatalf("parsing: %v %+v", err, cards)
+			}
+			got, err := vcardToContact(cards[0].Card)
+			if err != nil {
+				t.Fatalf("mapping: %v", err)
+			}
+			if !sameContent(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVCardExportImportRoundTrip(t *testing.T) {
+	for _, version := range []string{"3.0", "4.0"} {
+		t.Run(version, func(t *testing.T) {
+			from := newTestApp(t)
+			addContacts(t, from, roundTripContacts)
+			exported := serve(NewWebApp(from), http.MethodGet, "/api/contacts/export.vcf?version="+version, "", nil)
+			if exported.Code != http.StatusOK {
+				t.Fatalf("export: %d %s", exported.Code, exported.Body)
+			}
+
+			to := newTestApp(t)
+			imported := serve(NewWebApp(to), http.MethodPost, "/api/contacts/import.vcf", exported.Body.String(), map[string]string{"Content-Type": vcardType})
+			if imported.Code != http.StatusOK {
+				t.Fatalf("import: %d %s", imported.Code, imported.Body)
+			}
+			var report importResponseJson
+			if err := json.Unmarshal(imported.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Created != len(roundTripContacts) || report.Failed != 0 {
+				t.Errorf("import report: %+v", report)
+			}
+			if got, want := names(getContacts(t, to)), names(getContacts(t, from)); !slices.Equal(got, want) {
+				t.Errorf("imported contacts differ:\n got %q\nwant %q", got, want)
+			}
+
+			// Importing the export back into the book it came from changes
+			// nothing.
+			again := serve(NewWebApp(from), http.MethodPost, "/api/contacts/import.vcf", exported.Body.String(), map[string]string{"Content-Type": vcardType})
+			report = importResponseJson{}
+			if err := json.Unmarshal(again.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Skipped != len(roundTripContacts) {
+				t.Errorf("re-import report: %+v", report)
+			}
+		})
+	}
+}
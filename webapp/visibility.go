@@ -0,0 +1,104 @@
+package webapp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"example-api-server/appinterface"
+)
+
+// FieldVisibility says how much of a field a client gets to see.
+type FieldVisibility string
+
+const (
+	FieldFull   FieldVisibility = "full"
+	FieldMasked FieldVisibility = "masked"
+	FieldHidden FieldVisibility = "hidden"
+)
+
+func ParseFieldVisibility(s string) (FieldVisibility, error) {
+	switch v := FieldVisibility(s); v {
+	case FieldFull, FieldMasked, FieldHidden:
+		return v, nil
+	case "":
+		return FieldFull, nil
+	}
+	return FieldFull, fmt.Errorf("unknown field visibility %q, expected full, masked or hidden", s)
+}
+
+// Visibility holds the rules applied to every contact served to a client,
+// whatever the format.
+type Visibility struct {
+	Email FieldVisibility
+}
+
+// visibility returns the rules for the client making request, falling back
+// to the default ones.
+func (w *webApp) visibility(request *http.Request) Visibility {
+	return w.clientVisibility(requestClient(request).Name)
+}
+
+func (w *webApp) clientVisibility(name string) Visibility {
+	if v, ok := w.options.ClientVisibility[name]; ok {
+		return v
+	}
+	return w.options.Visibility
+}
+
+// patch has patch see the contact as v shows it, so a patch cannot copy an
+// email address the client is not shown into another field, or test it.
+func (v Visibility) patch(patch appinterface.ContactPatch) appinterface.ContactPatch {
+	if v.full() {
+		return patch
+	}
+	return func(current appinterface.Contact) (appinterface.Contact, error) {
+		return patch(v.Contact(current))
+	}
+}
+
+// maskEmail keeps the first character of the local part and the domain,
+// so b***@example.com.
+func maskEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	local, domain, found := strings.Cut(email, "@")
+	first := []rune(local)
+	masked := "***"
+	if len(first) > 0 {
+		masked = string(first[0]) + masked
+	}
+	if !found {
+		return masked
+	}
+	return masked + "@" + domain
+}
+
+// Contact applies the rules to c.  It is exported for the other servers of
+// the contacts, such as LDAP, to apply the same rules as the web app.
+func (v Visibility) Contact(c appinterface.Contact) appinterface.Contact {
+	switch v.Email {
+	case FieldMasked:
+		c.Email = maskEmail(c.Email)
+	case FieldHidden:
+		c.Email = ""
+	}
+	return c
+}
+
+// full reports whether the rules show contacts as they are stored.
+func (v Visibility) full() bool {
+	return v.Email == FieldFull || v.Email == ""
+}
+
+func (v Visibility) contacts(cs []appinterface.Contact) []appinterface.Contact {
+	if v.full() {
+		return cs
+	}
+	out := make([]appinterface.Contact, len(cs))
+	for i, c := range cs {
+		out[i] = v.Contact(c)
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+package webapp
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+// newMaskedBook serves a book holding Ada (ID 1) to the editors "full",
+// "masked" and "hidden", who are shown her email address as the names say.
+func newMaskedBook(t *testing.T) (appinterface.App, http.Handler, map[string]map[string]string) {
+	t.Helper()
+	a := newTestApp(t)
+	addContacts(t, a, []appinterface.Contact{{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}})
+	options := Options{ClientVisibility: map[string]Visibility{
+		"masked": {Email: FieldMasked},
+		"hidden": {Email: FieldHidden},
+	}}
+	keys := withKeys(t, &options, map[string]auth.Role{"full": auth.RoleEditor, "masked": auth.RoleEditor, "hidden": auth.RoleEditor})
+	handler, err := NewWebAppWithOptions(appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: a}), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, handler, keys
+}
+
+func ada(t *testing.T, a appinterface.App) appinterface.Contact {
+	t.Helper()
+	c, err := a.ContactDetails(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestPatchCannotRecoverEmail checks that a JSON Patch sees the email address
+// as the client does, so it can neither copy the real one into a field the
+// client is shown nor test for it.
+func TestPatchCannotRecoverEmail(t *testing.T) {
+	for _, client := range []string{"masked", "hidden"} {
+		t.Run(client, func(t *testing.T) {
+			a, handler, keys := newMaskedBook(t)
+			patch := with(keys[client], "Content-Type", jsonPatchType)
+			response := serve(handler, http.MethodPatch, "/api/contact/1", `[{"op":"copy","from":"/email","path":"/firstName"}]`, patch)
+			if strings.Contains(response.Body.String(), "ada@example.com") {
+				t.Errorf("the patch copied the email address: %d %s", response.Code, response.Body)
+			}
+			if c := ada(t, a); strings.Contains(c.FirstName, "ada@") || c.Email != "ada@example.com" {
+				t.Errorf("Ada after the copy: %+v", c)
+			}
+
+			right := serve(handler, http.MethodPatch, "/api/contact/1", `[{"op":"test","path":"/email","value":"ada@example.com"}]`, patch)
+			wrong := serve(handler, http.MethodPatch, "/api/contact/1", `[{"op":"test","path":"/email","value":"eve@example.com"}]`, patch)
+			if right.Code != http.StatusConflict || wrong.Code != http.StatusConflict {
+				t.Errorf("testing the real address: %d, a wrong one: %d", right.Code, wrong.Code)
+			}
+		})
+	}
+}
+
+// TestMaskedWritesKeepEmail has a masked client write back the contact it
+// was shown through every route that changes contacts, and checks that the
+// names it sends are kept and the email address it was never shown is too.
+func TestMaskedWritesKeepEmail(t *testing.T) {
+	const masked = "a***@example.com"
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		contentType string
+		ifMatch     string
+		status      int
+	}{
+		{name: "PUT", method: http.MethodPut, path: "/api/contact/1", body: "firstName=Augusta&lastName=King&email=a%2A%2A%2A%40example.com",
+			contentType: "application/x-www-form-urlencoded", ifMatch: `"v1-masked"`, status: http.StatusOK},
+		{name: "CardDAV", method: http.MethodPut, path: bookPath + "1.vcf", body: "BEGIN:VCARD\r\nVERSION:3.0\r\nN:King;Augusta;;;\r\nEMAIL:" + masked + "\r\nEND:VCARD\r\n",
+			contentType: vcardType, ifMatch: `"v1-masked"`, status: http.StatusNoContent},
+		{name: "CSV import", method: http.MethodPost, path: "/api/contacts/import?matchIds=true", body: "id,firstName,lastName,email\r\n1,Augusta,King," + masked + "\r\n",
+			contentType: "text/csv", status: http.StatusOK},
+		{name: "JSON Lines import", method: http.MethodPost, path: "/api/contacts/import.jsonl?matchIds=true", body: `{"id":1,"firstName":"Augusta","lastName":"King","email":"` + masked + `"}` + "\n",
+			contentType: "application/jsonl", status: http.StatusOK},
+		{name: "batch", method: http.MethodPost, path: "/api/batch", body: `[{"op":"update","id":1,"firstName":"Augusta","lastName":"King","email":"` + masked + `"}]`,
+			contentType: "application/json", status: http.StatusOK},
+		{name: "merge patch", method: http.MethodPatch, path: "/api/contact/1", body: `{"firstName":"Augusta","lastName":"King","email":"` + masked + `"}`,
+			contentType: mergePatchType, ifMatch: `"v1-masked"`, status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, handler, keys := newMaskedBook(t)
+			header := with(keys["masked"], "Content-Type", test.contentType)
+			if test.ifMatch != "" {
+				header["If-Match"] = test.ifMatch
+			}
+			response := serve(handler, test.method, test.path, test.body, header)
+			if response.Code != test.status {
+				t.Fatalf("%d %s", response.Code, response.Body)
+			}
+			if c := ada(t, a); c.FirstName != "Augusta" || c.LastName != "King" || c.Email != "ada@example.com" {
+				t.Errorf("Ada after the write: %+v", c)
+			}
+		})
+	}
+
+	// The vCard importer only creates contacts, so a card written back
+	// becomes a new contact and Ada is left alone.
+	a, handler, keys := newMaskedBook(t)
+	card := "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Lovelace;Ada;;;\r\nEMAIL:" + masked + "\r\nEND:VCARD\r\n"
+	response := serve(handler, http.MethodPost, "/api/contacts/import.vcf", card, with(keys["masked"], "Content-Type", vcardType))
+	if response.Code != http.StatusOK {
+		t.Fatalf("vCard import: %d %s", response.Code, response.Body)
+	}
+	if c := ada(t, a); c.Email != "ada@example.com" || c.Version != 1 {
+		t.Errorf("Ada after the vCard import: %+v", c)
+	}
+
+	// Clients shown the addresses as they are still change them.
+	a, handler, keys = newMaskedBook(t)
+	response = serve(handler, http.MethodPut, "/api/contact/1", "firstName=Ada&lastName=Lovelace&email=countess%40example.com",
+		with(keys["full"], "Content-Type", "application/x-www-form-urlencoded"))
+	if c := ada(t, a); response.Code != http.StatusOK || c.Email != "countess@example.com" {
+		t.Errorf("full client's change: %d %+v", response.Code, c)
+	}
+}
+
+// TestIfMatchOfAnotherRepresentation checks that the ETag of a masked copy of
+// a contact is no precondition on the contact as a full client sees it.
+func TestIfMatchOfAnotherRepresentation(t *testing.T) {
+	a, handler, keys := newMaskedBook(t)
+	for _, tag := range []string{`"v1-masked"`, `"v1-hidden"`, `"v1-anything"`} {
+		response := serve(handler, http.MethodPut, "/api/contact/1", "firstName=Augusta&lastName=King&email=ada%40example.com",
+			with(keys["full"], "Content-Type", "application/x-www-form-urlencoded", "If-Match", tag))
+		if response.Code != http.StatusPreconditionFailed {
+			t.Errorf("full client's PUT with If-Match %s: %d %s", tag, response.Code, response.Body)
+		}
+		response = serve(handler, http.MethodPut, bookPath+"1.vcf", "BEGIN:VCARD\r\nVERSION:3.0\r\nN:King;Augusta;;;\r\nEMAIL:ada@example.com\r\nEND:VCARD\r\n",
+			with(keys["full"], "Content-Type", vcardType, "If-Match", tag))
+		if response.Code != http.StatusPreconditionFailed {
+			t.Errorf("full client's CardDAV PUT with If-Match %s: %d", tag, response.Code)
+		}
+	}
+	// Nor is the tag of a full copy one on the masked copy.
+	response := serve(handler, http.MethodPatch, "/api/contact/1", `{"firstName":"Augusta"}`, with(keys["masked"], "Content-Type", mergePatchType, "If-Match", `"v1"`))
+	if response.Code != http.StatusPreconditionFailed {
+		t.Errorf("masked client's PATCH with If-Match \"v1\": %d", response.Code)
+	}
+	if c := ada(t, a); c.Version != 1 {
+		t.Errorf("Ada was changed: %+v", c)
+	}
+}
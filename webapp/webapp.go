@@ -4,17 +4,24 @@ import (
 	"bytes"
 	"embed"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/netip"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"example-api-server/appinterface"
+	"example-api-server/audit"
+	"example-api-server/auth"
+	"example-api-server/keyring"
 )
 
 type notFoundData struct {
@@ -40,6 +47,7 @@ var (
 	wrapper       *template.Template
 	errorTemplate *template.Template
 	home          *template.Template
+	login         *template.Template
 	notFound      *template.Template
 
 	//go:embed js
@@ -102,6 +110,8 @@ func initFromDir(parentPath string) {
 			wrapper = tpl
 		case "home":
 			home = tpl
+		case "login":
+			login = tpl
 		case "error":
 			errorTemplate = tpl
 		default:
@@ -116,25 +126,110 @@ func init() {
 }
 
 type webApp struct {
-	app appinterface.App
-	mux *http.ServeMux
+	books    appinterface.Books
+	mux      *http.ServeMux
+	handler  http.Handler
+	options  Options
+	sessions *auth.Sessions
+	// readLimiter and writeLimiter are nil when reads or writes are not
+	// limited.
+	readLimiter  *limiter
+	writeLimiter *limiter
+}
+
+// Options configures the optional parts of the web app.
+type Options struct {
+	// Keys, when set, encrypt the snapshots served for backups and decrypt
+	// the ones uploaded for restores.
+	Keys *keyring.Keyring
+	// Visibility applies to every client without rules of its own in
+	// ClientVisibility.
+	Visibility       Visibility
+	ClientVisibility map[string]Visibility
+	// APIKeys, when set, turns on authentication: every request but those
+	// for the login page, the server time and static assets needs one of
+	// its keys, or a session signed in with one.
+	APIKeys *auth.Store
+	// JWT, when set, also accepts bearer JWTs it verifies.
+	JWT *auth.JWTVerifier
+	// Grants maps books to the clients allowed in them and their role
+	// there.  Without authentication every book is open to everyone.
+	Grants map[string]map[string]auth.Role
+	// Groups maps group names to the clients in them, so contacts can be
+	// shared with a whole group.
+	Groups map[string][]string
+	// SessionLifetime is how long a browser stays signed in.
+	SessionLifetime time.Duration
+	// InsecureCookies lets the session cookie be sent over plain HTTP.
+	InsecureCookies bool
+	// RateLimits limit how many requests each client may make.
+	RateLimits RateLimits
+	// TrustedProxies are the addresses of the proxies whose X-Forwarded-For
+	// header gives the address of the client.
+	TrustedProxies []netip.Prefix
+	// Headers are the security headers sent with every response.
+	Headers SecurityHeaders
+	// Audit, when set, is the log the books record their changes in, which
+	// the web app tells who made each request and serves to admins.
+	Audit *audit.Log
+	// AuditContacts, when set, turns the contacts of audit entries, which
+	// are recorded as the books store them, into the contacts the books
+	// serve, such as by decrypting their email addresses.
+	AuditContacts func(appinterface.Contact) (appinterface.Contact, error)
 }
 
 func (w *webApp) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	w.mux.ServeHTTP(writer, request)
+	w.handler.ServeHTTP(writer, request)
 }
 
 func (w *webApp) setupRoutes() {
 	w.mux.Handle("/js/*", w.newJSHandler())
 	w.mux.Handle("/css/*", w.newCSSHandler())
 	w.mux.Handle("/img/*", w.newImageHandler())
-	w.mux.HandleFunc("GET /"+"{$}", w.renderIndex)
+	w.mux.HandleFunc("GET /"+"{$}", w.inBook(auth.PermRead, w.renderIndex))
+	// CardDAV serves the default book, through inBook like every other
+	// route, and checks each request against its method.
+	w.mux.Handle("/dav/", w.inBook(auth.PermRead, w.newCardDAVHandler().ServeHTTP))
+	w.mux.HandleFunc("/.well-known/carddav", w.wellKnownCardDAV)
 	w.mux.HandleFunc("GET /api/server-time", w.serverTime)
-	w.mux.HandleFunc("POST /api/add-contact", w.addContact)
-	w.mux.HandleFunc("GET /api/contacts", w.contacts)
-	w.mux.HandleFunc("GET /api/contact/{id}", w.contact)
-	w.mux.HandleFunc("PUT /api/contact/{id}", w.updateContact)
-	w.mux.HandleFunc("DELETE /api/contact/{id}", w.deleteContact)
+	w.mux.HandleFunc("POST "+cspReportPath, w.cspReport)
+	w.mux.Handle("GET /api/admin/metrics", w.allow(auth.PermAdmin, expvar.Handler().ServeHTTP))
+	w.mux.HandleFunc("GET /api/books", w.listBooks)
+	w.handleBook("POST", "/api/add-contact", auth.PermWrite, w.addContact)
+	w.handleBook("GET", "/api/contacts", auth.PermRead, w.contacts)
+	w.handleBook("GET", "/api/contacts/export.csv", auth.PermRead, w.exportCSV)
+	w.handleBook("POST", "/api/contacts/import", auth.PermWrite, w.importCSV)
+	w.handleBook("GET", "/api/contacts/export.vcf", auth.PermRead, w.exportVCards)
+	w.handleBook("POST", "/api/contacts/import.vcf", auth.PermWrite, w.importVCards)
+	w.handleBook("GET", "/api/contacts/export.jsonl", auth.PermRead, w.exportJSONL)
+	w.handleBook("POST", "/api/contacts/import.jsonl", auth.PermWrite, w.importJSONL)
+	w.handleBook("GET", "/api/contact/{id}", auth.PermRead, w.contact)
+	w.handleBook("PUT", "/api/contact/{id}", auth.PermWrite, w.updateContact)
+	w.handleBook("PATCH", "/api/contact/{id}", auth.PermWrite, w.patchContact)
+	w.handleBook("DELETE", "/api/contact/{id}", auth.PermDelete, w.deleteContact)
+	w.handleBook("PUT", "/api/contact/{id}/shares", auth.PermWrite, w.shareContact)
+	// A batch needs more than PermWrite when it deletes, which it checks
+	// once it has read the operations.
+	w.handleBook("POST", "/api/batch", auth.PermWrite, w.batch)
+	w.handleBook("GET", "/api/trash", auth.PermWrite, w.trash)
+	w.handleBook("POST", "/api/trash/{id}/restore", auth.PermWrite, w.restoreContact)
+	w.handleBook("POST", "/api/admin/snapshot", auth.PermAdmin, w.snapshot)
+	w.handleBook("POST", "/api/admin/restore", auth.PermAdmin, w.restoreSnapshot)
+	if w.options.Audit != nil {
+		w.handleBook("GET", "/api/admin/audit", auth.PermAdmin, w.auditLog)
+		w.handleBook("GET", "/api/admin/audit/export.jsonl", auth.PermAdmin, w.exportAudit)
+		// The chain runs through the entries of every book, so only admins
+		// of the whole server may check it.
+		w.mux.HandleFunc("GET /api/admin/audit/verify", w.allow(auth.PermAdmin, w.verifyAudit))
+	}
+	if w.options.APIKeys != nil {
+		w.mux.HandleFunc("GET /login", w.loginPage)
+		w.mux.HandleFunc("POST /login", w.login)
+		w.mux.HandleFunc("POST /logout", w.logout)
+		w.mux.HandleFunc("GET /api/admin/api-keys", w.allow(auth.PermAdmin, w.apiKeys))
+		w.mux.HandleFunc("POST /api/admin/api-keys", w.allow(auth.PermAdmin, w.createAPIKey))
+		w.mux.HandleFunc("DELETE /api/admin/api-keys/{id}", w.allow(auth.PermAdmin, w.deleteAPIKey))
+	}
 }
 
 type serverTime struct {
@@ -181,36 +276,29 @@ func (w *webApp) addContact(response http.ResponseWriter, request *http.Request)
 	// against attack vectors like encoding "JOHNNY DROP TABLES" and the like. As well as making
 	// sure that inputs are within expected ranges.  NEVER TRUST THE INTERNET!!!!
 	// All the above boilerplate is because we cannot trust anything from the internet.
-	err = w.app.AddContact(firstName, lastName, email) // <- This is how GOD intended it to be. ;-)
+	err = w.book(request).AddContact(request.Context(), firstName, lastName, email) // <- This is how GOD intended it to be. ;-)
 	if err != nil {
-		r := errorJson{
-			Error: fmt.Sprintf("Error adding contact: %v", err),
+		if w.sendOverloaded(err, response) {
+			return
 		}
-		w.sendErrorJson(r, "Error marshalling error: %v", response)
-		return
-	}
-}
-
-func (w *webApp) contacts(response http.ResponseWriter, request *http.Request) {
-	contacts, err := w.app.GetContacts()
-	if err != nil {
 		r := errorJson{
-			Error: fmt.Sprintf("Error getting contacts: %v", err),
+			Error: fmt.Sprintf("Error adding contact: %v", err),
 		}
 		w.sendErrorJson(r, "Error marshalling error: %v", response)
 		return
 	}
-	w.sendJson(contacts, "Error marshalling contacts: %v", response)
 }
 
-func (w *webApp) contact(response http.ResponseWriter, request *http.Request) {
+// pathID extracts and validates the {id} path parameter.  On failure it has
+// already written a 400 response and returns false.
+func (w *webApp) pathID(response http.ResponseWriter, request *http.Request) (int, bool) {
 	idString := request.PathValue("id")
 	if idString == "" {
 		r := errorJson{
 			Error: "Missing ID",
 		}
 		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
-		return
+		return 0, false
 	}
 	id, err := strconv.Atoi(idString)
 	if err != nil {
@@ -218,17 +306,59 @@ func (w *webApp) contact(response http.ResponseWriter, request *http.Request) {
 			Error: fmt.Sprintf("Error parsing ID: %v", err),
 		}
 		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
-		return
+		return 0, false
 	}
 	if id <= 0 {
 		r := errorJson{
 			Error: "Invalid ID",
 		}
 		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		return 0, false
+	}
+	return id, true
+}
+
+func (w *webApp) contacts(response http.ResponseWriter, request *http.Request) {
+	view := request.URL.Query().Get("view")
+	if !validView(view) {
+		r := errorJson{
+			Error: fmt.Sprintf("Unknown view %q, expected all, mine or shared", view),
+		}
+		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
 		return
 	}
-	contact, err := w.app.ContactDetails(id)
+	contacts, err := w.book(request).GetContacts(request.Context())
 	if err != nil {
+		if w.sendOverloaded(err, response) {
+			return
+		}
+		r := errorJson{
+			Error: fmt.Sprintf("Error getting contacts: %v", err),
+		}
+		w.sendErrorJson(r, "Error marshalling error: %v", response)
+		return
+	}
+	contacts = inView(view, request, contacts)
+	contacts = w.visibility(request).contacts(contacts)
+	w.sendJsonWithETag(contacts, "", request, "Error marshalling contacts: %v", response)
+}
+
+func (w *webApp) contact(response http.ResponseWriter, request *http.Request) {
+	// ServeMux wildcards must be whole segments, so /api/contact/{id}.vcf
+	// lands here too.
+	if strings.HasSuffix(request.PathValue("id"), ".vcf") {
+		w.contactVCard(response, request)
+		return
+	}
+	id, ok := w.pathID(response, request)
+	if !ok {
+		return
+	}
+	contact, err := w.book(request).ContactDetails(request.Context(), id)
+	if err != nil {
+		if w.sendOverloaded(err, response) {
+			return
+		}
 		if err == io.EOF {
 			r := errorJson{
 				Error: "Contact not found",
@@ -242,7 +372,8 @@ func (w *webApp) contact(response http.ResponseWriter, request *http.Request) {
 		w.sendErrorJson(r, "Error marshalling error: %v", response)
 		return
 	}
-	w.sendJson(contact, "Error marshalling contact: %v", response)
+	v := w.visibility(request)
+	w.sendJsonWithETag(v.Contact(contact), contactETag(contact, v), request, "Error marshalling contact: %v", response)
 }
 
 func (w *webApp) updateContact(response http.ResponseWriter, request *http.Request) {
@@ -258,27 +389,8 @@ func (w *webApp) updateContact(response http.ResponseWriter, request *http.Reque
 		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
 		return
 	}
-	idString := request.PathValue("id")
-	if idString == "" {
-		r := errorJson{
-			Error: "Missing ID",
-		}
-		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
-		return
-	}
-	id, err := strconv.Atoi(idString)
-	if err != nil {
-		r := errorJson{
-			Error: fmt.Sprintf("Error parsing ID: %v", err),
-		}
-		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
-		return
-	}
-	if id <= 0 {
-		r := errorJson{
-			Error: "Invalid ID",
-		}
-		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+	id, ok := w.pathID(response, request)
+	if !ok {
 		return
 	}
 	firstName := request.Form.Get("firstName")
@@ -292,62 +404,241 @@ func (w *webApp) updateContact(response http.ResponseWriter, request *http.Reque
 		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
 		return
 	}
-	err = w.app.UpdateContact(id, firstName, lastName, email) // <- This is how GOD intended it to be. ;-)
+	ifMatch, conditional := ifMatchVersions(request, w.visibility(request))
+	if conditional && len(ifMatch) == 0 {
+		w.preconditionFailed(response)
+		return
+	}
+	err = w.book(request).UpdateContact(request.Context(), id, ifMatch, firstName, lastName, email) // <- This is how GOD intended it to be. ;-)
 	if err != nil {
-		r := errorJson{
-			Error: fmt.Sprintf("Error updating contact: %v", err),
-		}
-		w.sendErrorJson(r, "Error marshalling error: %v", response)
+		w.sendMutationError("Error updating contact: %v", err, response)
 		return
 	}
 }
 
-func (w *webApp) deleteContact(response http.ResponseWriter, request *http.Request) {
-	idString := request.PathValue("id")
-	if idString == "" {
-		r := errorJson{
-			Error: "Missing ID",
-		}
-		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+func (w *webApp) patchContact(response http.ResponseWriter, request *http.Request) {
+	id, ok := w.pathID(response, request)
+	if !ok {
 		return
 	}
-	id, err := strconv.Atoi(idString)
+	// Limit the size of the request body to 4KB
+	// This is an example of protecting the server from overflow attacks
+	request.Body = http.MaxBytesReader(response, request.Body, 4096)
+	body, err := io.ReadAll(request.Body)
 	if err != nil {
 		r := errorJson{
-			Error: fmt.Sprintf("Error parsing ID: %v", err),
+			Error: fmt.Sprintf("Error reading patch: %v", err),
 		}
 		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
 		return
 	}
-	if id <= 0 {
+	var patch appinterface.ContactPatch
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	switch mediaType {
+	case mergePatchType:
+		patch, err = newMergePatch(body)
+	case jsonPatchType:
+		patch, err = newJSONPatch(body)
+	default:
+		response.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
 		r := errorJson{
-			Error: "Invalid ID",
+			Error: fmt.Sprintf("Unsupported patch type: %q", mediaType),
 		}
-		w.sendStatusJson(r, http.StatusBadRequest, "Error marshalling error: %v", response)
+		w.sendStatusJson(r, http.StatusUnsupportedMediaType, "Error marshalling error: %v", response)
+		return
+	}
+	if err != nil {
+		w.sendMutationError("Error patching contact: %v", err, response)
+		return
+	}
+	v := w.visibility(request)
+	ifMatch, conditional := ifMatchVersions(request, v)
+	if conditional && len(ifMatch) == 0 {
+		w.preconditionFailed(response)
+		return
+	}
+	contact, err := w.book(request).PatchContact(request.Context(), id, ifMatch, v.patch(patch))
+	if err != nil {
+		w.sendMutationError("Error patching contact: %v", err, response)
+		return
+	}
+	w.sendJsonWithETag(v.Contact(contact), contactETag(contact, v), request, "Error marshalling contact: %v", response)
+}
+
+func (w *webApp) deleteContact(response http.ResponseWriter, request *http.Request) {
+	id, ok := w.pathID(response, request)
+	if !ok {
+		return
+	}
+	ifMatch, conditional := ifMatchVersions(request, w.visibility(request))
+	if conditional && len(ifMatch) == 0 {
+		w.preconditionFailed(response)
 		return
 	}
-	err = w.app.DeleteContact(id)
+	err := w.book(request).DeleteContact(request.Context(), id, ifMatch)
 	if err != nil {
+		w.sendMutationError("Error deleting contact: %v", err, response)
+		return
+	}
+}
+
+// mutationErrorStatus maps the errors returned by conditional updates,
+// patches, deletes and batches onto an HTTP status and message.  Anything
+// unexpected is a 500 described using format.
+func mutationErrorStatus(format string, err error) (int, string) {
+	var pe *patchError
+	switch {
+	case errors.As(err, &pe):
+		return pe.status, pe.message
+	case errors.Is(err, appinterface.ErrInvalidContact):
+		return http.StatusUnprocessableEntity, err.Error()
+	case err == io.EOF:
+		return http.StatusNotFound, "Contact not found"
+	case err == appinterface.ErrVersionMismatch:
+		return http.StatusPreconditionFailed, "Contact has been modified"
+	case err == appinterface.ErrDuplicateContact:
+		return http.StatusConflict, "An identical contact already exists"
+	case err == appinterface.ErrReadOnly, err == appinterface.ErrNotOwner:
+		return http.StatusForbidden, err.Error()
+	case errors.Is(err, appinterface.ErrInvalidShare):
+		return http.StatusUnprocessableEntity, err.Error()
+	case err == appinterface.ErrUnknownBatchOperation:
+		return http.StatusBadRequest, err.Error()
+	case err == appinterface.ErrBatchRolledBack:
+		return http.StatusFailedDependency, err.Error()
+	case err == appinterface.ErrOverloaded:
+		return http.StatusServiceUnavailable, err.Error()
+	}
+	return http.StatusInternalServerError, fmt.Sprintf(format, err)
+}
+
+// overloadRetryAfter is how many seconds a client the app was too busy for
+// is told to wait before trying again.
+const overloadRetryAfter = 1
+
+// sendOverloaded tells the client to come back later if err is the app
+// being too busy, and reports whether it was.
+func (w *webApp) sendOverloaded(err error, response http.ResponseWriter) bool {
+	if err != appinterface.ErrOverloaded {
+		return false
+	}
+	response.Header().Set("Retry-After", strconv.Itoa(overloadRetryAfter))
+	r := errorJson{
+		Error: err.Error(),
+	}
+	w.sendStatusJson(r, http.StatusServiceUnavailable, "Error marshalling error: %v", response)
+	return true
+}
+
+func (w *webApp) sendMutationError(format string, err error, response http.ResponseWriter) {
+	if w.sendOverloaded(err, response) {
+		return
+	}
+	status, message := mutationErrorStatus(format, err)
+	r := errorJson{
+		Error: message,
+	}
+	if status == http.StatusInternalServerError {
+		w.sendErrorJson(r, "Error marshalling error: %v", response)
+		return
+	}
+	w.sendStatusJson(r, status, "Error marshalling error: %v", response)
+}
+
+func (w *webApp) trash(response http.ResponseWriter, request *http.Request) {
+	trash, err := w.book(request).GetTrash(request.Context())
+	if err != nil {
+		if w.sendOverloaded(err, response) {
+			return
+		}
 		r := errorJson{
-			Error: fmt.Sprintf("Error deleting contact: %v", err),
+			Error: fmt.Sprintf("Error getting trash: %v", err),
 		}
 		w.sendErrorJson(r, "Error marshalling error: %v", response)
 		return
 	}
+	v := w.visibility(request)
+	for i := range trash {
+		trash[i].Contact = v.Contact(trash[i].Contact)
+	}
+	w.sendJson(trash, "Error marshalling trash: %v", response)
+}
+
+func (w *webApp) restoreContact(response http.ResponseWriter, request *http.Request) {
+	id, ok := w.pathID(response, request)
+	if !ok {
+		return
+	}
+	err := w.book(request).RestoreContact(request.Context(), id)
+	if err != nil {
+		if w.sendOverloaded(err, response) {
+			return
+		}
+		switch err {
+		case io.EOF:
+			r := errorJson{
+				Error: "Contact not found in trash",
+			}
+			w.sendStatusJson(r, http.StatusNotFound, "Error marshalling error: %v", response)
+		case appinterface.ErrDuplicateContact:
+			r := errorJson{
+				Error: "An identical contact already exists",
+			}
+			w.sendStatusJson(r, http.StatusConflict, "Error marshalling error: %v", response)
+		case appinterface.ErrReadOnly:
+			r := errorJson{
+				Error: err.Error(),
+			}
+			w.sendStatusJson(r, http.StatusForbidden, "Error marshalling error: %v", response)
+		default:
+			r := errorJson{
+				Error: fmt.Sprintf("Error restoring contact: %v", err),
+			}
+			w.sendErrorJson(r, "Error marshalling error: %v", response)
+		}
+		return
+	}
 }
 
 func NewWebApp(app appinterface.App) http.Handler {
+	books := appinterface.NewBooks([]string{appinterface.DefaultBook}, map[string]appinterface.App{appinterface.DefaultBook: app})
+	handler, _ := NewWebAppWithOptions(books, Options{})
+	return handler
+}
+
+// NewWebAppWithOptions serves books, which must include the default book.
+func NewWebAppWithOptions(books appinterface.Books, options Options) (http.Handler, error) {
+	_, err := books.Book(appinterface.DefaultBook)
+	if err != nil {
+		return nil, fmt.Errorf("default book: %w", err)
+	}
 	r := &webApp{
-		app: app,
-		mux: http.NewServeMux(),
+		books:   books,
+		mux:     http.NewServeMux(),
+		options: options,
+	}
+	if options.RateLimits.Read.Rate > 0 {
+		r.readLimiter = newLimiter(options.RateLimits.Read)
+	}
+	if options.RateLimits.Write.Rate > 0 {
+		r.writeLimiter = newLimiter(options.RateLimits.Write)
 	}
 	r.setupRoutes()
-	return r
+	r.handler = r.rateLimit(r.mux)
+	if options.APIKeys != nil {
+		r.sessions = auth.NewSessions(options.SessionLifetime)
+		r.handler = r.requireAuth(r.handler)
+	}
+	r.handler = withRequestID(r.withSecurityHeaders(r.handler))
+	return r, nil
 }
 
 type wrapperData struct {
 	Title string
 	Body  template.HTML
+	// CSRFToken, for pages of a signed in browser, is where the page's
+	// scripts find the token to send with their changes.
+	CSRFToken string
 }
 
 func templateToString(t *template.Template, data any) string {
@@ -488,9 +779,23 @@ func (w *webApp) sendStatusJson(value any, status int, errorString string, respo
 
 func (w *webApp) renderIndex(response http.ResponseWriter, request *http.Request) {
 	htmlHeader(response)
+	// Contacts only have owners to show, and views to pick from, with
+	// authentication.
+	csrfToken := requestClient(request).CSRFToken
+	data := struct {
+		SignOut   bool
+		Ownership bool
+		CanWrite  bool
+		CanDelete bool
+		CSRFToken string
+		// Nonce lets the page's inline script past the
+		// Content-Security-Policy.
+		Nonce string
+	}{w.options.APIKeys != nil, w.options.APIKeys != nil, w.can(request, auth.PermWrite), w.can(request, auth.PermDelete), csrfToken, cspNonce(request)}
 	id := wrapperData{
-		Title: "Home",
-		Body:  templateToHTML(home, nil),
+		Title:     "Home",
+		Body:      templateToHTML(home, &data),
+		CSRFToken: csrfToken,
 	}
 	err := wrapper.Execute(response, &id)
 	if err != nil {
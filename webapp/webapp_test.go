@@ -0,0 +1,131 @@
+package webapp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"example-api-server/app"
+	"example-api-server/appinterface"
+	"example-api-server/auth"
+)
+
+// newTestApp starts an in-memory app that is stopped when the test ends.
+func newTestApp(t *testing.T) appinterface.App {
+	t.Helper()
+	a := app.NewApp(100, time.Second, time.Hour)
+	t.Cleanup(func() {
+		a.Stop()
+		a.Wait()
+	})
+	return a
+}
+
+// addContacts adds contacts to a, failing the test if any is refused.
+func addContacts(t *testing.T, a appinterface.App, contacts []appinterface.Contact) {
+	t.Helper()
+	for _, c := range contacts {
+		err := a.AddContact(context.Background(), c.FirstName, c.LastName, c.Email)
+		if err != nil {
+			t.Fatalf("adding %+v: %v", c, err)
+		}
+	}
+}
+
+// serve sends a request to handler and returns the recorded response.
+// header holds extra request headers.
+func serve(handler http.Handler, method string, path string, body string, header map[string]string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	request := httptest.NewRequest(method, path, r)
+	for k, v := range header {
+		request.Header.Set(k, v)
+	}
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+// names is the content of contacts, without IDs and versions, in a stable
+// order, for comparing the contacts of two apps.
+func names(contacts []appinterface.Contact) []string {
+	result := make([]string, len(contacts))
+	for i, c := range contacts {
+		result[i] = c.FirstName + "\x00" + c.LastName + "\x00" + c.Email
+	}
+	slices.Sort(result)
+	return result
+}
+
+func getContacts(t *testing.T, a appinterface.App) []appinterface.Contact {
+	t.Helper()
+	contacts, err := a.GetContacts(context.Background())
+	if err != nil {
+		t.Fatalf("getting contacts: %v", err)
+	}
+	return contacts
+}
+
+func getTrash(t *testing.T, a appinterface.App) []appinterface.TrashedContact {
+	t.Helper()
+	trash, err := a.GetTrash(context.Background())
+	if err != nil {
+		t.Fatalf("getting the trash: %v", err)
+	}
+	return trash
+}
+
+// sameContent reports whether two contacts have the same names and email.
+func sameContent(a appinterface.Contact, b appinterface.Contact) bool {
+	return a.FirstName == b.FirstName && a.LastName == b.LastName && a.Email == b.Email
+}
+
+// withKeys turns on authentication in options with a key for each client,
+// at the given role, and returns the "Authorization" header of each.
+func withKeys(t *testing.T, options *Options, roles map[string]auth.Role) map[string]map[string]string {
+	t.Helper()
+	var keys []auth.Key
+	headers := map[string]map[string]string{}
+	for name, role := range roles {
+		secret, err := auth.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := auth.NewConfiguredKey(name, string(role), auth.Hash(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		headers[name] = map[string]string{"Authorization": "Bearer " + secret}
+	}
+	store, err := auth.NewStore(keys, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.APIKeys = store
+	return headers
+}
+
+// with returns header with extra headers added.
+func with(header map[string]string, extra ...string) map[string]string {
+	result := map[string]string{}
+	for k, v := range header {
+		result[k] = v
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		result[extra[i]] = extra[i+1]
+	}
+	return result
+}
+
+// asUser is a context that has the app act for the user name.
+func asUser(name string) context.Context {
+	return appinterface.WithPrincipal(context.Background(), appinterface.Principal{Name: name})
+}